@@ -0,0 +1,489 @@
+// Package api serves the chat server over gRPC. The service definition is in
+// chat.proto; chat.pb.go and chat_grpc.pb.go are generated from it.
+package api
+
+//go:generate protoc --go_out=. --go_opt=paths=source_relative --go-grpc_out=. --go-grpc_opt=paths=source_relative chat.proto
+
+import (
+	"bufio"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/fahimimam/chatApplication/chat"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+)
+
+// DefaultEventBufferSize is how many events a session holds for StreamRoom;
+// further events are dropped until the stream catches up.
+const DefaultEventBufferSize = 256
+
+// DefaultSessionIdleTimeout is how long a session that is not streaming may
+// go without a call before it is closed, so callers that never stream or
+// Leave do not keep chat clients connected forever.
+const DefaultSessionIdleTimeout = 5 * time.Minute
+
+// Service implements ChatServer on top of a chat.Server. Each session is an
+// ordinary chat client in JSON mode, connected over an in-memory pipe, so
+// sessions obey the same limits, filters and permissions as everyone else,
+// and bans and per-IP limits apply to the gRPC caller's address.
+type Service struct {
+	UnimplementedChatServer
+
+	// SessionIdleTimeout closes sessions that are not streaming after this
+	// long without a call. Set it before serving; zero never closes them.
+	SessionIdleTimeout time.Duration
+
+	listener *chat.PipeListener
+	mu       sync.Mutex
+	sessions map[string]*session
+}
+
+// NewService serves s to gRPC callers. The sessions end when s shuts down.
+func NewService(s *chat.Server) *Service {
+	l := chat.NewPipeListener()
+	go s.Serve(context.Background(), l)
+	return &Service{
+		SessionIdleTimeout: DefaultSessionIdleTimeout,
+		listener:           l,
+		sessions:           make(map[string]*session),
+	}
+}
+
+func (svc *Service) JoinRoom(ctx context.Context, req *JoinRoomRequest) (*JoinRoomResponse, error) {
+	if req.Room == "" {
+		return nil, status.Error(codes.InvalidArgument, "room is required")
+	}
+	if err := checkArgs(req.Nickname, req.Room, req.Password); err != nil {
+		return nil, err
+	}
+	opened := req.Session == ""
+	var ss *session
+	var err error
+	if opened {
+		ss, err = svc.open(ctx, req.Nickname)
+	} else {
+		ss, err = svc.session(req.Session)
+	}
+	if err != nil {
+		return nil, err
+	}
+	cmd := "/join " + quote(req.Room)
+	if req.Password != "" {
+		cmd += " " + quote(req.Password)
+	}
+	if err := ss.do(ctx, cmd); err != nil {
+		if opened {
+			ss.close()
+		}
+		return nil, err
+	}
+	return &JoinRoomResponse{Session: ss.id}, nil
+}
+
+func (svc *Service) SendMessage(ctx context.Context, req *SendMessageRequest) (*SendMessageResponse, error) {
+	if strings.TrimSpace(req.Text) == "" {
+		return nil, status.Error(codes.InvalidArgument, "text is required")
+	}
+	if err := checkArgs(req.Text); err != nil {
+		return nil, err
+	}
+	ss, err := svc.session(req.Session)
+	if err != nil {
+		return nil, err
+	}
+	cmd := "/msg " + req.Text
+	if req.ParentId != 0 {
+		cmd = "/reply " + strconv.FormatUint(req.ParentId, 10) + " " + req.Text
+	}
+	return ss.post(ctx, cmd)
+}
+
+func (svc *Service) StreamRoom(req *StreamRoomRequest, stream Chat_StreamRoomServer) error {
+	ss, err := svc.session(req.Session)
+	if err != nil {
+		return err
+	}
+	if !ss.startStreaming() {
+		return status.Error(codes.FailedPrecondition, "session is already streaming")
+	}
+	defer ss.close()
+	for {
+		select {
+		case e := <-ss.events:
+			if err := stream.Send(e); err != nil {
+				return err
+			}
+		case <-ss.done:
+			// send what arrived before the server hung up
+			for {
+				select {
+				case e := <-ss.events:
+					if err := stream.Send(e); err != nil {
+						return err
+					}
+				default:
+					return nil
+				}
+			}
+		case <-stream.Context().Done():
+			return stream.Context().Err()
+		}
+	}
+}
+
+func (svc *Service) Leave(ctx context.Context, req *LeaveRequest) (*LeaveResponse, error) {
+	ss, err := svc.session(req.Session)
+	if err != nil {
+		return nil, err
+	}
+	ss.send("/quit")
+	ss.close()
+	return &LeaveResponse{}, nil
+}
+
+// open connects a new session as a chat client called nickname.
+func (svc *Service) open(ctx context.Context, nickname string) (*session, error) {
+	if nickname == "" {
+		return nil, status.Error(codes.InvalidArgument, "nickname is required to open a session")
+	}
+	var remote net.Addr = pipeAddr("grpc")
+	if p, ok := peer.FromContext(ctx); ok && p.Addr != nil {
+		remote = p.Addr
+	}
+	conn, err := svc.listener.DialAs(remote)
+	if err != nil {
+		return nil, status.Error(codes.Unavailable, "chat server is shutting down")
+	}
+	ss := &session{
+		id:      newSessionID(),
+		conn:    conn,
+		replies: make(chan output, 16),
+		events:  make(chan *RoomEvent, DefaultEventBufferSize),
+		done:    make(chan struct{}),
+	}
+	if svc.SessionIdleTimeout > 0 {
+		ss.idleTimeout = svc.SessionIdleTimeout
+		ss.idle = time.AfterFunc(ss.idleTimeout, ss.close)
+	}
+	go ss.read()
+	go func() {
+		<-ss.done
+		ss.stopIdle()
+		svc.mu.Lock()
+		delete(svc.sessions, ss.id)
+		svc.mu.Unlock()
+	}()
+
+	if err := ss.do(ctx, "/json on"); err != nil {
+		ss.close()
+		return nil, err
+	}
+	if err := ss.do(ctx, "/name "+quote(nickname)); err != nil {
+		ss.close()
+		return nil, err
+	}
+	svc.mu.Lock()
+	svc.sessions[ss.id] = ss
+	svc.mu.Unlock()
+	return ss, nil
+}
+
+// session finds a session and, since it is being used, restarts its idle
+// timer.
+func (svc *Service) session(id string) (*session, error) {
+	svc.mu.Lock()
+	ss, ok := svc.sessions[id]
+	svc.mu.Unlock()
+	if !ok {
+		return nil, status.Error(codes.NotFound, "unknown session")
+	}
+	ss.touch()
+	return ss, nil
+}
+
+// session is one chat client driven over the JSON line protocol.
+type session struct {
+	id   string
+	conn net.Conn
+	// cmdMu lets one command at a time wait for its replies.
+	cmdMu     sync.Mutex
+	replies   chan output
+	events    chan *RoomEvent
+	streaming atomic.Bool
+	// idle closes the session after idleTimeout without a call until it
+	// starts streaming; idleMu orders resets against that start. It is nil
+	// when sessions never idle out.
+	idleMu      sync.Mutex
+	idle        *time.Timer
+	idleTimeout time.Duration
+	// done is closed when the connection ends; reason is the last plain
+	// text line the server sent, which explains a refused connection.
+	done   chan struct{}
+	reason string
+}
+
+// output is a line of the chat server's JSON output.
+type output struct {
+	Type      string `json:"type"`
+	Text      string `json:"text"`
+	Code      string `json:"code"`
+	Message   string `json:"message"`
+	ID        string `json:"id"`
+	MessageID uint64 `json:"messageId"`
+	ParentID  uint64 `json:"parentId"`
+	Nick      string `json:"nick"`
+	Delivered *int   `json:"delivered"`
+}
+
+// read sorts the server's output into replies to the session's commands and
+// events for StreamRoom until the connection ends.
+func (ss *session) read() {
+	defer close(ss.done)
+	sc := bufio.NewScanner(ss.conn)
+	for sc.Scan() {
+		line := sc.Text()
+		var out output
+		if !strings.HasPrefix(line, "{") || json.Unmarshal([]byte(line), &out) != nil {
+			// the greeting, or anything sent before /json on took effect
+			ss.reason = strings.TrimSpace(line)
+			continue
+		}
+		switch out.Type {
+		case "ping":
+			go ss.send("/pong")
+		case "error", "ack":
+			ss.reply(out)
+		case "message":
+			switch {
+			case out.MessageID != 0:
+				ss.event(&RoomEvent{
+					Type:     RoomEvent_TYPE_MESSAGE,
+					Id:       out.MessageID,
+					ParentId: out.ParentID,
+					Nick:     out.Nick,
+					Text:     strings.TrimPrefix(out.Text, out.Nick+" : "),
+				})
+			case strings.HasPrefix(out.Text, "pong "):
+				ss.reply(out)
+			default:
+				ss.event(&RoomEvent{Type: RoomEvent_TYPE_NOTICE, Text: out.Text})
+			}
+		case "reaction":
+			ss.event(&RoomEvent{Type: RoomEvent_TYPE_REACTION, ParentId: out.MessageID, Nick: out.Nick, Text: out.Text})
+		case "mention":
+			ss.event(&RoomEvent{Type: RoomEvent_TYPE_MENTION, Room: out.Text, Id: out.MessageID, Nick: out.Nick, Text: out.Message})
+		case "typing":
+			ss.event(&RoomEvent{Type: RoomEvent_TYPE_TYPING, Nick: out.Text})
+		}
+	}
+}
+
+// reply hands out to the command waiting for it. Replies left over from a
+// command whose caller gave up are discarded by the next command, see
+// discardReplies.
+func (ss *session) reply(out output) {
+	select {
+	case ss.replies <- out:
+	default:
+	}
+}
+
+func (ss *session) discardReplies() {
+	for {
+		select {
+		case <-ss.replies:
+		default:
+			return
+		}
+	}
+}
+
+func (ss *session) event(e *RoomEvent) {
+	select {
+	case ss.events <- e:
+	default:
+	}
+}
+
+func (ss *session) send(line string) error {
+	_, err := ss.conn.Write([]byte(line + "\n"))
+	return err
+}
+
+// do runs command and waits until the server has handled it, returning the
+// first error it reported. It follows command with a /ping and waits for the
+// pong, so it only suits commands the server runs on its main loop, which
+// finish before the ping is read.
+func (ss *session) do(ctx context.Context, command string) error {
+	ss.cmdMu.Lock()
+	defer ss.cmdMu.Unlock()
+	ss.discardReplies()
+	token := newSessionID()
+	if err := ss.send(command + "\n/ping " + token); err != nil {
+		return ss.closedError()
+	}
+	var first error
+	for {
+		select {
+		case out := <-ss.replies:
+			switch {
+			case out.Type == "error" && first == nil:
+				first = statusError(out)
+			case out.Type == "message" && out.Text == "pong "+token:
+				return first
+			}
+		case <-ss.done:
+			return ss.closedError()
+		case <-ctx.Done():
+			return status.FromContextError(ctx.Err()).Err()
+		}
+	}
+}
+
+// post sends a message-posting command and waits for its acknowledgement.
+func (ss *session) post(ctx context.Context, command string) (*SendMessageResponse, error) {
+	ss.cmdMu.Lock()
+	defer ss.cmdMu.Unlock()
+	ss.discardReplies()
+	id := newSessionID()
+	line, _ := json.Marshal(struct {
+		ID      string `json:"id"`
+		Command string `json:"command"`
+	}{id, command})
+	if err := ss.send(string(line)); err != nil {
+		return nil, ss.closedError()
+	}
+	for {
+		select {
+		case out := <-ss.replies:
+			switch {
+			case out.Type == "error":
+				return nil, statusError(out)
+			case out.Type == "ack" && out.ID == id:
+				resp := &SendMessageResponse{Id: out.MessageID}
+				if out.Delivered != nil {
+					resp.Delivered = int32(*out.Delivered)
+				}
+				return resp, nil
+			}
+		case <-ss.done:
+			return nil, ss.closedError()
+		case <-ctx.Done():
+			return nil, status.FromContextError(ctx.Err()).Err()
+		}
+	}
+}
+
+// touch restarts the idle timer of a session that is not streaming.
+func (ss *session) touch() {
+	ss.idleMu.Lock()
+	defer ss.idleMu.Unlock()
+	if ss.idle != nil && !ss.streaming.Load() {
+		ss.idle.Reset(ss.idleTimeout)
+	}
+}
+
+// startStreaming marks the session as streaming, which ends its idle timer,
+// and reports false if it already was.
+func (ss *session) startStreaming() bool {
+	if !ss.streaming.CompareAndSwap(false, true) {
+		return false
+	}
+	ss.stopIdle()
+	return true
+}
+
+func (ss *session) stopIdle() {
+	ss.idleMu.Lock()
+	defer ss.idleMu.Unlock()
+	if ss.idle != nil {
+		ss.idle.Stop()
+	}
+}
+
+// close ends the session; the server sees the client disconnect.
+func (ss *session) close() {
+	ss.conn.Close()
+}
+
+func (ss *session) closedError() error {
+	select {
+	case <-ss.done:
+	default:
+		return status.Error(codes.Unavailable, "session closed")
+	}
+	if ss.reason != "" {
+		return status.Errorf(codes.Unavailable, "session closed: %s", ss.reason)
+	}
+	return status.Error(codes.Unavailable, "session closed")
+}
+
+// grpcCodes maps chat error codes to the closest gRPC status codes; others
+// become codes.Unknown.
+var grpcCodes = map[chat.ErrorCode]codes.Code{
+	chat.ErrUsage:            codes.InvalidArgument,
+	chat.ErrUnknownCommand:   codes.InvalidArgument,
+	chat.ErrInvalidInput:     codes.InvalidArgument,
+	chat.ErrInvalidArgument:  codes.InvalidArgument,
+	chat.ErrRoomNotFound:     codes.NotFound,
+	chat.ErrUserNotFound:     codes.NotFound,
+	chat.ErrMessageNotFound:  codes.NotFound,
+	chat.ErrRoomExists:       codes.AlreadyExists,
+	chat.ErrNickTaken:        codes.AlreadyExists,
+	chat.ErrRoomFull:         codes.ResourceExhausted,
+	chat.ErrRoomLimit:        codes.ResourceExhausted,
+	chat.ErrRateLimited:      codes.ResourceExhausted,
+	chat.ErrRejected:         codes.InvalidArgument,
+	chat.ErrNotInRoom:        codes.FailedPrecondition,
+	chat.ErrPermissionDenied: codes.PermissionDenied,
+	chat.ErrInvalidToken:     codes.Unauthenticated,
+	chat.ErrAuthFailed:       codes.Unauthenticated,
+	chat.ErrUnavailable:      codes.Unavailable,
+	chat.ErrInternal:         codes.Internal,
+}
+
+func statusError(out output) error {
+	code, ok := grpcCodes[chat.ErrorCode(out.Code)]
+	if !ok {
+		code = codes.Unknown
+	}
+	return status.Errorf(code, "%s: %s", out.Code, out.Message)
+}
+
+// checkArgs refuses arguments that would end the command line early.
+func checkArgs(args ...string) error {
+	for _, arg := range args {
+		if strings.ContainsAny(arg, "\r\n") {
+			return status.Error(codes.InvalidArgument, "arguments must not contain line breaks")
+		}
+	}
+	return nil
+}
+
+// quote makes arg a single argument to a tokenized command.
+func quote(arg string) string {
+	arg = strings.ReplaceAll(arg, `\`, `\\`)
+	return `"` + strings.ReplaceAll(arg, `"`, `\"`) + `"`
+}
+
+func newSessionID() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// pipeAddr stands in for the caller's address when gRPC does not know it.
+type pipeAddr string
+
+func (a pipeAddr) Network() string { return string(a) }
+func (a pipeAddr) String() string  { return string(a) }
@@ -0,0 +1,209 @@
+package api
+
+import (
+	"context"
+	"io"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/fahimimam/chatApplication/chat"
+	"github.com/sirupsen/logrus"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestMain(m *testing.M) {
+	logger := logrus.New()
+	logger.SetOutput(io.Discard)
+	chat.SetLogger(logger)
+	os.Exit(m.Run())
+}
+
+const testTimeout = 5 * time.Second
+
+// newTestService serves a fresh chat server over a Service whose sessions
+// idle out after idle, and shuts the server down when the test ends.
+func newTestService(t *testing.T, idle time.Duration) (*Service, *chat.Server) {
+	t.Helper()
+	s := chat.NewServer()
+	svc := NewService(s)
+	svc.SessionIdleTimeout = idle
+	t.Cleanup(func() { s.Close() })
+	return svc, s
+}
+
+func join(t *testing.T, svc *Service, nick, room string) string {
+	t.Helper()
+	resp, err := svc.JoinRoom(context.Background(), &JoinRoomRequest{Nickname: nick, Room: room})
+	if err != nil {
+		t.Fatalf("JoinRoom(%s, %s): %v", nick, room, err)
+	}
+	return resp.Session
+}
+
+// waitFor polls cond until it holds or the test times out.
+func waitFor(t *testing.T, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(testTimeout)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatal("timed out waiting for condition")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+// gone reports whether a session has been removed. It looks the session up
+// without svc.session, which would restart its idle timer.
+func gone(svc *Service, id string) func() bool {
+	return func() bool {
+		svc.mu.Lock()
+		defer svc.mu.Unlock()
+		_, ok := svc.sessions[id]
+		return !ok
+	}
+}
+
+// fakeStream collects what StreamRoom sends.
+type fakeStream struct {
+	grpc.ServerStream
+	ctx    context.Context
+	events chan *RoomEvent
+}
+
+func (f *fakeStream) Context() context.Context { return f.ctx }
+
+func (f *fakeStream) Send(e *RoomEvent) error {
+	f.events <- e
+	return nil
+}
+
+func stream(t *testing.T, svc *Service, id string) *fakeStream {
+	t.Helper()
+	ctx, cancel := context.WithCancel(context.Background())
+	f := &fakeStream{ctx: ctx, events: make(chan *RoomEvent, DefaultEventBufferSize)}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		svc.StreamRoom(&StreamRoomRequest{Session: id}, f)
+	}()
+	t.Cleanup(func() {
+		cancel()
+		<-done
+	})
+	return f
+}
+
+// next returns the first event of type typ with text containing want,
+// skipping others.
+func (f *fakeStream) next(t *testing.T, typ RoomEvent_Type, want string) *RoomEvent {
+	t.Helper()
+	timeout := time.After(testTimeout)
+	for {
+		select {
+		case e := <-f.events:
+			if e.Type == typ && strings.Contains(e.Text, want) {
+				return e
+			}
+		case <-timeout:
+			t.Fatalf("timed out waiting for a %s event with %q", typ, want)
+		}
+	}
+}
+
+func TestJoinRoomArguments(t *testing.T) {
+	svc, _ := newTestService(t, 0)
+	ctx := context.Background()
+
+	tests := []struct {
+		req  *JoinRoomRequest
+		code codes.Code
+	}{
+		{&JoinRoomRequest{Nickname: "alice"}, codes.InvalidArgument},
+		{&JoinRoomRequest{Room: "lobby"}, codes.InvalidArgument},
+		{&JoinRoomRequest{Nickname: "alice", Room: "lobby\nx"}, codes.InvalidArgument},
+		{&JoinRoomRequest{Room: "lobby", Session: "nosuchsession"}, codes.NotFound},
+	}
+	for _, tt := range tests {
+		if _, err := svc.JoinRoom(ctx, tt.req); status.Code(err) != tt.code {
+			t.Errorf("JoinRoom(%v) gave %v, want %s", tt.req, err, tt.code)
+		}
+	}
+}
+
+func TestSendAndStream(t *testing.T) {
+	svc, _ := newTestService(t, 0)
+	ctx := context.Background()
+
+	alice := join(t, svc, "alice", "lobby")
+	bob := join(t, svc, "bob", "lobby")
+	events := stream(t, svc, bob)
+
+	resp, err := svc.SendMessage(ctx, &SendMessageRequest{Session: alice, Text: "hello"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.Id == 0 {
+		t.Error("SendMessage returned no message ID")
+	}
+	e := events.next(t, RoomEvent_TYPE_MESSAGE, "hello")
+	if e.Id != resp.Id || e.Nick != "alice" || e.Text != "hello" {
+		t.Errorf("bob got %v, want alice's hello with ID %d", e, resp.Id)
+	}
+
+	if _, err := svc.SendMessage(ctx, &SendMessageRequest{Session: alice, Text: "re", ParentId: resp.Id}); err != nil {
+		t.Fatal(err)
+	}
+	if e := events.next(t, RoomEvent_TYPE_MESSAGE, "re"); e.ParentId != resp.Id {
+		t.Errorf("reply has parent %d, want %d", e.ParentId, resp.Id)
+	}
+	if err := svc.StreamRoom(&StreamRoomRequest{Session: bob}, &fakeStream{ctx: ctx}); status.Code(err) != codes.FailedPrecondition {
+		t.Errorf("a second stream gave %v", err)
+	}
+	if _, err := svc.SendMessage(ctx, &SendMessageRequest{Session: alice, Text: "  "}); status.Code(err) != codes.InvalidArgument {
+		t.Errorf("blank text gave %v", err)
+	}
+}
+
+func TestLeave(t *testing.T) {
+	svc, s := newTestService(t, 0)
+	ctx := context.Background()
+
+	alice := join(t, svc, "alice", "lobby")
+	bob := join(t, svc, "bob", "lobby")
+	events := stream(t, svc, bob)
+
+	if _, err := svc.Leave(ctx, &LeaveRequest{Session: alice}); err != nil {
+		t.Fatal(err)
+	}
+	events.next(t, RoomEvent_TYPE_NOTICE, "alice has left")
+	waitFor(t, gone(svc, alice))
+	waitFor(t, func() bool { return s.ConnectionCount() == 1 })
+
+	if _, err := svc.SendMessage(ctx, &SendMessageRequest{Session: alice, Text: "still here?"}); status.Code(err) != codes.NotFound {
+		t.Errorf("SendMessage after Leave gave %v", err)
+	}
+	if _, err := svc.Leave(ctx, &LeaveRequest{Session: alice}); status.Code(err) != codes.NotFound {
+		t.Errorf("a second Leave gave %v", err)
+	}
+}
+
+func TestIdleSessionsClose(t *testing.T) {
+	svc, s := newTestService(t, 50*time.Millisecond)
+
+	idle := join(t, svc, "idle", "lobby")
+	streaming := join(t, svc, "streaming", "lobby")
+	stream(t, svc, streaming)
+
+	waitFor(t, gone(svc, idle))
+	waitFor(t, func() bool { return s.ConnectionCount() == 1 })
+
+	// a streaming session outlives the timeout
+	time.Sleep(100 * time.Millisecond)
+	if _, err := svc.SendMessage(context.Background(), &SendMessageRequest{Session: streaming, Text: "still here"}); err != nil {
+		t.Errorf("streaming session was closed: %v", err)
+	}
+}
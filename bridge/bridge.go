@@ -0,0 +1,205 @@
+// Package bridge mirrors a chat room and a channel on another chat service,
+// such as Slack or Discord. A Bridge joins the room as a bot: what people say
+// in the room is posted to the channel under their nickname, and what people
+// say in the channel is posted to the room as "<name> text".
+package bridge
+
+import (
+	"context"
+	"errors"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/fahimimam/chatApplication/chatbot"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// DefaultQueueSize is how many room messages a Bridge holds while the
+	// remote service is slow or rate limiting it.
+	DefaultQueueSize = 256
+	// DefaultMinReconnectWait and DefaultMaxReconnectWait bound the
+	// doubling wait before RunDialer reconnects.
+	DefaultMinReconnectWait = time.Second
+	DefaultMaxReconnectWait = time.Minute
+)
+
+// RemoteMessage is a message posted in the remote channel.
+type RemoteMessage struct {
+	// Nick is the name the author appears as in the room.
+	Nick string
+	Text string
+}
+
+// Remote is a channel on another chat service.
+type Remote interface {
+	// Name identifies the service in logs, e.g. "slack".
+	Name() string
+	// Run calls deliver for each message people post in the channel from
+	// now on, skipping the bridge's own, until ctx is done or the channel
+	// cannot be read.
+	Run(ctx context.Context, deliver func(RemoteMessage)) error
+	// Send posts text to the channel as nick, waiting out any rate limit.
+	Send(ctx context.Context, nick, text string) error
+}
+
+// Bridge mirrors Room and a Remote channel.
+type Bridge struct {
+	// Nick is the bridge's nickname in the room.
+	Nick   string
+	Room   string
+	Remote Remote
+	// QueueSize caps the room messages waiting to be sent to the remote;
+	// more are dropped and logged.
+	QueueSize int
+	// MinReconnectWait and MaxReconnectWait bound the wait before
+	// RunDialer reconnects, which doubles while reconnecting fails.
+	MinReconnectWait time.Duration
+	MaxReconnectWait time.Duration
+	Log              logrus.FieldLogger
+}
+
+// New returns a bridge between room, where it appears as nick, and remote.
+func New(nick, room string, remote Remote) *Bridge {
+	return &Bridge{
+		Nick:             nick,
+		Room:             room,
+		Remote:           remote,
+		QueueSize:        DefaultQueueSize,
+		MinReconnectWait: DefaultMinReconnectWait,
+		MaxReconnectWait: DefaultMaxReconnectWait,
+		Log:              logrus.StandardLogger(),
+	}
+}
+
+type outgoing struct {
+	nick, text string
+}
+
+// Run mirrors the room and the channel over conn, a connection to the chat
+// server, until ctx is done, the connection ends or the channel cannot be
+// read. It returns ctx's error, the error that stopped the channel, or nil
+// when the chat server closed the connection.
+func (b *Bridge) Run(ctx context.Context, conn net.Conn) error {
+	runCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	log := b.Log.WithFields(logrus.Fields{
+		"room":   b.Room,
+		"remote": b.Remote.Name(),
+	})
+
+	queue := make(chan outgoing, b.QueueSize)
+	bot := chatbot.New(b.Nick)
+	bot.OnMessage(func(_ *chatbot.Bot, m chatbot.Message) {
+		select {
+		case queue <- outgoing{m.Nick, m.Text}:
+		default:
+			log.Warn("bridge queue full, dropping a message from the room")
+		}
+	})
+	bot.OnError(func(_ *chatbot.Bot, err error) {
+		log.WithField("error", err.Error()).Warn("the chat server refused a command from the bridge")
+	})
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for {
+			select {
+			case <-runCtx.Done():
+				return
+			case m := <-queue:
+				if err := b.Remote.Send(runCtx, m.nick, m.text); err != nil && runCtx.Err() == nil {
+					log.WithField("error", err.Error()).Warn("unable to post to the remote channel")
+				}
+			}
+		}
+	}()
+
+	// the remote is only read once the bot has asked to join the room, so
+	// nothing it relays reaches the server ahead of the join
+	remoteErr := make(chan error, 1)
+	bot.OnConnect(func(bot *chatbot.Bot) {
+		if err := bot.Join(b.Room); err != nil {
+			return
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			err := b.Remote.Run(runCtx, func(m RemoteMessage) {
+				// the room takes one line at a time
+				for _, line := range strings.Split(m.Text, "\n") {
+					if line = strings.TrimSpace(line); line == "" {
+						continue
+					}
+					if err := bot.Send("<" + m.Nick + "> " + line); err != nil {
+						log.WithField("error", err.Error()).Warn("unable to post to the room")
+					}
+				}
+			})
+			remoteErr <- err
+			cancel()
+		}()
+	})
+
+	err := bot.Run(runCtx, conn)
+	cancel()
+	wg.Wait()
+	select {
+	case rerr := <-remoteErr:
+		if rerr != nil && !errors.Is(rerr, context.Canceled) {
+			return rerr
+		}
+	default:
+		// the bot never connected, so the remote was not started
+	}
+	if perr := ctx.Err(); perr != nil {
+		return perr
+	}
+	return err
+}
+
+// RunDialer runs the bridge over connections from dial, starting again after
+// a wait whenever the chat connection ends or the remote channel fails, until
+// ctx is done or dial fails with net.ErrClosed, as a PipeListener's does once
+// the server has shut down. It returns ctx's error or dial's.
+func (b *Bridge) RunDialer(ctx context.Context, dial func() (net.Conn, error)) error {
+	log := b.Log.WithFields(logrus.Fields{
+		"room":   b.Room,
+		"remote": b.Remote.Name(),
+	})
+	wait := b.MinReconnectWait
+	for {
+		started := time.Now()
+		conn, err := dial()
+		if errors.Is(err, net.ErrClosed) {
+			return err
+		}
+		if err == nil {
+			err = b.Run(ctx, conn)
+		}
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		// a bridge that ran for a while starts over from the shortest wait
+		if time.Since(started) > b.MaxReconnectWait {
+			wait = b.MinReconnectWait
+		}
+		fields := logrus.Fields{"wait": wait.String()}
+		if err != nil {
+			fields["error"] = err.Error()
+		}
+		log.WithFields(fields).Warn("bridge disconnected, reconnecting")
+		timer := time.NewTimer(wait)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return ctx.Err()
+		case <-timer.C:
+		}
+		wait = min(wait*2, b.MaxReconnectWait)
+	}
+}
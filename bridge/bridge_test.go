@@ -0,0 +1,60 @@
+package bridge
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	"github.com/fahimimam/chatApplication/chat"
+)
+
+// burstRemote is a Remote whose channel sees messages all at once.
+type burstRemote []RemoteMessage
+
+func (burstRemote) Name() string { return "burst" }
+
+func (r burstRemote) Run(ctx context.Context, deliver func(RemoteMessage)) error {
+	for _, m := range r {
+		deliver(m)
+	}
+	<-ctx.Done()
+	return ctx.Err()
+}
+
+func (burstRemote) Send(ctx context.Context, nick, text string) error { return nil }
+
+func TestBridgeRelaysBursts(t *testing.T) {
+	// the default rate limit and flood protection, which a bridge skips
+	s := chat.NewServer()
+	l := chat.NewPipeListener()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		s.Serve(context.Background(), l)
+	}()
+	t.Cleanup(func() {
+		s.Close()
+		<-done
+	})
+	_, heard := runBot(t, s, l, "alice", "lobby")
+
+	var remote burstRemote
+	var want []string
+	for i := 1; i <= chat.DefaultMessageBurst+3; i++ {
+		remote = append(remote, RemoteMessage{Nick: "carol", Text: fmt.Sprintf("line %d", i)})
+		want = append(want, fmt.Sprintf("<carol> line %d", i))
+	}
+	for i := 0; i < chat.DefaultFloodRepeats; i++ {
+		remote = append(remote, RemoteMessage{Nick: "dave", Text: "again"})
+		want = append(want, "<dave> again")
+	}
+	remote = append(remote, RemoteMessage{Nick: "erin", Text: "one\ntwo"})
+	want = append(want, "<erin> one", "<erin> two")
+	runBridge(t, l, New("bridge", "lobby", remote))
+
+	for _, w := range want {
+		if m := receive(t, heard); m.Nick != "bridge" || m.Text != w {
+			t.Fatalf("alice heard %+v, want %q", m, w)
+		}
+	}
+}
@@ -0,0 +1,413 @@
+package bridge
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"github.com/gorilla/websocket"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// DefaultDiscordAPI is the base URL of the Discord REST API.
+	DefaultDiscordAPI = "https://discord.com/api/v10/"
+	// DefaultDiscordGateway is the Discord Gateway the remote reads from.
+	DefaultDiscordGateway = "wss://gateway.discord.gg/?v=10&encoding=json"
+	// DefaultDiscordRateLimitWait is how long to back off after a 429 that
+	// does not say how long.
+	DefaultDiscordRateLimitWait = time.Second
+	// MaxDiscordMessageLength is the most Discord takes in one message.
+	MaxDiscordMessageLength = 2000
+
+	// discordIntents asks for messages in guild channels and their text.
+	discordIntents = 1<<9 | 1<<15
+)
+
+// Discord gateway opcodes.
+const (
+	discordDispatch       = 0
+	discordHeartbeat      = 1
+	discordIdentify       = 2
+	discordReconnect      = 7
+	discordInvalidSession = 9
+	discordHello          = 10
+	discordHeartbeatACK   = 11
+)
+
+// Discord is a Remote for a Discord channel. It reads the channel from the
+// Gateway, reconnecting on its own when the connection drops, and posts to
+// it through the REST API, or through WebhookURL when that is set so that
+// each chatter appears under their own nickname. The bot needs the Message
+// Content intent.
+type Discord struct {
+	Token   string
+	Channel string
+	// WebhookURL, when set, is a webhook of the channel that messages from
+	// the room are posted through with the chatter's nickname as the
+	// author. Without it the bot posts them as "**nick**: text".
+	WebhookURL string
+	// Users maps Discord user IDs to the nicknames they appear as in the
+	// room, and back: an @nick in the room that maps to a user becomes a
+	// Discord mention. Other users appear by their Discord name.
+	Users map[string]string
+	// API is the base URL of the REST API, ending in a slash.
+	API     string
+	Gateway string
+	// RateLimitWait is how long to back off when Discord answers 429
+	// without saying how long.
+	RateLimitWait time.Duration
+	// MinReconnectWait and MaxReconnectWait bound the doubling wait before
+	// reconnecting to the Gateway.
+	MinReconnectWait time.Duration
+	MaxReconnectWait time.Duration
+	Client           *http.Client
+	Dialer           *websocket.Dialer
+	Log              logrus.FieldLogger
+}
+
+// NewDiscord returns a Remote for the Discord channel with the given ID,
+// using a bot token.
+func NewDiscord(token, channel string) *Discord {
+	return &Discord{
+		Token:            token,
+		Channel:          channel,
+		API:              DefaultDiscordAPI,
+		Gateway:          DefaultDiscordGateway,
+		RateLimitWait:    DefaultDiscordRateLimitWait,
+		MinReconnectWait: DefaultMinReconnectWait,
+		MaxReconnectWait: DefaultMaxReconnectWait,
+		Client:           &http.Client{Timeout: 30 * time.Second},
+		Dialer:           websocket.DefaultDialer,
+		Log:              logrus.StandardLogger(),
+	}
+}
+
+func (d *Discord) Name() string { return "discord" }
+
+// discordFatal are the Gateway close codes that reconnecting cannot fix,
+// such as a bad token or intents the bot may not use.
+var discordFatal = map[int]bool{4004: true, 4010: true, 4011: true, 4012: true, 4013: true, 4014: true}
+
+// Run reads the channel from the Gateway, reconnecting after a wait when the
+// connection drops or Discord asks for it. It returns ctx's error, or the
+// error of a connection Discord closed for a reason reconnecting cannot fix.
+func (d *Discord) Run(ctx context.Context, deliver func(RemoteMessage)) error {
+	wait := d.MinReconnectWait
+	for {
+		started := time.Now()
+		err := d.session(ctx, deliver)
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		var closeErr *websocket.CloseError
+		if errors.As(err, &closeErr) && discordFatal[closeErr.Code] {
+			return fmt.Errorf("discord gateway: %w", err)
+		}
+		if time.Since(started) > d.MaxReconnectWait {
+			wait = d.MinReconnectWait
+		}
+		d.Log.WithFields(logrus.Fields{
+			"channel": d.Channel,
+			"error":   err.Error(),
+			"wait":    wait.String(),
+		}).Warn("discord gateway disconnected, reconnecting")
+		timer := time.NewTimer(wait)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return ctx.Err()
+		case <-timer.C:
+		}
+		wait = min(wait*2, d.MaxReconnectWait)
+	}
+}
+
+// gatewayPayload is a Gateway message.
+type gatewayPayload struct {
+	Op   int             `json:"op"`
+	Data json.RawMessage `json:"d"`
+	Seq  *int64          `json:"s,omitempty"`
+	Type string          `json:"t,omitempty"`
+}
+
+type discordUser struct {
+	ID         string `json:"id"`
+	Username   string `json:"username"`
+	GlobalName string `json:"global_name"`
+	Bot        bool   `json:"bot"`
+}
+
+type discordMessage struct {
+	ChannelID string        `json:"channel_id"`
+	Content   string        `json:"content"`
+	WebhookID string        `json:"webhook_id"`
+	Author    discordUser   `json:"author"`
+	Mentions  []discordUser `json:"mentions"`
+}
+
+// session is one Gateway connection: it identifies, heartbeats and delivers
+// the channel's messages until the connection ends.
+func (d *Discord) session(ctx context.Context, deliver func(RemoteMessage)) error {
+	ws, _, err := d.Dialer.DialContext(ctx, d.Gateway, nil)
+	if err != nil {
+		return err
+	}
+	defer ws.Close()
+	stop := context.AfterFunc(ctx, func() { ws.Close() })
+	defer stop()
+
+	var writeMu sync.Mutex
+	send := func(op int, data any) error {
+		writeMu.Lock()
+		defer writeMu.Unlock()
+		return ws.WriteJSON(map[string]any{"op": op, "d": data})
+	}
+
+	var hello struct {
+		HeartbeatInterval int64 `json:"heartbeat_interval"`
+	}
+	var p gatewayPayload
+	if err := ws.ReadJSON(&p); err != nil {
+		return err
+	}
+	if p.Op != discordHello || json.Unmarshal(p.Data, &hello) != nil || hello.HeartbeatInterval <= 0 {
+		return fmt.Errorf("discord gateway: expected hello, got op %d", p.Op)
+	}
+	err = send(discordIdentify, map[string]any{
+		"token":   d.Token,
+		"intents": discordIntents,
+		"properties": map[string]string{
+			"os":      "linux",
+			"browser": "chatApplication",
+			"device":  "chatApplication",
+		},
+	})
+	if err != nil {
+		return err
+	}
+
+	// the heartbeat closes the connection when Discord stops acknowledging
+	// it, which ends the read loop below
+	state := &gatewayState{acked: true}
+	heartbeatDone := make(chan struct{})
+	defer close(heartbeatDone)
+	go func() {
+		ticker := time.NewTicker(time.Duration(hello.HeartbeatInterval) * time.Millisecond)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-heartbeatDone:
+				return
+			case <-ticker.C:
+			}
+			seq, acked := state.beat()
+			if !acked {
+				ws.Close()
+				return
+			}
+			send(discordHeartbeat, seq)
+		}
+	}()
+
+	var self string
+	for {
+		var p gatewayPayload
+		if err := ws.ReadJSON(&p); err != nil {
+			return err
+		}
+		state.saw(p.Seq)
+		switch p.Op {
+		case discordHeartbeat:
+			send(discordHeartbeat, state.last())
+		case discordHeartbeatACK:
+			state.ack()
+		case discordReconnect:
+			return errors.New("discord gateway asked to reconnect")
+		case discordInvalidSession:
+			return errors.New("discord gateway invalidated the session")
+		case discordDispatch:
+			switch p.Type {
+			case "READY":
+				var ready struct {
+					User discordUser `json:"user"`
+				}
+				json.Unmarshal(p.Data, &ready)
+				self = ready.User.ID
+			case "MESSAGE_CREATE":
+				var m discordMessage
+				if json.Unmarshal(p.Data, &m) != nil || m.ChannelID != d.Channel {
+					continue
+				}
+				if m.Author.Bot || m.WebhookID != "" || m.Author.ID == self || m.Content == "" {
+					continue
+				}
+				deliver(RemoteMessage{Nick: d.nick(m.Author), Text: d.fromDiscord(m)})
+			}
+		}
+	}
+}
+
+// gatewayState is what the heartbeat shares with the read loop.
+type gatewayState struct {
+	mu sync.Mutex
+	// seq is the last sequence number Discord sent, nil before the first.
+	seq   *int64
+	acked bool
+}
+
+func (g *gatewayState) saw(seq *int64) {
+	if seq == nil {
+		return
+	}
+	g.mu.Lock()
+	g.seq = seq
+	g.mu.Unlock()
+}
+
+func (g *gatewayState) last() *int64 {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return g.seq
+}
+
+func (g *gatewayState) ack() {
+	g.mu.Lock()
+	g.acked = true
+	g.mu.Unlock()
+}
+
+// beat returns the sequence number to heartbeat with and whether the last
+// heartbeat was acknowledged, and starts waiting for the next ack.
+func (g *gatewayState) beat() (*int64, bool) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	acked := g.acked
+	g.acked = false
+	return g.seq, acked
+}
+
+// nick is the name a Discord user appears as in the room.
+func (d *Discord) nick(u discordUser) string {
+	if nick, ok := d.Users[u.ID]; ok {
+		return nick
+	}
+	name := u.GlobalName
+	if name == "" {
+		name = u.Username
+	}
+	return strings.ReplaceAll(name, " ", "_")
+}
+
+var (
+	discordMention = regexp.MustCompile(`<@!?(\d+)>`)
+	discordEmoji   = regexp.MustCompile(`<a?(:\w+:)\d+>`)
+)
+
+// fromDiscord turns Discord markup in m into plain text: user mentions
+// become @nick and custom emoji their :name:.
+func (d *Discord) fromDiscord(m discordMessage) string {
+	text := discordMention.ReplaceAllStringFunc(m.Content, func(s string) string {
+		id := discordMention.FindStringSubmatch(s)[1]
+		for _, u := range m.Mentions {
+			if u.ID == id {
+				return "@" + d.nick(u)
+			}
+		}
+		if nick, ok := d.Users[id]; ok {
+			return "@" + nick
+		}
+		return s
+	})
+	return discordEmoji.ReplaceAllString(text, "$1")
+}
+
+// toDiscord turns @nick into a mention of the user Users maps to nick.
+func (d *Discord) toDiscord(text string) string {
+	return chatMention.ReplaceAllStringFunc(text, func(m string) string {
+		for id, nick := range d.Users {
+			if strings.EqualFold(nick, m[1:]) {
+				return "<@" + id + ">"
+			}
+		}
+		return m
+	})
+}
+
+// Send posts text to the channel as nick, through the webhook when there is
+// one. Only mentions of users, never @everyone or roles, notify anyone.
+func (d *Discord) Send(ctx context.Context, nick, text string) error {
+	body := map[string]any{
+		"allowed_mentions": map[string]any{"parse": []string{"users"}},
+	}
+	url := d.API + "channels/" + d.Channel + "/messages"
+	content := d.toDiscord(text)
+	if d.WebhookURL != "" {
+		url = d.WebhookURL
+		body["username"] = nick
+	} else {
+		content = "**" + nick + "**: " + content
+	}
+	if utf8.RuneCountInString(content) > MaxDiscordMessageLength {
+		content = string([]rune(content)[:MaxDiscordMessageLength])
+	}
+	body["content"] = content
+	return d.post(ctx, url, body)
+}
+
+// post sends a JSON request to url, waiting out rate limits as long as ctx
+// allows.
+func (d *Discord) post(ctx context.Context, url string, body any) error {
+	data, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+	for {
+		req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(data))
+		if err != nil {
+			return err
+		}
+		req.Header.Set("Content-Type", "application/json")
+		if d.WebhookURL == "" {
+			req.Header.Set("Authorization", "Bot "+d.Token)
+		}
+		resp, err := d.Client.Do(req)
+		if err != nil {
+			return err
+		}
+		var result struct {
+			Message    string  `json:"message"`
+			RetryAfter float64 `json:"retry_after"`
+		}
+		json.NewDecoder(resp.Body).Decode(&result)
+		resp.Body.Close()
+		switch {
+		case resp.StatusCode < 300:
+			return nil
+		case resp.StatusCode != http.StatusTooManyRequests:
+			return fmt.Errorf("discord: %s: %s", resp.Status, result.Message)
+		}
+		wait := d.RateLimitWait
+		if secs, err := strconv.ParseFloat(resp.Header.Get("Retry-After"), 64); err == nil && secs > 0 {
+			wait = time.Duration(secs * float64(time.Second))
+		} else if result.RetryAfter > 0 {
+			wait = time.Duration(result.RetryAfter * float64(time.Second))
+		}
+		timer := time.NewTimer(wait)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return ctx.Err()
+		case <-timer.C:
+		}
+	}
+}
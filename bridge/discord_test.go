@@ -0,0 +1,275 @@
+package bridge
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/fahimimam/chatApplication/chat"
+	"github.com/gorilla/websocket"
+)
+
+// fakeDiscord serves a Gateway that runs one script of payloads per
+// connection, and the REST endpoints messages are posted to.
+type fakeDiscord struct {
+	mu      sync.Mutex
+	scripts [][]any
+	conns   int
+	posts   chan discordPost
+	limited int
+}
+
+type discordPost struct {
+	Path     string
+	Auth     string
+	Content  string `json:"content"`
+	Username string `json:"username"`
+}
+
+func newFakeDiscord(t *testing.T, scripts ...[]any) (*fakeDiscord, *Discord) {
+	f := &fakeDiscord{scripts: scripts, posts: make(chan discordPost, 16)}
+	hs := httptest.NewServer(f)
+	t.Cleanup(hs.Close)
+	d := NewDiscord("tok", "C1")
+	d.API = hs.URL + "/"
+	d.Gateway = "ws" + strings.TrimPrefix(hs.URL, "http") + "/gateway"
+	d.RateLimitWait = 5 * time.Millisecond
+	d.MinReconnectWait = 5 * time.Millisecond
+	d.MaxReconnectWait = 20 * time.Millisecond
+	return f, d
+}
+
+func dispatch(typ string, data any) map[string]any {
+	return map[string]any{"op": discordDispatch, "t": typ, "s": 1, "d": data}
+}
+
+func discordMsg(channel, authorID, name, content string) map[string]any {
+	return dispatch("MESSAGE_CREATE", map[string]any{
+		"channel_id": channel,
+		"content":    content,
+		"author":     map[string]any{"id": authorID, "username": strings.ToLower(name), "global_name": name},
+	})
+}
+
+var upgrader = websocket.Upgrader{}
+
+func (f *fakeDiscord) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path == "/gateway" {
+		f.serveGateway(w, r)
+		return
+	}
+	var p discordPost
+	json.NewDecoder(r.Body).Decode(&p)
+	p.Path, p.Auth = r.URL.Path, r.Header.Get("Authorization")
+	f.mu.Lock()
+	limited := f.limited > 0
+	if limited {
+		f.limited--
+	}
+	f.mu.Unlock()
+	if limited {
+		w.WriteHeader(http.StatusTooManyRequests)
+		json.NewEncoder(w).Encode(map[string]any{"message": "slow down", "retry_after": 0.005})
+		return
+	}
+	f.posts <- p
+	w.WriteHeader(http.StatusOK)
+}
+
+func (f *fakeDiscord) serveGateway(w http.ResponseWriter, r *http.Request) {
+	ws, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		return
+	}
+	defer ws.Close()
+	f.mu.Lock()
+	var script []any
+	if f.conns < len(f.scripts) {
+		script = f.scripts[f.conns]
+	}
+	f.conns++
+	f.mu.Unlock()
+
+	var writeMu sync.Mutex
+	write := func(v any) {
+		writeMu.Lock()
+		defer writeMu.Unlock()
+		ws.WriteJSON(v)
+	}
+	write(map[string]any{"op": discordHello, "d": map[string]any{"heartbeat_interval": 20}})
+	var identify struct {
+		Op   int `json:"op"`
+		Data struct {
+			Token   string `json:"token"`
+			Intents int    `json:"intents"`
+		} `json:"d"`
+	}
+	if err := ws.ReadJSON(&identify); err != nil || identify.Op != discordIdentify {
+		return
+	}
+	if identify.Data.Token != "tok" {
+		writeMu.Lock()
+		ws.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(4004, "Authentication failed."))
+		writeMu.Unlock()
+		return
+	}
+	write(dispatch("READY", map[string]any{"user": map[string]any{"id": "900", "username": "bridge"}}))
+	go func() {
+		for _, p := range script {
+			write(p)
+		}
+	}()
+	for {
+		var p gatewayPayload
+		if err := ws.ReadJSON(&p); err != nil {
+			return
+		}
+		if p.Op == discordHeartbeat {
+			write(map[string]any{"op": discordHeartbeatACK})
+		}
+	}
+}
+
+func TestDiscordBridge(t *testing.T) {
+	s, l := newTestServer(t)
+	fake, discord := newFakeDiscord(t,
+		[]any{
+			discordMsg("C2", "101", "Carol", "in another channel"),
+			discordMsg("C1", "900", "bridge", "the bridge itself"),
+			dispatch("MESSAGE_CREATE", map[string]any{"channel_id": "C1", "content": "from a bot", "author": map[string]any{"id": "109", "bot": true}}),
+			dispatch("MESSAGE_CREATE", map[string]any{
+				"channel_id": "C1",
+				"content":    "hi <@!102> and <@103> <:party:123>",
+				"author":     map[string]any{"id": "101", "username": "carol", "global_name": "Carol S"},
+				"mentions":   []any{map[string]any{"id": "103", "username": "dave"}},
+			}),
+			map[string]any{"op": discordReconnect},
+		},
+		[]any{discordMsg("C1", "101", "Carol", "back again")},
+	)
+	discord.Users = map[string]string{"102": "bob"}
+	runBridge(t, l, New("discord", "lobby", discord))
+	inRoom(t, s, "discord", "lobby")
+	alice, heard := runBot(t, s, l, "alice", "lobby")
+
+	for _, want := range []string{"<Carol_S> hi @bob and @dave :party:", "<Carol> back again"} {
+		if m := receive(t, heard); m.Nick != "discord" || m.Text != want {
+			t.Errorf("alice heard %+v, want %q", m, want)
+		}
+	}
+
+	fake.mu.Lock()
+	fake.limited = 1
+	fake.mu.Unlock()
+	alice.Send("hello @bob")
+	post := receive(t, fake.posts)
+	if post.Path != "/channels/C1/messages" || post.Auth != "Bot tok" || post.Content != "**alice**: hello <@102>" {
+		t.Errorf("posted %+v", post)
+	}
+}
+
+func TestDiscordBridgeRelaysBursts(t *testing.T) {
+	// the default rate limit and flood protection, which a bridge skips
+	s := chat.NewServer()
+	l := chat.NewPipeListener()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		s.Serve(context.Background(), l)
+	}()
+	t.Cleanup(func() {
+		s.Close()
+		<-done
+	})
+	var script []any
+	for i := 0; i < chat.DefaultMessageBurst+chat.DefaultFloodRepeats; i++ {
+		script = append(script, discordMsg("C1", "101", "Carol", "same again"))
+	}
+	_, heard := runBot(t, s, l, "alice", "lobby")
+	_, discord := newFakeDiscord(t, script)
+	runBridge(t, l, New("discord", "lobby", discord))
+
+	for range script {
+		if m := receive(t, heard); m.Text != "<Carol> same again" {
+			t.Fatalf("alice heard %+v", m)
+		}
+	}
+}
+
+func TestDiscordWebhook(t *testing.T) {
+	s, l := newTestServer(t)
+	fake, discord := newFakeDiscord(t)
+	discord.WebhookURL = strings.TrimSuffix(discord.API, "/") + "/webhooks/1/secret"
+	runBridge(t, l, New("discord", "lobby", discord))
+	inRoom(t, s, "discord", "lobby")
+	alice, _ := runBot(t, s, l, "alice", "lobby")
+
+	alice.Send("hello")
+	post := receive(t, fake.posts)
+	if post.Path != "/webhooks/1/secret" || post.Auth != "" || post.Username != "alice" || post.Content != "hello" {
+		t.Errorf("posted %+v", post)
+	}
+}
+
+func TestDiscordBadToken(t *testing.T) {
+	_, discord := newFakeDiscord(t)
+	discord.Token = "wrong"
+	ctx, cancel := context.WithTimeout(context.Background(), testTimeout)
+	defer cancel()
+	err := discord.Run(ctx, func(RemoteMessage) {})
+	if err == nil || !strings.Contains(err.Error(), "4004") {
+		t.Errorf("Run = %v, want the authentication failure", err)
+	}
+}
+
+// idleRemote is a Remote that never hears anything.
+type idleRemote struct{}
+
+func (idleRemote) Name() string { return "idle" }
+
+func (idleRemote) Run(ctx context.Context, deliver func(RemoteMessage)) error {
+	<-ctx.Done()
+	return ctx.Err()
+}
+
+func (idleRemote) Send(ctx context.Context, nick, text string) error { return nil }
+
+func TestRunDialerReconnects(t *testing.T) {
+	s, l := newTestServer(t)
+	b := New("bridge", "lobby", idleRemote{})
+	b.MinReconnectWait = time.Millisecond
+
+	conns := make(chan net.Conn, 4)
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() {
+		done <- b.RunDialer(ctx, func() (net.Conn, error) {
+			conn, err := l.Dial()
+			if err == nil {
+				conns <- conn
+			}
+			return conn, err
+		})
+	}()
+
+	receive(t, conns).Close()
+	receive(t, conns)
+	inRoom(t, s, "bridge", "lobby")
+	cancel()
+	if err := receive(t, done); err != context.Canceled {
+		t.Errorf("RunDialer = %v after cancel", err)
+	}
+
+	// once the server is gone it stops dialing
+	go func() { done <- b.RunDialer(context.Background(), l.Dial) }()
+	s.Close()
+	if err := receive(t, done); err == nil {
+		t.Error("RunDialer returned nil after the server closed")
+	}
+}
@@ -0,0 +1,254 @@
+package bridge
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// DefaultSlackAPI is the base URL of the Slack Web API.
+	DefaultSlackAPI = "https://slack.com/api/"
+	// DefaultSlackPollInterval is how often a Slack remote reads its
+	// channel, well inside the rate limit of conversations.history.
+	DefaultSlackPollInterval = 2 * time.Second
+	// DefaultSlackRateLimitWait is how long to back off after a 429 that
+	// carries no Retry-After.
+	DefaultSlackRateLimitWait = time.Second
+)
+
+// Slack is a Remote for a Slack channel, read and written through the Web
+// API with a bot token. The token needs the channels:history, chat:write,
+// chat:write.customize and users:read scopes; the last two let the bridge
+// post under each chatter's nickname and show Slack users by name.
+type Slack struct {
+	Token   string
+	Channel string
+	// Users maps Slack user IDs to the nicknames they appear as in the
+	// room, and back: an @nick in the room that maps to a user becomes a
+	// Slack mention. Other users appear by their Slack display name.
+	Users map[string]string
+	// API is the base URL of the Web API, ending in a slash.
+	API          string
+	PollInterval time.Duration
+	// RateLimitWait is how long to back off when Slack answers 429 without
+	// saying how long in Retry-After.
+	RateLimitWait time.Duration
+	Client        *http.Client
+
+	mu    sync.Mutex
+	names map[string]string
+}
+
+// NewSlack returns a Remote for the Slack channel with the given ID.
+func NewSlack(token, channel string) *Slack {
+	return &Slack{
+		Token:         token,
+		Channel:       channel,
+		API:           DefaultSlackAPI,
+		PollInterval:  DefaultSlackPollInterval,
+		RateLimitWait: DefaultSlackRateLimitWait,
+		Client:        &http.Client{Timeout: 30 * time.Second},
+		names:         make(map[string]string),
+	}
+}
+
+func (s *Slack) Name() string { return "slack" }
+
+// slackMessage is a message as conversations.history lists it.
+type slackMessage struct {
+	TS      string `json:"ts"`
+	User    string `json:"user"`
+	Text    string `json:"text"`
+	Subtype string `json:"subtype"`
+	BotID   string `json:"bot_id"`
+}
+
+// Run polls the channel's history for messages newer than the last it saw.
+// Messages from bots, the bridge's own included, and events such as joins
+// are skipped.
+func (s *Slack) Run(ctx context.Context, deliver func(RemoteMessage)) error {
+	oldest := strconv.FormatInt(time.Now().Unix(), 10) + ".000000"
+	ticker := time.NewTicker(s.PollInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+		var resp struct {
+			Messages []slackMessage `json:"messages"`
+		}
+		err := s.call(ctx, http.MethodGet, "conversations.history", url.Values{
+			"channel": {s.Channel},
+			"oldest":  {oldest},
+			"limit":   {"200"},
+		}, &resp)
+		if err != nil {
+			return err
+		}
+		// newest first
+		for i := len(resp.Messages) - 1; i >= 0; i-- {
+			m := resp.Messages[i]
+			oldest = m.TS
+			if m.Subtype != "" || m.BotID != "" || m.User == "" {
+				continue
+			}
+			deliver(RemoteMessage{Nick: s.nick(ctx, m.User), Text: s.fromSlack(ctx, m.Text)})
+		}
+	}
+}
+
+// Send posts text to the channel with nick as the author's name.
+func (s *Slack) Send(ctx context.Context, nick, text string) error {
+	return s.call(ctx, http.MethodPost, "chat.postMessage", url.Values{
+		"channel":  {s.Channel},
+		"username": {nick},
+		"text":     {s.toSlack(text)},
+	}, nil)
+}
+
+// nick is the name Slack user id appears as in the room.
+func (s *Slack) nick(ctx context.Context, id string) string {
+	if nick, ok := s.Users[id]; ok {
+		return nick
+	}
+	s.mu.Lock()
+	name, ok := s.names[id]
+	s.mu.Unlock()
+	if ok {
+		return name
+	}
+	var resp struct {
+		User struct {
+			Name    string `json:"name"`
+			Profile struct {
+				DisplayName string `json:"display_name"`
+				RealName    string `json:"real_name"`
+			} `json:"profile"`
+		} `json:"user"`
+	}
+	if err := s.call(ctx, http.MethodGet, "users.info", url.Values{"user": {id}}, &resp); err != nil {
+		// try again next time
+		return id
+	}
+	name = resp.User.Profile.DisplayName
+	if name == "" {
+		name = resp.User.Profile.RealName
+	}
+	if name == "" {
+		name = resp.User.Name
+	}
+	if name == "" {
+		name = id
+	}
+	name = strings.ReplaceAll(name, " ", "_")
+	s.mu.Lock()
+	s.names[id] = name
+	s.mu.Unlock()
+	return name
+}
+
+var (
+	slackMention = regexp.MustCompile(`<@([A-Z0-9]+)(\|[^>]*)?>`)
+	slackLink    = regexp.MustCompile(`<([^@#!][^|>]*)(\|([^>]*))?>`)
+	chatMention  = regexp.MustCompile(`@(\w+)`)
+)
+
+// fromSlack turns Slack markup into plain text: user mentions become @nick
+// and links their text.
+func (s *Slack) fromSlack(ctx context.Context, text string) string {
+	text = slackMention.ReplaceAllStringFunc(text, func(m string) string {
+		return "@" + s.nick(ctx, slackMention.FindStringSubmatch(m)[1])
+	})
+	text = slackLink.ReplaceAllStringFunc(text, func(m string) string {
+		parts := slackLink.FindStringSubmatch(m)
+		if parts[3] != "" {
+			return parts[3]
+		}
+		return parts[1]
+	})
+	return strings.NewReplacer("&lt;", "<", "&gt;", ">", "&amp;", "&").Replace(text)
+}
+
+// toSlack escapes text for Slack and turns @nick into a mention of the user
+// Users maps to nick.
+func (s *Slack) toSlack(text string) string {
+	text = strings.NewReplacer("&", "&amp;", "<", "&lt;", ">", "&gt;").Replace(text)
+	return chatMention.ReplaceAllStringFunc(text, func(m string) string {
+		for id, nick := range s.Users {
+			if strings.EqualFold(nick, m[1:]) {
+				return "<@" + id + ">"
+			}
+		}
+		return m
+	})
+}
+
+// call invokes a Web API method and decodes the response into out, which
+// may be nil. It waits out rate limits, as long as ctx allows.
+func (s *Slack) call(ctx context.Context, httpMethod, method string, args url.Values, out any) error {
+	for {
+		var req *http.Request
+		var err error
+		if httpMethod == http.MethodGet {
+			req, err = http.NewRequestWithContext(ctx, httpMethod, s.API+method+"?"+args.Encode(), nil)
+		} else {
+			req, err = http.NewRequestWithContext(ctx, httpMethod, s.API+method, strings.NewReader(args.Encode()))
+			if req != nil {
+				req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			}
+		}
+		if err != nil {
+			return err
+		}
+		req.Header.Set("Authorization", "Bearer "+s.Token)
+		resp, err := s.Client.Do(req)
+		if err != nil {
+			return err
+		}
+		if resp.StatusCode == http.StatusTooManyRequests {
+			resp.Body.Close()
+			wait := s.RateLimitWait
+			if secs, err := strconv.Atoi(resp.Header.Get("Retry-After")); err == nil && secs > 0 {
+				wait = time.Duration(secs) * time.Second
+			}
+			timer := time.NewTimer(wait)
+			select {
+			case <-ctx.Done():
+				timer.Stop()
+				return ctx.Err()
+			case <-timer.C:
+			}
+			continue
+		}
+		var result struct {
+			OK    bool   `json:"ok"`
+			Error string `json:"error"`
+		}
+		var raw json.RawMessage
+		err = json.NewDecoder(resp.Body).Decode(&raw)
+		resp.Body.Close()
+		if err == nil {
+			err = json.Unmarshal(raw, &result)
+		}
+		if err != nil {
+			return fmt.Errorf("slack %s: %s: %w", method, resp.Status, err)
+		}
+		if !result.OK {
+			return fmt.Errorf("slack %s: %s", method, result.Error)
+		}
+		if out != nil {
+			return json.Unmarshal(raw, out)
+		}
+		return nil
+	}
+}
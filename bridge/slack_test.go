@@ -0,0 +1,226 @@
+package bridge
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/fahimimam/chatApplication/chat"
+	"github.com/fahimimam/chatApplication/chatbot"
+	"github.com/sirupsen/logrus"
+)
+
+func TestMain(m *testing.M) {
+	logger := logrus.New()
+	logger.SetOutput(io.Discard)
+	chat.SetLogger(logger)
+	logrus.SetOutput(io.Discard)
+	os.Exit(m.Run())
+}
+
+const testTimeout = 5 * time.Second
+
+// newTestServer serves a chat server on a PipeListener until the test ends.
+func newTestServer(t *testing.T) (*chat.Server, *chat.PipeListener) {
+	t.Helper()
+	s := chat.NewServer()
+	s.FloodMessages = 0
+	s.FloodRepeats = 0
+	l := chat.NewPipeListener()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		s.Serve(context.Background(), l)
+	}()
+	t.Cleanup(func() {
+		s.Close()
+		<-done
+	})
+	return s, l
+}
+
+// inRoom waits until the server lists nick as a member of room.
+func inRoom(t *testing.T, s *chat.Server, nick, room string) {
+	t.Helper()
+	deadline := time.Now().Add(testTimeout)
+	for time.Now().Before(deadline) {
+		for _, r := range s.Snapshot().Rooms {
+			for _, m := range r.Members {
+				if r.Name == room && m == nick {
+					return
+				}
+			}
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	t.Fatalf("%s never joined %s", nick, room)
+}
+
+// runBot runs a chatbot for a person in room and returns what it hears.
+func runBot(t *testing.T, s *chat.Server, l *chat.PipeListener, nick, room string) (*chatbot.Bot, <-chan chatbot.Message) {
+	t.Helper()
+	messages := make(chan chatbot.Message, 16)
+	bot := chatbot.New(nick, room)
+	bot.OnMessage(func(_ *chatbot.Bot, m chatbot.Message) { messages <- m })
+	conn, err := l.Dial()
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		bot.Run(ctx, conn)
+	}()
+	t.Cleanup(func() {
+		cancel()
+		<-done
+	})
+	inRoom(t, s, nick, room)
+	return bot, messages
+}
+
+func receive[T any](t *testing.T, ch <-chan T) T {
+	t.Helper()
+	select {
+	case v := <-ch:
+		return v
+	case <-time.After(testTimeout):
+		var zero T
+		t.Fatal("timed out")
+		return zero
+	}
+}
+
+// fakeSlack serves the parts of the Web API the Slack remote uses.
+type fakeSlack struct {
+	mu      sync.Mutex
+	history []slackMessage
+	ts      int64
+	limited int
+	posts   chan url.Values
+}
+
+func newFakeSlack(t *testing.T) (*fakeSlack, *Slack) {
+	f := &fakeSlack{ts: time.Now().Unix() + 1, posts: make(chan url.Values, 16)}
+	hs := httptest.NewServer(http.HandlerFunc(f.serve))
+	t.Cleanup(hs.Close)
+	slack := NewSlack("xoxb-test", "C1")
+	slack.API = hs.URL + "/"
+	slack.PollInterval = 5 * time.Millisecond
+	slack.RateLimitWait = 5 * time.Millisecond
+	return f, slack
+}
+
+// say adds a message to the channel's history.
+func (f *fakeSlack) say(m slackMessage) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.ts++
+	m.TS = strconv.FormatInt(f.ts, 10) + ".000100"
+	f.history = append(f.history, m)
+}
+
+func (f *fakeSlack) serve(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if r.Header.Get("Authorization") != "Bearer xoxb-test" {
+		json.NewEncoder(w).Encode(map[string]any{"ok": false, "error": "invalid_auth"})
+		return
+	}
+	if f.limited > 0 {
+		f.limited--
+		w.WriteHeader(http.StatusTooManyRequests)
+		return
+	}
+	r.ParseForm()
+	switch r.URL.Path {
+	case "/conversations.history":
+		oldest, _ := strconv.ParseFloat(r.Form.Get("oldest"), 64)
+		var newer []slackMessage
+		for i := len(f.history) - 1; i >= 0; i-- {
+			if ts, _ := strconv.ParseFloat(f.history[i].TS, 64); ts > oldest {
+				newer = append(newer, f.history[i])
+			}
+		}
+		json.NewEncoder(w).Encode(map[string]any{"ok": true, "messages": newer})
+	case "/users.info":
+		profile := map[string]string{"display_name": "", "real_name": "Carol Smith"}
+		json.NewEncoder(w).Encode(map[string]any{"ok": true, "user": map[string]any{"name": "carol", "profile": profile}})
+	case "/chat.postMessage":
+		f.posts <- r.PostForm
+		json.NewEncoder(w).Encode(map[string]any{"ok": true})
+	default:
+		json.NewEncoder(w).Encode(map[string]any{"ok": false, "error": "unknown_method"})
+	}
+}
+
+// testAddr is the address a bridge dials the test server from.
+type testAddr string
+
+func (a testAddr) Network() string { return "test" }
+func (a testAddr) String() string  { return string(a) }
+
+// runBridge runs b over a trusted connection, as StartBridges does.
+func runBridge(t *testing.T, l *chat.PipeListener, b *Bridge) <-chan error {
+	t.Helper()
+	conn, err := l.DialTrusted(testAddr(b.Remote.Name()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() { done <- b.Run(ctx, conn) }()
+	t.Cleanup(cancel)
+	return done
+}
+
+func TestSlackBridge(t *testing.T) {
+	s, l := newTestServer(t)
+	fake, slack := newFakeSlack(t)
+	slack.Users = map[string]string{"U2": "bob"}
+	runBridge(t, l, New("slack", "lobby", slack))
+	inRoom(t, s, "slack", "lobby")
+	alice, heard := runBot(t, s, l, "alice", "lobby")
+
+	fake.mu.Lock()
+	fake.limited = 2
+	fake.mu.Unlock()
+	alice.Send("hi @bob & co")
+	post := receive(t, fake.posts)
+	if post.Get("channel") != "C1" || post.Get("username") != "alice" || post.Get("text") != "hi <@U2> &amp; co" {
+		t.Errorf("posted %v", post)
+	}
+
+	fake.say(slackMessage{User: "U9", BotID: "B1", Text: "from a bot"})
+	fake.say(slackMessage{User: "U1", Subtype: "channel_join", Text: "joined"})
+	fake.say(slackMessage{User: "U1", Text: "hello <@U2> &amp; see <https://example.com|the docs>\nbye"})
+	for _, want := range []string{"<Carol_Smith> hello @bob & see the docs", "<Carol_Smith> bye"} {
+		if m := receive(t, heard); m.Nick != "slack" || m.Text != want {
+			t.Errorf("alice heard %+v, want %q", m, want)
+		}
+	}
+}
+
+func TestSlackBridgeStopsOnAPIError(t *testing.T) {
+	_, l := newTestServer(t)
+	_, slack := newFakeSlack(t)
+	slack.Token = "wrong"
+	done := runBridge(t, l, New("slack", "lobby", slack))
+	select {
+	case err := <-done:
+		if err == nil || err.Error() != "slack conversations.history: invalid_auth" {
+			t.Errorf("Run = %v", err)
+		}
+	case <-time.After(testTimeout):
+		t.Fatal("the bridge kept running with a bad token")
+	}
+}
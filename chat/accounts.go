@@ -0,0 +1,123 @@
+package chat
+
+import (
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sync"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// MinPasswordLength is the shortest password /register accepts, in bytes.
+const MinPasswordLength = 8
+
+var errAccountExists = errors.New("account already exists")
+
+// passwordCost is the bcrypt cost of new hashes; tests lower it.
+var passwordCost = bcrypt.DefaultCost
+
+// Accounts stores a bcrypt hash per registered nickname in a JSON file, so
+// registrations survive restarts. Hashing and verifying are deliberately
+// slow; call them off the Run goroutine. At most half the CPUs hash at once,
+// and further callers wait their turn.
+type Accounts struct {
+	path   string
+	mu     sync.Mutex
+	hashes map[string][]byte
+	// hashing is a semaphore bounding concurrent bcrypt work.
+	hashing chan struct{}
+}
+
+// NewAccounts loads the accounts file at path. A missing file is created on
+// the first registration.
+func NewAccounts(path string) (*Accounts, error) {
+	a := &Accounts{
+		path:    path,
+		hashes:  make(map[string][]byte),
+		hashing: make(chan struct{}, max(1, runtime.NumCPU()/2)),
+	}
+	b, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return a, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(b, &a.hashes); err != nil {
+		return nil, err
+	}
+	return a, nil
+}
+
+// Exists reports whether nick is registered.
+func (a *Accounts) Exists(nick string) bool {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	_, ok := a.hashes[nick]
+	return ok
+}
+
+// Register stores a hash of password for nick and writes the file.
+func (a *Accounts) Register(nick, password string) error {
+	a.hashing <- struct{}{}
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), passwordCost)
+	<-a.hashing
+	if err != nil {
+		return err
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if _, ok := a.hashes[nick]; ok {
+		return errAccountExists
+	}
+	a.hashes[nick] = hash
+	if err := a.save(); err != nil {
+		delete(a.hashes, nick)
+		return err
+	}
+	return nil
+}
+
+// Verify reports whether password is correct for nick.
+func (a *Accounts) Verify(nick, password string) bool {
+	a.mu.Lock()
+	hash, ok := a.hashes[nick]
+	a.mu.Unlock()
+	if !ok {
+		return false
+	}
+	a.hashing <- struct{}{}
+	defer func() { <-a.hashing }()
+	return bcrypt.CompareHashAndPassword(hash, []byte(password)) == nil
+}
+
+// save writes the accounts file.
+func (a *Accounts) save() error {
+	b, err := json.MarshalIndent(a.hashes, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(a.path, b)
+}
+
+// writeFileAtomic replaces the file at path with data through a temporary
+// file and a rename, so a crash never leaves it half written.
+func writeFileAtomic(path string, data []byte) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+"-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
@@ -0,0 +1,128 @@
+package chat
+
+import (
+	"errors"
+	"path/filepath"
+	"testing"
+)
+
+func newTestAccounts(t *testing.T) *Accounts {
+	t.Helper()
+	a, err := NewAccounts(filepath.Join(t.TempDir(), "accounts.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return a
+}
+
+func TestAccountsPersist(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "accounts.json")
+	a, err := NewAccounts(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := a.Register("alice", "hunter22"); err != nil {
+		t.Fatal(err)
+	}
+	if err := a.Register("alice", "other-password"); !errors.Is(err, errAccountExists) {
+		t.Errorf("registering twice gave %v", err)
+	}
+
+	b, err := NewAccounts(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !b.Exists("alice") || b.Exists("bob") {
+		t.Error("the reloaded accounts differ")
+	}
+	if !b.Verify("alice", "hunter22") {
+		t.Error("the right password was refused")
+	}
+	if b.Verify("alice", "hunter23") || b.Verify("bob", "hunter22") {
+		t.Error("a wrong password or nick was accepted")
+	}
+}
+
+func TestRegisterAndLogin(t *testing.T) {
+	_, l := newTestServer(t, func(s *Server) {
+		s.Accounts = newTestAccounts(t)
+		s.MessageRate = 0
+	})
+
+	alice := dial(t, l)
+	if out := alice.do("/register alice short"); !hasLine(out, "password must be at least 8 characters") {
+		t.Errorf("short password got %q", out)
+	}
+	alice.send("/register alice hunter22")
+	alice.expect("registered alice")
+	alice.expect("Server will know you by alice")
+	alice.send("/quit")
+	alice.expectClosed()
+
+	guest := dial(t, l)
+	if out := guest.do("/name alice"); !hasLine(out, "nickname alice is registered, use /login to claim it") {
+		t.Errorf("/name of a registered nick got %q", out)
+	}
+	if out := guest.do("/invite alice"); !hasLine(out, "guests cannot use /invite") {
+		t.Errorf("AccountOnly command as a guest got %q", out)
+	}
+	guest.send("/login alice hunter22")
+	guest.expect("you are now logged in as alice")
+	if out := guest.do("/login alice hunter22"); !hasLine(out, "you are already logged in as alice") {
+		t.Errorf("logging in twice got %q", out)
+	}
+}
+
+func TestLoginBackoff(t *testing.T) {
+	clock := newFakeClock()
+	accounts := newTestAccounts(t)
+	if err := accounts.Register("alice", "hunter22"); err != nil {
+		t.Fatal(err)
+	}
+	_, l := newTestServer(t, func(s *Server) {
+		s.Accounts = accounts
+		s.MessageRate = 0
+	}, WithClock(clock.Now))
+
+	c := dial(t, l)
+	c.send("/login alice wrong-password")
+	c.expect("invalid nickname or password")
+	if out := c.do("/login alice hunter22"); !hasLine(out, "too many failed logins, try again in 1s") {
+		t.Errorf("login during the backoff got %q", out)
+	}
+
+	// each failure doubles the wait
+	clock.Advance(LoginBackoffBase)
+	c.send("/login alice wrong-password")
+	c.expect("invalid nickname or password")
+	if out := c.do("/login alice hunter22"); !hasLine(out, "try again in 2s") {
+		t.Errorf("login after a second failure got %q", out)
+	}
+
+	// the backoff is per address
+	other := dial(t, l)
+	other.send("/login alice hunter22")
+	other.expect("you are now logged in as alice")
+	other.send("/quit")
+	other.expectClosed()
+
+	clock.Advance(2 * LoginBackoffBase)
+	c.send("/login alice hunter22")
+	c.expect("you are now logged in as alice")
+}
+
+func TestLoginBackoffCap(t *testing.T) {
+	clock := newFakeClock()
+	s := NewServer(WithClock(clock.Now))
+	c := &Client{Conn: addrConn{remote: nextAddr()}}
+	for i := 0; i < 20; i++ {
+		s.loginFailed(c)
+	}
+	if wait := s.loginBackoffs[remoteIP(c.Conn)].until.Sub(clock.Now()); wait != LoginBackoffMax {
+		t.Errorf("wait after many failures = %s, want %s", wait, LoginBackoffMax)
+	}
+	s.loginSucceeded(c)
+	if err := s.checkLoginBackoff(c); err != nil {
+		t.Errorf("backoff after a success: %v", err)
+	}
+}
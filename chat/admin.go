@@ -0,0 +1,197 @@
+package chat
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+)
+
+// MaxAnnouncementLength caps the text of an announcement made through the
+// admin API.
+const MaxAnnouncementLength = 1024
+
+// AdminAPI serves the REST admin API. Paths are relative to where it is
+// mounted, so serve it with http.StripPrefix, and behind RequireAdmin:
+//
+//	GET    /rooms              list the rooms
+//	DELETE /rooms/NAME         delete a room, moving its members out
+//	GET    /clients            list the connected clients
+//	POST   /clients/NICK/kick  disconnect a client
+//	POST   /announce           send {"text": "..."} to every client, or with
+//	                           "room" set to that room's members
+//
+// Responses are JSON. Errors look like {"code": "room_not_found", "error":
+// "..."}, with the same codes JSON mode clients see.
+func (s *Server) AdminAPI() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		parts := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+		switch {
+		case len(parts) == 1 && parts[0] == "rooms":
+			if allowMethod(w, r, http.MethodGet) {
+				writeJSON(w, http.StatusOK, s.Snapshot().Rooms)
+			}
+		case len(parts) == 2 && parts[0] == "rooms":
+			if allowMethod(w, r, http.MethodDelete) {
+				s.adminDeleteRoom(w, parts[1])
+			}
+		case len(parts) == 1 && parts[0] == "clients":
+			if allowMethod(w, r, http.MethodGet) {
+				writeJSON(w, http.StatusOK, s.Snapshot().Clients)
+			}
+		case len(parts) == 3 && parts[0] == "clients" && parts[2] == "kick":
+			if allowMethod(w, r, http.MethodPost) {
+				s.adminKick(w, parts[1])
+			}
+		case len(parts) == 1 && parts[0] == "announce":
+			if allowMethod(w, r, http.MethodPost) {
+				s.adminAnnounce(w, r)
+			}
+		default:
+			writeAPIError(w, errorf(ErrUnknownCommand, "no such endpoint: %s %s", r.Method, r.URL.Path))
+		}
+	})
+}
+
+func (s *Server) adminDeleteRoom(w http.ResponseWriter, name string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	room, ok := s.Rooms[name]
+	if !ok {
+		writeAPIError(w, errorf(ErrRoomNotFound, "room %q not found", name))
+		return
+	}
+	for m := range room.Members {
+		room.RemoveMember(m)
+		m.Room = nil
+		m.Message(fmt.Sprintf("%s was deleted by an admin", room.Name))
+		s.Events.OnLeave(m, room)
+	}
+	delete(s.Rooms, name)
+	s.deleteHistory(name)
+	s.deleteHooks(name)
+	if rs, ok := s.Events.(RoomStateSink); ok {
+		rs.OnRoomDelete(name)
+	}
+	s.Logger().WithFields(logrus.Fields{
+		"room": name,
+	}).Info("room deleted through the admin API")
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *Server) adminKick(w http.ResponseWriter, nick string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	target := s.findClient(nick)
+	if target == nil {
+		writeAPIError(w, errorf(ErrUserNotFound, "%s is not connected", nick))
+		return
+	}
+	s.Logger().WithFields(logrus.Fields{
+		"target": target.NickName,
+	}).Info("client kicked through the admin API")
+	target.Message("you were disconnected by an admin")
+	s.closeClient(target, ReasonKicked)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *Server) adminAnnounce(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Text string `json:"text"`
+		Room string `json:"room"`
+	}
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 4*MaxAnnouncementLength)).Decode(&req); err != nil {
+		writeAPIError(w, errorf(ErrInvalidInput, "invalid JSON body: %v", err))
+		return
+	}
+	text, err := announcement(req.Text)
+	if err != nil {
+		writeAPIError(w, err)
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var room *Room
+	if req.Room != "" {
+		var ok bool
+		if room, ok = s.Rooms[req.Room]; !ok {
+			writeAPIError(w, errorf(ErrRoomNotFound, "room %q not found", req.Room))
+			return
+		}
+	}
+	writeJSON(w, http.StatusOK, map[string]int{"delivered": s.announce(room, text)})
+}
+
+// announcement checks the text of an announcement and returns it trimmed.
+func announcement(text string) (string, error) {
+	text = strings.TrimSpace(text)
+	switch {
+	case text == "":
+		return "", errorf(ErrInvalidArgument, "text is required")
+	case len(text) > MaxAnnouncementLength || strings.ContainsAny(text, "\r\n"):
+		return "", errorf(ErrInvalidArgument, "text must be one line of at most %d bytes", MaxAnnouncementLength)
+	}
+	return text, nil
+}
+
+// announce sends text as an announcement to room's members, or to every
+// client when room is nil, and returns how many it reached. The caller holds
+// mu.
+func (s *Server) announce(room *Room, text string) int {
+	notice := "announcement: " + text
+	if room != nil {
+		delivered, _ := room.Announce(notice)
+		return delivered
+	}
+	var delivered int
+	s.clientsMu.Lock()
+	for c := range s.clients {
+		if c.deliver(notice) == nil {
+			delivered++
+		}
+	}
+	s.clientsMu.Unlock()
+	return delivered
+}
+
+func allowMethod(w http.ResponseWriter, r *http.Request, method string) bool {
+	if r.Method == method {
+		return true
+	}
+	w.Header().Set("Allow", method)
+	writeJSON(w, http.StatusMethodNotAllowed, apiError{Code: ErrUsage, Error: fmt.Sprintf("use %s", method)})
+	return false
+}
+
+type apiError struct {
+	Code  ErrorCode `json:"code"`
+	Error string    `json:"error"`
+}
+
+// httpStatuses maps error codes to HTTP statuses; others are 400.
+var httpStatuses = map[ErrorCode]int{
+	ErrUnknownCommand:   http.StatusNotFound,
+	ErrRoomNotFound:     http.StatusNotFound,
+	ErrUserNotFound:     http.StatusNotFound,
+	ErrPermissionDenied: http.StatusForbidden,
+	ErrRateLimited:      http.StatusTooManyRequests,
+	ErrInternal:         http.StatusInternalServerError,
+}
+
+func writeAPIError(w http.ResponseWriter, err error) {
+	code := errorCode(err)
+	status, ok := httpStatuses[code]
+	if !ok {
+		status = http.StatusBadRequest
+	}
+	writeJSON(w, status, apiError{Code: code, Error: err.Error()})
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
@@ -0,0 +1,266 @@
+package chat
+
+import (
+	"bufio"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// newAdminServer serves the admin API and event stream the way config.Main
+// mounts them.
+func newAdminServer(t *testing.T, configure func(s *Server)) (*Server, *PipeListener, *httptest.Server) {
+	t.Helper()
+	hub := NewEventHub(0)
+	s, l := newTestServer(t, func(s *Server) {
+		s.AdminToken = "secret"
+		s.Events = hub
+		if configure != nil {
+			configure(s)
+		}
+	})
+	mux := http.NewServeMux()
+	mux.Handle("/admin/events", s.RequireAdmin(hub))
+	mux.Handle("/admin/", http.StripPrefix("/admin", s.RequireAdmin(s.AdminAPI())))
+	hs := httptest.NewServer(mux)
+	t.Cleanup(hs.Close)
+	return s, l, hs
+}
+
+func adminRequest(t *testing.T, hs *httptest.Server, method, path, body string) (*http.Response, apiError) {
+	t.Helper()
+	req, err := http.NewRequest(method, hs.URL+path, strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Authorization", "Bearer secret")
+	resp, err := hs.Client().Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	var apiErr apiError
+	if resp.StatusCode >= 300 {
+		json.NewDecoder(resp.Body).Decode(&apiErr)
+	}
+	return resp, apiErr
+}
+
+func TestRequireAdmin(t *testing.T) {
+	s, _, hs := newAdminServer(t, nil)
+
+	for _, auth := range []string{"", "Bearer wrong", "secret"} {
+		req, _ := http.NewRequest(http.MethodGet, hs.URL+"/admin/rooms", nil)
+		if auth != "" {
+			req.Header.Set("Authorization", auth)
+		}
+		resp, err := hs.Client().Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusForbidden {
+			t.Errorf("Authorization %q got %s", auth, resp.Status)
+		}
+	}
+
+	s.AdminToken = ""
+	if resp, _ := adminRequest(t, hs, http.MethodGet, "/admin/rooms", ""); resp.StatusCode != http.StatusForbidden {
+		t.Errorf("with no admin token configured got %s", resp.Status)
+	}
+}
+
+func TestAdminListAndKick(t *testing.T) {
+	_, l, hs := newAdminServer(t, nil)
+	alice := dial(t, l)
+	alice.join("alice", "lobby")
+
+	req, _ := http.NewRequest(http.MethodGet, hs.URL+"/admin/rooms", nil)
+	req.Header.Set("Authorization", "Bearer secret")
+	resp, err := hs.Client().Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var rooms []RoomState
+	json.NewDecoder(resp.Body).Decode(&rooms)
+	resp.Body.Close()
+	if len(rooms) != 1 || rooms[0].Name != "lobby" || rooms[0].Owner != "alice" {
+		t.Errorf("GET /rooms = %+v", rooms)
+	}
+
+	if resp, _ := adminRequest(t, hs, http.MethodPost, "/admin/clients/alice/kick", ""); resp.StatusCode != http.StatusNoContent {
+		t.Fatalf("kick got %s", resp.Status)
+	}
+	if out := alice.expectClosed(); !hasLine(out, "you were disconnected by an admin") {
+		t.Errorf("alice got %q", out)
+	}
+	if resp, apiErr := adminRequest(t, hs, http.MethodPost, "/admin/clients/alice/kick", ""); resp.StatusCode != http.StatusNotFound || apiErr.Code != ErrUserNotFound {
+		t.Errorf("kicking a gone client got %s %+v", resp.Status, apiErr)
+	}
+	if resp, apiErr := adminRequest(t, hs, http.MethodGet, "/admin/clients/alice/kick", ""); resp.StatusCode != http.StatusMethodNotAllowed || resp.Header.Get("Allow") != http.MethodPost {
+		t.Errorf("GET on kick got %s %+v", resp.Status, apiErr)
+	}
+	if resp, apiErr := adminRequest(t, hs, http.MethodGet, "/admin/nothing", ""); resp.StatusCode != http.StatusNotFound || apiErr.Code != ErrUnknownCommand {
+		t.Errorf("an unknown endpoint got %s %+v", resp.Status, apiErr)
+	}
+}
+
+func TestAdminAnnounce(t *testing.T) {
+	_, l, hs := newAdminServer(t, nil)
+	alice, bob := dial(t, l), dial(t, l)
+	alice.join("alice", "lobby")
+	bob.join("bob", "kitchen")
+
+	if resp, _ := adminRequest(t, hs, http.MethodPost, "/admin/announce", `{"text": "lobby only", "room": "lobby"}`); resp.StatusCode != http.StatusOK {
+		t.Fatalf("announce got %s", resp.Status)
+	}
+	alice.expect("announcement: lobby only")
+	if resp, _ := adminRequest(t, hs, http.MethodPost, "/admin/announce", `{"text": "everyone"}`); resp.StatusCode != http.StatusOK {
+		t.Fatalf("announce got %s", resp.Status)
+	}
+	if _, skipped := bob.expect("announcement: everyone"); hasLine(skipped, "lobby only") {
+		t.Errorf("bob got the lobby's announcement: %q", skipped)
+	}
+
+	for body, code := range map[string]ErrorCode{
+		`{"text": ""}`:                      ErrInvalidArgument,
+		`{"text": "two\nlines"}`:            ErrInvalidArgument,
+		`{"text": "hi", "room": "nowhere"}`: ErrRoomNotFound,
+		`not json`:                          ErrInvalidInput,
+	} {
+		if _, apiErr := adminRequest(t, hs, http.MethodPost, "/admin/announce", body); apiErr.Code != code {
+			t.Errorf("announce %s got %+v, want %s", body, apiErr, code)
+		}
+	}
+}
+
+func TestAdminDeleteRoom(t *testing.T) {
+	h, err := NewFileHistory(t.TempDir(), time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer h.Close()
+	s, l, hs := newAdminServer(t, func(s *Server) { s.PersistentHistory = h })
+	alice := dial(t, l)
+	alice.join("alice", "lobby")
+	alice.send("/msg soon gone")
+	alice.expect("OK 1")
+
+	if resp, _ := adminRequest(t, hs, http.MethodDelete, "/admin/rooms/lobby", ""); resp.StatusCode != http.StatusNoContent {
+		t.Fatalf("delete got %s", resp.Status)
+	}
+	alice.expect("lobby was deleted by an admin")
+	if rooms := s.Snapshot().Rooms; len(rooms) != 0 {
+		t.Errorf("rooms after the delete = %+v", rooms)
+	}
+	if msgs, _ := h.Load("lobby", 10); len(msgs) != 0 {
+		t.Errorf("the deleted room's history is still stored: %+v", msgs)
+	}
+	if out := alice.do("/join lobby"); !hasLine(out, "you're the first one here") || hasLine(out, "soon gone") {
+		t.Errorf("rejoining got %q", out)
+	}
+	if resp, apiErr := adminRequest(t, hs, http.MethodDelete, "/admin/rooms/nowhere", ""); resp.StatusCode != http.StatusNotFound || apiErr.Code != ErrRoomNotFound {
+		t.Errorf("deleting a missing room got %s %+v", resp.Status, apiErr)
+	}
+}
+
+func TestAdminDeleteRoomDropsHooks(t *testing.T) {
+	hooks := newTestWebhooks(t)
+	hooks.Add("lobby", "https://example.com/hook")
+	s, l, hs := newAdminServer(t, func(s *Server) {
+		s.Events = EventSinks{s.Events, hooks}
+		s.IncomingWebhooks = []IncomingWebhook{{Room: "lobby", Nick: "ci", Token: "build"}}
+	})
+	dial(t, l).join("alice", "lobby")
+
+	if resp, _ := adminRequest(t, hs, http.MethodDelete, "/admin/rooms/lobby", ""); resp.StatusCode != http.StatusNoContent {
+		t.Fatalf("delete got %s", resp.Status)
+	}
+	if got := hooks.URLs("lobby"); len(got) != 0 {
+		t.Errorf("the deleted room still has webhooks %v", got)
+	}
+	s.mu.RLock()
+	_, ok := s.findHook("lobby", "build")
+	s.mu.RUnlock()
+	if ok {
+		t.Error("the deleted room still has its incoming webhook")
+	}
+}
+
+func TestEventStream(t *testing.T) {
+	_, l, hs := newAdminServer(t, nil)
+
+	req, _ := http.NewRequest(http.MethodGet, hs.URL+"/admin/events", nil)
+	req.Header.Set("Authorization", "Bearer secret")
+	resp, err := hs.Client().Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if ct := resp.Header.Get("Content-Type"); ct != "text/event-stream" {
+		t.Fatalf("Content-Type = %q", ct)
+	}
+
+	alice := dial(t, l)
+	alice.join("alice", "lobby")
+	alice.send("/msg hello")
+
+	events := make(chan Event)
+	go func() {
+		defer close(events)
+		sc := bufio.NewScanner(resp.Body)
+		for sc.Scan() {
+			if data, ok := strings.CutPrefix(sc.Text(), "data: "); ok {
+				var e Event
+				json.Unmarshal([]byte(data), &e)
+				events <- e
+			}
+		}
+	}()
+	var got []string
+	for _, want := range []string{"nick", "join", "message"} {
+		select {
+		case e := <-events:
+			got = append(got, e.Type)
+			if e.Type != want {
+				t.Fatalf("events = %q, want %s next", got, want)
+			}
+			if e.Type == "message" && (e.Room != "lobby" || e.Text != "hello" || e.NickName != "alice") {
+				t.Errorf("message event = %+v", e)
+			}
+		case <-time.After(testTimeout):
+			t.Fatalf("timed out after events %q", got)
+		}
+	}
+}
+
+func TestEventHubDropsForSlowSubscribers(t *testing.T) {
+	hub := NewEventHub(1)
+	events, cancel := hub.Subscribe()
+	dropped := testutil.ToFloat64(droppedEventsCounter)
+
+	r := NewRoom("lobby", 0, 10)
+	c := &Client{NickName: "alice"}
+	for i := 0; i < 3; i++ {
+		hub.OnJoin(c, r)
+	}
+	if got := testutil.ToFloat64(droppedEventsCounter) - dropped; got != 2 {
+		t.Errorf("dropped %v events, want 2", got)
+	}
+	if e := <-events; e.Type != "join" || e.Room != "lobby" {
+		t.Errorf("event = %+v", e)
+	}
+
+	cancel()
+	hub.OnLeave(c, r)
+	select {
+	case e := <-events:
+		t.Errorf("got %+v after cancelling", e)
+	default:
+	}
+}
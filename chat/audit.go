@@ -0,0 +1,159 @@
+package chat
+
+import (
+	"fmt"
+	"io"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	auditSyncInterval = 5 * time.Second
+	// auditQueueWait bounds how long Audit waits for room in a full queue
+	// before it gives up on the entry.
+	auditQueueWait = 100 * time.Millisecond
+)
+
+// AuditEntry is one audited message. Room is empty for direct messages,
+// which name their recipient in Target instead.
+type AuditEntry struct {
+	Time       time.Time
+	Room       string
+	Target     string
+	NickName   string
+	RemoteAddr string
+	Message    string
+}
+
+func (e AuditEntry) String() string {
+	where := fmt.Sprintf("room=%q", e.Room)
+	if e.Target != "" {
+		where = fmt.Sprintf("to=%q", e.Target)
+	}
+	return fmt.Sprintf("%s %s nick=%q addr=%s msg=%q",
+		e.Time.UTC().Format(time.RFC3339Nano), where, e.NickName, e.RemoteAddr, e.Message)
+}
+
+// AuditWriter records every delivered message, direct messages included. Implementations must not block
+// the caller, which is the server's command loop, for more than a moment.
+type AuditWriter interface {
+	Audit(entry AuditEntry)
+}
+
+type syncer interface {
+	Sync() error
+}
+
+// AuditLogger is an append-only AuditWriter backed by any io.Writer. Entries
+// are queued and written by a background goroutine; if the queue stays full
+// for auditQueueWait the entry is dropped, logged and counted in
+// tcp_chat_audit_dropped_total rather than stalling the chat. Writers that
+// support Sync (such as *os.File) are synced periodically and on Close.
+type AuditLogger struct {
+	w       io.Writer
+	entries chan AuditEntry
+	done    chan struct{}
+	dropped atomic.Uint64
+
+	// mu guards closed; Audit holds it for reading while it sends so that
+	// Close cannot close entries underneath it
+	mu     sync.RWMutex
+	closed bool
+}
+
+func NewAuditLogger(w io.Writer, queueSize int) *AuditLogger {
+	a := &AuditLogger{
+		w:       w,
+		entries: make(chan AuditEntry, queueSize),
+		done:    make(chan struct{}),
+	}
+	go a.run()
+	return a
+}
+
+// Audit queues entry for writing. Entries audited after Close are ignored.
+func (a *AuditLogger) Audit(entry AuditEntry) {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	if a.closed {
+		return
+	}
+	select {
+	case a.entries <- entry:
+		return
+	default:
+	}
+
+	timer := time.NewTimer(auditQueueWait)
+	defer timer.Stop()
+	select {
+	case a.entries <- entry:
+	case <-timer.C:
+		a.dropped.Add(1)
+		auditDroppedCounter.Inc()
+		log.WithFields(logrus.Fields{
+			"room":    entry.Room,
+			"nick":    entry.NickName,
+			"dropped": a.dropped.Load(),
+		}).Error("audit queue full, dropping entry")
+	}
+}
+
+// Dropped returns the number of entries dropped because the queue was full.
+func (a *AuditLogger) Dropped() uint64 {
+	return a.dropped.Load()
+}
+
+// Close writes out everything still queued and syncs the underlying writer.
+func (a *AuditLogger) Close() {
+	a.mu.Lock()
+	if a.closed {
+		a.mu.Unlock()
+		return
+	}
+	a.closed = true
+	close(a.entries)
+	a.mu.Unlock()
+	<-a.done
+}
+
+func (a *AuditLogger) run() {
+	defer close(a.done)
+	ticker := time.NewTicker(auditSyncInterval)
+	defer ticker.Stop()
+
+	dirty := false
+	for {
+		select {
+		case entry, ok := <-a.entries:
+			if !ok {
+				a.sync()
+				return
+			}
+			if _, err := io.WriteString(a.w, entry.String()+"\n"); err != nil {
+				log.WithFields(logrus.Fields{
+					"error": err.Error(),
+				}).Error("failed to write audit entry")
+			}
+			dirty = true
+		case <-ticker.C:
+			if dirty {
+				a.sync()
+				dirty = false
+			}
+		}
+	}
+}
+
+func (a *AuditLogger) sync() {
+	if s, ok := a.w.(syncer); ok {
+		if err := s.Sync(); err != nil {
+			log.WithFields(logrus.Fields{
+				"error": err.Error(),
+			}).Error("failed to sync audit log")
+		}
+	}
+}
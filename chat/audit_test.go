@@ -0,0 +1,118 @@
+package chat
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAuditEntryString(t *testing.T) {
+	e := AuditEntry{
+		Time:       time.Date(2024, 1, 1, 12, 0, 0, 0, time.FixedZone("CET", 3600)),
+		Room:       "lobby",
+		NickName:   "alice",
+		RemoteAddr: "10.0.0.1:4000",
+		Message:    `say "hi"`,
+	}
+	want := `2024-01-01T11:00:00Z room="lobby" nick="alice" addr=10.0.0.1:4000 msg="say \"hi\""`
+	if got := e.String(); got != want {
+		t.Errorf("String() = %s, want %s", got, want)
+	}
+}
+
+func TestAuditEntryStringDirectMessage(t *testing.T) {
+	e := AuditEntry{
+		Time:       time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC),
+		Target:     "bob",
+		NickName:   "alice",
+		RemoteAddr: "10.0.0.1:4000",
+		Message:    "psst",
+	}
+	want := `2024-01-01T12:00:00Z to="bob" nick="alice" addr=10.0.0.1:4000 msg="psst"`
+	if got := e.String(); got != want {
+		t.Errorf("String() = %s, want %s", got, want)
+	}
+}
+
+func TestAuditLogsMessages(t *testing.T) {
+	var buf bytes.Buffer
+	audit := NewAuditLogger(&buf, 16)
+	_, l := newTestServer(t, func(s *Server) { s.Audit = audit })
+
+	alice := dial(t, l)
+	alice.join("alice", "lobby")
+	alice.send("/msg first")
+	alice.send("/msg second")
+	alice.expect("OK 2")
+
+	// Close drains the queue, so everything audited so far is in buf
+	audit.Close()
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("audit log has %d lines, want 2:\n%s", len(lines), buf.String())
+	}
+	for i, msg := range []string{"first", "second"} {
+		if !strings.Contains(lines[i], `room="lobby" nick="alice"`) || !strings.HasSuffix(lines[i], `msg="`+msg+`"`) {
+			t.Errorf("line %d = %s", i, lines[i])
+		}
+	}
+}
+
+// blockingWriter holds every write until release is closed.
+type blockingWriter struct {
+	release chan struct{}
+}
+
+func (w blockingWriter) Write(p []byte) (int, error) {
+	<-w.release
+	return len(p), nil
+}
+
+func TestAuditCountsDroppedEntries(t *testing.T) {
+	w := blockingWriter{release: make(chan struct{})}
+	audit := NewAuditLogger(w, 1)
+	defer audit.Close()
+	defer close(w.release)
+
+	// the first entry is taken by the writer, the second fills the queue,
+	// and the third waits auditQueueWait before it is dropped
+	for i := 0; i < 3; i++ {
+		audit.Audit(AuditEntry{Room: "lobby", Message: "hi"})
+	}
+	if got := audit.Dropped(); got != 1 {
+		t.Errorf("Dropped() = %d, want 1", got)
+	}
+}
+
+func TestAuditAfterClose(t *testing.T) {
+	var buf bytes.Buffer
+	audit := NewAuditLogger(&buf, 16)
+	audit.Close()
+	audit.Close()
+
+	audit.Audit(AuditEntry{Room: "lobby", Message: "late"})
+	if buf.Len() != 0 {
+		t.Errorf("audited after Close: %q", buf.String())
+	}
+}
+
+func TestAuditLogsDirectMessages(t *testing.T) {
+	var buf bytes.Buffer
+	audit := NewAuditLogger(&buf, 16)
+	_, l := newTestServer(t, func(s *Server) { s.Audit = audit })
+
+	addr := nextAddr()
+	alice, bob := dialAs(t, l, addr), dial(t, l)
+	alice.do("/name alice")
+	bob.do("/name bob")
+	alice.send("/dm bob psst")
+	bob.expect("[dm from alice] psst")
+	alice.expect("[dm to bob] psst")
+
+	audit.Close()
+	want := `to="bob" nick="alice" addr=` + addr.String() + ` msg="psst"`
+	if got := strings.TrimSpace(buf.String()); !strings.HasSuffix(got, want) {
+		t.Errorf("audit log = %q, want it to end with %q", got, want)
+	}
+}
@@ -0,0 +1,256 @@
+package chat
+
+import (
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"net"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// BanList is a thread-safe set of banned IPs and CIDR ranges. It is consulted
+// from the accept loop and every connection goroutine in NewClient and
+// mutated from the command loop, so all access goes through mu.
+//
+// Bans may expire. A list loaded from a file writes the bans made at run time
+// back to it, so they survive restarts.
+type BanList struct {
+	// Now is the clock expiries are checked against.
+	Now   func() time.Time
+	path  string
+	mu    sync.RWMutex
+	ips   map[string]ban
+	cidrs map[string]ban
+}
+
+// ban is one entry of a BanList.
+type ban struct {
+	// ipNet is the banned range, or nil for a single address.
+	ipNet *net.IPNet
+	// expires is when the ban lifts, or zero for a permanent ban.
+	expires time.Time
+	// saved marks bans made at run time, which are written to the ban file.
+	// The entries given to LoadBanList come from the config on every start.
+	saved bool
+}
+
+func (b ban) active(now time.Time) bool {
+	return b.expires.IsZero() || now.Before(b.expires)
+}
+
+// banRecord is a ban as stored in the ban file.
+type banRecord struct {
+	Entry   string     `json:"entry"`
+	Expires *time.Time `json:"expires,omitempty"`
+}
+
+// NewBanList keeps its bans in memory only.
+func NewBanList(entries ...string) (*BanList, error) {
+	return LoadBanList("", entries...)
+}
+
+// LoadBanList loads the bans saved in the file at path, adds the permanent
+// entries, and saves later changes back to the file. A missing file is
+// created on the first ban; an empty path keeps bans in memory only.
+func LoadBanList(path string, entries ...string) (*BanList, error) {
+	b := &BanList{
+		Now:   time.Now,
+		path:  path,
+		ips:   make(map[string]ban),
+		cidrs: make(map[string]ban),
+	}
+	if path != "" {
+		data, err := os.ReadFile(path)
+		if err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return nil, err
+		}
+		var records []banRecord
+		if len(data) > 0 {
+			if err := json.Unmarshal(data, &records); err != nil {
+				return nil, err
+			}
+		}
+		for _, r := range records {
+			key, ipNet, err := parseBan(r.Entry)
+			if err != nil {
+				return nil, err
+			}
+			entry := ban{ipNet: ipNet, saved: true}
+			if r.Expires != nil {
+				entry.expires = *r.Expires
+			}
+			b.set(key, entry)
+		}
+	}
+	for _, e := range entries {
+		key, ipNet, err := parseBan(e)
+		if err != nil {
+			return nil, err
+		}
+		b.set(key, ban{ipNet: ipNet})
+	}
+	return b, nil
+}
+
+// parseBan parses an IP address or CIDR range into the key it is stored
+// under.
+func parseBan(entry string) (string, *net.IPNet, error) {
+	entry = strings.TrimSpace(entry)
+	if strings.Contains(entry, "/") {
+		_, ipNet, err := net.ParseCIDR(entry)
+		if err != nil {
+			return "", nil, err
+		}
+		return ipNet.String(), ipNet, nil
+	}
+	ip := net.ParseIP(entry)
+	if ip == nil {
+		return "", nil, &net.ParseError{Type: "IP address", Text: entry}
+	}
+	return ip.String(), nil, nil
+}
+
+// Ban adds an IP address or CIDR range to the list for good.
+func (b *BanList) Ban(entry string) error {
+	return b.BanFor(entry, 0)
+}
+
+// BanFor adds an IP address or CIDR range to the list until d has passed, or
+// for good when d is 0, and saves the list. An entry that does not parse
+// gives a *net.ParseError; if saving fails the list is left as it was.
+func (b *BanList) BanFor(entry string, d time.Duration) error {
+	key, ipNet, err := parseBan(entry)
+	if err != nil {
+		return err
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	added := ban{ipNet: ipNet, saved: true}
+	if d > 0 {
+		added.expires = b.Now().Add(d)
+	}
+	prev, existed := b.get(key)
+	b.set(key, added)
+	if err := b.save(); err != nil {
+		if existed {
+			b.set(key, prev)
+		} else {
+			b.remove(key)
+		}
+		return err
+	}
+	return nil
+}
+
+// Unban removes an IP address or CIDR range and reports whether it was
+// banned. A ban from the config comes back on the next start.
+func (b *BanList) Unban(entry string) (bool, error) {
+	key, _, err := parseBan(entry)
+	if err != nil {
+		return false, nil
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	prev, ok := b.get(key)
+	if !ok || !prev.active(b.Now()) {
+		return false, nil
+	}
+	b.remove(key)
+	if err := b.save(); err != nil {
+		b.set(key, prev)
+		return false, err
+	}
+	return true, nil
+}
+
+func (b *BanList) IsBanned(ip string) bool {
+	parsed := net.ParseIP(ip)
+	if parsed == nil {
+		return false
+	}
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	now := b.Now()
+	if entry, ok := b.ips[parsed.String()]; ok && entry.active(now) {
+		return true
+	}
+	for _, entry := range b.cidrs {
+		if entry.ipNet.Contains(parsed) && entry.active(now) {
+			return true
+		}
+	}
+	return false
+}
+
+func (b *BanList) get(key string) (ban, bool) {
+	if strings.Contains(key, "/") {
+		entry, ok := b.cidrs[key]
+		return entry, ok
+	}
+	entry, ok := b.ips[key]
+	return entry, ok
+}
+
+func (b *BanList) set(key string, entry ban) {
+	if entry.ipNet != nil {
+		b.cidrs[key] = entry
+	} else {
+		b.ips[key] = entry
+	}
+}
+
+func (b *BanList) remove(key string) {
+	delete(b.ips, key)
+	delete(b.cidrs, key)
+}
+
+// save writes the bans made at run time that have not expired to the ban
+// file, dropping expired ones from the list. It does nothing for a list
+// kept in memory only. The caller holds mu.
+func (b *BanList) save() error {
+	now := b.Now()
+	records := []banRecord{}
+	for _, m := range []map[string]ban{b.ips, b.cidrs} {
+		for key, entry := range m {
+			if !entry.active(now) {
+				delete(m, key)
+				continue
+			}
+			if !entry.saved {
+				continue
+			}
+			r := banRecord{Entry: key}
+			if !entry.expires.IsZero() {
+				expires := entry.expires
+				r.Expires = &expires
+			}
+			records = append(records, r)
+		}
+	}
+	if b.path == "" {
+		return nil
+	}
+	sort.Slice(records, func(i, j int) bool { return records[i].Entry < records[j].Entry })
+	data, err := json.MarshalIndent(records, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(b.path, data)
+}
+
+// remoteIP returns the host part of the connection's remote address.
+func remoteIP(conn net.Conn) string {
+	addr := conn.RemoteAddr().String()
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return addr
+	}
+	return host
+}
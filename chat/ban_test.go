@@ -0,0 +1,123 @@
+package chat
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestBanList(t *testing.T) {
+	b, err := NewBanList("192.0.2.1", "198.51.100.0/24")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for ip, want := range map[string]bool{
+		"192.0.2.1":     true,
+		"192.0.2.2":     false,
+		"198.51.100.77": true,
+		"not-an-ip":     false,
+	} {
+		if got := b.IsBanned(ip); got != want {
+			t.Errorf("IsBanned(%s) = %v, want %v", ip, got, want)
+		}
+	}
+	if _, err := NewBanList("nonsense"); err == nil {
+		t.Error("NewBanList accepted a bad entry")
+	}
+	if ok, _ := b.Unban("198.51.100.0/24"); !ok || b.IsBanned("198.51.100.77") {
+		t.Error("Unban of a range did not lift it")
+	}
+	if ok, _ := b.Unban("203.0.113.1"); ok {
+		t.Error("Unban of an address that was never banned reported true")
+	}
+}
+
+func TestBanExpiry(t *testing.T) {
+	clock := newFakeClock()
+	b, _ := NewBanList()
+	b.Now = clock.Now
+
+	if err := b.BanFor("192.0.2.1", time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	if !b.IsBanned("192.0.2.1") {
+		t.Fatal("a fresh ban is not in effect")
+	}
+	clock.Advance(time.Hour)
+	if b.IsBanned("192.0.2.1") {
+		t.Error("the ban outlived its duration")
+	}
+	if ok, _ := b.Unban("192.0.2.1"); ok {
+		t.Error("Unban of an expired ban reported true")
+	}
+}
+
+func TestBanListPersists(t *testing.T) {
+	clock := newFakeClock()
+	path := filepath.Join(t.TempDir(), "bans.json")
+	b, err := LoadBanList(path, "10.0.0.0/8")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b.Now = clock.Now
+	b.Ban("192.0.2.1")
+	b.BanFor("192.0.2.2", time.Hour)
+	b.Ban("198.51.100.9")
+	b.Unban("198.51.100.9")
+
+	// the entry from the config is not written to the file
+	data, _ := os.ReadFile(path)
+	if strings.Contains(string(data), "10.0.0.0/8") {
+		t.Errorf("the ban file holds a config entry: %s", data)
+	}
+
+	reloaded, err := LoadBanList(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	reloaded.Now = clock.Now
+	for ip, want := range map[string]bool{"192.0.2.1": true, "192.0.2.2": true, "198.51.100.9": false, "10.1.2.3": false} {
+		if got := reloaded.IsBanned(ip); got != want {
+			t.Errorf("after reloading, IsBanned(%s) = %v, want %v", ip, got, want)
+		}
+	}
+	clock.Advance(2 * time.Hour)
+	if reloaded.IsBanned("192.0.2.2") {
+		t.Error("a reloaded ban kept no expiry")
+	}
+
+	os.WriteFile(path, []byte("{"), 0o644)
+	if _, err := LoadBanList(path); err == nil {
+		t.Error("loading a corrupt ban file succeeded")
+	}
+}
+
+func TestBanIPForDuration(t *testing.T) {
+	clock := newFakeClock()
+	s, l := newTestServer(t, func(s *Server) {
+		s.AdminToken = "secret"
+		s.Bans.Now = clock.Now
+	})
+
+	admin := dial(t, l)
+	admin.do("/admin secret")
+	addr := &net.TCPAddr{IP: net.ParseIP("192.0.2.50"), Port: 1}
+	if out := admin.do("/banip 192.0.2.50 soon"); !hasLine(out, "soon is not a duration") {
+		t.Errorf("/banip with a bad duration got %q", out)
+	}
+	if out := admin.do("/banip 192.0.2.50 10m"); !hasLine(out, "banned 192.0.2.50 for 10m0s, disconnecting 0 clients") {
+		t.Errorf("/banip with a duration got %q", out)
+	}
+	if out := connect(t, l, addr).expectClosed(); !hasLine(out, "you are banned") {
+		t.Errorf("connecting while banned got %q", out)
+	}
+
+	clock.Advance(10 * time.Minute)
+	dialAs(t, l, addr)
+	if s.Bans.IsBanned("192.0.2.50") {
+		t.Error("the ban is still in effect after it expired")
+	}
+}
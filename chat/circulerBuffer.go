@@ -1,9 +1,14 @@
 package chat
 
-import "sync"
+import (
+	"strings"
+	"sync"
+)
 
+// CircularBuffer is the default HistoryStore: it keeps the last size
+// messages in memory.
 type CircularBuffer struct {
-	messages []string
+	messages []Message
 	size     int
 	start    int
 	end      int
@@ -13,12 +18,12 @@ type CircularBuffer struct {
 
 func NewCircularBuffer(size int) *CircularBuffer {
 	return &CircularBuffer{
-		messages: make([]string, size),
+		messages: make([]Message, size),
 		size:     size,
 	}
 }
 
-func (cb *CircularBuffer) Add(message string) {
+func (cb *CircularBuffer) Append(message Message) {
 	cb.mutex.Lock()
 	defer cb.mutex.Unlock()
 	cb.messages[cb.end] = message
@@ -30,12 +35,89 @@ func (cb *CircularBuffer) Add(message string) {
 	}
 }
 
-func (cb *CircularBuffer) GetAll() []string {
+func (cb *CircularBuffer) GetAll() []Message {
 	cb.mutex.Lock()
 	defer cb.mutex.Unlock()
-	result := make([]string, cb.count)
+	result := make([]Message, cb.count)
 	for i := 0; i < cb.count; i++ {
 		result[i] = cb.messages[(cb.start+i)%cb.size]
 	}
 	return result
 }
+
+// LastN returns up to the last n messages, oldest first.
+func (cb *CircularBuffer) LastN(n int) []Message {
+	cb.mutex.Lock()
+	defer cb.mutex.Unlock()
+	n = max(0, min(n, cb.count))
+	result := make([]Message, n)
+	skip := cb.count - n
+	for i := 0; i < n; i++ {
+		result[i] = cb.messages[(cb.start+skip+i)%cb.size]
+	}
+	return result
+}
+
+// Before returns up to n messages held before the chat message with ID id,
+// oldest first. If id itself has been evicted, the page ends before the
+// oldest chat message with a later ID.
+func (cb *CircularBuffer) Before(id uint64, n int) []Message {
+	all := cb.GetAll()
+	end := len(all)
+	if id != 0 {
+		for i, m := range all {
+			if m.Kind == KindChat && m.ID >= id {
+				end = i
+				break
+			}
+		}
+	}
+	return all[max(0, end-max(0, n)):end]
+}
+
+func (cb *CircularBuffer) Search(query string) []Message {
+	query = strings.ToLower(query)
+	var result []Message
+	for _, msg := range cb.GetAll() {
+		if strings.Contains(strings.ToLower(msg.Text), query) {
+			result = append(result, msg)
+		}
+	}
+	return result
+}
+
+// Clear empties the buffer and drops its references to old messages.
+func (cb *CircularBuffer) Clear() {
+	cb.mutex.Lock()
+	defer cb.mutex.Unlock()
+	for i := range cb.messages {
+		cb.messages[i] = Message{}
+	}
+	cb.start = 0
+	cb.end = 0
+	cb.count = 0
+}
+
+// Resize reallocates the buffer to hold size messages, keeping the newest
+// ones that still fit.
+func (cb *CircularBuffer) Resize(size int) {
+	cb.mutex.Lock()
+	defer cb.mutex.Unlock()
+	n := min(cb.count, size)
+	messages := make([]Message, size)
+	skip := cb.count - n
+	for i := 0; i < n; i++ {
+		messages[i] = cb.messages[(cb.start+skip+i)%cb.size]
+	}
+	cb.messages = messages
+	cb.size = size
+	cb.start = 0
+	cb.end = n % size
+	cb.count = n
+}
+
+func (cb *CircularBuffer) Len() int {
+	cb.mutex.Lock()
+	defer cb.mutex.Unlock()
+	return cb.count
+}
@@ -1,70 +1,565 @@
 package chat
 
 import (
-	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"net"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 )
 
+// Client is a live connection. Only the plain fields are marshaled; use
+// State for a serializable copy that is safe to hand out.
 type Client struct {
-	Conn     net.Conn       `json:"conn"`
-	NickName string         `json:"nickName"`
-	Room     *Room          `json:"Room"`
-	Commands chan<- Command `json:"commands"`
+	Conn     net.Conn `json:"-"`
+	NickName string   `json:"nickName"`
+	// Room is the only room the client is in; joining another room leaves it,
+	// so a client never receives fan-out from more than one room.
+	Room       *Room  `json:"-"`
+	Away       bool   `json:"away"`
+	AwayReason string `json:"awayReason"`
+	Admin      bool   `json:"admin"`
+	// Account is the registered nickname the client logged in as; empty
+	// for guests.
+	Account string          `json:"account,omitempty"`
+	Muted   map[string]bool `json:"muted"`
+	// RateLimiter throttles the commands marked RateLimited; nil when the
+	// server sets no limit, and for trusted clients.
+	RateLimiter *RateLimiter `json:"-"`
+	// DND limits room chat to messages that mention the client's nickname.
+	DND bool `json:"dnd"`
+	// HideTyping stops "is typing" notices from reaching the client.
+	HideTyping   bool          `json:"hideTyping"`
+	ReadTimeout  time.Duration `json:"-"`
+	SessionToken string        `json:"-"`
+	// LastSeen is when the client last sent a command.
+	LastSeen time.Time `json:"lastSeen"`
+
+	server      *Server
+	ctx         context.Context
+	closeOnce   sync.Once
+	writeFailed atomic.Bool
+	// lastInput is the UnixNano time of the last line read, for the
+	// heartbeat; heartbeatFailed is set when the heartbeat gave up on the
+	// connection.
+	lastInput       atomic.Int64
+	heartbeatFailed atomic.Bool
+	// jsonMode and color are set by /json and /color on the Run goroutine
+	// and read by every goroutine that writes to the client, including its
+	// heartbeat and idle warning.
+	jsonMode atomic.Bool
+	color    atomic.Bool
+	// trusted is set for clients from PipeListener.DialTrusted, which skip
+	// the message rate limit and flood protection.
+	trusted bool
+	// irc is the connection of a client that came in through an
+	// IRCListener, whose input and output are translated; see irc.go. It is
+	// nil for everyone else.
+	irc *ircConn
+	// hashing is set while a /register or /login is checking the password.
+	hashing bool
+	// out queues lines for the writer goroutine; see outbox.go.
+	out        chan []byte
+	outMu      sync.Mutex
+	outClosed  bool
+	writerDone chan struct{}
+	// outFullSince is when out was first found full, zero while it has
+	// room; guarded by outMu.
+	outFullSince time.Time
+	slowConsumer atomic.Bool
+	// left, leaveReason and quitMessage are only touched on the Run
+	// goroutine.
+	left        bool
+	leaveReason string
+	quitMessage string
+	// lastTyping is when the client last announced it was typing, for the
+	// debounce in Server.Typing. Only touched while running the client's
+	// commands.
+	lastTyping time.Time
+	flood      floodState
+	// pending counts the client's commands queued on room worker
+	// pendingWorker; see Server.RoomWorkers. Only the Run goroutine adds to it.
+	pending       sync.WaitGroup
+	pendingWorker int
+	// handleMu runs the client's commands one at a time while the server
+	// has Middleware; recorders are the CommandHooks noting its errors,
+	// guarded by recMu since other clients' commands may send it errors too.
+	handleMu  sync.Mutex
+	recMu     sync.Mutex
+	recorders []*errorRecord
+}
+
+type ClientState struct {
+	NickName   string    `json:"nickName"`
+	RemoteAddr string    `json:"remoteAddr"`
+	Room       string    `json:"room,omitempty"`
+	Away       bool      `json:"away"`
+	AwayReason string    `json:"awayReason,omitempty"`
+	Admin      bool      `json:"admin"`
+	Account    string    `json:"account,omitempty"`
+	LastSeen   time.Time `json:"lastSeen"`
 }
 
-func (c *Client) ReadInput() {
+func (c *Client) State() ClientState {
+	state := ClientState{
+		NickName:   c.NickName,
+		RemoteAddr: c.Conn.RemoteAddr().String(),
+		Away:       c.Away,
+		AwayReason: c.AwayReason,
+		Admin:      c.Admin,
+		Account:    c.Account,
+		LastSeen:   c.LastSeen,
+	}
+	if c.Room != nil {
+		state.Room = c.Room.Name
+	}
+	return state
+}
+
+// ReadInput queues commands until the connection fails or the server shuts
+// down. It returns the read error that ended it, or nil on shutdown.
+func (c *Client) ReadInput() error {
+	lines := newLineReader(c.Conn, c.server.MaxLineLength)
+	var warning *time.Timer
+	defer func() {
+		if warning != nil {
+			warning.Stop()
+		}
+	}()
 	for {
-		msg, err := bufio.NewReader(c.Conn).ReadString('\n')
+		if c.ReadTimeout > 0 {
+			c.Conn.SetReadDeadline(time.Now().Add(c.ReadTimeout))
+			warning = c.armIdleWarning(warning)
+		}
+		msg, err := lines.ReadLine()
+		if c.ctx.Err() != nil {
+			return nil
+		}
+		if err == nil || errors.Is(err, errLineTooLong) {
+			c.lastInput.Store(time.Now().UnixNano())
+		}
+		if errors.Is(err, errLineTooLong) {
+			c.Error(errorf(ErrInvalidInput, "line too long: the limit is %d bytes", c.server.MaxLineLength))
+			continue
+		}
 		if err != nil {
-			return
+			return err
 		}
-		msg = strings.Trim(msg, "\r\n")
-		args := strings.Split(msg, " ")
-		cmd := strings.TrimSpace(args[0])
-
-		switch cmd {
-		case "/name":
-			c.Commands <- Command{
-				ID:     CMD_NICKNAME,
-				Client: c,
-				Args:   args,
-			}
-		case "/rooms":
-			c.Commands <- Command{
-				ID:     CMD_ROOMS,
-				Client: c,
-				Args:   args,
+		if c.irc != nil {
+			var ok bool
+			if msg, ok = c.readIRC(msg); !ok {
+				continue
 			}
-		case "/msg":
-			c.Commands <- Command{
-				ID:     CMD_MSG,
-				Client: c,
-				Args:   args,
+		}
+		msg, msgID, err := parseInput(msg)
+		if err != nil {
+			c.Error(err)
+			continue
+		}
+		args := strings.Split(msg, " ")
+		cmd := resolveAlias(strings.TrimSpace(args[0]))
+
+		id, ok := commandsByName[cmd]
+		if !ok {
+			if suggestion := suggestCommand(cmd); suggestion != "" {
+				c.Error(errorf(ErrUnknownCommand, "Unknown command: %s, did you mean %s?", cmd, suggestion))
+			} else {
+				c.Error(errorf(ErrUnknownCommand, "Unknown command: %s", cmd))
 			}
-		case "/join":
-			c.Commands <- Command{
-				ID:     CMD_JOIN,
-				Client: c,
-				Args:   args,
+			continue
+		}
+		if commands[id].RateLimited && c.RateLimiter != nil {
+			if ok, wait := c.RateLimiter.Allow(c.server.Now()); !ok {
+				c.Error(errorf(ErrRateLimited, "slow down: you can send another message in %s", wait.Round(100*time.Millisecond)))
+				continue
 			}
-		case "/quit":
-			c.Commands <- Command{
-				ID:     CMD_QUIT,
-				Client: c,
-				Args:   args,
+		}
+		if !commands[id].FreeText {
+			if args, err = tokenize(msg); err != nil {
+				c.Error(err)
+				continue
 			}
-		default:
-			c.Error(fmt.Errorf("Unknown command: %s", cmd))
+			args[0] = cmd
+		}
+
+		if !c.server.Enqueue(Command{
+			ID:     id,
+			Client: c,
+			Args:   args,
+			MsgID:  msgID,
+		}) {
+			return nil
 		}
 	}
 }
 
+// DefaultIdleWarning is the default Server.IdleWarning.
+const DefaultIdleWarning = time.Minute
+
+// armIdleWarning (re)starts the timer that warns c it is about to be
+// disconnected for idling, reusing t when it is not nil.
+func (c *Client) armIdleWarning(t *time.Timer) *time.Timer {
+	warning := c.server.IdleWarning
+	if warning <= 0 || c.ReadTimeout <= warning {
+		return t
+	}
+	after := c.ReadTimeout - warning
+	if t != nil {
+		t.Reset(after)
+		return t
+	}
+	return time.AfterFunc(after, func() {
+		c.Message(fmt.Sprintf("you will be disconnected in %s unless you send something", formatDuration(warning)))
+	})
+}
+
+// heartbeat sends a PING every interval until ctx is done. Any input counts
+// as a reply, /pong being the cheapest; after misses intervals in a row
+// without one, the connection is presumed dead and closed, and the client
+// leaves with the heartbeat reason.
+func (c *Client) heartbeat(ctx context.Context, interval time.Duration, misses int) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	missed := 0
+	last := c.lastInput.Load()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		if input := c.lastInput.Load(); input != last {
+			last, missed = input, 0
+		} else if missed++; missed >= misses {
+			c.heartbeatFailed.Store(true)
+			c.Close()
+			return
+		}
+		c.deliverPing()
+	}
+}
+
+// deliverPing writes a heartbeat: a bare "PING" line, or a "ping" line in
+// JSON mode.
+func (c *Client) deliverPing() {
+	line := "PING\n"
+	switch {
+	case c.irc != nil:
+		line = "PING :" + ircServerName + "\r\n"
+	case c.jsonMode.Load():
+		line = encodeJSON(jsonOutput{Type: "ping"})
+	}
+	if err := c.write(line); err != nil {
+		writeErrorsCounter.WithLabelValues("ping").Inc()
+	}
+}
+
+// jsonInput is a line of input in JSON mode. Plain command lines are accepted
+// in either mode.
+type jsonInput struct {
+	ID      string `json:"id"`
+	Command string `json:"command"`
+}
+
+// jsonOutput is a line of output in JSON mode.
+type jsonOutput struct {
+	Type      string    `json:"type"`
+	Text      string    `json:"text,omitempty"`
+	Code      ErrorCode `json:"code,omitempty"`
+	Message   string    `json:"message,omitempty"`
+	ID        string    `json:"id,omitempty"`
+	MessageID uint64    `json:"messageId,omitempty"`
+	ParentID  uint64    `json:"parentId,omitempty"`
+	Nick      string    `json:"nick,omitempty"`
+	Delivered *int      `json:"delivered,omitempty"`
+	// Event names what a notice is about, such as "join", for clients that
+	// would rather not parse its text.
+	Event string `json:"event,omitempty"`
+}
+
+func parseInput(line string) (string, string, error) {
+	if !strings.HasPrefix(line, "{") {
+		return line, "", nil
+	}
+	var in jsonInput
+	if err := json.Unmarshal([]byte(line), &in); err != nil {
+		return "", "", errorf(ErrInvalidInput, "invalid JSON input: %v", err)
+	}
+	return in.Command, in.ID, nil
+}
+
 func (c *Client) Error(err error) {
-	c.Conn.Write([]byte("Error: " + err.Error() + "\n"))
+	c.noteError(err)
+	line := c.server.ErrorPrefix + err.Error() + "\n"
+	if c.color.Load() {
+		line = colorize(ansiError, c.server.ErrorPrefix+err.Error()) + "\n"
+	}
+	if c.jsonMode.Load() {
+		line = encodeJSON(jsonOutput{Type: "error", Code: errorCode(err), Message: err.Error()})
+	}
+	if c.irc != nil {
+		line = c.irc.errorLine(err, c.server.ErrorPrefix)
+	}
+	if werr := c.write(line); werr != nil {
+		writeErrorsCounter.WithLabelValues("error").Inc()
+	}
+}
+
+// Ack confirms a posted message with the ID the room gave it, as
+// "OK <messageID>". JSON mode clients also get back their own id and how many
+// members received the message.
+func (c *Client) Ack(id string, messageID uint64, delivered int) {
+	if c.irc != nil {
+		// IRC has no acknowledgements
+		return
+	}
+	line := fmt.Sprintf("OK %d\n", messageID)
+	if c.jsonMode.Load() {
+		line = encodeJSON(jsonOutput{Type: "ack", ID: id, MessageID: messageID, Delivered: &delivered})
+	} else if c.server.ChatV2Replies {
+		return
+	}
+	if err := c.write(line); err != nil {
+		writeErrorsCounter.WithLabelValues("reply").Inc()
+	}
 }
 
 func (c *Client) Message(msg string) {
-	c.Conn.Write([]byte("> " + msg + "\n"))
+	if err := c.deliver(msg); err != nil {
+		writeErrorsCounter.WithLabelValues("reply").Inc()
+	}
+}
+
+// writeFailure closes a connection we can no longer write to. ReadInput then
+// fails and the client is cleaned up with the write_error reason.
+func (c *Client) writeFailure() {
+	if c.writeFailed.CompareAndSwap(false, true) {
+		c.Close()
+	}
+}
+
+func (c *Client) deliver(msg string) error {
+	if c.irc != nil {
+		return c.writeIRC(c.irc.notice(msg))
+	}
+	line := c.server.MessagePrefix + msg + "\n"
+	if c.jsonMode.Load() {
+		line = encodeJSON(jsonOutput{Type: "message", Text: msg})
+	} else if c.color.Load() {
+		line = c.server.MessagePrefix + colorize(ansiSystem, msg) + "\n"
+	}
+	return c.write(line)
+}
+
+// deliverEvent is deliver for a notice that nick did event, such as "join".
+// JSON mode clients get the event and the nickname alongside the text.
+func (c *Client) deliverEvent(event, nick, msg string) error {
+	if c.irc != nil {
+		return c.writeIRC(c.irc.event(event, nick, msg))
+	}
+	if !c.jsonMode.Load() {
+		return c.deliver(msg)
+	}
+	return c.write(encodeJSON(jsonOutput{Type: "message", Text: msg, Event: event, Nick: nick}))
+}
+
+// deliverTyping tells the client that nick is typing. JSON mode clients get
+// a "typing" line carrying the nickname.
+func (c *Client) deliverTyping(nick string) error {
+	if c.irc != nil {
+		return nil
+	}
+	line := c.server.MessagePrefix + nick + " is typing…\n"
+	if c.jsonMode.Load() {
+		line = encodeJSON(jsonOutput{Type: "typing", Text: nick})
+	}
+	return c.write(line)
+}
+
+// deliverChat writes a chat message. It is byte-identical to deliver of the
+// formatted message, or of "nick: text" with ChatV2Replies, unless color is
+// on, in which case the nickname is colored: green for the client's own
+// lines, a per-nickname color otherwise.
+// JSON mode clients get the message and parent IDs as messageId and parentId.
+func (c *Client) deliverChat(m Message) error {
+	if c.irc != nil {
+		return c.writeIRC(c.irc.chat(m))
+	}
+	if c.jsonMode.Load() {
+		line := encodeJSON(jsonOutput{Type: "message", Text: formatChat(m.Nick, m.Text), MessageID: m.ID, ParentID: m.ParentID, Nick: m.Nick})
+		return c.write(line)
+	}
+	if c.server.ChatV2Replies {
+		return c.deliver(m.Nick + ": " + m.Text)
+	}
+	if !c.color.Load() {
+		return c.deliver(m.String())
+	}
+	code := nickColor(m.Nick)
+	if m.Nick == c.NickName {
+		code = ansiOwn
+	}
+	colored := m
+	colored.Nick = colorize(code, m.Nick)
+	return c.write(c.server.MessagePrefix + colored.String() + "\n")
+}
+
+// deliverReaction tells the client about a reaction. JSON mode clients get a
+// "reaction" line with the message ID, the reacting nickname and the emoji.
+func (c *Client) deliverReaction(r Message) error {
+	if c.irc != nil || !c.jsonMode.Load() {
+		return c.deliver(r.String())
+	}
+	return c.write(encodeJSON(jsonOutput{Type: "reaction", MessageID: r.ParentID, Nick: r.Nick, Text: r.Text}))
+}
+
+// deliverMention tells the client that m, posted in room, mentions them. The
+// line is highlighted when color is on; JSON mode clients get a "mention" line
+// carrying the room as text alongside the message ID and sender.
+func (c *Client) deliverMention(room string, m Message) error {
+	if c.irc != nil {
+		// IRC clients highlight their nickname themselves
+		return nil
+	}
+	line := fmt.Sprintf("%s mentioned you in %s: %s", m.Nick, room, m.String())
+	switch {
+	case c.jsonMode.Load():
+		line = encodeJSON(jsonOutput{Type: "mention", Text: room, MessageID: m.ID, Nick: m.Nick, Message: m.Text})
+	case c.color.Load():
+		line = c.server.MessagePrefix + colorize(ansiMention, line) + "\n"
+	default:
+		line = c.server.MessagePrefix + line + "\n"
+	}
+	return c.write(line)
+}
+
+// deliverDM writes a direct message from nick.
+func (c *Client) deliverDM(nick, msg string) error {
+	if c.irc != nil {
+		return c.writeIRC(c.irc.dm(nick, msg))
+	}
+	return c.deliver(fmt.Sprintf("[dm from %s] %s", nick, msg))
+}
+
+// welcome tells c it has joined r and who else is there.
+func (c *Client) welcome(r *Room) {
+	if c.irc != nil {
+		if err := c.writeIRC(c.irc.joined(r.Name, r.Nicknames(nil))); err != nil {
+			writeErrorsCounter.WithLabelValues("reply").Inc()
+		}
+		return
+	}
+	if c.server.ChatV2Replies {
+		return
+	}
+	c.Message(fmt.Sprintf("Welcome to %s", r.Name))
+	if others := r.Nicknames(c); len(others) > 0 {
+		c.Message(fmt.Sprintf("currently here: %s", strings.Join(others, ", ")))
+	} else {
+		c.Message("you're the first one here")
+	}
+}
+
+// renamed tells c it is now known by its NickName instead of oldName.
+func (c *Client) renamed(oldName string) {
+	if c.irc == nil {
+		if c.server.ChatV2Replies {
+			c.Message("Nickname changed to: " + c.NickName)
+			return
+		}
+		c.Message(fmt.Sprintf("all right, Server will know you by %s", c.NickName))
+		return
+	}
+	var room string
+	var names []string
+	if c.Room != nil {
+		room, names = c.Room.Name, c.Room.Nicknames(nil)
+	}
+	if err := c.writeIRC(c.irc.renamed(oldName, c.NickName, c.server.MOTD, room, names)); err != nil {
+		writeErrorsCounter.WithLabelValues("reply").Inc()
+	}
+}
+
+// parted tells c it was taken out of r, for reason. Everyone else hears why
+// from whoever removed them, so only IRC clients, which have to close the
+// channel, need telling.
+func (c *Client) parted(r *Room, reason string) {
+	if c.irc == nil {
+		return
+	}
+	if err := c.writeIRC(c.irc.parted(r.Name, reason)); err != nil {
+		writeErrorsCounter.WithLabelValues("reply").Inc()
+	}
+}
+
+// replay writes a message from history the way it was first delivered.
+func (c *Client) replay(m Message) {
+	var err error
+	switch m.Kind {
+	case KindChat:
+		err = c.deliverChat(m)
+	case KindReaction:
+		err = c.deliverReaction(m)
+	default:
+		err = c.deliver(m.String())
+	}
+	if err != nil {
+		writeErrorsCounter.WithLabelValues("history").Inc()
+	}
+}
+
+func encodeJSON(v jsonOutput) string {
+	b, _ := json.Marshal(v)
+	return string(b) + "\n"
+}
+
+func (c *Client) AwayMessage() string {
+	if c.AwayReason == "" {
+		return fmt.Sprintf("%s is away", c.NickName)
+	}
+	return fmt.Sprintf("%s is away: %s", c.NickName, c.AwayReason)
+}
+
+// Presence is "away", with the reason when there is one, or "online".
+func (c *Client) Presence() string {
+	if !c.Away {
+		return "online"
+	}
+	if c.AwayReason == "" {
+		return "away"
+	}
+	return "away: " + c.AwayReason
+}
+
+func (c *Client) HasMuted(nick string) bool {
+	return c.Muted[nick]
+}
+
+// wantsChat reports whether a room chat line from nick should be delivered.
+// System messages bypass this check.
+func (c *Client) wantsChat(nick, text string) bool {
+	if c.HasMuted(nick) {
+		return false
+	}
+	return !c.DND || mentions(text, c.NickName)
+}
+
+// Close closes the connection exactly once; later calls are no-ops. Lines
+// already queued are still written first, then the writer closes the
+// connection. Reads are cut short at once.
+func (c *Client) Close() error {
+	var err error
+	c.closeOnce.Do(func() {
+		if c.out == nil {
+			err = c.Conn.Close()
+			return
+		}
+		c.Conn.SetReadDeadline(time.Now())
+		c.closeOutbox()
+	})
+	return err
 }
@@ -0,0 +1,30 @@
+package chat
+
+import (
+	"fmt"
+	"hash/fnv"
+)
+
+const (
+	ansiReset  = "\x1b[0m"
+	ansiSystem = "\x1b[33m"
+	ansiError  = "\x1b[31m"
+	ansiOwn    = "\x1b[1;32m"
+	// ansiMention is reverse video, so a mention stands out whatever the
+	// nickname colors are.
+	ansiMention = "\x1b[1;7m"
+)
+
+var nickColors = []int{31, 32, 34, 35, 36, 91, 92, 93, 94, 95, 96}
+
+func colorize(code, s string) string {
+	return code + s + ansiReset
+}
+
+// nickColor picks a stable color for nick so everyone sees the same person
+// in the same color.
+func nickColor(nick string) string {
+	h := fnv.New32a()
+	h.Write([]byte(nick))
+	return fmt.Sprintf("\x1b[%dm", nickColors[h.Sum32()%uint32(len(nickColors))])
+}
@@ -1,5 +1,10 @@
 package chat
 
+import (
+	"fmt"
+	"strings"
+)
+
 type commandID int
 
 const (
@@ -8,12 +13,266 @@ const (
 	CMD_ROOMS
 	CMD_MSG
 	CMD_QUIT
+	CMD_AWAY
+	CMD_BACK
+	CMD_ADMIN
+	CMD_BAN
+	CMD_UNBAN
+	CMD_MUTE
+	CMD_UNMUTE
+	CMD_RESUME
+	CMD_RENAME
+	CMD_UPTIME
+	CMD_STATS
+	CMD_JSON
+	CMD_CLEAR
+	CMD_COLOR
+	CMD_USERS
+	CMD_DND
+	CMD_INVITE
+	CMD_LAST
+	CMD_DM
+	CMD_REGISTER
+	CMD_LOGIN
+	CMD_LOCK
+	CMD_UNLOCK
+	CMD_KICK
+	CMD_WHO
+	CMD_HELP
+	CMD_TYPING
+	CMD_REACT
+	CMD_REPLY
+	CMD_THREAD
+	CMD_READ
+	CMD_SEEN
+	CMD_HISTORY
+	CMD_SET
+	CMD_SEARCH
+	CMD_PING
+	CMD_PONG
+	CMD_BANIP
+	CMD_ANNOUNCE
+	CMD_SHUTDOWN
+	CMD_FILTER
+	CMD_LEAVE
+)
+
+// CommandHandler runs a command on the Run goroutine, or on a worker for
+// read-only commands.
+type CommandHandler func(s *Server, cmd Command)
+
+// CommandSpec describes a command in the registry that ReadInput, dispatch
+// and /help are driven by.
+type CommandSpec struct {
+	// Usage is the command as shown in help and usage errors, e.g.
+	// "/join ROOM". Its first word is the name clients type.
+	Usage       string
+	Description string
+	Handler     CommandHandler
+	// FreeText commands take their arguments as typed; everything else goes
+	// through tokenize so quoted arguments can contain spaces.
+	FreeText bool
+	// ReadOnly commands only read server state, so they may run on the
+	// worker pool alongside each other.
+	ReadOnly bool
+	// AccountOnly commands are refused to guests while accounts are enabled.
+	AccountOnly bool
+	// AdminOnly commands are refused to everyone but admins, and /help only
+	// lists them to admins.
+	AdminOnly bool
+	// RateLimited commands post to other clients, or are costly to serve
+	// like /login, so they count against the client's message rate limit.
+	RateLimited bool
+	// RoomScoped commands only touch the client's own room, so with room
+	// workers they run on that room's worker instead of the Run goroutine.
+	RoomScoped bool
+}
+
+// Name is the command as typed, e.g. "/join".
+func (spec *CommandSpec) Name() string {
+	return strings.Fields(spec.Usage)[0]
+}
+
+// handle adapts a Server method that only needs the client and its
+// arguments.
+func handle(f func(s *Server, c *Client, args []string)) CommandHandler {
+	return func(s *Server, cmd Command) {
+		f(s, cmd.Client, cmd.Args)
+	}
+}
+
+// commands is the registry of every command clients can type, and
+// commandsByName indexes it by typed name, e.g. "/join". Both are filled in
+// init, since the handlers refer back to the registry for usage errors.
+var (
+	commands       map[commandID]*CommandSpec
+	commandsByName map[string]commandID
 )
 
+func init() {
+	commands = map[commandID]*CommandSpec{
+		CMD_NICKNAME: {Usage: "/name NEW_NICKNAME", Description: "change your nickname", Handler: handle((*Server).NickName)},
+		CMD_JOIN:     {Usage: "/join ROOM [PASSWORD] [--history=N]", Description: "join a room, creating it if needed", Handler: handle((*Server).Join)},
+		CMD_LEAVE:    {Usage: "/leave", Description: "leave your room without joining another", Handler: handle((*Server).Leave)},
+		CMD_ROOMS:    {Usage: "/rooms", Description: "list the rooms", Handler: handle((*Server).ListRooms), ReadOnly: true},
+		CMD_MSG:      {Usage: "/msg MESSAGE", Description: "send a message to your room", Handler: (*Server).postMessage, FreeText: true, RateLimited: true, RoomScoped: true},
+		CMD_QUIT:     {Usage: "/quit [MESSAGE]", Description: "leave the server, optionally saying goodbye", Handler: handle((*Server).Quit), FreeText: true},
+		CMD_AWAY:     {Usage: "/away [REASON]", Description: "mark yourself as away", Handler: handle((*Server).Away), FreeText: true},
+		CMD_BACK:     {Usage: "/back", Description: "clear your away status", Handler: handle((*Server).Back)},
+		CMD_ADMIN:    {Usage: "/admin TOKEN", Description: "become an admin", Handler: handle((*Server).Admin)},
+		CMD_BAN:      {Usage: "/ban NICK", Description: "ban a user from your room, or from the server if you are an admin", Handler: handle((*Server).Ban)},
+		CMD_UNBAN:    {Usage: "/unban IP", Description: "lift a server ban (admins)", Handler: handle((*Server).Unban)},
+		CMD_MUTE:     {Usage: "/mute NICK", Description: "hide a user's messages", Handler: handle((*Server).Mute)},
+		CMD_UNMUTE:   {Usage: "/unmute NICK", Description: "show a muted user's messages again", Handler: handle((*Server).Unmute)},
+		CMD_RESUME:   {Usage: "/resume TOKEN", Description: "pick up a dropped session", Handler: handle((*Server).Resume)},
+		CMD_RENAME:   {Usage: "/rename OLD NEW", Description: "rename a room you operate", Handler: handle((*Server).Rename), AccountOnly: true},
+		CMD_UPTIME:   {Usage: "/uptime", Description: "show how long the server has been up", Handler: handle((*Server).Uptime), ReadOnly: true},
+		CMD_STATS:    {Usage: "/stats", Description: "show connection, room and message counts", Handler: handle((*Server).Stats), ReadOnly: true},
+		CMD_JSON:     {Usage: "/json on|off", Description: "switch JSON output on or off", Handler: handle((*Server).JSONMode)},
+		CMD_CLEAR:    {Usage: "/clear", Description: "wipe the history of a room you operate", Handler: handle((*Server).Clear), AccountOnly: true},
+		CMD_COLOR:    {Usage: "/color on|off", Description: "switch ANSI colors on or off", Handler: handle((*Server).ColorMode)},
+		CMD_USERS:    {Usage: "/users", Description: "list everyone connected", Handler: handle((*Server).Users)},
+		CMD_DND:      {Usage: "/dnd on|off", Description: "only receive messages that mention you", Handler: handle((*Server).DoNotDisturb)},
+		CMD_INVITE:   {Usage: "/invite NICK", Description: "invite a user to your room", Handler: handle((*Server).Invite), AccountOnly: true},
+		CMD_LAST:     {Usage: "/last NICK", Description: "show when a user was last active", Handler: handle((*Server).Last)},
+		CMD_DM:       {Usage: "/dm NICK MESSAGE", Description: "send a private message", Handler: handle((*Server).DirectMessage), FreeText: true, AccountOnly: true, RateLimited: true},
+		CMD_REGISTER: {Usage: "/register NICK PASSWORD", Description: "register a nickname and log in", Handler: handle((*Server).Register), RateLimited: true},
+		CMD_LOGIN:    {Usage: "/login NICK PASSWORD", Description: "log in to a registered nickname", Handler: handle((*Server).Login), RateLimited: true},
+		CMD_LOCK:     {Usage: "/lock ROOM PASSWORD", Description: "require a password to join a room you operate", Handler: handle((*Server).Lock)},
+		CMD_UNLOCK:   {Usage: "/unlock ROOM", Description: "remove a room's password", Handler: handle((*Server).Unlock)},
+		CMD_KICK:     {Usage: "/kick NICK", Description: "remove a user from your room, or from any room if you are an admin", Handler: handle((*Server).Kick)},
+		CMD_WHO:      {Usage: "/who [ROOM]", Description: "list a room's members", Handler: handle((*Server).Who), ReadOnly: true},
+		CMD_HELP:     {Usage: "/help [COMMAND]", Description: "list commands, or describe one", Handler: handle((*Server).Help), ReadOnly: true},
+		CMD_REACT:    {Usage: "/react ID EMOJI", Description: "react to a message in your room", Handler: handle((*Server).React), RateLimited: true, RoomScoped: true},
+		CMD_TYPING:   {Usage: "/typing [on|off]", Description: "tell your room you are typing, or turn typing notices on or off", Handler: handle((*Server).Typing), RoomScoped: true},
+		CMD_REPLY:    {Usage: "/reply ID MESSAGE", Description: "reply to a message in your room", Handler: (*Server).reply, FreeText: true, RateLimited: true, RoomScoped: true},
+		CMD_THREAD:   {Usage: "/thread ID", Description: "show a message and its replies", Handler: handle((*Server).Thread), ReadOnly: true, RoomScoped: true},
+		CMD_READ:     {Usage: "/read [ID]", Description: "mark your room's messages read up to ID, or all of them", Handler: handle((*Server).MarkRead), RoomScoped: true},
+		CMD_HISTORY:  {Usage: "/history ROOM N [BEFORE_ID]", Description: "show the last N messages of a room, or the N before a message", Handler: handle((*Server).History), ReadOnly: true, RoomScoped: true},
+		CMD_SET:      {Usage: "/set history N", Description: "change how many messages a room you operate keeps", Handler: handle((*Server).Set)},
+		CMD_FILTER:   {Usage: "/filter [add WORD [REPLACEMENT]|remove WORD|mode mask|reject]", Description: "list the words your room filters, or change them in a room you operate", Handler: handle((*Server).FilterWords)},
+		CMD_SEARCH:   {Usage: "/search ROOM QUERY", Description: "find messages in a room's history", Handler: handle((*Server).Search), FreeText: true, ReadOnly: true, RoomScoped: true},
+		CMD_PING:     {Usage: "/ping [TEXT]", Description: "check the connection; the server answers pong", Handler: handle((*Server).Ping), FreeText: true, ReadOnly: true},
+		CMD_PONG:     {Usage: "/pong", Description: "answer the server's PING heartbeat", Handler: handle((*Server).Pong), ReadOnly: true},
+		CMD_SEEN:     {Usage: "/seen [ROOM]", Description: "show how far each member of a room has read", Handler: handle((*Server).ReadReceipts), ReadOnly: true, RoomScoped: true},
+		CMD_BANIP:    {Usage: "/banip IP|CIDR [DURATION]", Description: "ban an address or range from the server, for good or for a duration such as 24h, disconnecting whoever uses it", Handler: handle((*Server).BanIP), AdminOnly: true},
+		CMD_ANNOUNCE: {Usage: "/announce MESSAGE", Description: "send an announcement to everyone connected", Handler: handle((*Server).Announce), FreeText: true, AdminOnly: true},
+		CMD_SHUTDOWN: {Usage: "/shutdown [MESSAGE]", Description: "shut the server down, optionally announcing why", Handler: handle((*Server).RequestShutdown), FreeText: true, AdminOnly: true},
+	}
+	commandsByName = make(map[string]commandID, len(commands))
+	for id, spec := range commands {
+		commandsByName[spec.Name()] = id
+	}
+}
+
+// RegisterCommand adds a command to the registry, so clients can type it and
+// /help lists it. Call it before any server starts serving.
+func RegisterCommand(spec CommandSpec) error {
+	if spec.Usage == "" || !strings.HasPrefix(spec.Usage, "/") || spec.Handler == nil {
+		return fmt.Errorf("chat: command needs a usage starting with / and a handler")
+	}
+	name := spec.Name()
+	if _, ok := commandsByName[name]; ok {
+		return fmt.Errorf("chat: command %s is already registered", name)
+	}
+	if _, ok := CommandAliases[name]; ok {
+		return fmt.Errorf("chat: %s is already an alias", name)
+	}
+	id := commandID(len(commands))
+	for commands[id] != nil {
+		id++
+	}
+	commands[id] = &spec
+	commandsByName[name] = id
+	return nil
+}
+
+// String returns the command as typed, e.g. "/join".
+func (id commandID) String() string {
+	switch id {
+	case cmdDisconnect:
+		return "disconnect"
+	case cmdDeferred:
+		return "deferred"
+	}
+	if spec, ok := commands[id]; ok {
+		return spec.Name()
+	}
+	return fmt.Sprintf("command(%d)", int(id))
+}
+
+func usageError(id commandID) error {
+	return errorf(ErrUsage, "missing argument. usage: %s", commands[id].Usage)
+}
+
+// CommandAliases maps alternate spellings to the canonical command name.
+var CommandAliases = map[string]string{
+	"/j":    "/join",
+	"/q":    "/quit",
+	"/nick": "/name",
+	"/w":    "/dm",
+	"/part": "/leave",
+}
+
+func resolveAlias(cmd string) string {
+	if canonical, ok := CommandAliases[cmd]; ok {
+		return canonical
+	}
+	return cmd
+}
+
+// suggestCommand returns the known command closest to cmd, or "" when nothing
+// is within a couple of edits. Ties go to the alphabetically first name.
+func suggestCommand(cmd string) string {
+	best, bestDist := "", 3
+	for name := range commandsByName {
+		if d := editDistance(cmd, name); d < bestDist || (d == bestDist && name < best) {
+			best, bestDist = name, d
+		}
+	}
+	for alias := range CommandAliases {
+		if d := editDistance(cmd, alias); d < bestDist || (d == bestDist && alias < best) {
+			best, bestDist = alias, d
+		}
+	}
+	return best
+}
+
+func editDistance(a, b string) int {
+	prev := make([]int, len(b)+1)
+	cur := make([]int, len(b)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(a); i++ {
+		cur[0] = i
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			cur[j] = min(prev[j]+1, cur[j-1]+1, prev[j-1]+cost)
+		}
+		prev, cur = cur, prev
+	}
+	return prev[len(b)]
+}
+
+// cmdDisconnect is queued by NewClient when ReadInput fails without a /quit.
+// It cannot be typed by users.
+const cmdDisconnect commandID = -1
+
+// cmdDeferred runs fn on the Run goroutine. Commands that do slow work, such
+// as hashing a password, do it on their own goroutine and queue the result
+// back this way so the Run loop never waits on them.
+const cmdDeferred commandID = -2
+
 type Command struct {
 	ID     commandID `json:"id"`
 	Client *Client   `json:"client"`
 	Args   []string  `json:"args"`
-}
+	// MsgID is an optional client-supplied id echoed back in JSON mode acks.
+	MsgID string `json:"msgId"`
 
-// /room
+	fn func()
+}
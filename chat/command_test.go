@@ -0,0 +1,255 @@
+package chat
+
+import (
+	"net"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestTokenize(t *testing.T) {
+	tests := []struct {
+		line string
+		want []string
+	}{
+		{"/join lobby", []string{"/join", "lobby"}},
+		{"  /join   lobby  ", []string{"/join", "lobby"}},
+		{`/name "John Doe"`, []string{"/name", "John Doe"}},
+		{`/msg "say \"hi\""`, []string{"/msg", `say "hi"`}},
+		{`/msg "a\\b"`, []string{"/msg", `a\b`}},
+		{`/name ""`, []string{"/name", ""}},
+		{"", nil},
+	}
+	for _, tt := range tests {
+		got, err := tokenize(tt.line)
+		if err != nil {
+			t.Errorf("tokenize(%q): %v", tt.line, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("tokenize(%q) = %q, want %q", tt.line, got, tt.want)
+		}
+	}
+	if _, err := tokenize(`/name "John`); errorCode(err) != ErrInvalidInput {
+		t.Errorf("unbalanced quote gave %v, want an %s error", err, ErrInvalidInput)
+	}
+}
+
+func TestAliases(t *testing.T) {
+	for alias, name := range CommandAliases {
+		if _, ok := commandsByName[name]; !ok {
+			t.Errorf("alias %s points at unknown command %s", alias, name)
+		}
+		if _, ok := commandsByName[alias]; ok {
+			t.Errorf("alias %s shadows a command", alias)
+		}
+	}
+
+	_, l := newTestServer(t, nil)
+	alice, bob := dial(t, l), dial(t, l)
+	if out := alice.do("/nick alice"); !hasLine(out, "Server will know you by alice") {
+		t.Errorf("/nick got %q", out)
+	}
+	if out := alice.do("/j lobby"); !hasLine(out, "Welcome to lobby") {
+		t.Errorf("/j got %q", out)
+	}
+	bob.do("/name bob")
+	if out := bob.do("/w alice psst"); !hasLine(out, "[dm to alice] psst") {
+		t.Errorf("/w got %q", out)
+	}
+	alice.expect("[dm from bob] psst")
+	bob.send("/q")
+	bob.expectClosed()
+}
+
+func TestUsageErrors(t *testing.T) {
+	_, l := newTestServer(t, nil)
+	c := dial(t, l)
+
+	for _, id := range []commandID{CMD_NICKNAME, CMD_JOIN, CMD_MSG, CMD_MUTE, CMD_RENAME, CMD_DM, CMD_LAST, CMD_INVITE} {
+		if out := c.do(id.String()); !hasLine(out, "missing argument. usage: "+commands[id].Usage) {
+			t.Errorf("%s with no arguments got %q", id, out)
+		}
+	}
+}
+
+func TestMessageBeforeJoin(t *testing.T) {
+	_, l := newTestServer(t, nil)
+	c := dial(t, l)
+	c.send("/msg hello")
+	c.expect("you must join the room first")
+}
+
+func TestUnknownCommand(t *testing.T) {
+	_, l := newTestServer(t, nil)
+	c := dial(t, l)
+	if out := c.do("/jion lobby"); !hasLine(out, "Unknown command: /jion") {
+		t.Errorf("misspelled command got %q", out)
+	}
+	if out := c.do("/help j"); !hasLine(out, commands[CMD_JOIN].Usage) {
+		t.Errorf("/help for an alias got %q", out)
+	}
+}
+
+func TestJSONErrorCodes(t *testing.T) {
+	_, l := newTestServer(t, nil)
+	c := dial(t, l)
+	c.do("/json on")
+
+	tests := []struct {
+		line string
+		code ErrorCode
+	}{
+		{"/join", ErrUsage},
+		{"/nosuchcommand", ErrUnknownCommand},
+		{"/who nowhere", ErrRoomNotFound},
+		{"/dm nobody hi", ErrUserNotFound},
+		{"/admin wrong", ErrInvalidToken},
+		{"/announce hello", ErrPermissionDenied},
+		{`/name "open`, ErrInvalidInput},
+	}
+	for _, tt := range tests {
+		want := `{"type":"error","code":"` + string(tt.code) + `"`
+		if out := c.do(tt.line); !hasLine(out, want) {
+			t.Errorf("%s got %q, want code %s", tt.line, out, tt.code)
+		}
+	}
+}
+
+func TestMessageAcks(t *testing.T) {
+	_, l := newTestServer(t, nil)
+
+	alice, bob, carol := dial(t, l), dial(t, l), dial(t, l)
+	alice.join("alice", "lobby")
+	bob.join("bob", "lobby")
+	carol.join("carol", "lobby")
+
+	alice.send("/msg plain")
+	if line, _ := alice.expect("OK"); line != "OK 1" {
+		t.Errorf("plain-text ack = %q", line)
+	}
+	alice.do("/json on")
+	alice.send(`{"id":"m-2","command":"/msg hello both"}`)
+	want := `{"type":"ack","id":"m-2","messageId":2,"delivered":2}`
+	if line, _ := alice.expect(`"type":"ack"`); line != want {
+		t.Errorf("JSON ack = %s, want %s", line, want)
+	}
+
+	// a member who muted alice does not count as a recipient
+	carol.do("/mute alice")
+	alice.send(`{"id":"m-3","command":"/msg just bob"}`)
+	if line, _ := alice.expect(`"type":"ack"`); !strings.Contains(line, `"delivered":1`) {
+		t.Errorf("JSON ack with carol muting = %s", line)
+	}
+}
+
+func TestUptimeAndStats(t *testing.T) {
+	clock := newFakeClock()
+	_, l := newTestServer(t, nil, WithClock(clock.Now))
+
+	alice := dial(t, l)
+	alice.send("/uptime")
+	alice.expect("up 0s")
+	clock.Advance(3*time.Hour + 12*time.Minute + 5*time.Second)
+	alice.send("/uptime")
+	alice.expect("up 3h12m")
+
+	alice.send("/stats")
+	alice.expect("connections: 1, rooms: 0, messages: 0")
+	dial(t, l).join("bob", "lobby")
+	alice.join("alice", "lobby")
+	alice.send("/msg one")
+	alice.send("/msg two")
+	alice.expect("OK 2")
+	alice.send("/stats")
+	alice.expect("connections: 2, rooms: 1, messages: 2")
+}
+
+func TestFormatDuration(t *testing.T) {
+	for _, tc := range []struct {
+		d    time.Duration
+		want string
+	}{
+		{0, "0s"},
+		{999 * time.Millisecond, "0s"},
+		{45 * time.Second, "45s"},
+		{90 * time.Second, "1m30s"},
+		{3*time.Hour + 12*time.Minute + 59*time.Second, "3h12m"},
+		{2 * time.Hour, "2h"},
+		{50*time.Hour + 30*time.Minute, "2d2h"},
+	} {
+		if got := formatDuration(tc.d); got != tc.want {
+			t.Errorf("formatDuration(%v) = %q, want %q", tc.d, got, tc.want)
+		}
+	}
+}
+
+func TestMessageRoomArg(t *testing.T) {
+	_, l := newTestServer(t, func(s *Server) { s.MessageRoomArg = true })
+
+	alice, bob, carol := dial(t, l), dial(t, l), dial(t, l)
+	alice.join("alice", "lobby")
+	bob.join("bob", "lobby")
+	carol.join("carol", "kitchen")
+
+	alice.send("/msg lobby hello")
+	if line, _ := bob.expect("hello"); line != "> [1] alice : hello" {
+		t.Errorf("bob got %q", line)
+	}
+	// naming a room one is not in is refused
+	carol.send("/msg lobby sneaking in")
+	carol.expect("you must join lobby to post there")
+	alice.send("/msg not a room name")
+	bob.expect("alice : not a room name")
+}
+
+func TestAdminOnlyCommands(t *testing.T) {
+	s, l := newTestServer(t, func(s *Server) { s.AdminToken = "secret" })
+
+	admin := dial(t, l)
+	admin.do("/name root")
+	if out := admin.do("/help"); hasLine(out, "/shutdown") {
+		t.Errorf("/help lists /shutdown to a guest: %q", out)
+	}
+	if out := admin.do("/shutdown"); !hasLine(out, "/shutdown is for admins only") {
+		t.Errorf("/shutdown by a guest got %q", out)
+	}
+	admin.do("/admin secret")
+	if out := admin.do("/help"); !hasLine(out, "/shutdown") {
+		t.Errorf("/help hides /shutdown from an admin: %q", out)
+	}
+
+	// sync makes sure the server has registered each client before the
+	// admin acts on everyone connected
+	other := dial(t, l)
+	other.sync()
+	admin.do("/announce maintenance at noon")
+	other.expect("announcement: maintenance at noon")
+
+	banned := &net.TCPAddr{IP: net.ParseIP("192.0.2.99"), Port: 1}
+	victim := dialAs(t, l, banned)
+	victim.sync()
+	if out := admin.do("/banip not-an-ip"); !hasLine(out, "not-an-ip is not an IP address or CIDR range") {
+		t.Errorf("/banip with a bad entry got %q", out)
+	}
+	if out := admin.do("/banip 192.0.2.0/24"); !hasLine(out, "banned 192.0.2.0/24, disconnecting 1 clients") {
+		t.Errorf("/banip got %q", out)
+	}
+	if out := victim.expectClosed(); !hasLine(out, "you are banned") {
+		t.Errorf("banned client got %q", out)
+	}
+	if out := connect(t, l, banned).expectClosed(); !hasLine(out, "you are banned") {
+		t.Errorf("reconnecting from a banned address got %q", out)
+	}
+
+	admin.do("/shutdown back soon")
+	other.expect("announcement: back soon")
+	select {
+	case <-s.ShutdownRequested():
+	default:
+		t.Error("ShutdownRequested is not closed after /shutdown")
+	}
+	// a second /shutdown must not panic on the closed channel
+	admin.do("/shutdown")
+}
@@ -0,0 +1,184 @@
+package chat
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// The tests in this file are meant for -race.
+
+func TestConcurrentJoins(t *testing.T) {
+	s, l := newTestServer(t, func(s *Server) { s.MessageRate = 0 })
+
+	const n = 20
+	clients := make([]*testClient, n)
+	for i := range clients {
+		clients[i] = dial(t, l)
+		clients[i].do(fmt.Sprintf("/name user%d", i))
+	}
+	var wg sync.WaitGroup
+	for _, c := range clients {
+		wg.Add(1)
+		go func(c *testClient) {
+			defer wg.Done()
+			fmt.Fprintf(c.conn, "/join fresh\n/msg hi\n")
+		}(c)
+	}
+	wg.Wait()
+	for _, c := range clients {
+		c.expect("Welcome to fresh")
+		c.sync()
+	}
+
+	state := s.Snapshot()
+	if len(state.Rooms) != 1 || len(state.Rooms[0].Members) != n {
+		t.Fatalf("rooms = %+v, want one room with %d members", state.Rooms, n)
+	}
+	if got := state.Rooms[0].HistoryLen; got > n {
+		t.Errorf("history has %d messages, want at most %d", got, n)
+	}
+}
+
+func TestReadReceiptsAcrossRooms(t *testing.T) {
+	_, l := newTestServer(t, func(s *Server) {
+		s.MessageRate = 0
+		s.FloodMessages = 0
+		s.FloodRepeats = 0
+	})
+
+	alice, bob, carol := dial(t, l), dial(t, l), dial(t, l)
+	alice.join("alice", "lobby")
+	bob.join("bob", "lobby")
+	carol.join("carol", "kitchen")
+
+	// lobby's cursors move on lobby's worker while carol reads them from
+	// kitchen's
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 50; i++ {
+			fmt.Fprintf(alice.conn, "/msg %d\n/read\n", i)
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 50; i++ {
+			fmt.Fprintf(carol.conn, "/seen lobby\n")
+		}
+	}()
+	wg.Wait()
+	bob.expect("alice : 49")
+	alice.expect("read up to 50 in lobby")
+
+	// /seen runs on a room worker, so wait for the answer itself rather
+	// than a /ping
+	carol.send("/seen lobby")
+	carol.expect("read receipts for lobby (latest 50): alice (read 50, received 50), bob (read 0, received 50)")
+}
+
+func TestReadOnlyAndMutatingCommands(t *testing.T) {
+	s, l := newTestServer(t, func(s *Server) {
+		s.MessageRate = 0
+		s.FloodMessages = 0
+		s.FloodRepeats = 0
+		// the workers answer a burst faster than a test client reads it
+		s.OutboxSize = 4096
+	}, WithWorkers(4), WithRoomWorkers(2))
+
+	// readers inspect rooms and members on the workers while writers
+	// create rooms, rename themselves, move between rooms and post
+	const n = 4
+	readers, writers := make([]*testClient, n), make([]*testClient, n)
+	for i := 0; i < n; i++ {
+		readers[i] = dial(t, l)
+		readers[i].join(fmt.Sprintf("reader%d", i), "lobby")
+		writers[i] = dial(t, l)
+		writers[i].join(fmt.Sprintf("writer%d", i), "lobby")
+	}
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		wg.Add(2)
+		go func(c *testClient) {
+			defer wg.Done()
+			for j := 0; j < 10; j++ {
+				fmt.Fprintf(c.conn, "/rooms\n/who lobby\n/stats\n/history lobby 5\n/search lobby hi\n/seen lobby\n")
+			}
+		}(readers[i])
+		go func(c *testClient, i int) {
+			defer wg.Done()
+			for j := 0; j < 10; j++ {
+				fmt.Fprintf(c.conn, "/join room%d\n/msg hi %d\n/name writer%d-%d\n/join lobby\n/msg hi again\n", j%3, j, i, j)
+			}
+		}(writers[i], i)
+	}
+	wg.Wait()
+	for _, c := range append(readers, writers...) {
+		c.sync()
+	}
+
+	members := 0
+	for _, r := range s.Snapshot().Rooms {
+		members += len(r.Members)
+	}
+	if members != 2*n {
+		t.Errorf("rooms hold %d members, want %d", members, 2*n)
+	}
+}
+
+// BenchmarkReadOnlyCommands compares read-only commands run on the Run
+// goroutine with the same commands spread over a worker pool.
+func BenchmarkReadOnlyCommands(b *testing.B) {
+	for _, bc := range []struct {
+		name    string
+		workers int
+	}{
+		{"serial", 0},
+		{"pooled", 4},
+	} {
+		b.Run(bc.name, func(b *testing.B) {
+			_, l := newTestServer(b, func(s *Server) {
+				s.MessageRate = 0
+				// room for every answer, so none is dropped while the
+				// readers catch up
+				s.OutboxSize = max(DefaultOutboxSize, b.N)
+			}, WithWorkers(bc.workers))
+			const n = 8
+			clients := make([]*testClient, n)
+			for i := range clients {
+				clients[i] = dial(b, l)
+			}
+
+			b.ResetTimer()
+			var wg sync.WaitGroup
+			for i, c := range clients {
+				count := b.N / n
+				if i < b.N%n {
+					count++
+				}
+				wg.Add(2)
+				go func(c *testClient, count int) {
+					defer wg.Done()
+					for j := 0; j < count; j++ {
+						fmt.Fprintf(c.conn, "/stats\n")
+					}
+				}(c, count)
+				go func(c *testClient, count int) {
+					defer wg.Done()
+					for count > 0 {
+						line, ok := <-c.lines
+						if !ok {
+							return
+						}
+						if strings.Contains(line, "connections: ") {
+							count--
+						}
+					}
+				}(c, count)
+			}
+			wg.Wait()
+		})
+	}
+}
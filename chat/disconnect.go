@@ -0,0 +1,47 @@
+package chat
+
+import (
+	"errors"
+	"io"
+	"net"
+)
+
+// Reasons a client left, used for the reason log field and the
+// tcp_chat_disconnects_total label.
+const (
+	ReasonQuit       = "quit"
+	ReasonEOF        = "eof"
+	ReasonTimeout    = "timeout"
+	ReasonWriteError = "write_error"
+	ReasonBanned     = "banned"
+	ReasonShutdown   = "shutdown"
+	ReasonReplaced   = "replaced"
+	ReasonHeartbeat  = "heartbeat"
+	// ReasonSlowConsumer is a client evicted for not reading its output.
+	ReasonSlowConsumer = "slow_consumer"
+	ReasonError        = "error"
+	// ReasonKicked is a client an admin disconnected through the admin API.
+	ReasonKicked = "kicked"
+)
+
+// classifyDisconnect turns the error that ended ReadInput into a reason. A
+// failed write or heartbeat closes the connection, so it takes precedence over
+// whatever the read saw afterwards; an eviction in turn explains the failed
+// writes that follow it.
+func classifyDisconnect(c *Client, err error) string {
+	var netErr net.Error
+	switch {
+	case c.slowConsumer.Load():
+		return ReasonSlowConsumer
+	case c.writeFailed.Load():
+		return ReasonWriteError
+	case c.heartbeatFailed.Load():
+		return ReasonHeartbeat
+	case errors.Is(err, io.EOF):
+		return ReasonEOF
+	case errors.As(err, &netErr) && netErr.Timeout():
+		return ReasonTimeout
+	default:
+		return ReasonError
+	}
+}
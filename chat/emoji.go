@@ -0,0 +1,111 @@
+package chat
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strings"
+)
+
+var defaultEmoji = map[string]string{
+	"smile":      "🙂",
+	"grin":       "😀",
+	"joy":        "😂",
+	"wink":       "😉",
+	"sad":        "🙁",
+	"cry":        "😢",
+	"heart":      "❤️",
+	"thumbsup":   "👍",
+	"thumbsdown": "👎",
+	"fire":       "🔥",
+	"tada":       "🎉",
+	"wave":       "👋",
+	"thinking":   "🤔",
+	"eyes":       "👀",
+	"rocket":     "🚀",
+}
+
+// EmojiExpander replaces :name: shortcodes with their emoji. Unknown codes are
+// left untouched, as is anything between a pair of backticks so code snippets
+// such as `a:b:c` survive as typed.
+type EmojiExpander struct {
+	codes map[string]string
+}
+
+func NewEmojiExpander() *EmojiExpander {
+	e := &EmojiExpander{codes: make(map[string]string, len(defaultEmoji))}
+	for name, emoji := range defaultEmoji {
+		e.codes[name] = emoji
+	}
+	return e
+}
+
+func (e *EmojiExpander) Add(name, emoji string) {
+	e.codes[strings.Trim(name, ":")] = emoji
+}
+
+// LoadFile adds shortcodes from a file with one "name emoji" pair per line.
+func (e *EmojiExpander) LoadFile(path string) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		fields := strings.Fields(text)
+		if len(fields) != 2 {
+			return fmt.Errorf("%s:%d: expected \"name emoji\"", path, line)
+		}
+		e.Add(fields[0], fields[1])
+	}
+	return scanner.Err()
+}
+
+func (e *EmojiExpander) Filter(msg string) string {
+	if !strings.Contains(msg, ":") {
+		return msg
+	}
+
+	parts := strings.Split(msg, "`")
+	for i := 0; i < len(parts); i += 2 {
+		parts[i] = e.expand(parts[i])
+	}
+	// an unmatched trailing backtick opens no code span
+	if len(parts)%2 == 0 {
+		last := len(parts) - 1
+		parts[last] = e.expand(parts[last])
+	}
+	return strings.Join(parts, "`")
+}
+
+func (e *EmojiExpander) expand(text string) string {
+	var b strings.Builder
+	for {
+		open := strings.IndexByte(text, ':')
+		if open < 0 {
+			break
+		}
+		end := strings.IndexByte(text[open+1:], ':')
+		if end < 0 {
+			break
+		}
+		end += open + 1
+		if emoji, ok := e.codes[text[open+1:end]]; ok {
+			b.WriteString(text[:open])
+			b.WriteString(emoji)
+			text = text[end+1:]
+			continue
+		}
+		// keep the closing colon, it may open the next shortcode
+		b.WriteString(text[:end])
+		text = text[end:]
+	}
+	b.WriteString(text)
+	return b.String()
+}
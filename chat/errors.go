@@ -0,0 +1,56 @@
+package chat
+
+import (
+	"errors"
+	"fmt"
+)
+
+// ErrorCode is the machine-readable reason sent with errors in JSON mode.
+// Plain text clients only see the message.
+type ErrorCode string
+
+const (
+	ErrUsage            ErrorCode = "usage"
+	ErrUnknownCommand   ErrorCode = "unknown_command"
+	ErrInvalidInput     ErrorCode = "invalid_input"
+	ErrInvalidArgument  ErrorCode = "invalid_argument"
+	ErrRoomNotFound     ErrorCode = "room_not_found"
+	ErrRoomExists       ErrorCode = "room_exists"
+	ErrRoomFull         ErrorCode = "room_full"
+	ErrRoomLimit        ErrorCode = "room_limit"
+	ErrNotInRoom        ErrorCode = "not_in_room"
+	ErrUserNotFound     ErrorCode = "user_not_found"
+	ErrMessageNotFound  ErrorCode = "message_not_found"
+	ErrNickTaken        ErrorCode = "nick_taken"
+	ErrPermissionDenied ErrorCode = "permission_denied"
+	ErrInvalidToken     ErrorCode = "invalid_token"
+	ErrAuthFailed       ErrorCode = "auth_failed"
+	ErrRateLimited      ErrorCode = "rate_limited"
+	ErrRejected         ErrorCode = "rejected"
+	ErrUnavailable      ErrorCode = "unavailable"
+	ErrInternal         ErrorCode = "internal"
+)
+
+// CodedError is an error a client can branch on by Code.
+type CodedError struct {
+	Code    ErrorCode
+	Message string
+}
+
+func (e *CodedError) Error() string {
+	return e.Message
+}
+
+func errorf(code ErrorCode, format string, a ...any) error {
+	return &CodedError{Code: code, Message: fmt.Sprintf(format, a...)}
+}
+
+// errorCode returns the code carried by err, or ErrInternal for errors that
+// carry none.
+func errorCode(err error) ErrorCode {
+	var ce *CodedError
+	if errors.As(err, &ce) {
+		return ce.Code
+	}
+	return ErrInternal
+}
@@ -0,0 +1,129 @@
+package chat
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+const DefaultEventBufferSize = 64
+
+// Event is one state transition as streamed by EventHub.
+type Event struct {
+	Type     string    `json:"type"`
+	Time     time.Time `json:"time"`
+	NickName string    `json:"nickName"`
+	Room     string    `json:"room,omitempty"`
+	Text     string    `json:"text,omitempty"`
+	OldName  string    `json:"oldName,omitempty"`
+}
+
+// EventHub is an EventSink that fans events out to any number of
+// subscribers, such as the /admin/events stream. Each subscriber has a
+// bounded buffer; events for a subscriber that has fallen behind are dropped
+// so the chat never waits on a slow dashboard.
+type EventHub struct {
+	bufferSize int
+	mu         sync.Mutex
+	subs       map[chan Event]struct{}
+}
+
+func NewEventHub(bufferSize int) *EventHub {
+	if bufferSize <= 0 {
+		bufferSize = DefaultEventBufferSize
+	}
+	return &EventHub{
+		bufferSize: bufferSize,
+		subs:       make(map[chan Event]struct{}),
+	}
+}
+
+// Subscribe returns a channel of future events and a function that cancels
+// the subscription.
+func (h *EventHub) Subscribe() (<-chan Event, func()) {
+	ch := make(chan Event, h.bufferSize)
+	h.mu.Lock()
+	h.subs[ch] = struct{}{}
+	h.mu.Unlock()
+	return ch, func() {
+		h.mu.Lock()
+		delete(h.subs, ch)
+		h.mu.Unlock()
+	}
+}
+
+func (h *EventHub) publish(e Event) {
+	e.Time = time.Now()
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for ch := range h.subs {
+		select {
+		case ch <- e:
+		default:
+			droppedEventsCounter.Inc()
+		}
+	}
+}
+
+func (h *EventHub) OnJoin(c *Client, r *Room) {
+	h.publish(Event{Type: "join", NickName: c.NickName, Room: r.Name})
+}
+
+func (h *EventHub) OnLeave(c *Client, r *Room) {
+	h.publish(Event{Type: "leave", NickName: c.NickName, Room: r.Name})
+}
+
+func (h *EventHub) OnMessage(c *Client, r *Room, msg string) {
+	h.publish(Event{Type: "message", NickName: c.NickName, Room: r.Name, Text: msg})
+}
+
+func (h *EventHub) OnNickChange(c *Client, oldName, newName string) {
+	h.publish(Event{Type: "nick", NickName: newName, OldName: oldName})
+}
+
+// ServeHTTP streams events as server-sent events until the request ends.
+func (h *EventHub) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming unsupported", http.StatusInternalServerError)
+		return
+	}
+	events, cancel := h.Subscribe()
+	defer cancel()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case e := <-events:
+			data, _ := json.Marshal(e)
+			if _, err := fmt.Fprintf(w, "event: %s\ndata: %s\n\n", e.Type, data); err != nil {
+				return
+			}
+			flusher.Flush()
+		}
+	}
+}
+
+// RequireAdmin only lets requests through to next when they carry the
+// server's admin token as "Authorization: Bearer TOKEN". With no admin token
+// configured every request is refused.
+func (s *Server) RequireAdmin(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !ok || s.AdminToken == "" || subtle.ConstantTimeCompare([]byte(token), []byte(s.AdminToken)) != 1 {
+			http.Error(w, "forbidden", http.StatusForbidden)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,75 @@
+package chat
+
+// EventSink observes membership and chat state transitions. The server calls
+// it on the Run goroutine while holding its lock, right after each change
+// takes effect, so implementations must be quick and must not call back into
+// the Server. With room workers, OnMessage is called on the room's worker
+// instead, holding the lock for reading, so it may run concurrently for
+// different rooms. The client and room are passed as they are at that moment;
+// copy any field you need to keep.
+type EventSink interface {
+	OnJoin(c *Client, r *Room)
+	OnLeave(c *Client, r *Room)
+	OnMessage(c *Client, r *Room, msg string)
+	OnNickChange(c *Client, oldName, newName string)
+}
+
+// RoomStateSink is an EventSink that keeps state by room name, such as
+// Webhooks. The server tells it when a room is renamed or deleted, under the
+// same rules as the other events, so that the state follows the room.
+type RoomStateSink interface {
+	EventSink
+	OnRoomRename(oldName, newName string)
+	OnRoomDelete(name string)
+}
+
+// NopEventSink ignores every event. It is the server's default sink.
+type NopEventSink struct{}
+
+func (NopEventSink) OnJoin(*Client, *Room)                {}
+func (NopEventSink) OnLeave(*Client, *Room)               {}
+func (NopEventSink) OnMessage(*Client, *Room, string)     {}
+func (NopEventSink) OnNickChange(*Client, string, string) {}
+
+// EventSinks passes every event to each of its sinks in turn.
+type EventSinks []EventSink
+
+func (s EventSinks) OnJoin(c *Client, r *Room) {
+	for _, sink := range s {
+		sink.OnJoin(c, r)
+	}
+}
+
+func (s EventSinks) OnLeave(c *Client, r *Room) {
+	for _, sink := range s {
+		sink.OnLeave(c, r)
+	}
+}
+
+func (s EventSinks) OnMessage(c *Client, r *Room, msg string) {
+	for _, sink := range s {
+		sink.OnMessage(c, r, msg)
+	}
+}
+
+func (s EventSinks) OnNickChange(c *Client, oldName, newName string) {
+	for _, sink := range s {
+		sink.OnNickChange(c, oldName, newName)
+	}
+}
+
+func (s EventSinks) OnRoomRename(oldName, newName string) {
+	for _, sink := range s {
+		if rs, ok := sink.(RoomStateSink); ok {
+			rs.OnRoomRename(oldName, newName)
+		}
+	}
+}
+
+func (s EventSinks) OnRoomDelete(name string) {
+	for _, sink := range s {
+		if rs, ok := sink.(RoomStateSink); ok {
+			rs.OnRoomDelete(name)
+		}
+	}
+}
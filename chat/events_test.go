@@ -0,0 +1,60 @@
+package chat
+
+import (
+	"fmt"
+	"reflect"
+	"sync"
+	"testing"
+)
+
+// recordingSink keeps every event it sees as a line of text.
+type recordingSink struct {
+	mu     sync.Mutex
+	events []string
+}
+
+func (r *recordingSink) record(format string, args ...any) {
+	r.mu.Lock()
+	r.events = append(r.events, fmt.Sprintf(format, args...))
+	r.mu.Unlock()
+}
+
+func (r *recordingSink) Events() []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]string(nil), r.events...)
+}
+
+func (r *recordingSink) OnJoin(c *Client, room *Room) {
+	r.record("join %s %s", c.NickName, room.Name)
+}
+
+func (r *recordingSink) OnLeave(c *Client, room *Room) {
+	r.record("leave %s %s", c.NickName, room.Name)
+}
+
+func (r *recordingSink) OnMessage(c *Client, room *Room, msg string) {
+	r.record("message %s %s %s", c.NickName, room.Name, msg)
+}
+
+func (r *recordingSink) OnNickChange(c *Client, oldName, newName string) {
+	r.record("nick %s %s", oldName, newName)
+}
+
+func TestEventSinkSeesJoinMessageQuit(t *testing.T) {
+	sink := &recordingSink{}
+	s, l := newTestServer(t, func(s *Server) { s.Events = sink })
+	alice := dial(t, l)
+	alice.do("/name alice")
+	before := len(sink.Events())
+	alice.do("/join lobby")
+	alice.do("/msg hello")
+	alice.send("/quit")
+	alice.expectClosed()
+	waitFor(t, func() bool { return s.ConnectionCount() == 0 })
+
+	want := []string{"join alice lobby", "message alice lobby hello", "leave alice lobby"}
+	if got := sink.Events()[before:]; !reflect.DeepEqual(got, want) {
+		t.Errorf("events = %q, want %q", got, want)
+	}
+}
@@ -0,0 +1,200 @@
+package chat
+
+import (
+	"bufio"
+	"os"
+	"sort"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// Filter rewrites message text before it is broadcast or stored.
+type Filter interface {
+	Filter(msg string) string
+}
+
+// WordFilter masks banned words with asterisks. Matching is case-insensitive
+// and only applies to whole words, so "class" is left alone when "ass" is
+// banned.
+type WordFilter struct {
+	words map[string]struct{}
+}
+
+func NewWordFilter(words []string) *WordFilter {
+	f := &WordFilter{words: make(map[string]struct{})}
+	for _, w := range words {
+		w = strings.ToLower(strings.TrimSpace(w))
+		if w != "" {
+			f.words[w] = struct{}{}
+		}
+	}
+	return f
+}
+
+// LoadWordFilter reads one banned word per line, skipping blanks and lines
+// starting with #.
+func LoadWordFilter(path string) (*WordFilter, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var words []string
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		words = append(words, line)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return NewWordFilter(words), nil
+}
+
+func (f *WordFilter) Filter(msg string) string {
+	if len(f.words) == 0 {
+		return msg
+	}
+	return replaceWords(msg, func(word string) string {
+		if _, ok := f.words[strings.ToLower(word)]; ok {
+			return mask(word)
+		}
+		return word
+	})
+}
+
+// replaceWords returns msg with every word, a run of letters, digits and
+// underscores, passed through replace.
+func replaceWords(msg string, replace func(word string) string) string {
+	var b strings.Builder
+	start := -1
+	for i, r := range msg {
+		if isWordRune(r) {
+			if start < 0 {
+				start = i
+			}
+			continue
+		}
+		if start >= 0 {
+			b.WriteString(replace(msg[start:i]))
+			start = -1
+		}
+		b.WriteRune(r)
+	}
+	if start >= 0 {
+		b.WriteString(replace(msg[start:]))
+	}
+	return b.String()
+}
+
+func mask(word string) string {
+	return strings.Repeat("*", utf8.RuneCountInString(word))
+}
+
+func isWordRune(r rune) bool {
+	return unicode.IsLetter(r) || unicode.IsDigit(r) || r == '_'
+}
+
+// Filters applies each filter in order.
+type Filters []Filter
+
+func (fs Filters) Filter(msg string) string {
+	for _, f := range fs {
+		msg = f.Filter(msg)
+	}
+	return msg
+}
+
+// FilterMode is what a RoomFilter does with a message containing one of its
+// words.
+type FilterMode string
+
+const (
+	// FilterMask masks each word with asterisks, or swaps in its
+	// replacement when it has one.
+	FilterMask FilterMode = "mask"
+	// FilterReject refuses the whole message.
+	FilterReject FilterMode = "reject"
+)
+
+// RoomFilter is a room's own list of disallowed words, kept by its operator
+// with /filter on top of the server-wide Filter. Matching is case-insensitive
+// and whole-word, as for WordFilter. It is changed on the Run goroutine and
+// read by the room's posts, which never run alongside it, so it needs no
+// lock.
+type RoomFilter struct {
+	Mode FilterMode
+	// words maps each lower-cased word to its replacement, or to "" when it
+	// is masked.
+	words map[string]string
+}
+
+func NewRoomFilter(words ...string) *RoomFilter {
+	f := &RoomFilter{Mode: FilterMask, words: make(map[string]string)}
+	for _, w := range words {
+		f.Add(w, "")
+	}
+	return f
+}
+
+// Add filters word, swapping in replacement when it is not empty. It reports
+// false for a word with characters that can never match.
+func (f *RoomFilter) Add(word, replacement string) bool {
+	word = strings.ToLower(strings.TrimSpace(word))
+	if word == "" || strings.IndexFunc(word, func(r rune) bool { return !isWordRune(r) }) >= 0 {
+		return false
+	}
+	f.words[word] = replacement
+	return true
+}
+
+// Remove stops filtering word and reports whether it was filtered.
+func (f *RoomFilter) Remove(word string) bool {
+	word = strings.ToLower(strings.TrimSpace(word))
+	_, ok := f.words[word]
+	delete(f.words, word)
+	return ok
+}
+
+// Words lists the filtered words in order, each followed by " -> " and its
+// replacement when it has one.
+func (f *RoomFilter) Words() []string {
+	words := make([]string, 0, len(f.words))
+	for w, replacement := range f.words {
+		if replacement != "" {
+			w += " -> " + replacement
+		}
+		words = append(words, w)
+	}
+	sort.Strings(words)
+	return words
+}
+
+// Apply returns msg with the filtered words masked or replaced. In reject
+// mode it reports false instead when msg contains any of them.
+func (f *RoomFilter) Apply(msg string) (string, bool) {
+	if len(f.words) == 0 {
+		return msg, true
+	}
+	rejected := false
+	out := replaceWords(msg, func(word string) string {
+		replacement, ok := f.words[strings.ToLower(word)]
+		switch {
+		case !ok:
+			return word
+		case f.Mode == FilterReject:
+			rejected = true
+			return word
+		case replacement != "":
+			return replacement
+		default:
+			return mask(word)
+		}
+	})
+	return out, !rejected
+}
@@ -0,0 +1,218 @@
+package chat
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestWordFilter(t *testing.T) {
+	f := NewWordFilter([]string{"darn", " Heck ", ""})
+	tests := []struct{ in, want string }{
+		{"darn it", "**** it"},
+		{"DARN it", "**** it"},
+		{"what the heck!", "what the ****!"},
+		{"darnation is fine", "darnation is fine"},
+		{"heck_yes stays", "heck_yes stays"},
+		{"(darn), heck.", "(****), ****."},
+		{"", ""},
+	}
+	for _, tt := range tests {
+		if got := f.Filter(tt.in); got != tt.want {
+			t.Errorf("Filter(%q) = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestLoadWordFilter(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "words.txt")
+	if err := os.WriteFile(path, []byte("# banned words\ndarn\n\n  heck  \n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	f, err := LoadWordFilter(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := f.Filter("darn heck banned"); got != "**** **** banned" {
+		t.Errorf("Filter = %q", got)
+	}
+	if _, err := LoadWordFilter(filepath.Join(t.TempDir(), "missing.txt")); err == nil {
+		t.Error("loading a missing file succeeded")
+	}
+}
+
+func TestEmojiExpander(t *testing.T) {
+	e := NewEmojiExpander()
+	e.Add(":party:", "🥳")
+	tests := []struct{ in, want string }{
+		{"hi :wave:", "hi 👋"},
+		{":fire::rocket:", "🔥🚀"},
+		{"unknown :nope: stays", "unknown :nope: stays"},
+		{"time 12:30:fire:", "time 12:30🔥"},
+		{"code `a:fire:b` stays", "code `a:fire:b` stays"},
+		{"open ` :tada:", "open ` 🎉"},
+		{"custom :party:", "custom 🥳"},
+		{"no colons", "no colons"},
+	}
+	for _, tt := range tests {
+		if got := e.Filter(tt.in); got != tt.want {
+			t.Errorf("Filter(%q) = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestEmojiLoadFile(t *testing.T) {
+	dir := t.TempDir()
+	good := filepath.Join(dir, "emoji.txt")
+	os.WriteFile(good, []byte("# custom\nparrot 🦜\n:cat: 🐈\n"), 0o644)
+	bad := filepath.Join(dir, "bad.txt")
+	os.WriteFile(bad, []byte("parrot\n"), 0o644)
+
+	e := NewEmojiExpander()
+	if err := e.LoadFile(good); err != nil {
+		t.Fatal(err)
+	}
+	if got := e.Filter(":parrot: :cat:"); got != "🦜 🐈" {
+		t.Errorf("Filter = %q", got)
+	}
+	if err := e.LoadFile(bad); err == nil || !strings.Contains(err.Error(), "bad.txt:1") {
+		t.Errorf("LoadFile of a malformed line gave %v", err)
+	}
+}
+
+func TestFiltersOnMessages(t *testing.T) {
+	_, l := newTestServer(t, func(s *Server) {
+		s.Filter = Filters{NewEmojiExpander(), NewWordFilter([]string{"darn"})}
+	})
+
+	alice, bob := dial(t, l), dial(t, l)
+	alice.join("alice", "lobby")
+	bob.join("bob", "lobby")
+
+	alice.send("/msg darn :fire:")
+	if line, _ := bob.expect("alice :"); !strings.HasSuffix(line, "alice : **** 🔥") {
+		t.Errorf("bob got %q", line)
+	}
+	bob.send("/dm alice darn")
+	alice.expect("[dm from bob] ****")
+	alice.send("/quit darn it")
+	bob.expect("alice has left: **** it")
+}
+
+func TestColorMode(t *testing.T) {
+	_, l := newTestServer(t, nil)
+
+	alice, bob := dial(t, l), dial(t, l)
+	alice.join("alice", "lobby")
+	bob.join("bob", "lobby")
+	if out := bob.do("/color on"); !hasLine(out, colorize(ansiSystem, "color on")) {
+		t.Errorf("/color on got %q", out)
+	}
+
+	alice.send("/msg hello")
+	if line, _ := bob.expect("hello"); !strings.Contains(line, colorize(nickColor("alice"), "alice")) {
+		t.Errorf("bob got %q, want alice's nick in her color", line)
+	}
+	if out := bob.do("/color maybe"); !hasLine(out, ansiError+"Error: missing argument") {
+		t.Errorf("bad /color got %q", out)
+	}
+
+	bob.do("/color off")
+	alice.send("/msg plain")
+	if line, _ := bob.expect("plain"); strings.Contains(line, "\x1b[") {
+		t.Errorf("bob got %q with color off", line)
+	}
+}
+
+func TestNickColorStable(t *testing.T) {
+	if nickColor("alice") != nickColor("alice") {
+		t.Error("nickColor is not stable")
+	}
+	seen := map[string]bool{}
+	for _, nick := range []string{"alice", "bob", "carol", "dave", "erin", "frank"} {
+		seen[nickColor(nick)] = true
+	}
+	if len(seen) < 2 {
+		t.Error("every nick got the same color")
+	}
+}
+
+func TestRoomFilter(t *testing.T) {
+	f := NewRoomFilter("darn")
+	if !f.Add("Heck", "[bleep]") || f.Add("two words", "") || f.Add("", "") {
+		t.Fatal("Add accepted or refused the wrong words")
+	}
+	tests := []struct{ in, want string }{
+		{"darn it", "**** it"},
+		{"what the HECK", "what the [bleep]"},
+		{"darnation is fine", "darnation is fine"},
+	}
+	for _, tt := range tests {
+		if got, ok := f.Apply(tt.in); !ok || got != tt.want {
+			t.Errorf("Apply(%q) = %q, %v, want %q", tt.in, got, ok, tt.want)
+		}
+	}
+	if got := f.Words(); !reflect.DeepEqual(got, []string{"darn", "heck -> [bleep]"}) {
+		t.Errorf("Words() = %q", got)
+	}
+
+	f.Mode = FilterReject
+	if _, ok := f.Apply("oh darn"); ok {
+		t.Error("reject mode let a filtered word through")
+	}
+	if got, ok := f.Apply("all clean"); !ok || got != "all clean" {
+		t.Errorf("reject mode changed a clean message: %q, %v", got, ok)
+	}
+	if !f.Remove("DARN") || f.Remove("darn") {
+		t.Error("Remove reported the wrong result")
+	}
+	if _, ok := f.Apply("oh darn"); !ok {
+		t.Error("a removed word is still rejected")
+	}
+}
+
+func TestFilterCommand(t *testing.T) {
+	_, l := newTestServer(t, func(s *Server) {
+		s.FloodMessages = 0
+		s.FloodRepeats = 0
+		s.RoomBannedWords = map[string][]string{"lobby": {"darn"}}
+	})
+
+	alice, bob := dial(t, l), dial(t, l)
+	alice.join("alice", "lobby")
+	bob.join("bob", "lobby")
+
+	if out := bob.do("/filter"); !hasLine(out, "lobby filters (mask): darn") {
+		t.Errorf("/filter listing got %q", out)
+	}
+	if out := bob.do("/filter add heck"); !hasLine(out, "permission denied") {
+		t.Errorf("/filter add by a member got %q", out)
+	}
+	if out := alice.do(`/filter add heck "[bleep]"`); !hasLine(out, "filtering heck in lobby") {
+		t.Errorf("/filter add got %q", out)
+	}
+	alice.send("/msg darn, what the heck")
+	if line, _ := bob.expect("what the"); !strings.HasSuffix(line, "alice : ****, what the [bleep]") {
+		t.Errorf("bob got %q", line)
+	}
+
+	if out := alice.do("/filter mode block"); !hasLine(out, "usage: "+commands[CMD_FILTER].Usage) {
+		t.Errorf("/filter with a bad mode got %q", out)
+	}
+	alice.do("/filter mode reject")
+	alice.send("/msg darn it")
+	alice.expect("your message uses a word that is not allowed in lobby")
+	alice.do("/filter remove darn")
+	alice.send("/msg darn it")
+	if line, skipped := bob.expect("alice : darn it"); hasLine(skipped, "****") {
+		t.Errorf("bob got the rejected message before %q: %q", line, skipped)
+	}
+
+	carol := dial(t, l)
+	carol.join("carol", "kitchen")
+	if out := carol.do("/filter"); !hasLine(out, "no words are filtered in kitchen") {
+		t.Errorf("/filter in an unfiltered room got %q", out)
+	}
+}
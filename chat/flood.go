@@ -0,0 +1,89 @@
+package chat
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// By default a client that posts more than DefaultFloodMessages messages in
+// DefaultFloodWindow, or DefaultFloodRepeats identical messages in a row, is
+// muted for DefaultFloodMuteDuration.
+const (
+	DefaultFloodMessages     = 10
+	DefaultFloodWindow       = 10 * time.Second
+	DefaultFloodRepeats      = 3
+	DefaultFloodMuteDuration = 30 * time.Second
+)
+
+// Reasons a client was muted for flooding, used for the
+// tcp_chat_auto_mutes_total label.
+const (
+	FloodReasonVolume = "volume"
+	FloodReasonRepeat = "repeat"
+)
+
+// floodState is what flood protection remembers about a client. It is only
+// touched while running the client's commands, which never run concurrently.
+type floodState struct {
+	// sent holds the times of the client's recent messages, oldest first.
+	sent       []time.Time
+	lastText   string
+	repeats    int
+	mutedUntil time.Time
+}
+
+// checkFlood records a message c is about to post to room and returns an
+// error when it must be refused: because c is serving an automatic mute, or
+// because this message tips c into one. The room operator is told about new
+// mutes. Trusted clients are never refused.
+func (s *Server) checkFlood(c *Client, room *Room, text string) error {
+	if c.trusted {
+		return nil
+	}
+	now := s.Now()
+	f := &c.flood
+	if now.Before(f.mutedUntil) {
+		return errorf(ErrRateLimited, "you are muted for flooding for another %s", formatDuration(f.mutedUntil.Sub(now)))
+	}
+
+	if s.FloodMessages > 0 {
+		cutoff := now.Add(-s.FloodWindow)
+		kept := f.sent[:0]
+		for _, at := range f.sent {
+			if at.After(cutoff) {
+				kept = append(kept, at)
+			}
+		}
+		f.sent = append(kept, now)
+	}
+	if text == f.lastText {
+		f.repeats++
+	} else {
+		f.lastText, f.repeats = text, 1
+	}
+
+	var reason string
+	switch {
+	case s.FloodMessages > 0 && len(f.sent) > s.FloodMessages:
+		reason = FloodReasonVolume
+	case s.FloodRepeats > 0 && f.repeats >= s.FloodRepeats:
+		reason = FloodReasonRepeat
+	default:
+		return nil
+	}
+	f.mutedUntil = now.Add(s.FloodMuteDuration)
+	f.sent, f.lastText, f.repeats = nil, "", 0
+	autoMutesCounter.WithLabelValues(reason).Inc()
+	s.Logger().WithFields(logrus.Fields{
+		"remote_addr": c.Conn.RemoteAddr().String(),
+		"nick":        c.NickName,
+		"room":        room.Name,
+		"reason":      reason,
+	}).Warn("client muted for flooding")
+	if op := room.Owner; op != nil && op != c && !op.left {
+		op.Message(fmt.Sprintf("%s was muted for %s for flooding %s (%s)", c.NickName, formatDuration(s.FloodMuteDuration), room.Name, reason))
+	}
+	return errorf(ErrRateLimited, "you have been muted for %s for flooding", formatDuration(s.FloodMuteDuration))
+}
@@ -0,0 +1,62 @@
+package chat
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"io"
+)
+
+var errLineTooLong = errors.New("line too long")
+
+// lineReader splits a connection's input into lines. There is one per
+// connection for its whole life, so bytes read past the end of one line are
+// kept for the next; a line may arrive over any number of reads.
+type lineReader struct {
+	r *bufio.Reader
+	// limit is the longest line accepted, in bytes, not counting its line
+	// ending; 0 allows any length.
+	limit int
+}
+
+func newLineReader(r io.Reader, limit int) *lineReader {
+	return &lineReader{r: bufio.NewReader(r), limit: limit}
+}
+
+// ReadLine returns the next line without its "\n" or "\r\n" ending. A line
+// longer than the limit is skipped up to its newline and reported as
+// errLineTooLong, so the rest of the stream stays in step and memory stays
+// bounded. A final line with no newline is returned before io.EOF.
+func (l *lineReader) ReadLine() (string, error) {
+	var line []byte
+	tooLong := false
+	for {
+		chunk, err := l.r.ReadSlice('\n')
+		if !tooLong {
+			line = append(line, chunk...)
+			if l.limit > 0 && len(trimLineEnding(line)) > l.limit {
+				tooLong, line = true, nil
+			}
+		}
+		if errors.Is(err, bufio.ErrBufferFull) {
+			continue
+		}
+		if tooLong {
+			if err == nil {
+				return "", errLineTooLong
+			}
+			return "", err
+		}
+		if err != nil && (!errors.Is(err, io.EOF) || len(line) == 0) {
+			return "", err
+		}
+		return string(trimLineEnding(line)), nil
+	}
+}
+
+// trimLineEnding drops one trailing "\n" or "\r\n". A "\r" ending a final
+// line that has no newline is dropped too.
+func trimLineEnding(line []byte) []byte {
+	line = bytes.TrimSuffix(line, []byte("\n"))
+	return bytes.TrimSuffix(line, []byte("\r"))
+}
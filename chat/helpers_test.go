@@ -0,0 +1,224 @@
+package chat
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+func TestMain(m *testing.M) {
+	log.SetOutput(io.Discard)
+	passwordCost = bcrypt.MinCost
+	os.Exit(m.Run())
+}
+
+// testTimeout bounds every wait in the tests, so a missing line fails the
+// test instead of hanging it.
+const testTimeout = 5 * time.Second
+
+// newTestServer starts a server on a PipeListener and closes it when the test
+// ends. configure, when not nil, adjusts the server before it serves.
+func newTestServer(t testing.TB, configure func(s *Server), opts ...Option) (*Server, *PipeListener) {
+	t.Helper()
+	s := NewServer(opts...)
+	s.MOTD = "welcome"
+	if configure != nil {
+		configure(s)
+	}
+	l := NewPipeListener()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		s.Serve(context.Background(), l)
+	}()
+	t.Cleanup(func() {
+		s.Close()
+		<-done
+	})
+	return s, l
+}
+
+// lastIP hands out a distinct address to every test client, so the per-IP
+// connection limit only applies where a test asks for it.
+var lastIP atomic.Uint32
+
+func nextAddr() net.Addr {
+	n := lastIP.Add(1)
+	return &net.TCPAddr{IP: net.IPv4(10, byte(n>>16), byte(n>>8), byte(n)), Port: 40000}
+}
+
+// testClient is one connection to a test server, read line by line.
+type testClient struct {
+	t     testing.TB
+	conn  net.Conn
+	lines chan string
+}
+
+// dial connects a client and waits for the MOTD.
+func dial(t testing.TB, l *PipeListener) *testClient {
+	t.Helper()
+	return dialAs(t, l, nextAddr())
+}
+
+func dialAs(t testing.TB, l *PipeListener, addr net.Addr) *testClient {
+	t.Helper()
+	c := connect(t, l, addr)
+	c.expect("welcome")
+	return c
+}
+
+// connect connects a client without waiting for anything.
+func connect(t testing.TB, l *PipeListener, addr net.Addr) *testClient {
+	t.Helper()
+	conn, err := l.DialAs(addr)
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	c := &testClient{t: t, conn: conn, lines: make(chan string, 1024)}
+	go func() {
+		defer close(c.lines)
+		sc := bufio.NewScanner(conn)
+		for sc.Scan() {
+			c.lines <- sc.Text()
+		}
+	}()
+	t.Cleanup(func() { conn.Close() })
+	return c
+}
+
+func (c *testClient) send(line string) {
+	c.t.Helper()
+	c.conn.SetWriteDeadline(time.Now().Add(testTimeout))
+	if _, err := c.conn.Write([]byte(line + "\n")); err != nil {
+		c.t.Fatalf("send %q: %v", line, err)
+	}
+}
+
+// next returns the next line, failing the test if none arrives in time. ok
+// is false once the connection has closed.
+func (c *testClient) next() (line string, ok bool) {
+	c.t.Helper()
+	select {
+	case line, ok = <-c.lines:
+		return line, ok
+	case <-time.After(testTimeout):
+		c.t.Fatalf("timed out waiting for a line")
+		return "", false
+	}
+}
+
+// expect reads lines until one contains want and returns it, with the lines
+// skipped on the way.
+func (c *testClient) expect(want string) (string, []string) {
+	c.t.Helper()
+	var skipped []string
+	for {
+		line, ok := c.next()
+		if !ok {
+			c.t.Fatalf("connection closed waiting for %q; got %q", want, skipped)
+		}
+		if strings.Contains(line, want) {
+			return line, skipped
+		}
+		skipped = append(skipped, line)
+	}
+}
+
+// do sends line and returns everything the server sent until it handled it.
+// It relies on /ping answering in order, so it suits commands that run on
+// the Run goroutine.
+var pingSeq atomic.Int64
+
+func (c *testClient) do(line string) []string {
+	c.t.Helper()
+	token := fmt.Sprintf("sync-%d", pingSeq.Add(1))
+	c.send(line)
+	c.send("/ping " + token)
+	_, out := c.expect("pong " + token)
+	return out
+}
+
+// sync waits until the server has handled everything c sent so far.
+func (c *testClient) sync() []string {
+	c.t.Helper()
+	token := fmt.Sprintf("sync-%d", pingSeq.Add(1))
+	c.send("/ping " + token)
+	_, out := c.expect("pong " + token)
+	return out
+}
+
+// expectClosed reads until the server closes the connection and returns
+// what it sent first.
+func (c *testClient) expectClosed() []string {
+	c.t.Helper()
+	var out []string
+	for {
+		line, ok := c.next()
+		if !ok {
+			return out
+		}
+		out = append(out, line)
+	}
+}
+
+// join names the client and joins room.
+func (c *testClient) join(nick, room string) {
+	c.t.Helper()
+	if out := c.do("/name " + nick); hasLine(out, "Error") {
+		c.t.Fatalf("/name %s: %q", nick, out)
+	}
+	if out := c.do("/join " + room); hasLine(out, "Error") {
+		c.t.Fatalf("/join %s: %q", room, out)
+	}
+}
+
+// hasLine reports whether any line contains want.
+func hasLine(lines []string, want string) bool {
+	for _, l := range lines {
+		if strings.Contains(l, want) {
+			return true
+		}
+	}
+	return false
+}
+
+// fakeClock is a settable clock for WithClock.
+type fakeClock struct {
+	now atomic.Int64
+}
+
+func newFakeClock() *fakeClock {
+	c := &fakeClock{}
+	c.now.Store(time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC).UnixNano())
+	return c
+}
+
+func (c *fakeClock) Now() time.Time {
+	return time.Unix(0, c.now.Load()).UTC()
+}
+
+func (c *fakeClock) Advance(d time.Duration) {
+	c.now.Add(int64(d))
+}
+
+// waitFor polls cond until it holds, for state that settles asynchronously
+// such as the connection count after a close.
+func waitFor(t *testing.T, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(testTimeout)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatal("timed out waiting for the condition")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
@@ -0,0 +1,255 @@
+package chat
+
+import (
+	"bufio"
+	"errors"
+	"io/fs"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+const DefaultHistoryFlushInterval = 5 * time.Second
+
+// HistoryStore holds the recent messages of one room. Rooms use a
+// CircularBuffer unless Server.NewHistory says otherwise. Implementations
+// must be safe for concurrent use, since read-only commands may run on
+// worker goroutines.
+type HistoryStore interface {
+	// Append records m as the newest message.
+	Append(m Message)
+	// LastN returns up to the last n messages, oldest first.
+	LastN(n int) []Message
+	// Before returns up to n messages stored before the chat message with
+	// ID id, oldest first, for paging backwards. An id of 0 pages from the
+	// newest message, like LastN.
+	Before(id uint64, n int) []Message
+	// Search returns the stored messages whose text contains query,
+	// ignoring case, oldest first. The sender's nickname and the message
+	// IDs are not searched.
+	Search(query string) []Message
+	// Clear drops every message.
+	Clear()
+	// Resize changes how many messages are held. Growing keeps every
+	// message; shrinking keeps the newest size.
+	Resize(size int)
+	// Len is the number of messages held.
+	Len() int
+}
+
+// PersistentHistory keeps room history across restarts as lines written by
+// Message.String. Each Room's HistoryStore stays the hot cache that /join
+// replays from; the store only sees appends and is read when a room is
+// created. Append is called on the Run
+// goroutine, so implementations should queue rather than block on I/O.
+type PersistentHistory interface {
+	// Append records line as the newest message of room.
+	Append(room, line string)
+	// Load returns up to the last n messages of room, oldest first, with
+	// their Sent time when the store keeps one.
+	Load(room string, n int) ([]Message, error)
+	// Rooms lists every room with stored history.
+	Rooms() ([]string, error)
+	// Rename moves the history of a renamed room.
+	Rename(oldName, newName string) error
+	// Delete drops the history of a room, for a deleted room or /clear.
+	Delete(room string) error
+	// Flush writes out anything still queued.
+	Flush() error
+	Close() error
+}
+
+// FileHistory persists room history as one append-only file per room in a
+// directory. Appends are buffered in memory and written in batches every
+// flush interval, so a busy room costs one write per interval rather than one
+// per message. Close (or Flush) writes out whatever is still pending.
+type FileHistory struct {
+	dir string
+
+	mu      sync.Mutex
+	pending map[string][]string
+	// flushMu serializes flushes so batches for a room reach disk in order.
+	flushMu sync.Mutex
+
+	done    chan struct{}
+	stopped chan struct{}
+	once    sync.Once
+}
+
+func NewFileHistory(dir string, interval time.Duration) (*FileHistory, error) {
+	if interval <= 0 {
+		interval = DefaultHistoryFlushInterval
+	}
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	h := &FileHistory{
+		dir:     dir,
+		pending: make(map[string][]string),
+		done:    make(chan struct{}),
+		stopped: make(chan struct{}),
+	}
+	go h.run(interval)
+	return h, nil
+}
+
+// Append queues line for room. It never touches the disk.
+func (h *FileHistory) Append(room, line string) {
+	h.mu.Lock()
+	h.pending[room] = append(h.pending[room], line)
+	h.mu.Unlock()
+}
+
+// Load returns up to the last n persisted messages of room, oldest first,
+// including lines that are still waiting to be flushed. The files keep no
+// timestamps, so Sent is zero.
+func (h *FileHistory) Load(room string, n int) ([]Message, error) {
+	if err := h.Flush(); err != nil {
+		return nil, err
+	}
+	f, err := os.Open(h.path(room))
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var lines []string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		lines = append(lines, scanner.Text())
+		if len(lines) > n {
+			lines = lines[1:]
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	msgs := make([]Message, len(lines))
+	for i, line := range lines {
+		msgs[i] = ParseMessage(line)
+	}
+	return msgs, nil
+}
+
+// Rooms lists the rooms that have a history file.
+func (h *FileHistory) Rooms() ([]string, error) {
+	if err := h.Flush(); err != nil {
+		return nil, err
+	}
+	entries, err := os.ReadDir(h.dir)
+	if err != nil {
+		return nil, err
+	}
+	var rooms []string
+	for _, e := range entries {
+		name, ok := strings.CutSuffix(e.Name(), ".log")
+		if !ok || e.IsDir() {
+			continue
+		}
+		if room, err := url.PathUnescape(name); err == nil {
+			rooms = append(rooms, room)
+		}
+	}
+	return rooms, nil
+}
+
+// Rename moves the persisted history of a renamed room.
+func (h *FileHistory) Rename(oldName, newName string) error {
+	if err := h.Flush(); err != nil {
+		return err
+	}
+	h.flushMu.Lock()
+	defer h.flushMu.Unlock()
+	err := os.Rename(h.path(oldName), h.path(newName))
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	return err
+}
+
+// Delete removes the history file of room, along with lines still waiting
+// to be written.
+func (h *FileHistory) Delete(room string) error {
+	h.flushMu.Lock()
+	defer h.flushMu.Unlock()
+	h.mu.Lock()
+	delete(h.pending, room)
+	h.mu.Unlock()
+	err := os.Remove(h.path(room))
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	return err
+}
+
+// Flush writes every pending line to disk now.
+func (h *FileHistory) Flush() error {
+	h.flushMu.Lock()
+	defer h.flushMu.Unlock()
+
+	h.mu.Lock()
+	batch := h.pending
+	h.pending = make(map[string][]string)
+	h.mu.Unlock()
+
+	var errs []error
+	for room, lines := range batch {
+		if err := h.write(room, lines); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// Close stops the background flusher and performs a final flush. Nothing may
+// be appended after Close.
+func (h *FileHistory) Close() error {
+	h.once.Do(func() {
+		close(h.done)
+		<-h.stopped
+	})
+	return h.Flush()
+}
+
+func (h *FileHistory) run(interval time.Duration) {
+	defer close(h.stopped)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-h.done:
+			return
+		case <-ticker.C:
+			if err := h.Flush(); err != nil {
+				log.WithFields(logrus.Fields{
+					"error": err.Error(),
+				}).Error("failed to flush room history")
+			}
+		}
+	}
+}
+
+func (h *FileHistory) write(room string, lines []string) error {
+	f, err := os.OpenFile(h.path(room), os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := f.WriteString(strings.Join(lines, "\n") + "\n"); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// path escapes the room name so it is always a single file inside dir.
+func (h *FileHistory) path(room string) string {
+	return filepath.Join(h.dir, url.PathEscape(room)+".log")
+}
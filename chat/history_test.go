@@ -0,0 +1,152 @@
+package chat
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// historyStores opens each PersistentHistory implementation on dir. The
+// hour-long flush interval leaves flushing to the tests.
+var historyStores = map[string]func(t *testing.T, dir string) PersistentHistory{
+	"file": func(t *testing.T, dir string) PersistentHistory {
+		h, err := NewFileHistory(dir, time.Hour)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return h
+	},
+	"sqlite": func(t *testing.T, dir string) PersistentHistory {
+		h, err := NewSQLiteHistory(filepath.Join(dir, "history.db"), time.Hour)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return h
+	},
+}
+
+func chatLine(id uint64, nick, text string) string {
+	return Message{ID: id, Kind: KindChat, Nick: nick, Text: text}.String()
+}
+
+func TestPersistentHistory(t *testing.T) {
+	for name, open := range historyStores {
+		t.Run(name, func(t *testing.T) {
+			dir := t.TempDir()
+			h := open(t, dir)
+			for i := uint64(1); i <= 5; i++ {
+				h.Append("lobby", chatLine(i, "alice", "hello"))
+			}
+			h.Append("a/b", chatLine(1, "bob", "slashes"))
+
+			// Load sees lines that were never flushed
+			msgs, err := h.Load("lobby", 3)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(msgs) != 3 || msgs[0].ID != 3 || msgs[2].ID != 5 || msgs[2].Nick != "alice" || msgs[2].Text != "hello" {
+				t.Fatalf("Load = %+v, want messages 3 to 5", msgs)
+			}
+			if rooms, err := h.Rooms(); err != nil || len(rooms) != 2 {
+				t.Errorf("Rooms() = %q, %v", rooms, err)
+			}
+
+			if err := h.Rename("lobby", "hall"); err != nil {
+				t.Fatal(err)
+			}
+			if msgs, _ := h.Load("lobby", 10); len(msgs) != 0 {
+				t.Errorf("the old name still has %d messages", len(msgs))
+			}
+			h.Append("a/b", chatLine(2, "bob", "pending"))
+			if err := h.Delete("a/b"); err != nil {
+				t.Fatal(err)
+			}
+			if msgs, _ := h.Load("a/b", 10); len(msgs) != 0 {
+				t.Errorf("a deleted room still has %+v", msgs)
+			}
+			if err := h.Delete("never-existed"); err != nil {
+				t.Errorf("deleting a room without history: %v", err)
+			}
+			if err := h.Close(); err != nil {
+				t.Fatal(err)
+			}
+
+			reopened := open(t, dir)
+			defer reopened.Close()
+			msgs, err = reopened.Load("hall", 10)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(msgs) != 5 {
+				t.Errorf("after reopening, hall has %d messages, want 5", len(msgs))
+			}
+			if rooms, _ := reopened.Rooms(); len(rooms) != 1 || rooms[0] != "hall" {
+				t.Errorf("after reopening, Rooms() = %q", rooms)
+			}
+		})
+	}
+}
+
+func TestSQLiteHistoryKeepsSent(t *testing.T) {
+	h, err := NewSQLiteHistory(filepath.Join(t.TempDir(), "history.db"), time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer h.Close()
+
+	before := time.Now().Truncate(time.Millisecond)
+	h.Append("lobby", chatLine(1, "alice", "hi"))
+	after := time.Now()
+	msgs, err := h.Load("lobby", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(msgs) != 1 || msgs[0].Sent.Before(before) || msgs[0].Sent.After(after) {
+		t.Errorf("Load = %+v, want Sent between %s and %s", msgs, before, after)
+	}
+}
+
+func TestRestoreRooms(t *testing.T) {
+	for name, open := range historyStores {
+		t.Run(name, func(t *testing.T) {
+			dir := t.TempDir()
+			h := open(t, dir)
+			_, l := newTestServer(t, func(s *Server) { s.PersistentHistory = h })
+			alice := dial(t, l)
+			alice.join("alice", "lobby")
+			alice.send("/msg first")
+			alice.send("/msg second")
+			alice.expect("OK 2")
+			if err := h.Close(); err != nil {
+				t.Fatal(err)
+			}
+
+			// a new server on the same store picks up where the first left
+			h = open(t, dir)
+			defer h.Close()
+			s, l := newTestServer(t, func(s *Server) { s.PersistentHistory = h })
+			if err := s.RestoreRooms(); err != nil {
+				t.Fatal(err)
+			}
+			bob := dial(t, l)
+			bob.do("/name bob")
+			out := bob.do("/join lobby")
+			if !hasLine(out, "[1] alice : first") || !hasLine(out, "[2] alice : second") {
+				t.Errorf("join after a restart replayed %q", out)
+			}
+			bob.send("/msg third")
+			bob.expect("OK 3")
+
+			if out := bob.do("/clear"); !hasLine(out, "permission denied") {
+				t.Fatalf("/clear by a member got %q", out)
+			}
+			s.mu.Lock()
+			s.Rooms["lobby"].Owner = s.findClient("bob")
+			s.mu.Unlock()
+			bob.do("/clear")
+			if msgs, err := h.Load("lobby", 10); err != nil || len(msgs) != 0 {
+				t.Errorf("after /clear the store has %+v, %v", msgs, err)
+			}
+		})
+	}
+}
@@ -0,0 +1,163 @@
+package chat
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"io"
+	"mime"
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+)
+
+// IncomingWebhook lets external systems such as CI or alerting post into
+// Room as Nick by presenting Token. Nick is only a display name: it is not
+// reserved, and the hook is never a member of the room.
+type IncomingWebhook struct {
+	Room  string `json:"room" yaml:"room"`
+	Nick  string `json:"nick" yaml:"nick"`
+	Token string `json:"token" yaml:"token"`
+}
+
+// HooksAPI serves the incoming webhooks. Paths are relative to where it is
+// mounted, so serve it with http.StripPrefix:
+//
+//	POST /ROOM?token=TOKEN  post the body to ROOM as the hook's nickname
+//
+// The body is {"text": "..."} when sent as application/json and the text
+// itself otherwise. The response is {"id": ID, "delivered": N}; errors look
+// like the admin API's.
+func (s *Server) HooksAPI() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		room := strings.Trim(r.URL.Path, "/")
+		if room == "" || strings.Contains(room, "/") {
+			writeAPIError(w, errorf(ErrUnknownCommand, "no such endpoint: %s %s", r.Method, r.URL.Path))
+			return
+		}
+		if !allowMethod(w, r, http.MethodPost) {
+			return
+		}
+		s.mu.RLock()
+		hook, ok := s.findHook(room, r.URL.Query().Get("token"))
+		s.mu.RUnlock()
+		if !ok {
+			writeAPIError(w, errorf(ErrPermissionDenied, "invalid token for %s", room))
+			return
+		}
+		text, err := hookText(w, r)
+		if err != nil {
+			writeAPIError(w, err)
+			return
+		}
+		id, delivered, err := s.postHook(hook, text)
+		if err != nil {
+			writeAPIError(w, err)
+			return
+		}
+		s.Logger().WithFields(logrus.Fields{
+			"room":        hook.Room,
+			"nick":        hook.Nick,
+			"remote_addr": r.RemoteAddr,
+		}).Debug("message posted through an incoming webhook")
+		writeJSON(w, http.StatusOK, map[string]uint64{"id": id, "delivered": uint64(delivered)})
+	})
+}
+
+// findHook returns the incoming webhook for room whose token is token. s.mu
+// must be held.
+func (s *Server) findHook(room, token string) (IncomingWebhook, bool) {
+	if token == "" {
+		return IncomingWebhook{}, false
+	}
+	for _, hook := range s.IncomingWebhooks {
+		if hook.Room == room && subtle.ConstantTimeCompare([]byte(token), []byte(hook.Token)) == 1 {
+			return hook, true
+		}
+	}
+	return IncomingWebhook{}, false
+}
+
+// renameHooks points the incoming webhooks of oldName at newName. s.mu must
+// be held for writing.
+func (s *Server) renameHooks(oldName, newName string) {
+	hooks := make([]IncomingWebhook, len(s.IncomingWebhooks))
+	for i, hook := range s.IncomingWebhooks {
+		if hook.Room == oldName {
+			hook.Room = newName
+		}
+		hooks[i] = hook
+	}
+	s.IncomingWebhooks = hooks
+}
+
+// deleteHooks drops the incoming webhooks of room, along with their clients.
+// s.mu must be held for writing.
+func (s *Server) deleteHooks(room string) {
+	var hooks []IncomingWebhook
+	for _, hook := range s.IncomingWebhooks {
+		if hook.Room == room {
+			delete(s.hookClients, hook.Token)
+			continue
+		}
+		hooks = append(hooks, hook)
+	}
+	s.IncomingWebhooks = hooks
+}
+
+// hookText reads the text of a message posted to an incoming webhook. It is
+// held to the same limits as an announcement.
+func hookText(w http.ResponseWriter, r *http.Request) (string, error) {
+	body := http.MaxBytesReader(w, r.Body, 4*MaxAnnouncementLength)
+	if mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type")); mediaType == "application/json" {
+		var req struct {
+			Text string `json:"text"`
+		}
+		if err := json.NewDecoder(body).Decode(&req); err != nil {
+			return "", errorf(ErrInvalidInput, "invalid JSON body: %v", err)
+		}
+		return announcement(req.Text)
+	}
+	b, err := io.ReadAll(body)
+	if err != nil {
+		return "", errorf(ErrInvalidInput, "unable to read the body: %v", err)
+	}
+	return announcement(string(b))
+}
+
+// postHook posts text to hook's room as a chat message from the hook. Each
+// hook has a client of its own that is never connected, so flood protection
+// and the room's filters apply to it like anyone else.
+func (s *Server) postHook(hook IncomingWebhook, text string) (uint64, int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	room, ok := s.Rooms[hook.Room]
+	if !ok {
+		return 0, 0, errorf(ErrRoomNotFound, "room %q not found", hook.Room)
+	}
+	c, ok := s.hookClients[hook.Token]
+	if !ok {
+		c = &Client{Conn: hookConn{}, NickName: hook.Nick, server: s}
+		if s.hookClients == nil {
+			s.hookClients = make(map[string]*Client)
+		}
+		s.hookClients[hook.Token] = c
+	}
+	return s.post(c, room, text, 0)
+}
+
+// hookConn stands in for the connection of an incoming webhook's client.
+// Lines written to it, such as away replies, go nowhere.
+type hookConn struct {
+	net.Conn
+}
+
+func (hookConn) Write(b []byte) (int, error) { return len(b), nil }
+func (hookConn) Close() error                { return nil }
+func (hookConn) RemoteAddr() net.Addr        { return hookAddr{} }
+
+type hookAddr struct{}
+
+func (hookAddr) Network() string { return "webhook" }
+func (hookAddr) String() string  { return "webhook" }
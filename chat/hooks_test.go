@@ -0,0 +1,119 @@
+package chat
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func newHooksServer(t *testing.T, configure func(s *Server)) (*Server, *PipeListener, *httptest.Server) {
+	t.Helper()
+	s, l := newTestServer(t, func(s *Server) {
+		s.IncomingWebhooks = []IncomingWebhook{
+			{Room: "lobby", Nick: "ci", Token: "build"},
+			{Room: "ops", Nick: "pager", Token: "alert"},
+		}
+		if configure != nil {
+			configure(s)
+		}
+	})
+	mux := http.NewServeMux()
+	mux.Handle("/hooks/", http.StripPrefix("/hooks", s.HooksAPI()))
+	hs := httptest.NewServer(mux)
+	t.Cleanup(hs.Close)
+	return s, l, hs
+}
+
+func postHook(t *testing.T, hs *httptest.Server, path, contentType, body string) (*http.Response, map[string]any) {
+	t.Helper()
+	resp, err := hs.Client().Post(hs.URL+path, contentType, strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	var out map[string]any
+	json.NewDecoder(resp.Body).Decode(&out)
+	return resp, out
+}
+
+func TestIncomingWebhook(t *testing.T) {
+	_, l, hs := newHooksServer(t, nil)
+	alice := dial(t, l)
+	alice.join("alice", "lobby")
+
+	resp, out := postHook(t, hs, "/hooks/lobby?token=build", "application/json", `{"text": "build #12 passed"}`)
+	if resp.StatusCode != http.StatusOK || out["delivered"] != float64(1) || out["id"] == float64(0) {
+		t.Errorf("posting JSON got %s %v", resp.Status, out)
+	}
+	alice.expect("ci : build #12 passed")
+
+	if resp, _ := postHook(t, hs, "/hooks/lobby?token=build", "text/plain", "deploy finished\n"); resp.StatusCode != http.StatusOK {
+		t.Errorf("posting text got %s", resp.Status)
+	}
+	alice.expect("ci : deploy finished")
+	alice.send("/history lobby 10")
+	alice.expect("ci : build #12 passed")
+}
+
+func TestIncomingWebhookRefusals(t *testing.T) {
+	_, l, hs := newHooksServer(t, nil)
+	dial(t, l).join("alice", "lobby")
+
+	for _, tc := range []struct {
+		method, path, body string
+		status             int
+		code               ErrorCode
+	}{
+		{http.MethodPost, "/hooks/lobby", "hi", http.StatusForbidden, ErrPermissionDenied},
+		{http.MethodPost, "/hooks/lobby?token=wrong", "hi", http.StatusForbidden, ErrPermissionDenied},
+		// a token only works for its own room
+		{http.MethodPost, "/hooks/lobby?token=alert", "hi", http.StatusForbidden, ErrPermissionDenied},
+		{http.MethodPost, "/hooks/ops?token=alert", "hi", http.StatusNotFound, ErrRoomNotFound},
+		{http.MethodPost, "/hooks/lobby?token=build", "  ", http.StatusBadRequest, ErrInvalidArgument},
+		{http.MethodPost, "/hooks/lobby?token=build", "two\nlines", http.StatusBadRequest, ErrInvalidArgument},
+		{http.MethodGet, "/hooks/lobby?token=build", "", http.StatusMethodNotAllowed, ErrUsage},
+		{http.MethodPost, "/hooks/?token=build", "hi", http.StatusNotFound, ErrUnknownCommand},
+	} {
+		req, _ := http.NewRequest(tc.method, hs.URL+tc.path, strings.NewReader(tc.body))
+		resp, err := hs.Client().Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var apiErr apiError
+		json.NewDecoder(resp.Body).Decode(&apiErr)
+		resp.Body.Close()
+		if resp.StatusCode != tc.status || apiErr.Code != tc.code {
+			t.Errorf("%s %s %q got %s %s, want %d %s", tc.method, tc.path, tc.body, resp.Status, apiErr.Code, tc.status, tc.code)
+		}
+	}
+}
+
+func TestIncomingWebhookFlood(t *testing.T) {
+	_, l, hs := newHooksServer(t, func(s *Server) {
+		s.FloodRepeats = 2
+		s.FloodMuteDuration = DefaultFloodMuteDuration
+	})
+	dial(t, l).join("alice", "lobby")
+
+	postHook(t, hs, "/hooks/lobby?token=build", "text/plain", "same again")
+	if resp, _ := postHook(t, hs, "/hooks/lobby?token=build", "text/plain", "same again"); resp.StatusCode != http.StatusTooManyRequests {
+		t.Errorf("a flooding hook got %s", resp.Status)
+	}
+}
+
+func TestIncomingWebhookFollowsRename(t *testing.T) {
+	_, l, hs := newHooksServer(t, nil)
+	alice := dial(t, l)
+	alice.join("alice", "lobby")
+	alice.do("/rename lobby hall")
+
+	if resp, _ := postHook(t, hs, "/hooks/hall?token=build", "text/plain", "moved"); resp.StatusCode != http.StatusOK {
+		t.Errorf("posting to the new name got %s", resp.Status)
+	}
+	alice.expect("ci : moved")
+	if resp, _ := postHook(t, hs, "/hooks/lobby?token=build", "text/plain", "lost"); resp.StatusCode != http.StatusForbidden {
+		t.Errorf("posting to the old name got %s", resp.Status)
+	}
+}
@@ -0,0 +1,431 @@
+package chat
+
+import (
+	"net"
+	"strings"
+	"sync"
+)
+
+// ircServerName is the name the server goes by in IRC replies.
+const ircServerName = "chat"
+
+// ircNamesLength caps the nicknames listed in one RPL_NAMREPLY, keeping the
+// line well inside IRC's 512 bytes.
+const ircNamesLength = 400
+
+// IRCListener wraps l so that the clients it accepts speak IRC instead of the
+// chat protocol, letting IRC clients such as irssi or weechat connect without
+// a custom client:
+//
+//	go s.Serve(ctx, chat.IRCListener(l))
+//
+// It is a compatibility layer rather than an IRC server. NICK, JOIN, PART,
+// PRIVMSG, NOTICE, PING and QUIT become the chat commands they stand for, and
+// any other command becomes the chat command of the same name, so
+// "/quote HISTORY lobby 10" runs /history. Channels are rooms with a '#' in
+// front; since a client is in one room at a time, joining a channel parts the
+// one it was in.
+func IRCListener(l net.Listener) net.Listener {
+	return ircListener{l}
+}
+
+type ircListener struct {
+	net.Listener
+}
+
+func (l ircListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return &ircConn{Conn: conn}, nil
+}
+
+// ircConn is a connection from an IRC client. The Client reading it passes
+// every line through readIRC, and its deliver methods render their output
+// with the ircConn's methods, which return the IRC lines to write.
+type ircConn struct {
+	net.Conn
+
+	// mu guards the rest: the client's reader translates input while the
+	// Run goroutine and room workers render output.
+	mu sync.Mutex
+	// registered is set once the server accepted the nickname the client
+	// registered with. Until then IRC clients expect nothing but replies to
+	// their registration, so chat and room events are held back.
+	registered bool
+	gotUser    bool
+	// wantNick is the nickname last asked for with NICK, and nick the one
+	// the client has since registering.
+	wantNick string
+	nick     string
+	// channel is the room the client is in, without the '#'; empty when it
+	// is in none.
+	channel string
+}
+
+// ircBeforeWelcome are the commands an IRC client may send before it has
+// registered.
+var ircBeforeWelcome = map[string]bool{
+	"CAP":  true,
+	"PASS": true,
+	"NICK": true,
+	"USER": true,
+	"PING": true,
+	"PONG": true,
+	"QUIT": true,
+}
+
+// readIRC translates a line from an IRC client into the chat command it
+// stands for. Commands IRC clients expect answered on the spot, such as PING
+// and CAP, are answered here and ok is false, as it is for lines that have no
+// chat equivalent.
+func (c *Client) readIRC(line string) (cmd string, ok bool) {
+	cmd, reply := c.irc.translate(line, c.server.MessageRoomArg)
+	if err := c.writeIRC(reply); err != nil {
+		writeErrorsCounter.WithLabelValues("reply").Inc()
+	}
+	return cmd, cmd != ""
+}
+
+// writeIRC writes lines rendered for an IRC client, which may be none.
+func (c *Client) writeIRC(lines string) error {
+	if lines == "" {
+		return nil
+	}
+	return c.write(lines)
+}
+
+// translate returns the chat command for an IRC line, or "", and the reply to
+// write straight back, or "". roomArg is the server's MessageRoomArg: with it
+// /msg has to name the room, or a message starting with a room's name would
+// go to that room.
+func (ic *ircConn) translate(line string, roomArg bool) (cmd, reply string) {
+	command, params := parseIRC(line)
+	arg := func(i int) string {
+		if i < len(params) {
+			return params[i]
+		}
+		return ""
+	}
+	ic.mu.Lock()
+	defer ic.mu.Unlock()
+	if command == "" {
+		return "", ""
+	}
+	if !ic.registered && !ircBeforeWelcome[command] {
+		return "", ic.numeric("451", ":You have not registered")
+	}
+
+	switch command {
+	case "CAP":
+		// there are no capabilities to offer
+		switch sub := strings.ToUpper(arg(0)); sub {
+		case "LS", "LIST":
+			return "", ircLine(":"+ircServerName, "CAP", ic.me(), sub, ":")
+		case "REQ":
+			return "", ircLine(":"+ircServerName, "CAP", ic.me(), "NAK", ":"+arg(1))
+		}
+		return "", ""
+	case "PASS":
+		return "", ""
+	case "NICK":
+		if arg(0) == "" {
+			return "", ic.numeric("431", ":No nickname given")
+		}
+		ic.wantNick = arg(0)
+		if ic.registered {
+			return "/name " + arg(0), ""
+		}
+		return ic.register(), ""
+	case "USER":
+		if ic.registered {
+			return "", ic.numeric("462", ":You may not reregister")
+		}
+		ic.gotUser = true
+		return ic.register(), ""
+	case "PING":
+		return "", ircLine(":"+ircServerName, "PONG", ircServerName, ":"+arg(0))
+	case "PONG":
+		return "/pong", ""
+	case "QUIT":
+		return strings.TrimSpace("/quit " + arg(0)), ""
+	case "JOIN":
+		if arg(0) == "" {
+			return "", ic.numeric("461", "JOIN", ":Not enough parameters")
+		}
+		if arg(0) == "0" {
+			return "/leave", ""
+		}
+		// a client is in one room at a time, so only the first channel
+		// counts
+		channel, _, _ := strings.Cut(arg(0), ",")
+		key, _, _ := strings.Cut(arg(1), ",")
+		return strings.TrimSpace("/join " + strings.TrimPrefix(channel, "#") + " " + key), ""
+	case "PART":
+		channel, _, _ := strings.Cut(arg(0), ",")
+		if ic.channel == "" || channel != "#"+ic.channel {
+			return "", ic.numeric("442", channel, ":You're not on that channel")
+		}
+		return "/leave", ""
+	case "PRIVMSG", "NOTICE":
+		// NOTICE never gets an error back, so that bots cannot loop
+		target, text := arg(0), arg(1)
+		if target == "" || text == "" {
+			if command == "NOTICE" {
+				return "", ""
+			}
+			if target == "" {
+				return "", ic.numeric("411", ":No recipient given (PRIVMSG)")
+			}
+			return "", ic.numeric("412", ":No text to send")
+		}
+		text, ok := fromCTCP(text)
+		if !ok {
+			return "", ""
+		}
+		if !strings.HasPrefix(target, "#") {
+			return "/dm " + target + " " + text, ""
+		}
+		if ic.channel == "" || target != "#"+ic.channel {
+			if command == "NOTICE" {
+				return "", ""
+			}
+			return "", ic.numeric("404", target, ":Cannot send to channel")
+		}
+		if roomArg {
+			return "/msg " + ic.channel + " " + text, ""
+		}
+		return "/msg " + text, ""
+	case "MODE":
+		// rooms and users have no modes, but clients ask after joining
+		if strings.HasPrefix(arg(0), "#") {
+			return "", ic.numeric("324", arg(0), "+")
+		}
+		return "", ic.numeric("221", "+")
+	case "WHO":
+		target := arg(0)
+		if target == "" {
+			target = "*"
+		}
+		return "", ic.numeric("315", target, ":End of /WHO list.")
+	}
+	return strings.TrimSpace("/" + strings.ToLower(command) + " " + strings.Join(params, " ")), ""
+}
+
+// register asks for the nickname the client registers with once it has sent
+// both NICK and USER. The server's answer completes the registration: see
+// renamed and errorLine.
+func (ic *ircConn) register() string {
+	if ic.wantNick == "" || !ic.gotUser {
+		return ""
+	}
+	return "/name " + ic.wantNick
+}
+
+// fromCTCP turns a CTCP ACTION, sent for /me, into "* text". ok is false for
+// any other CTCP request, which has no chat equivalent.
+func fromCTCP(text string) (string, bool) {
+	if !strings.HasPrefix(text, "\x01") {
+		return text, true
+	}
+	action, ok := strings.CutPrefix(strings.Trim(text, "\x01"), "ACTION ")
+	if !ok {
+		return "", false
+	}
+	return "* " + action, true
+}
+
+// renamed renders the server accepting nick, which was oldName. The first
+// nickname accepted completes the registration, so the client gets the
+// welcome, the MOTD and the room it was put in meanwhile, with its members.
+func (ic *ircConn) renamed(oldName, nick, motd, room string, names []string) string {
+	ic.mu.Lock()
+	defer ic.mu.Unlock()
+	if ic.registered {
+		ic.nick = nick
+		return ircLine(":"+ircSource(oldName), "NICK", ":"+nick)
+	}
+	ic.registered, ic.nick = true, nick
+	out := ic.numeric("001", ":Welcome to the chat server, "+nick) +
+		ic.numeric("002", ":Your host is "+ircServerName) +
+		ic.numeric("004", ircServerName, "chat", "o", "o")
+	if motd = strings.TrimRight(motd, "\n"); motd == "" {
+		out += ic.numeric("422", ":MOTD File is missing")
+	} else {
+		out += ic.numeric("375", ":- "+ircServerName+" Message of the day -")
+		for _, line := range strings.Split(motd, "\n") {
+			out += ic.numeric("372", ":- "+line)
+		}
+		out += ic.numeric("376", ":End of /MOTD command.")
+	}
+	if ic.channel = room; room != "" {
+		out += ic.joinLines(names)
+	}
+	return out
+}
+
+// joined renders the client joining room, whose members are names. Joining
+// a room leaves the previous one, so that channel is parted first.
+func (ic *ircConn) joined(room string, names []string) string {
+	ic.mu.Lock()
+	defer ic.mu.Unlock()
+	var out string
+	if ic.registered && ic.channel != "" && ic.channel != room {
+		out = ircLine(":"+ircSource(ic.nick), "PART", "#"+ic.channel)
+	}
+	ic.channel = room
+	if !ic.registered {
+		return out
+	}
+	return out + ic.joinLines(names)
+}
+
+// joinLines renders the client joining its channel: the JOIN and the
+// channel's members as a NAMES reply.
+func (ic *ircConn) joinLines(names []string) string {
+	channel := "#" + ic.channel
+	out := ircLine(":"+ircSource(ic.nick), "JOIN", channel)
+	for len(names) > 0 {
+		n, length := 0, 0
+		for n < len(names) && (n == 0 || length+len(names[n]) < ircNamesLength) {
+			length += len(names[n]) + 1
+			n++
+		}
+		out += ic.numeric("353", "=", channel, ":"+strings.Join(names[:n], " "))
+		names = names[n:]
+	}
+	return out + ic.numeric("366", channel, ":End of /NAMES list.")
+}
+
+// parted renders the client being taken out of room.
+func (ic *ircConn) parted(room, reason string) string {
+	ic.mu.Lock()
+	defer ic.mu.Unlock()
+	if ic.channel != room {
+		return ""
+	}
+	ic.channel = ""
+	if !ic.registered {
+		return ""
+	}
+	return ircLine(":"+ircSource(ic.nick), "PART", "#"+room, ":"+reason)
+}
+
+// chat renders a chat message in the client's room.
+func (ic *ircConn) chat(m Message) string {
+	ic.mu.Lock()
+	defer ic.mu.Unlock()
+	if !ic.registered || ic.channel == "" {
+		return ""
+	}
+	return ircLine(":"+ircSource(m.Nick), "PRIVMSG", "#"+ic.channel, ":"+m.Text)
+}
+
+// dm renders a direct message from nick.
+func (ic *ircConn) dm(nick, msg string) string {
+	ic.mu.Lock()
+	defer ic.mu.Unlock()
+	return ircLine(":"+ircSource(nick), "PRIVMSG", ic.me(), ":"+msg)
+}
+
+// event renders a notice that nick did event in the client's room; see
+// Client.deliverEvent.
+func (ic *ircConn) event(event, nick, msg string) string {
+	ic.mu.Lock()
+	defer ic.mu.Unlock()
+	if !ic.registered || ic.channel == "" {
+		return ""
+	}
+	switch event {
+	case "join":
+		return ircLine(":"+ircSource(nick), "JOIN", "#"+ic.channel)
+	case "leave":
+		return ircLine(":"+ircSource(nick), "PART", "#"+ic.channel, ":"+msg)
+	case "nick":
+		// nick is the new nickname; NickName's notice carries the old one
+		if oldName, ok := strings.CutSuffix(msg, " is now known as "+nick); ok {
+			return ircLine(":"+ircSource(oldName), "NICK", ":"+nick)
+		}
+	}
+	return ic.notices(msg)
+}
+
+// notice renders a server notice to the client.
+func (ic *ircConn) notice(msg string) string {
+	ic.mu.Lock()
+	defer ic.mu.Unlock()
+	return ic.notices(msg)
+}
+
+// errorLine renders err. A nickname that is taken, or registered to an
+// account, gets ERR_NICKNAMEINUSE, which is how IRC clients know to try
+// another; everything else is a notice.
+func (ic *ircConn) errorLine(err error, prefix string) string {
+	ic.mu.Lock()
+	defer ic.mu.Unlock()
+	code := errorCode(err)
+	if code == ErrNickTaken || (code == ErrPermissionDenied && !ic.registered) {
+		return ic.numeric("433", ic.wantNick, ":"+err.Error())
+	}
+	return ic.notices(prefix + err.Error())
+}
+
+// notices renders msg as one NOTICE per line.
+func (ic *ircConn) notices(msg string) string {
+	var out string
+	for _, line := range strings.Split(msg, "\n") {
+		out += ircLine(":"+ircServerName, "NOTICE", ic.me(), ":"+line)
+	}
+	return out
+}
+
+// numeric renders a numeric reply, which IRC addresses to the client's
+// nickname, or "*" before it has one.
+func (ic *ircConn) numeric(code string, params ...string) string {
+	return ircLine(append([]string{":" + ircServerName, code, ic.me()}, params...)...)
+}
+
+func (ic *ircConn) me() string {
+	if ic.nick == "" {
+		return "*"
+	}
+	return ic.nick
+}
+
+// ircSource is the source prefix of lines about nick.
+func ircSource(nick string) string {
+	return nick + "!" + nick + "@" + ircServerName
+}
+
+func ircLine(parts ...string) string {
+	return strings.Join(parts, " ") + "\r\n"
+}
+
+// parseIRC splits an IRC line into its command, upper-cased, and its
+// parameters, dropping any tags and source. The last parameter may contain
+// spaces when it follows a ':'.
+func parseIRC(line string) (string, []string) {
+	line = strings.TrimLeft(line, " ")
+	if strings.HasPrefix(line, "@") {
+		_, line, _ = strings.Cut(line, " ")
+		line = strings.TrimLeft(line, " ")
+	}
+	if strings.HasPrefix(line, ":") {
+		_, line, _ = strings.Cut(line, " ")
+	}
+	var fields []string
+	for line = strings.TrimLeft(line, " "); line != ""; line = strings.TrimLeft(line, " ") {
+		if len(fields) > 0 && line[0] == ':' {
+			fields = append(fields, line[1:])
+			break
+		}
+		var field string
+		field, line, _ = strings.Cut(line, " ")
+		fields = append(fields, field)
+	}
+	if len(fields) == 0 {
+		return "", nil
+	}
+	return strings.ToUpper(fields[0]), fields[1:]
+}
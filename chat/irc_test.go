@@ -0,0 +1,179 @@
+package chat
+
+import (
+	"context"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// newIRCListener serves IRC clients for s on a PipeListener of their own.
+func newIRCListener(t *testing.T, s *Server) *PipeListener {
+	t.Helper()
+	l := NewPipeListener()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		s.Serve(context.Background(), IRCListener(l))
+	}()
+	t.Cleanup(func() {
+		s.Close()
+		<-done
+	})
+	return l
+}
+
+// dialIRC connects an IRC client and registers it as nick.
+func dialIRC(t *testing.T, l *PipeListener, nick string) *testClient {
+	t.Helper()
+	c := connect(t, l, nextAddr())
+	c.send("NICK " + nick)
+	c.send("USER " + nick + " 0 * :" + nick)
+	c.expect(" 001 " + nick + " ")
+	return c
+}
+
+func TestIRCRegistration(t *testing.T) {
+	s, _ := newTestServer(t, nil)
+	irc := connect(t, newIRCListener(t, s), nextAddr())
+
+	irc.send("CAP LS 302")
+	irc.expect(":chat CAP * LS :")
+	irc.send("JOIN #lobby")
+	irc.expect(":chat 451 * :You have not registered")
+	irc.send("NICK alice")
+	irc.send("USER alice 0 * :Alice")
+	_, before := irc.expect(":chat 001 alice :Welcome")
+	if hasLine(before, "welcome") {
+		t.Errorf("the MOTD came before the welcome: %q", before)
+	}
+	irc.expect(":chat 372 alice :- welcome")
+	irc.expect(":chat 376 alice")
+	irc.send("PING :lag-1")
+	irc.expect(":chat PONG chat :lag-1")
+}
+
+func TestIRCNicknameInUse(t *testing.T) {
+	s, l := newTestServer(t, nil)
+	bob := dial(t, l)
+	bob.do("/name alice")
+	irc := connect(t, newIRCListener(t, s), nextAddr())
+
+	irc.send("NICK alice")
+	irc.send("USER alice 0 * :Alice")
+	irc.expect(":chat 433 * alice :nickname alice is already in use")
+	irc.send("NICK alice_")
+	irc.expect(":chat 001 alice_ ")
+	irc.send("NICK alice")
+	irc.expect(":chat 433 alice_ alice ")
+}
+
+func TestIRCChannel(t *testing.T) {
+	s, l := newTestServer(t, nil)
+	bob := dial(t, l)
+	bob.join("bob", "lobby")
+	alice := dialIRC(t, newIRCListener(t, s), "alice")
+
+	alice.send("JOIN #lobby")
+	alice.expect(":alice!alice@chat JOIN #lobby")
+	alice.expect(":chat 353 alice = #lobby :alice bob")
+	alice.expect(":chat 366 alice #lobby :End of /NAMES list.")
+	bob.expect("alice has joined the room")
+
+	bob.send("/msg hi alice")
+	alice.expect(":bob!bob@chat PRIVMSG #lobby :hi alice")
+	alice.send("PRIVMSG #lobby :hello bob")
+	bob.expect("alice : hello bob")
+	alice.send("PRIVMSG #lobby :\x01ACTION waves\x01")
+	bob.expect("alice : * waves")
+	alice.send("PRIVMSG #elsewhere :hello?")
+	alice.expect(":chat 404 alice #elsewhere :Cannot send to channel")
+
+	bob.send("/name robert")
+	alice.expect(":bob!bob@chat NICK :robert")
+	alice.send("NICK alicia")
+	alice.expect(":alice!alice@chat NICK :alicia")
+	bob.expect("alice is now known as alicia")
+
+	// commands IRC lacks go through as chat commands
+	alice.send("UPTIME")
+	alice.expect(":chat NOTICE alicia :up ")
+
+	alice.send("PART #lobby")
+	alice.expect(":alicia!alicia@chat PART #lobby :alicia has left the room")
+	bob.expect("alicia has left the room")
+	alice.send("QUIT :bye")
+	alice.expectClosed()
+}
+
+func TestIRCSwitchingChannels(t *testing.T) {
+	s, _ := newTestServer(t, nil)
+	alice := dialIRC(t, newIRCListener(t, s), "alice")
+
+	alice.send("JOIN #lobby")
+	alice.expect(":alice!alice@chat JOIN #lobby")
+	alice.send("JOIN #games,#lobby")
+	alice.expect(":alice!alice@chat PART #lobby")
+	alice.expect(":alice!alice@chat JOIN #games")
+	alice.send("PART #lobby")
+	alice.expect(":chat 442 alice #lobby :You're not on that channel")
+}
+
+func TestIRCDirectMessage(t *testing.T) {
+	s, l := newTestServer(t, func(s *Server) { s.Accounts = newTestAccounts(t) })
+	bob := dial(t, l)
+	bob.send("/register bob hunter22")
+	bob.expect("registered bob")
+	alice := dialIRC(t, newIRCListener(t, s), "alice")
+
+	bob.send("/dm alice psst")
+	alice.expect(":bob!bob@chat PRIVMSG alice :psst")
+}
+
+func TestIRCDefaultRoom(t *testing.T) {
+	s, l := newTestServer(t, func(s *Server) { s.DefaultRoom = "lobby" })
+	bob := dial(t, l)
+	bob.do("/name bob")
+	bob.sync()
+	bob.send("/msg earlier")
+	bob.sync()
+	irc := connect(t, newIRCListener(t, s), nextAddr())
+
+	irc.send("NICK alice")
+	irc.send("USER alice 0 * :Alice")
+	_, before := irc.expect(":chat 001 alice ")
+	if hasLine(before, "PRIVMSG") || hasLine(before, "JOIN") {
+		t.Errorf("got room lines before the welcome: %q", before)
+	}
+	irc.expect(":alice!alice@chat JOIN #lobby")
+	irc.expect(":chat 353 alice = #lobby :alice bob")
+}
+
+func TestIRCServerPing(t *testing.T) {
+	s, _ := newTestServer(t, func(s *Server) { s.HeartbeatInterval = 20 * time.Millisecond })
+	alice := dialIRC(t, newIRCListener(t, s), "alice")
+
+	alice.expect("PING :chat")
+	alice.send("PONG :chat")
+}
+
+func TestParseIRC(t *testing.T) {
+	tests := []struct {
+		line    string
+		command string
+		params  []string
+	}{
+		{"", "", nil},
+		{"privmsg #lobby :hello there", "PRIVMSG", []string{"#lobby", "hello there"}},
+		{"@time=now :alice!a@host JOIN #lobby key", "JOIN", []string{"#lobby", "key"}},
+		{"NICK  alice", "NICK", []string{"alice"}},
+		{"USER alice 0 * :", "USER", []string{"alice", "0", "*", ""}},
+		{"QUIT", "QUIT", []string{}},
+	}
+	for _, tt := range tests {
+		command, params := parseIRC(tt.line)
+		if command != tt.command || !reflect.DeepEqual(params, tt.params) {
+			t.Errorf("parseIRC(%q) = %q %q, want %q %q", tt.line, command, params, tt.command, tt.params)
+		}
+	}
+}
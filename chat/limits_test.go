@@ -0,0 +1,137 @@
+package chat
+
+import (
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRoomMemberLimit(t *testing.T) {
+	s, l := newTestServer(t, nil)
+	if _, err := s.CreateRoom("small", 2); err != nil {
+		t.Fatal(err)
+	}
+
+	a, b, c := dial(t, l), dial(t, l), dial(t, l)
+	a.join("a", "small")
+	b.join("b", "small")
+	if out := c.do("/join small"); !hasLine(out, `room "small" is full`) {
+		t.Fatalf("third join got %q, want the room full error", out)
+	}
+
+	// a leaving frees its seat
+	a.send("/quit")
+	a.expectClosed()
+	if out := c.do("/join small"); hasLine(out, "Error") {
+		t.Fatalf("join after a seat freed up got %q", out)
+	}
+	if got := s.Snapshot().Rooms[0].Members; len(got) != 2 {
+		t.Errorf("members = %q, want two", got)
+	}
+}
+
+func TestRoomLimit(t *testing.T) {
+	_, l := newTestServer(t, func(s *Server) { s.MaxRooms = 1 })
+
+	a, b := dial(t, l), dial(t, l)
+	a.join("a", "one")
+	if out := b.do("/join two"); !hasLine(out, "room limit reached") {
+		t.Fatalf("second room got %q, want the room limit error", out)
+	}
+	if out := b.do("/join one"); hasLine(out, "Error") {
+		t.Fatalf("joining the existing room got %q", out)
+	}
+}
+
+func TestConnectionLimit(t *testing.T) {
+	s, l := newTestServer(t, func(s *Server) { s.MaxConnections = 2 })
+
+	a := dial(t, l)
+	dial(t, l)
+	if out := connect(t, l, nextAddr()).expectClosed(); !hasLine(out, "server at capacity") {
+		t.Fatalf("third connection got %q", out)
+	}
+
+	a.send("/quit")
+	a.expectClosed()
+	waitFor(t, func() bool { return s.ConnectionCount() == 1 })
+	dial(t, l)
+}
+
+func TestPerIPLimit(t *testing.T) {
+	s, l := newTestServer(t, func(s *Server) { s.MaxConnectionsPerIP = 2 })
+	addr := &net.TCPAddr{IP: net.ParseIP("192.0.2.7"), Port: 1}
+
+	a := dialAs(t, l, addr)
+	dialAs(t, l, addr)
+	if out := connect(t, l, addr).expectClosed(); !hasLine(out, "too many connections from your address") {
+		t.Fatalf("third connection got %q", out)
+	}
+	// other addresses are unaffected
+	dial(t, l)
+
+	a.send("/quit")
+	a.expectClosed()
+	waitFor(t, func() bool { return s.ConnectionCount() == 2 })
+	dialAs(t, l, addr)
+}
+
+func TestMaxLineLength(t *testing.T) {
+	_, l := newTestServer(t, func(s *Server) { s.MaxLineLength = 16 })
+
+	c := dial(t, l)
+	if out := c.do("/msg " + strings.Repeat("x", 32)); !hasLine(out, "line too long") {
+		t.Fatalf("long line got %q", out)
+	}
+	// the stream stays in step after the long line
+	if out := c.do("/name carol"); hasLine(out, "Error") {
+		t.Fatalf("/name after a long line got %q", out)
+	}
+}
+
+func TestReadTimeout(t *testing.T) {
+	s, l := newTestServer(t, func(s *Server) { s.ReadTimeout = 300 * time.Millisecond })
+
+	alice, bob := dial(t, l), dial(t, l)
+	alice.join("alice", "lobby")
+	bob.join("bob", "lobby")
+
+	// alice keeps talking past the timeout while bob says nothing
+	var seen []string
+	deadline := time.Now().Add(3 * s.ReadTimeout)
+	for time.Now().Before(deadline) {
+		seen = append(seen, alice.sync()...)
+		time.Sleep(s.ReadTimeout / 4)
+	}
+	if out := bob.expectClosed(); !hasLine(out, "disconnected after 0s of inactivity") {
+		t.Errorf("bob got %q before the timeout", out)
+	}
+	if !hasLine(seen, "bob has left") {
+		t.Errorf("alice never saw bob leave: %q", seen)
+	}
+	waitFor(t, func() bool { return s.ConnectionCount() == 1 })
+}
+
+func TestIdleWarning(t *testing.T) {
+	_, l := newTestServer(t, func(s *Server) {
+		s.ReadTimeout = 1200 * time.Millisecond
+		s.IdleWarning = time.Second
+	})
+
+	alice, bob := dial(t, l), dial(t, l)
+	// alice keeps talking, so her warning keeps being put off
+	var seen []string
+	for i := 0; i < 5; i++ {
+		seen = append(seen, alice.sync()...)
+		time.Sleep(100 * time.Millisecond)
+	}
+	if hasLine(seen, "you will be disconnected") {
+		t.Errorf("alice was warned while active: %q", seen)
+	}
+
+	bob.expect("you will be disconnected in 1s unless you send something")
+	if out := bob.expectClosed(); !hasLine(out, "disconnected after 1s of inactivity") {
+		t.Errorf("bob got %q after the warning", out)
+	}
+}
@@ -0,0 +1,30 @@
+package chat
+
+import (
+	"os"
+
+	"github.com/sirupsen/logrus"
+)
+
+var log = logrus.New()
+
+func init() {
+	log.SetFormatter(&logrus.TextFormatter{})
+	log.SetOutput(os.Stdout)
+	log.SetLevel(logrus.InfoLevel)
+}
+
+// SetLogger replaces the logger used by the chat package: by servers without
+// a logger of their own from WithLogger, and by the AuditLogger, Webhooks and
+// history stores. Call it before starting any server.
+func SetLogger(l *logrus.Logger) {
+	log = l
+}
+
+// Logger returns the logger the server logs through.
+func (s *Server) Logger() *logrus.Logger {
+	if s.logger != nil {
+		return s.logger
+	}
+	return log
+}
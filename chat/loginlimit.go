@@ -0,0 +1,76 @@
+package chat
+
+import (
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// After a failed /login, the address it came from must wait
+// LoginBackoffBase before trying again, doubling with every further failure
+// up to LoginBackoffMax. A successful login clears the backoff.
+const (
+	LoginBackoffBase = time.Second
+	LoginBackoffMax  = time.Minute
+)
+
+// maxLoginBackoffs bounds how many addresses the server remembers failed
+// logins for; expired entries are dropped once there are more.
+const maxLoginBackoffs = 4096
+
+// loginBackoff is what the server remembers about failed logins from one
+// address. It is only touched on the Run goroutine.
+type loginBackoff struct {
+	failures int
+	until    time.Time
+}
+
+// checkLoginBackoff refuses a login from c's address while it is backing off.
+func (s *Server) checkLoginBackoff(c *Client) error {
+	b, ok := s.loginBackoffs[remoteIP(c.Conn)]
+	if !ok {
+		return nil
+	}
+	if now := s.Now(); now.Before(b.until) {
+		return errorf(ErrRateLimited, "too many failed logins, try again in %s", formatDuration(b.until.Sub(now)))
+	}
+	return nil
+}
+
+// loginFailed makes c's address back off before its next login.
+func (s *Server) loginFailed(c *Client) {
+	now := s.Now()
+	ip := remoteIP(c.Conn)
+	b, ok := s.loginBackoffs[ip]
+	if !ok {
+		if len(s.loginBackoffs) >= maxLoginBackoffs {
+			s.pruneLoginBackoffs(now)
+		}
+		b = &loginBackoff{}
+		s.loginBackoffs[ip] = b
+	}
+	b.failures++
+	wait := LoginBackoffMax
+	if b.failures < 8 {
+		wait = min(LoginBackoffBase<<(b.failures-1), LoginBackoffMax)
+	}
+	b.until = now.Add(wait)
+	s.Logger().WithFields(logrus.Fields{
+		"remote_addr": c.Conn.RemoteAddr().String(),
+		"failures":    b.failures,
+	}).Warn("failed login")
+}
+
+// loginSucceeded clears the backoff of c's address.
+func (s *Server) loginSucceeded(c *Client) {
+	delete(s.loginBackoffs, remoteIP(c.Conn))
+}
+
+// pruneLoginBackoffs forgets addresses that have not failed for a while.
+func (s *Server) pruneLoginBackoffs(now time.Time) {
+	for ip, b := range s.loginBackoffs {
+		if now.Sub(b.until) > LoginBackoffMax {
+			delete(s.loginBackoffs, ip)
+		}
+	}
+}
@@ -0,0 +1,135 @@
+package chat
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// Kinds of room history entries.
+const (
+	KindChat     = "chat"
+	KindReaction = "reaction"
+	// KindNotice is any stored line that is neither chat nor a reaction.
+	KindNotice = "notice"
+)
+
+// Message is one entry of room history. Chat messages have an ID and, when
+// they reply to another message, a ParentID. A reaction's ParentID is the
+// message reacted to and its Text the emoji.
+type Message struct {
+	ID       uint64 `json:"id,omitempty"`
+	ParentID uint64 `json:"parentId,omitempty"`
+	Kind     string `json:"kind"`
+	Nick     string `json:"nick,omitempty"`
+	Text     string `json:"text"`
+	// Sent is when the message was posted. It is not part of String, so it
+	// is zero for messages restored from persistent history.
+	Sent time.Time `json:"sent"`
+}
+
+// String renders the message as clients see it, which is also how persistent
+// stores keep it:
+//
+//	[12] nick : text           chat
+//	[13 re 12] nick : text     reply to 12
+//	nick reacted emoji to [12] reaction
+//
+// Chat lines written before messages had IDs are just "nick : text".
+func (m Message) String() string {
+	switch m.Kind {
+	case KindReaction:
+		return fmt.Sprintf("%s reacted %s to [%d]", m.Nick, m.Text, m.ParentID)
+	case KindNotice:
+		return m.Text
+	}
+	switch {
+	case m.ID == 0:
+		return formatChat(m.Nick, m.Text)
+	case m.ParentID != 0:
+		return fmt.Sprintf("[%d re %d] %s", m.ID, m.ParentID, formatChat(m.Nick, m.Text))
+	default:
+		return fmt.Sprintf("[%d] %s", m.ID, formatChat(m.Nick, m.Text))
+	}
+}
+
+func formatChat(nick, text string) string {
+	return nick + " : " + text
+}
+
+// ParseMessage reads a line written by Message.String back. Lines it does not
+// recognise come back as notices.
+func ParseMessage(line string) Message {
+	if m, ok := parseChat(line); ok {
+		return m
+	}
+	if m, ok := parseReaction(line); ok {
+		return m
+	}
+	return Message{Kind: KindNotice, Text: line}
+}
+
+func parseChat(line string) (Message, bool) {
+	m := Message{Kind: KindChat}
+	if rest, ok := strings.CutPrefix(line, "["); ok {
+		if ids, after, ok := strings.Cut(rest, "] "); ok {
+			idText, parentText, isReply := strings.Cut(ids, " re ")
+			id, err := strconv.ParseUint(idText, 10, 64)
+			if err == nil && isReply {
+				m.ParentID, err = strconv.ParseUint(parentText, 10, 64)
+			}
+			if err == nil {
+				m.ID, line = id, after
+			}
+		}
+	}
+	nick, text, ok := strings.Cut(line, " : ")
+	if !ok {
+		return Message{}, false
+	}
+	m.Nick, m.Text = nick, text
+	return m, true
+}
+
+func parseReaction(line string) (Message, bool) {
+	rest, idText, ok := strings.Cut(line, " to [")
+	if !ok || !strings.HasSuffix(idText, "]") {
+		return Message{}, false
+	}
+	id, err := strconv.ParseUint(strings.TrimSuffix(idText, "]"), 10, 64)
+	if err != nil {
+		return Message{}, false
+	}
+	nick, emoji, ok := strings.Cut(rest, " reacted ")
+	if !ok {
+		return Message{}, false
+	}
+	return Message{Kind: KindReaction, ParentID: id, Nick: nick, Text: emoji}, true
+}
+
+// parseMentions returns the nicknames written as @nick in text, each once, in
+// the order they first appear. A mention ends at the first character that
+// cannot be part of a nickname, so "@bob," mentions bob.
+func parseMentions(text string) []string {
+	var nicks []string
+	seen := make(map[string]bool)
+	for _, word := range strings.Fields(text) {
+		_, rest, ok := strings.Cut(word, "@")
+		if !ok {
+			continue
+		}
+		end := strings.IndexFunc(rest, func(r rune) bool {
+			return !unicode.IsLetter(r) && !unicode.IsDigit(r) && r != '_' && r != '-'
+		})
+		if end >= 0 {
+			rest = rest[:end]
+		}
+		if rest != "" && !seen[strings.ToLower(rest)] {
+			seen[strings.ToLower(rest)] = true
+			nicks = append(nicks, rest)
+		}
+	}
+	return nicks
+}
@@ -0,0 +1,113 @@
+package chat
+
+import (
+	"errors"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	connectionsGauge = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "tcp_chat_connections",
+		Help: "Number of active connections",
+	})
+	commandsCounter = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "tcp_chat_commands_total",
+			Help: "Total number of commands received",
+		},
+		[]string{"command"},
+	)
+	writeErrorsCounter = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "tcp_chat_write_errors_total",
+			Help: "Total number of failed writes to clients",
+		},
+		[]string{"reason"},
+	)
+	droppedMessagesCounter = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "tcp_chat_dropped_messages_total",
+		Help: "Total number of messages that could not be delivered to a client",
+	})
+	disconnectsCounter = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "tcp_chat_disconnects_total",
+			Help: "Total number of client disconnects by reason",
+		},
+		[]string{"reason"},
+	)
+	droppedEventsCounter = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "tcp_chat_dropped_events_total",
+		Help: "Total number of events not streamed to a subscriber that fell behind",
+	})
+	mentionsCounter = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "tcp_chat_mentions_total",
+		Help: "Total number of @mention notifications sent to clients",
+	})
+	autoMutesCounter = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "tcp_chat_auto_mutes_total",
+			Help: "Total number of clients muted automatically for flooding by reason",
+		},
+		[]string{"reason"},
+	)
+	slowConsumersCounter = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "tcp_chat_slow_consumers_total",
+		Help: "Total number of clients disconnected for letting their outbound queue stay full",
+	})
+	rejectedConnectionsCounter = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "tcp_chat_rejected_connections_total",
+			Help: "Total number of connections refused at connect time by reason",
+		},
+		[]string{"reason"},
+	)
+	webhookFailuresCounter = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "tcp_chat_webhook_failures_total",
+			Help: "Total number of webhook deliveries dropped by reason",
+		},
+		[]string{"reason"},
+	)
+	auditDroppedCounter = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "tcp_chat_audit_dropped_total",
+		Help: "Total number of audit entries dropped because the audit queue was full",
+	})
+	commandDuration = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name:    "tcp_chat_command_duration_seconds",
+			Help:    "Time spent processing a command, from dequeue to handler completion",
+			Buckets: []float64{.0001, .00025, .0005, .001, .0025, .005, .01, .025, .05, .1, .25, .5, 1},
+		},
+		[]string{"command"},
+	)
+)
+
+// registerMetrics registers the package's collectors with reg. They are
+// package-wide, so registering them again with the same registry, as a
+// second server would, is not an error.
+func registerMetrics(reg prometheus.Registerer) error {
+	for _, c := range []prometheus.Collector{
+		connectionsGauge,
+		commandsCounter,
+		writeErrorsCounter,
+		droppedMessagesCounter,
+		commandDuration,
+		disconnectsCounter,
+		rejectedConnectionsCounter,
+		droppedEventsCounter,
+		mentionsCounter,
+		autoMutesCounter,
+		slowConsumersCounter,
+		webhookFailuresCounter,
+		auditDroppedCounter,
+	} {
+		if err := reg.Register(c); err != nil {
+			var already prometheus.AlreadyRegisteredError
+			if !errors.As(err, &already) {
+				return err
+			}
+		}
+	}
+	return nil
+}
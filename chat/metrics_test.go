@@ -0,0 +1,77 @@
+package chat
+
+import (
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// The collectors are package-wide and the tests do not run in parallel, so
+// each test compares the values before and after what it does.
+
+func TestCommandMetrics(t *testing.T) {
+	_, l := newTestServer(t, nil)
+	joins := testutil.ToFloat64(commandsCounter.WithLabelValues(CMD_JOIN.String()))
+
+	c := dial(t, l)
+	c.join("alice", "lobby")
+	if got := testutil.ToFloat64(commandsCounter.WithLabelValues(CMD_JOIN.String())) - joins; got != 1 {
+		t.Errorf("/join counted %v times, want 1", got)
+	}
+	if testutil.CollectAndCount(commandDuration) == 0 {
+		t.Error("no command durations observed")
+	}
+}
+
+func TestConnectionMetrics(t *testing.T) {
+	s, l := newTestServer(t, func(s *Server) { s.MaxConnections = 1 })
+	open := testutil.ToFloat64(connectionsGauge)
+	rejected := testutil.ToFloat64(rejectedConnectionsCounter.WithLabelValues(RejectServerFull))
+	quits := testutil.ToFloat64(disconnectsCounter.WithLabelValues(ReasonQuit))
+
+	c := dial(t, l)
+	c.sync()
+	if got := testutil.ToFloat64(connectionsGauge) - open; got != 1 {
+		t.Errorf("connections gauge rose by %v, want 1", got)
+	}
+	connect(t, l, nextAddr()).expectClosed()
+	if got := testutil.ToFloat64(rejectedConnectionsCounter.WithLabelValues(RejectServerFull)) - rejected; got != 1 {
+		t.Errorf("%s rejections rose by %v, want 1", RejectServerFull, got)
+	}
+
+	c.send("/quit")
+	c.expectClosed()
+	waitFor(t, func() bool { return s.ConnectionCount() == 0 })
+	waitFor(t, func() bool { return testutil.ToFloat64(connectionsGauge) == open })
+	if got := testutil.ToFloat64(disconnectsCounter.WithLabelValues(ReasonQuit)) - quits; got != 1 {
+		t.Errorf("%s disconnects rose by %v, want 1", ReasonQuit, got)
+	}
+}
+
+func TestMentionMetric(t *testing.T) {
+	_, l := newTestServer(t, nil)
+	mentions := testutil.ToFloat64(mentionsCounter)
+
+	alice, bob := dial(t, l), dial(t, l)
+	alice.join("alice", "lobby")
+	bob.join("bob", "lobby")
+	alice.send("/msg hi @bob")
+	bob.expect("alice mentioned you in lobby")
+	// the ack follows the mention's count
+	alice.expect("OK ")
+	if got := testutil.ToFloat64(mentionsCounter) - mentions; got != 1 {
+		t.Errorf("mentions rose by %v, want 1", got)
+	}
+}
+
+func TestRegisterMetricsTwice(t *testing.T) {
+	reg := prometheus.NewRegistry()
+	if err := registerMetrics(reg); err != nil {
+		t.Fatal(err)
+	}
+	if err := registerMetrics(reg); err != nil {
+		t.Errorf("registering again: %v", err)
+	}
+	NewServer(WithMetrics(reg))
+}
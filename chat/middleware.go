@@ -0,0 +1,119 @@
+package chat
+
+import (
+	"time"
+)
+
+// Middleware wraps the handling of every command clients type, so features
+// such as logging, filtering, rate limiting and metrics can be layered on
+// without touching the handlers. It can act before and after calling next,
+// pass next a changed command, or refuse the command by not calling next.
+//
+// Middleware runs wherever the command does: on the Run goroutine, a worker
+// or a room worker. It sees commands after the admin and account checks, and
+// never sees internal commands such as disconnects.
+type Middleware func(next CommandHandler) CommandHandler
+
+// CommandResult is what a CommandHook's After learns about a command.
+type CommandResult struct {
+	// Err is the first error the client was sent while the command ran,
+	// including one returned by Before; nil when it succeeded.
+	Err      error
+	Duration time.Duration
+}
+
+// CommandHook builds a Middleware from a pre- and a post-hook, either of
+// which may be nil. Before runs ahead of the command and refuses it by
+// returning an error, which is sent to the client. After runs once the
+// command is done, refused or not.
+type CommandHook struct {
+	Before func(s *Server, cmd Command) error
+	After  func(s *Server, cmd Command, result CommandResult)
+}
+
+func (h CommandHook) Middleware() Middleware {
+	return func(next CommandHandler) CommandHandler {
+		return func(s *Server, cmd Command) {
+			start := time.Now()
+			rec := cmd.Client.recordErrors()
+			if h.Before == nil {
+				next(s, cmd)
+			} else if err := h.Before(s, cmd); err != nil {
+				cmd.Client.Error(err)
+			} else {
+				next(s, cmd)
+			}
+			result := CommandResult{Err: cmd.Client.stopRecording(rec), Duration: time.Since(start)}
+			if h.After != nil {
+				h.After(s, cmd, result)
+			}
+		}
+	}
+}
+
+// runCommand is the innermost handler: the one registered for the command.
+func runCommand(s *Server, cmd Command) {
+	if spec, ok := commands[cmd.ID]; ok {
+		spec.Handler(s, cmd)
+	}
+}
+
+// chain wraps runCommand in s.Middleware, the first outermost.
+func (s *Server) chain() CommandHandler {
+	h := CommandHandler(runCommand)
+	for i := len(s.Middleware) - 1; i >= 0; i-- {
+		h = s.Middleware[i](h)
+	}
+	return h
+}
+
+// handle runs cmd through the middleware. With middleware, a client's
+// commands are handled one at a time, even read-only ones on different
+// workers, so that the errors a CommandHook records belong to its command.
+func (s *Server) handle(cmd Command) {
+	if len(s.Middleware) == 0 {
+		runCommand(s, cmd)
+		return
+	}
+	cmd.Client.handleMu.Lock()
+	defer cmd.Client.handleMu.Unlock()
+	s.handler(s, cmd)
+}
+
+// errorRecord holds the first error sent to a client since recordErrors.
+type errorRecord struct {
+	err error
+}
+
+// recordErrors starts noting the errors sent to c, for CommandHook.
+func (c *Client) recordErrors() *errorRecord {
+	rec := &errorRecord{}
+	c.recMu.Lock()
+	c.recorders = append(c.recorders, rec)
+	c.recMu.Unlock()
+	return rec
+}
+
+// stopRecording ends rec and returns the first error it saw.
+func (c *Client) stopRecording(rec *errorRecord) error {
+	c.recMu.Lock()
+	defer c.recMu.Unlock()
+	for i, r := range c.recorders {
+		if r == rec {
+			c.recorders = append(c.recorders[:i], c.recorders[i+1:]...)
+			break
+		}
+	}
+	return rec.err
+}
+
+// noteError hands err to every record in progress that has none yet.
+func (c *Client) noteError(err error) {
+	c.recMu.Lock()
+	defer c.recMu.Unlock()
+	for _, r := range c.recorders {
+		if r.err == nil {
+			r.err = err
+		}
+	}
+}
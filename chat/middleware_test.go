@@ -0,0 +1,108 @@
+package chat
+
+import (
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestMiddlewareOrder(t *testing.T) {
+	var mu sync.Mutex
+	var calls []string
+	trace := func(name string) Middleware {
+		return func(next CommandHandler) CommandHandler {
+			return func(s *Server, cmd Command) {
+				if cmd.ID != CMD_NICKNAME {
+					next(s, cmd)
+					return
+				}
+				mu.Lock()
+				calls = append(calls, name+" before")
+				mu.Unlock()
+				next(s, cmd)
+				mu.Lock()
+				calls = append(calls, name+" after")
+				mu.Unlock()
+			}
+		}
+	}
+	_, l := newTestServer(t, nil, WithMiddleware(trace("outer")), WithMiddleware(trace("inner")))
+
+	c := dial(t, l)
+	c.do("/name alice")
+	mu.Lock()
+	defer mu.Unlock()
+	if got := strings.Join(calls, ", "); got != "outer before, inner before, inner after, outer after" {
+		t.Errorf("calls = %s", got)
+	}
+}
+
+func TestMiddlewareRewritesCommands(t *testing.T) {
+	shout := func(next CommandHandler) CommandHandler {
+		return func(s *Server, cmd Command) {
+			if cmd.ID == CMD_MSG {
+				cmd.Args = append([]string{cmd.Args[0]}, strings.ToUpper(strings.Join(cmd.Args[1:], " ")))
+			}
+			next(s, cmd)
+		}
+	}
+	_, l := newTestServer(t, nil, WithMiddleware(shout))
+
+	alice, bob := dial(t, l), dial(t, l)
+	alice.join("alice", "lobby")
+	bob.join("bob", "lobby")
+	alice.send("/msg quiet please")
+	bob.expect("alice : QUIET PLEASE")
+}
+
+func TestCommandHook(t *testing.T) {
+	var mu sync.Mutex
+	results := map[commandID][]CommandResult{}
+	hook := CommandHook{
+		Before: func(s *Server, cmd Command) error {
+			if cmd.ID == CMD_DM {
+				return errorf(ErrPermissionDenied, "direct messages are off")
+			}
+			return nil
+		},
+		After: func(s *Server, cmd Command, result CommandResult) {
+			mu.Lock()
+			results[cmd.ID] = append(results[cmd.ID], result)
+			mu.Unlock()
+		},
+	}
+	_, l := newTestServer(t, nil, WithMiddleware(hook.Middleware()), WithWorkers(2), WithRoomWorkers(2))
+
+	alice, bob := dial(t, l), dial(t, l)
+	alice.join("alice", "lobby")
+	bob.join("bob", "lobby")
+	if out := alice.do("/dm bob hi"); !hasLine(out, "direct messages are off") {
+		t.Errorf("refused /dm got %q", out)
+	}
+	alice.do("/join")
+	alice.do("/who")
+	alice.send("/msg hello")
+	alice.expect("OK")
+	// After runs once the reply is sent, and /who and /msg run off the Run
+	// goroutine, so their results may trail the replies
+	waitFor(t, func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		return len(results[CMD_WHO]) == 1 && len(results[CMD_MSG]) == 1
+	})
+
+	mu.Lock()
+	defer mu.Unlock()
+	if r := results[CMD_DM]; len(r) != 1 || errorCode(r[0].Err) != ErrPermissionDenied {
+		t.Errorf("/dm results = %v, want the refusal", r)
+	}
+	if r := results[CMD_JOIN]; len(r) != 3 || r[0].Err != nil || errorCode(r[2].Err) != ErrUsage {
+		t.Errorf("/join results = %v, want two joins and a usage error", r)
+	}
+	if r := results[CMD_WHO]; len(r) != 1 || r[0].Err != nil {
+		t.Errorf("/who results = %v", r)
+	}
+	if r := results[CMD_MSG]; len(r) != 1 || r[0].Err != nil || r[0].Duration <= 0 {
+		t.Errorf("/msg results = %v", r)
+	}
+}
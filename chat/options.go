@@ -0,0 +1,84 @@
+package chat
+
+import (
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/sirupsen/logrus"
+)
+
+type Option func(*Server)
+
+// WithCommandBuffer sets how many commands clients can queue before their
+// ReadInput blocks waiting for the server.
+func WithCommandBuffer(size int) Option {
+	return func(s *Server) {
+		s.Commands = make(chan Command, size)
+	}
+}
+
+// WithWorkers runs read-only commands on n extra goroutines instead of the
+// Run loop. Zero keeps every command on the Run goroutine.
+func WithWorkers(n int) Option {
+	return func(s *Server) {
+		s.Workers = n
+	}
+}
+
+// WithRoomWorkers runs room-scoped commands on n goroutines, each serving a
+// share of the rooms, instead of the Run loop. Zero keeps them on the Run
+// goroutine.
+func WithRoomWorkers(n int) Option {
+	return func(s *Server) {
+		s.RoomWorkers = n
+	}
+}
+
+// WithHistorySize sets how many messages each room keeps for replay.
+func WithHistorySize(n int) Option {
+	return func(s *Server) {
+		s.HistorySize = n
+	}
+}
+
+// WithLogger makes the server log through l instead of the package's logger.
+// Other servers are unaffected.
+func WithLogger(l *logrus.Logger) Option {
+	return func(s *Server) {
+		s.logger = l
+	}
+}
+
+// WithMetrics registers the package's Prometheus metrics with reg, usually
+// prometheus.DefaultRegisterer. Nothing is exported without it. Like
+// prometheus.MustRegister, it panics if a metric clashes with another.
+func WithMetrics(reg prometheus.Registerer) Option {
+	return func(s *Server) {
+		if err := registerMetrics(reg); err != nil {
+			panic(err)
+		}
+	}
+}
+
+// WithHistory keeps each room's history in the store built by newHistory
+// rather than the default CircularBuffer.
+func WithHistory(newHistory func(room string, size int) HistoryStore) Option {
+	return func(s *Server) {
+		s.NewHistory = newHistory
+	}
+}
+
+// WithMiddleware adds mw around every command clients type, after any
+// middleware already added.
+func WithMiddleware(mw ...Middleware) Option {
+	return func(s *Server) {
+		s.Middleware = append(s.Middleware, mw...)
+	}
+}
+
+// WithClock replaces time.Now, mainly so tests can control uptime.
+func WithClock(now func() time.Time) Option {
+	return func(s *Server) {
+		s.Now = now
+	}
+}
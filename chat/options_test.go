@@ -0,0 +1,44 @@
+package chat
+
+import (
+	"bytes"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+)
+
+// syncBuffer is a bytes.Buffer safe to write from the server's goroutines.
+type syncBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+func TestWithLogger(t *testing.T) {
+	var out syncBuffer
+	logger := logrus.New()
+	logger.SetOutput(&out)
+	s, l := newTestServer(t, nil, WithLogger(logger))
+	other := NewServer()
+
+	dial(t, l)
+	if !strings.Contains(out.String(), "new client has connected") {
+		t.Errorf("the server's logger got %q", out.String())
+	}
+	if s.Logger() != logger || other.Logger() == logger {
+		t.Error("WithLogger changed the logger of servers it was not given to")
+	}
+}
@@ -0,0 +1,108 @@
+package chat
+
+import (
+	"errors"
+	"net"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// By default each client can have DefaultOutboxSize lines waiting to be
+// written, a single write may take up to DefaultWriteTimeout, and a client
+// whose queue stays full for DefaultSlowConsumerTimeout is disconnected.
+const (
+	DefaultOutboxSize          = 256
+	DefaultWriteTimeout        = 10 * time.Second
+	DefaultSlowConsumerTimeout = 5 * time.Second
+)
+
+var errOutboxFull = errors.New("outbound queue full")
+
+// startWriter gives c an outbound queue of size lines and the goroutine that
+// drains it, so whoever sends to c, usually the Run goroutine fanning out to
+// a room, never waits on c's connection. Each write gets timeout to complete.
+func (c *Client) startWriter(size int, timeout time.Duration) {
+	c.out = make(chan []byte, size)
+	c.writerDone = make(chan struct{})
+	go c.writeLoop(timeout)
+}
+
+// write queues line for the writer goroutine. It fails without waiting when
+// the queue is full or the client is closed; clients created without a
+// writer are written to directly. A client whose queue has been full for
+// longer than the server's SlowConsumerTimeout is evicted.
+func (c *Client) write(line string) error {
+	if c.out == nil {
+		_, err := c.Conn.Write([]byte(line))
+		if err != nil {
+			c.writeFailure()
+		}
+		return err
+	}
+	c.outMu.Lock()
+	defer c.outMu.Unlock()
+	if c.outClosed {
+		return net.ErrClosed
+	}
+	select {
+	case c.out <- []byte(line):
+		c.outFullSince = time.Time{}
+		return nil
+	default:
+	}
+	now := c.server.Now()
+	if c.outFullSince.IsZero() {
+		c.outFullSince = now
+	} else if limit := c.server.SlowConsumerTimeout; limit > 0 && now.Sub(c.outFullSince) > limit {
+		c.evictSlowConsumer()
+	}
+	return errOutboxFull
+}
+
+// evictSlowConsumer cuts the connection of a client that stopped reading.
+// Unlike Close it does not wait for the queue to drain, since it never will;
+// ReadInput fails and the client leaves with the slow_consumer reason.
+func (c *Client) evictSlowConsumer() {
+	if !c.slowConsumer.CompareAndSwap(false, true) {
+		return
+	}
+	slowConsumersCounter.Inc()
+	c.server.Logger().WithFields(logrus.Fields{
+		"remote_addr": c.Conn.RemoteAddr().String(),
+		"queued":      len(c.out),
+	}).Warn("evicting slow consumer")
+	c.Conn.Close()
+}
+
+// writeLoop writes queued lines until Close closes the queue, then closes the
+// connection. After a failed write it keeps draining without writing, so
+// senders never block.
+func (c *Client) writeLoop(timeout time.Duration) {
+	defer close(c.writerDone)
+	defer c.Conn.Close()
+	failed := false
+	for line := range c.out {
+		if failed {
+			continue
+		}
+		if timeout > 0 {
+			c.Conn.SetWriteDeadline(time.Now().Add(timeout))
+		}
+		if _, err := c.Conn.Write(line); err != nil {
+			failed = true
+			c.writeFailure()
+		}
+	}
+}
+
+// closeOutbox stops accepting lines. The writer flushes what is queued and
+// then closes the connection.
+func (c *Client) closeOutbox() {
+	c.outMu.Lock()
+	defer c.outMu.Unlock()
+	if !c.outClosed {
+		c.outClosed = true
+		close(c.out)
+	}
+}
@@ -0,0 +1,134 @@
+package chat
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// newOutboxClient returns a client with an outbox of size lines writing to
+// one end of a pipe, and the other end, which nothing reads until the test
+// does.
+func newOutboxClient(t *testing.T, s *Server, size int, timeout time.Duration) (*Client, net.Conn) {
+	t.Helper()
+	conn, peer := net.Pipe()
+	c := &Client{Conn: conn, server: s}
+	c.startWriter(size, timeout)
+	t.Cleanup(func() {
+		peer.Close()
+		c.Close()
+		<-c.writerDone
+	})
+	return c, peer
+}
+
+func TestOutboxQueuesWithoutBlocking(t *testing.T) {
+	s := NewServer()
+	c, peer := newOutboxClient(t, s, 2, 0)
+
+	// the writer holds one line while it waits on the pipe, and the queue
+	// the rest until it is full
+	queued := 0
+	for ; queued < 10; queued++ {
+		if err := c.write("line\n"); err != nil {
+			if !errors.Is(err, errOutboxFull) {
+				t.Fatalf("write = %v, want errOutboxFull", err)
+			}
+			break
+		}
+	}
+	if queued < 2 || queued > 3 {
+		t.Fatalf("queued %d lines before the outbox was full, want 2 or 3", queued)
+	}
+
+	r := bufio.NewReader(peer)
+	for i := 0; i < queued; i++ {
+		if line, err := r.ReadString('\n'); err != nil || line != "line\n" {
+			t.Fatalf("read %q, %v; want the queued line", line, err)
+		}
+	}
+	if err := c.write("more\n"); err != nil {
+		t.Errorf("write after draining = %v", err)
+	}
+	if line, err := r.ReadString('\n'); err != nil || line != "more\n" {
+		t.Errorf("read %q, %v; want more", line, err)
+	}
+}
+
+func TestOutboxWriteTimeout(t *testing.T) {
+	s := NewServer()
+	c, _ := newOutboxClient(t, s, 4, 20*time.Millisecond)
+
+	if err := c.write("nobody reads this\n"); err != nil {
+		t.Fatalf("write = %v", err)
+	}
+	select {
+	case <-c.writerDone:
+	case <-time.After(testTimeout):
+		t.Fatal("the writer never gave up on a write nobody reads")
+	}
+	if !c.writeFailed.Load() {
+		t.Error("a timed out write was not counted as a failure")
+	}
+	if err := c.write("after\n"); !errors.Is(err, net.ErrClosed) {
+		t.Errorf("write after the failure = %v, want net.ErrClosed", err)
+	}
+}
+
+func TestSlowConsumerEviction(t *testing.T) {
+	clock := newFakeClock()
+	s := NewServer(WithClock(clock.Now))
+	s.SlowConsumerTimeout = 5 * time.Second
+	c, peer := newOutboxClient(t, s, 1, 0)
+	before := testutil.ToFloat64(slowConsumersCounter)
+
+	for c.write("line\n") == nil {
+	}
+	// the queue has been full for exactly the timeout: not yet
+	clock.Advance(s.SlowConsumerTimeout)
+	if err := c.write("line\n"); !errors.Is(err, errOutboxFull) {
+		t.Fatalf("write = %v, want errOutboxFull", err)
+	}
+	if c.slowConsumer.Load() {
+		t.Fatal("evicted at the timeout, want only past it")
+	}
+	clock.Advance(time.Millisecond)
+	c.write("line\n")
+	if !c.slowConsumer.Load() {
+		t.Fatal("not evicted after the queue stayed full past the timeout")
+	}
+	if got := testutil.ToFloat64(slowConsumersCounter) - before; got != 1 {
+		t.Errorf("slow consumer counter went up by %v, want 1", got)
+	}
+	if got := classifyDisconnect(c, nil); got != ReasonSlowConsumer {
+		t.Errorf("disconnect reason = %q, want %q", got, ReasonSlowConsumer)
+	}
+	// the peer sees the connection cut instead of the rest of the queue
+	peer.SetReadDeadline(time.Now().Add(testTimeout))
+	if _, err := io.Copy(io.Discard, peer); err != nil {
+		t.Errorf("reading the evicted connection = %v, want EOF", err)
+	}
+}
+
+func TestSlowConsumerRecovers(t *testing.T) {
+	clock := newFakeClock()
+	s := NewServer(WithClock(clock.Now))
+	c, peer := newOutboxClient(t, s, 1, 0)
+
+	for c.write("line\n") == nil {
+	}
+	// reading before the timeout resets it
+	r := bufio.NewReader(peer)
+	r.ReadString('\n')
+	clock.Advance(s.SlowConsumerTimeout + time.Second)
+	for c.write("line\n") == nil {
+	}
+	if c.slowConsumer.Load() {
+		t.Error("evicted a client that caught up before the timeout")
+	}
+}
@@ -0,0 +1,100 @@
+package chat
+
+import (
+	"net"
+	"sync"
+)
+
+// PipeListener is an in-memory net.Listener whose connections are net.Pipe
+// pairs, so a program can drive an embedded server, for example from tests,
+// without the network. Pipes from Dial all report the same remote address, so
+// they count against one MaxConnectionsPerIP; DialAs lets the caller say
+// whom a pipe is for.
+type PipeListener struct {
+	conns chan net.Conn
+	done  chan struct{}
+	once  sync.Once
+}
+
+func NewPipeListener() *PipeListener {
+	return &PipeListener{
+		conns: make(chan net.Conn),
+		done:  make(chan struct{}),
+	}
+}
+
+// Dial connects to the server accepting on l and returns the client's end.
+// It waits for Accept and fails with net.ErrClosed once l is closed.
+func (l *PipeListener) Dial() (net.Conn, error) {
+	return l.DialAs(pipeAddr{})
+}
+
+// DialAs is Dial with remote as the address the server sees, so bans and
+// per-IP limits apply to whoever the pipe is for.
+func (l *PipeListener) DialAs(remote net.Addr) (net.Conn, error) {
+	return l.dial(addrConn{remote: remote})
+}
+
+// DialTrusted is DialAs for a client the server trusts, such as a bridge
+// relaying another chat service: it skips the message rate limit and flood
+// protection, which would otherwise throttle everyone it relays as if they
+// were one client.
+func (l *PipeListener) DialTrusted(remote net.Addr) (net.Conn, error) {
+	return l.dial(addrConn{remote: remote, trusted: true})
+}
+
+// dial hands the server end of a new pipe to Accept as server, whose Conn it
+// fills in.
+func (l *PipeListener) dial(server addrConn) (net.Conn, error) {
+	conn, client := net.Pipe()
+	server.Conn = conn
+	select {
+	case l.conns <- server:
+		return client, nil
+	case <-l.done:
+		conn.Close()
+		client.Close()
+		return nil, net.ErrClosed
+	}
+}
+
+func (l *PipeListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.conns:
+		return conn, nil
+	case <-l.done:
+		return nil, net.ErrClosed
+	}
+}
+
+func (l *PipeListener) Close() error {
+	l.once.Do(func() {
+		close(l.done)
+	})
+	return nil
+}
+
+func (l *PipeListener) Addr() net.Addr {
+	return pipeAddr{}
+}
+
+type pipeAddr struct{}
+
+func (pipeAddr) Network() string { return "pipe" }
+func (pipeAddr) String() string  { return "pipe" }
+
+// addrConn is a connection that reports another remote address. trusted is
+// set for DialTrusted.
+type addrConn struct {
+	net.Conn
+	remote  net.Addr
+	trusted bool
+}
+
+// isTrusted reports whether conn came from PipeListener.DialTrusted.
+func isTrusted(conn net.Conn) bool {
+	ac, ok := conn.(addrConn)
+	return ok && ac.trusted
+}
+
+func (c addrConn) RemoteAddr() net.Addr { return c.remote }
@@ -0,0 +1,47 @@
+package chat
+
+import (
+	"math"
+	"time"
+)
+
+// By default a client may post DefaultMessageBurst messages at once and then
+// DefaultMessageRate messages a second.
+const (
+	DefaultMessageRate  = 1.0
+	DefaultMessageBurst = 5
+)
+
+// RateLimiter is a token bucket: it holds up to burst tokens, refills at rate
+// tokens a second and each message takes one. It is not safe for concurrent
+// use; each client's limiter is only used by its ReadInput goroutine.
+type RateLimiter struct {
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+// NewRateLimiter returns a full bucket.
+func NewRateLimiter(rate float64, burst int) *RateLimiter {
+	return &RateLimiter{
+		rate:   rate,
+		burst:  float64(burst),
+		tokens: float64(burst),
+	}
+}
+
+// Allow takes a token at now and reports whether there was one. When there
+// was not, it also returns how long until the next one.
+func (l *RateLimiter) Allow(now time.Time) (bool, time.Duration) {
+	if !l.last.IsZero() {
+		l.tokens = math.Min(l.burst, l.tokens+now.Sub(l.last).Seconds()*l.rate)
+	}
+	l.last = now
+	if l.tokens >= 1 {
+		l.tokens--
+		return true, 0
+	}
+	wait := time.Duration((1 - l.tokens) / l.rate * float64(time.Second))
+	return false, wait
+}
@@ -0,0 +1,64 @@
+package chat
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRateLimiter(t *testing.T) {
+	clock := newFakeClock()
+	l := NewRateLimiter(2, 3)
+
+	for i := 0; i < 3; i++ {
+		if ok, _ := l.Allow(clock.Now()); !ok {
+			t.Fatalf("message %d of the burst was refused", i+1)
+		}
+	}
+	if ok, wait := l.Allow(clock.Now()); ok || wait != 500*time.Millisecond {
+		t.Errorf("Allow past the burst = %t, %s; want false, 500ms", ok, wait)
+	}
+
+	clock.Advance(250 * time.Millisecond)
+	if ok, wait := l.Allow(clock.Now()); ok || wait != 250*time.Millisecond {
+		t.Errorf("Allow after half a token = %t, %s; want false, 250ms", ok, wait)
+	}
+	clock.Advance(250 * time.Millisecond)
+	if ok, _ := l.Allow(clock.Now()); !ok {
+		t.Error("Allow after a whole token was refused")
+	}
+
+	// a long pause refills the bucket to the burst and no further
+	clock.Advance(time.Hour)
+	for i := 0; i < 3; i++ {
+		if ok, _ := l.Allow(clock.Now()); !ok {
+			t.Fatalf("message %d after the pause was refused", i+1)
+		}
+	}
+	if ok, _ := l.Allow(clock.Now()); ok {
+		t.Error("the bucket refilled past its burst")
+	}
+}
+
+func TestRateLimitedCommands(t *testing.T) {
+	clock := newFakeClock()
+	_, l := newTestServer(t, func(s *Server) {
+		s.MessageRate = 1
+		s.MessageBurst = 2
+	}, WithClock(clock.Now))
+
+	alice := dial(t, l)
+	alice.join("alice", "lobby")
+	alice.do("/msg one")
+	alice.do("/msg two")
+	if out := alice.do("/msg three"); !hasLine(out, "slow down: you can send another message in 1s") {
+		t.Errorf("a message past the burst got %q", out)
+	}
+	// commands that are not rate limited still go through
+	if out := alice.do("/who"); !hasLine(out, "alice") {
+		t.Errorf("/who while rate limited got %q", out)
+	}
+	clock.Advance(time.Second)
+	if out := alice.do("/msg four"); hasLine(out, "slow down") {
+		t.Errorf("a message after the refill got %q", out)
+	}
+}
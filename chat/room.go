@@ -1,16 +1,348 @@
 package chat
 
-import "net"
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"hash/fnv"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	DefaultMaxMembersPerRoom = 100
+	DefaultHistorySize       = 100
+	MaxHistorySize           = 10000
+)
 
 type Room struct {
-	Name    string               `json:"name"`
-	Members map[net.Addr]*Client `json:"members"`
+	Name       string               `json:"name"`
+	Members    map[*Client]struct{} `json:"-"`
+	MaxMembers int                  `json:"maxMembers"`
+	History    HistoryStore         `json:"-"`
+	// Owner created the room and is its operator: they can /kick and /ban
+	// members, /lock it, /rename it and /clear its history.
+	Owner *Client `json:"-"`
+	count atomic.Int32
+	// cursorMu guards lastID and cursors. Room workers move them while
+	// holding the server's mu only for reading, alongside read-only
+	// commands such as /seen ROOM that read them.
+	cursorMu sync.Mutex
+	lastID   uint64
+	// shard picks the room worker that runs the room's commands. It is a
+	// hash of the name the room was created with, so renaming keeps it.
+	shard uint32
+	// joinedAt records when each member joined, for /who.
+	joinedAt map[*Client]time.Time
+	// cursors tracks how far each member has got through the room's
+	// messages, for /seen.
+	cursors map[*Client]*ReadCursor
+	// Nicknames and addresses banned by the operator stay banned for the
+	// life of the room.
+	bannedNicks map[string]bool
+	bannedIPs   map[string]bool
+	// password is the SHA-256 of the room password; nil when the room is
+	// open.
+	password []byte
+	// Filter holds the words the operator has disallowed with /filter; nil
+	// until they add one.
+	Filter *RoomFilter `json:"-"`
+}
+
+func NewRoom(name string, maxMembers, historySize int) *Room {
+	return &Room{
+		Name:       name,
+		Members:    make(map[*Client]struct{}),
+		joinedAt:   make(map[*Client]time.Time),
+		cursors:    make(map[*Client]*ReadCursor),
+		MaxMembers: maxMembers,
+		History:    NewCircularBuffer(historySize),
+		shard:      shardOf(name),
+	}
+}
+
+func shardOf(name string) uint32 {
+	h := fnv.New32a()
+	h.Write([]byte(name))
+	return h.Sum32()
+}
+
+// AddMember reserves a seat before touching the members map so concurrent
+// joins can never push the room past MaxMembers. A limit of 0 is unlimited.
+// at is recorded as the member's join time.
+func (r *Room) AddMember(c *Client, at time.Time) bool {
+	n := r.count.Add(1)
+	if r.MaxMembers > 0 && int(n) > r.MaxMembers {
+		r.count.Add(-1)
+		return false
+	}
+	r.Members[c] = struct{}{}
+	r.joinedAt[c] = at
+	r.cursorMu.Lock()
+	r.cursors[c] = &ReadCursor{}
+	r.cursorMu.Unlock()
+	return true
+}
+
+func (r *Room) RemoveMember(c *Client) {
+	if _, ok := r.Members[c]; !ok {
+		return
+	}
+	delete(r.Members, c)
+	delete(r.joinedAt, c)
+	r.cursorMu.Lock()
+	delete(r.cursors, c)
+	r.cursorMu.Unlock()
+	r.count.Add(-1)
 }
 
-func (r *Room) Broadcast(sender *Client, msg string) {
-	for addr, m := range r.Members {
-		if addr != sender.Conn.RemoteAddr() {
-			m.Message(msg)
+// JoinedAt returns when c joined the room.
+func (r *Room) JoinedAt(c *Client) time.Time {
+	return r.joinedAt[c]
+}
+
+// ReadCursor is how far a member has got through a room's messages.
+type ReadCursor struct {
+	// Received is the newest message ID delivered to the member.
+	Received uint64 `json:"received"`
+	// Read is the newest message ID the member has acknowledged with /read,
+	// or posted themselves.
+	Read uint64 `json:"read"`
+}
+
+// Cursor returns c's read cursor in the room.
+func (r *Room) Cursor(c *Client) ReadCursor {
+	r.cursorMu.Lock()
+	defer r.cursorMu.Unlock()
+	if cur, ok := r.cursors[c]; ok {
+		return *cur
+	}
+	return ReadCursor{}
+}
+
+// markReceived moves c's received cursor up to id. Cursors never move back.
+func (r *Room) markReceived(c *Client, id uint64) {
+	r.cursorMu.Lock()
+	defer r.cursorMu.Unlock()
+	if cur, ok := r.cursors[c]; ok && id > cur.Received {
+		cur.Received = id
+	}
+}
+
+// MarkRead moves c's read cursor up to id; anything read was also received.
+// Cursors never move back.
+func (r *Room) MarkRead(c *Client, id uint64) {
+	r.cursorMu.Lock()
+	defer r.cursorMu.Unlock()
+	if cur, ok := r.cursors[c]; ok {
+		cur.Received = max(cur.Received, id)
+		cur.Read = max(cur.Read, id)
+	}
+}
+
+// LastMessageID is the ID of the newest chat message posted to the room, or 0
+// when there is none.
+func (r *Room) LastMessageID() uint64 {
+	r.cursorMu.Lock()
+	defer r.cursorMu.Unlock()
+	return r.lastID
+}
+
+func (r *Room) Len() int {
+	return int(r.count.Load())
+}
+
+// Nicknames returns the sorted nicknames of every member except the given one.
+func (r *Room) Nicknames(except *Client) []string {
+	var names []string
+	for m := range r.Members {
+		if m != except {
+			names = append(names, m.NickName)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Broadcast sends a notice about sender to every other member and reports how
+// many writes succeeded and failed.
+func (r *Room) Broadcast(sender *Client, msg string) (delivered int, failed int) {
+	for m := range r.Members {
+		if m != sender {
+			r.deliver(m, msg, &delivered, &failed)
+		}
+	}
+	return delivered, failed
+}
+
+// BroadcastEvent is Broadcast for a notice that nick did event: "join",
+// "leave" or "nick". See Client.deliverEvent. A nil sender reaches every
+// member.
+func (r *Room) BroadcastEvent(sender *Client, event, nick, msg string) (delivered int, failed int) {
+	for m := range r.Members {
+		if m != sender {
+			r.tally(m.deliverEvent(event, nick, msg), &delivered, &failed)
 		}
 	}
+	return delivered, failed
+}
+
+// Announce sends a server notice to every member, including the client that
+// triggered it.
+func (r *Room) Announce(msg string) (delivered int, failed int) {
+	for m := range r.Members {
+		r.deliver(m, msg, &delivered, &failed)
+	}
+	return delivered, failed
+}
+
+// Send delivers a chat message from sender to every other member that has not
+// muted them. Notices about the sender (joins, renames) still go through
+// Broadcast.
+func (r *Room) Send(sender *Client, msg Message) (delivered int, failed int) {
+	for m := range r.Members {
+		if m != sender && m.wantsChat(sender.NickName, msg.Text) {
+			err := m.deliverChat(msg)
+			if err == nil {
+				r.markReceived(m, msg.ID)
+			}
+			r.tally(err, &delivered, &failed)
+		}
+	}
+	return delivered, failed
+}
+
+// Mention sends a highlighted notification to every other member named as
+// @nick in msg, whether or not Send delivered them the message itself: a
+// mention gets through /mute and do-not-disturb.
+func (r *Room) Mention(sender *Client, msg Message) (delivered int, failed int) {
+	for _, nick := range parseMentions(msg.Text) {
+		for m := range r.Members {
+			if m != sender && strings.EqualFold(m.NickName, nick) {
+				r.tally(m.deliverMention(r.Name, msg), &delivered, &failed)
+				mentionsCounter.Inc()
+			}
+		}
+	}
+	return delivered, failed
+}
+
+// React delivers a reaction to every member, including the one who reacted,
+// except members who have muted them.
+func (r *Room) React(rx Message) (delivered int, failed int) {
+	for m := range r.Members {
+		if !m.HasMuted(rx.Nick) {
+			r.tally(m.deliverReaction(rx), &delivered, &failed)
+		}
+	}
+	return delivered, failed
+}
+
+// FindMessage looks a chat message up by ID among the history the room still
+// holds.
+func (r *Room) FindMessage(id uint64) (Message, bool) {
+	for _, m := range r.History.LastN(r.History.Len()) {
+		if m.Kind == KindChat && m.ID == id {
+			return m, true
+		}
+	}
+	return Message{}, false
+}
+
+// NextMessageID returns the ID for the room's next chat message. IDs start
+// at 1 and only grow, including across restarts when history is persisted.
+// Only the goroutine running the room's commands calls it.
+func (r *Room) NextMessageID() uint64 {
+	r.cursorMu.Lock()
+	defer r.cursorMu.Unlock()
+	r.lastID++
+	return r.lastID
+}
+
+// restore loads persisted history and continues numbering after the highest
+// message ID in it.
+func (r *Room) restore(msgs []Message) {
+	r.cursorMu.Lock()
+	defer r.cursorMu.Unlock()
+	for _, m := range msgs {
+		r.History.Append(m)
+		if m.ID > r.lastID {
+			r.lastID = m.ID
+		}
+	}
+}
+
+// Ban keeps nick, and ip when it is not empty, out of the room.
+func (r *Room) Ban(nick, ip string) {
+	if r.bannedNicks == nil {
+		r.bannedNicks = make(map[string]bool)
+		r.bannedIPs = make(map[string]bool)
+	}
+	r.bannedNicks[nick] = true
+	if ip != "" {
+		r.bannedIPs[ip] = true
+	}
+}
+
+// IsBanned reports whether c is banned from the room by nickname or address.
+func (r *Room) IsBanned(c *Client) bool {
+	return r.bannedNicks[c.NickName] || r.bannedIPs[remoteIP(c.Conn)]
+}
+
+// Lock requires password to join the room from now on.
+func (r *Room) Lock(password string) {
+	sum := sha256.Sum256([]byte(password))
+	r.password = sum[:]
+}
+
+func (r *Room) Unlock() {
+	r.password = nil
+}
+
+func (r *Room) Locked() bool {
+	return r.password != nil
+}
+
+// CheckPassword reports whether password opens the room. Open rooms accept
+// anything.
+func (r *Room) CheckPassword(password string) bool {
+	if r.password == nil {
+		return true
+	}
+	sum := sha256.Sum256([]byte(password))
+	return subtle.ConstantTimeCompare(sum[:], r.password) == 1
+}
+
+// Typing tells the other members that sender is typing. It is not chat, so
+// it bypasses history; members who hide typing notices, have muted sender or
+// are in DND mode are skipped.
+func (r *Room) Typing(sender *Client) {
+	for m := range r.Members {
+		if m == sender || m.HideTyping || m.DND || m.HasMuted(sender.NickName) {
+			continue
+		}
+		if err := m.deliverTyping(sender.NickName); err != nil {
+			writeErrorsCounter.WithLabelValues("typing").Inc()
+		}
+	}
+}
+
+func (r *Room) IsOwner(c *Client) bool {
+	return r.Owner != nil && r.Owner == c
+}
+
+func (r *Room) deliver(m *Client, msg string, delivered, failed *int) {
+	r.tally(m.deliver(msg), delivered, failed)
+}
+
+func (r *Room) tally(err error, delivered, failed *int) {
+	if err != nil {
+		writeErrorsCounter.WithLabelValues("broadcast").Inc()
+		droppedMessagesCounter.Inc()
+		*failed++
+		return
+	}
+	*delivered++
 }
@@ -0,0 +1,600 @@
+package chat
+
+import (
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestJoinListsMembers(t *testing.T) {
+	_, l := newTestServer(t, nil)
+
+	alice := dial(t, l)
+	alice.do("/name alice")
+	if out := alice.do("/join lobby"); !hasLine(out, "you're the first one here") {
+		t.Errorf("first join got %q", out)
+	}
+	bob := dial(t, l)
+	bob.do("/name bob")
+	if out := bob.do("/join lobby"); !hasLine(out, "currently here: alice") {
+		t.Errorf("second join got %q", out)
+	}
+	alice.expect("bob has joined the room")
+}
+
+func TestJoinReplaysHistory(t *testing.T) {
+	_, l := newTestServer(t, nil)
+
+	alice := dial(t, l)
+	alice.join("alice", "lobby")
+	alice.send("/msg first")
+	alice.send("/msg second")
+	alice.send("/history lobby 2")
+	alice.expect("second")
+
+	bob := dial(t, l)
+	bob.do("/name bob")
+	out := bob.do("/join lobby")
+	if !hasLine(out, "alice : first") || !hasLine(out, "alice : second") {
+		t.Errorf("join replayed %q, want both messages", out)
+	}
+}
+
+func TestJoinLeavesPreviousRoom(t *testing.T) {
+	_, l := newTestServer(t, nil)
+
+	alice, bob := dial(t, l), dial(t, l)
+	alice.join("alice", "lobby")
+	bob.join("bob", "lobby")
+
+	// clients are in one room at a time, so none gets fan-out from many
+	alice.do("/join games")
+	bob.expect("alice has left")
+	bob.do("/msg only lobby hears this")
+	if out := alice.do("/msg hello games"); hasLine(out, "only lobby hears this") {
+		t.Errorf("alice still gets lobby chat after joining games: %q", out)
+	}
+	if out := bob.do("/who lobby"); hasLine(out, "alice") {
+		t.Errorf("alice is still listed in lobby: %q", out)
+	}
+}
+
+func TestNickChangeBroadcast(t *testing.T) {
+	_, l := newTestServer(t, nil)
+
+	alice, bob := dial(t, l), dial(t, l)
+	alice.join("alice", "lobby")
+	bob.join("bob", "lobby")
+
+	if out := alice.do("/name alicia"); !hasLine(out, "Server will know you by alicia") {
+		t.Errorf("/name got %q", out)
+	}
+	bob.expect("alice is now known as alicia")
+	if out := bob.do("/name alicia"); !hasLine(out, "Error") {
+		t.Errorf("taking a nick in use got %q", out)
+	}
+}
+
+func TestLeave(t *testing.T) {
+	_, l := newTestServer(t, nil)
+
+	alice := dial(t, l)
+	alice.join("alice", "lobby")
+	bob := dial(t, l)
+	bob.join("bob", "lobby")
+
+	if out := alice.do("/part"); !hasLine(out, "you left lobby") {
+		t.Errorf("/part got %q", out)
+	}
+	bob.expect("alice has left the room")
+	if out := alice.do("/leave"); !hasLine(out, "you are not in a room") {
+		t.Errorf("second /leave got %q", out)
+	}
+	if out := bob.do("/who lobby"); hasLine(out, "alice") {
+		t.Errorf("alice is still listed: %q", out)
+	}
+}
+
+func TestAway(t *testing.T) {
+	_, l := newTestServer(t, nil)
+
+	alice, bob := dial(t, l), dial(t, l)
+	alice.join("alice", "lobby")
+	bob.join("bob", "lobby")
+
+	alice.do("/away lunch")
+	bob.send("/msg are you there alice?")
+	bob.expect("alice is away: lunch")
+
+	// posting clears the away status
+	alice.send("/msg back now")
+	alice.expect("welcome back, you are no longer away")
+	if out := alice.do("/back"); !hasLine(out, "you are not marked as away") {
+		t.Errorf("/back got %q", out)
+	}
+}
+
+func TestMute(t *testing.T) {
+	_, l := newTestServer(t, nil)
+
+	alice, bob := dial(t, l), dial(t, l)
+	alice.join("alice", "lobby")
+	bob.join("bob", "lobby")
+
+	if out := bob.do("/mute alice"); !hasLine(out, "muted alice") {
+		t.Fatalf("/mute got %q", out)
+	}
+	alice.send("/msg you cannot hear this")
+	// the mute follows a nick change
+	alice.do("/name alicia")
+	bob.expect("alice is now known as alicia")
+	alice.send("/msg nor this")
+	bob.do("/unmute alicia")
+	alice.send("/msg but this")
+
+	line, skipped := bob.expect("but this")
+	if hasLine(skipped, "cannot hear") || hasLine(skipped, "nor this") {
+		t.Errorf("bob got muted messages: %q", skipped)
+	}
+	if !strings.Contains(line, "alicia : but this") {
+		t.Errorf("bob got %q", line)
+	}
+	if out := bob.do("/mute bob"); !hasLine(out, "you cannot mute yourself") {
+		t.Errorf("muting oneself got %q", out)
+	}
+}
+
+func TestDoNotDisturb(t *testing.T) {
+	_, l := newTestServer(t, nil)
+
+	alice, bob := dial(t, l), dial(t, l)
+	alice.join("alice", "lobby")
+	bob.join("bob", "lobby")
+
+	bob.do("/dnd on")
+	alice.send("/msg general chatter")
+	alice.send("/msg hey bob, look")
+	if _, skipped := bob.expect("hey bob, look"); hasLine(skipped, "general chatter") {
+		t.Errorf("bob got chatter in DND mode: %q", skipped)
+	}
+
+	bob.do("/dnd off")
+	alice.send("/msg more chatter")
+	bob.expect("more chatter")
+}
+
+func TestUsers(t *testing.T) {
+	_, l := newTestServer(t, nil)
+
+	// connect and join out of alphabetical order
+	dave, carol, bob, alice := dial(t, l), dial(t, l), dial(t, l), dial(t, l)
+	dave.join("dave", "general")
+	carol.join("carol", "random")
+	bob.do("/name bob")
+	alice.join("alice", "general")
+
+	alice.send("/users")
+	want := "connected users (4): alice [general], bob [none], carol [random], dave [general]"
+	if line, _ := alice.expect("connected users"); !strings.HasSuffix(line, want) {
+		t.Errorf("/users = %q, want %q", line, want)
+	}
+	carol.send("/quit")
+	carol.expectClosed()
+	bob.send("/users")
+	bob.expect("connected users (3): alice [general], bob [none], dave [general]")
+}
+
+func TestRenameRoom(t *testing.T) {
+	_, l := newTestServer(t, nil)
+
+	alice, bob := dial(t, l), dial(t, l)
+	alice.join("alice", "lobby")
+	bob.join("bob", "lobby")
+
+	if out := bob.do("/rename lobby hall"); !hasLine(out, "permission denied") {
+		t.Errorf("rename by a member got %q", out)
+	}
+	alice.do("/rename lobby hall")
+	bob.expect("this room is now called hall")
+	if out := bob.do("/who hall"); !hasLine(out, "alice") {
+		t.Errorf("/who hall got %q", out)
+	}
+	if out := bob.do("/join lobby"); !hasLine(out, "you're the first one here") {
+		t.Errorf("lobby should be free after the rename, got %q", out)
+	}
+}
+
+func TestChatV2Replies(t *testing.T) {
+	_, l := newTestServer(t, func(s *Server) {
+		s.ChatV2Replies = true
+		s.MessageRoomArg = true
+		s.MessagePrefix = ""
+	})
+
+	alice, bob := dial(t, l), dial(t, l)
+	if out := alice.do("/rooms"); !hasLine(out, "Rooms: no rooms available") {
+		t.Errorf("/rooms got %q", out)
+	}
+	if out := alice.do("/name alice"); !hasLine(out, "Nickname changed to: alice") {
+		t.Errorf("/name got %q", out)
+	}
+	if out := alice.do("/join lobby"); hasLine(out, "Welcome to") {
+		t.Errorf("/join got %q, want no room welcome", out)
+	}
+	bob.do("/name bob")
+	bob.do("/join lobby")
+	alice.expect("bob joined the room")
+	if out := alice.do("/rooms"); !hasLine(out, "Rooms: lobby") {
+		t.Errorf("/rooms got %q", out)
+	}
+
+	out := alice.do("/msg lobby hi bob")
+	if hasLine(out, "OK") {
+		t.Errorf("/msg got %q, want no acknowledgement", out)
+	}
+	if line, _ := bob.expect("hi bob"); line != "alice: hi bob" {
+		t.Errorf("bob got %q", line)
+	}
+	bob.send("/quit see you")
+	if line, _ := alice.expect("left"); line != "bob left the room" {
+		t.Errorf("alice got %q", line)
+	}
+	alice.send("/nosuchcommand")
+	if line, _ := alice.expect("Error: "); !strings.HasPrefix(line, "Error: ") {
+		t.Errorf("error line %q", line)
+	}
+}
+
+func TestClearHistory(t *testing.T) {
+	_, l := newTestServer(t, nil)
+
+	alice := dial(t, l)
+	alice.join("alice", "lobby")
+	alice.send("/msg secret")
+	alice.send("/history lobby 1")
+	alice.expect("secret")
+	if out := alice.do("/clear"); !hasLine(out, "room history cleared by alice") {
+		t.Errorf("/clear got %q", out)
+	}
+
+	bob := dial(t, l)
+	bob.do("/name bob")
+	if out := bob.do("/join lobby"); hasLine(out, "secret") {
+		t.Errorf("cleared message replayed: %q", out)
+	}
+	if out := bob.do("/clear"); !hasLine(out, "permission denied") {
+		t.Errorf("/clear by a member got %q", out)
+	}
+}
+
+func TestSearch(t *testing.T) {
+	_, l := newTestServer(t, nil)
+
+	alice, bob := dial(t, l), dial(t, l)
+	alice.join("alice", "lobby")
+	bob.join("bob", "lobby")
+	alice.send("/msg hello there")
+	alice.expect("OK 1")
+	bob.send("/msg ask alice about it")
+	bob.expect("OK 2")
+
+	// neither the sender's nickname nor the message IDs are searched
+	alice.send("/search lobby alice")
+	alice.expect(`1 messages in lobby match "alice":`)
+	if line, _ := alice.next(); !strings.HasSuffix(line, "[2] bob : ask alice about it") {
+		t.Errorf("/search alice got %q", line)
+	}
+	alice.send("/search lobby 1")
+	alice.expect(`no messages in lobby match "1"`)
+	alice.send("/search lobby HELLO")
+	alice.expect(`1 messages in lobby match "HELLO":`)
+	if line, _ := alice.next(); !strings.HasSuffix(line, "[1] alice : hello there") {
+		t.Errorf("/search HELLO got %q", line)
+	}
+
+	carol := dial(t, l)
+	carol.send("/search lobby hello")
+	carol.expect("you must join lobby first")
+	carol.send("/search lobby")
+	carol.expect("usage: /search ROOM QUERY")
+}
+
+func TestBroadcastCounts(t *testing.T) {
+	s := NewServer()
+	r := NewRoom("lobby", 0, 10)
+	member := func(nick string) (*Client, net.Conn) {
+		server, client := net.Pipe()
+		t.Cleanup(func() { server.Close(); client.Close() })
+		c := &Client{Conn: server, NickName: nick, server: s}
+		r.AddMember(c, time.Now())
+		return c, client
+	}
+	sender, own := member("alice")
+	go io.Copy(io.Discard, own)
+	_, healthy := member("bob")
+	go io.Copy(io.Discard, healthy)
+	_, gone := member("carol")
+	gone.Close()
+
+	if delivered, failed := r.Broadcast(sender, "hi"); delivered != 1 || failed != 1 {
+		t.Errorf("Broadcast = %d delivered, %d failed, want 1 and 1", delivered, failed)
+	}
+	if delivered, failed := r.Send(sender, Message{ID: 1, Kind: KindChat, Nick: "alice", Text: "hi"}); delivered != 1 || failed != 1 {
+		t.Errorf("Send = %d delivered, %d failed, want 1 and 1", delivered, failed)
+	}
+	// Announce has no sender to skip
+	if delivered, failed := r.Announce("news"); delivered != 2 || failed != 1 {
+		t.Errorf("Announce = %d delivered, %d failed, want 2 and 1", delivered, failed)
+	}
+}
+
+func TestCircularBuffer(t *testing.T) {
+	cb := NewCircularBuffer(3)
+	for i := 1; i <= 5; i++ {
+		cb.Append(Message{ID: uint64(i)})
+	}
+	if cb.Len() != 3 {
+		t.Fatalf("Len() = %d, want 3", cb.Len())
+	}
+	if got := cb.GetAll(); got[0].ID != 3 || got[2].ID != 5 {
+		t.Errorf("GetAll() = %v, want IDs 3 to 5", got)
+	}
+	if got := cb.LastN(2); len(got) != 2 || got[0].ID != 4 {
+		t.Errorf("LastN(2) = %v, want IDs 4 and 5", got)
+	}
+
+	cb.Clear()
+	if cb.Len() != 0 || len(cb.GetAll()) != 0 {
+		t.Fatalf("after Clear, Len() = %d and GetAll() = %v", cb.Len(), cb.GetAll())
+	}
+	cb.Append(Message{ID: 6})
+	if got := cb.GetAll(); len(got) != 1 || got[0].ID != 6 {
+		t.Errorf("GetAll() after Clear and Append = %v", got)
+	}
+}
+
+func TestCircularBufferResize(t *testing.T) {
+	cb := NewCircularBuffer(4)
+	for i := 1; i <= 6; i++ {
+		cb.Append(Message{ID: uint64(i)})
+	}
+	// the buffer has wrapped, so shrinking must unwrap it
+	cb.Resize(2)
+	if got := cb.GetAll(); len(got) != 2 || got[0].ID != 5 || got[1].ID != 6 {
+		t.Fatalf("GetAll() after Resize(2) = %v, want IDs 5 and 6", got)
+	}
+	cb.Append(Message{ID: 7})
+	if got := cb.GetAll(); len(got) != 2 || got[0].ID != 6 || got[1].ID != 7 {
+		t.Errorf("GetAll() after Append = %v, want IDs 6 and 7", got)
+	}
+	cb.Resize(3)
+	cb.Append(Message{ID: 8})
+	if got := cb.GetAll(); len(got) != 3 || got[0].ID != 6 || got[2].ID != 8 {
+		t.Errorf("GetAll() after growing = %v, want IDs 6 to 8", got)
+	}
+}
+
+func TestSetHistory(t *testing.T) {
+	s, l := newTestServer(t, nil)
+
+	alice, bob := dial(t, l), dial(t, l)
+	alice.join("alice", "lobby")
+	bob.join("bob", "lobby")
+	for _, msg := range []string{"one", "two", "three"} {
+		alice.do("/msg " + msg)
+	}
+
+	if out := bob.do("/set history 2"); !hasLine(out, "permission denied") {
+		t.Errorf("/set by a member got %q", out)
+	}
+	if out := alice.do("/set history 0"); !hasLine(out, "history size must be between 1 and") {
+		t.Errorf("/set history 0 got %q", out)
+	}
+	if out := alice.do("/set history lots"); !hasLine(out, "history size must be a number") {
+		t.Errorf("/set history lots got %q", out)
+	}
+	alice.do("/set history 2")
+	bob.expect("alice set the history size of lobby to 2")
+	if n := s.Snapshot().Rooms[0].HistoryLen; n != 2 {
+		t.Errorf("history holds %d messages after /set history 2, want 2", n)
+	}
+
+	carol := dial(t, l)
+	carol.do("/name carol")
+	out := carol.do("/join lobby")
+	if hasLine(out, "alice : one") || !hasLine(out, "alice : two") || !hasLine(out, "alice : three") {
+		t.Errorf("/join after shrinking the history replayed %q", out)
+	}
+}
+
+func TestQuitMessage(t *testing.T) {
+	_, l := newTestServer(t, nil)
+
+	alice, bob := dial(t, l), dial(t, l)
+	alice.join("alice", "lobby")
+	bob.join("bob", "lobby")
+
+	alice.send("/quit see you tomorrow")
+	if out := alice.expectClosed(); !hasLine(out, "sad to see you go") {
+		t.Errorf("alice got %q", out)
+	}
+	bob.expect("alice has left: see you tomorrow")
+}
+
+func TestInvite(t *testing.T) {
+	_, l := newTestServer(t, nil)
+
+	alice, bob := dial(t, l), dial(t, l)
+	alice.join("alice", "lobby")
+	bob.do("/name bob")
+
+	if out := alice.do("/invite bob"); !hasLine(out, "invited bob to lobby") {
+		t.Errorf("/invite got %q", out)
+	}
+	bob.expect("alice invites you to join lobby (type /join lobby)")
+	if out := alice.do("/invite nobody"); !hasLine(out, "no user named nobody") {
+		t.Errorf("inviting an unknown user got %q", out)
+	}
+	bob.do("/join lobby")
+	if out := alice.do("/invite bob"); !hasLine(out, "bob is already in lobby") {
+		t.Errorf("inviting a member got %q", out)
+	}
+}
+
+func TestLastSeen(t *testing.T) {
+	clock := newFakeClock()
+	_, l := newTestServer(t, nil, WithClock(clock.Now))
+
+	alice, bob := dial(t, l), dial(t, l)
+	alice.join("alice", "lobby")
+	bob.join("bob", "lobby")
+
+	if out := bob.do("/last alice"); !hasLine(out, "alice is online now") {
+		t.Errorf("/last for an online user got %q", out)
+	}
+	alice.send("/quit")
+	alice.expectClosed()
+	bob.expect("alice has left the chat")
+
+	clock.Advance(90 * time.Second)
+	if out := bob.do("/last alice"); !hasLine(out, "alice was last seen 1m30s ago") {
+		t.Errorf("/last after /quit got %q", out)
+	}
+	if out := bob.do("/last nobody"); !hasLine(out, "unknown user") {
+		t.Errorf("/last for an unknown user got %q", out)
+	}
+}
+
+func TestJSONNoticeEvents(t *testing.T) {
+	_, l := newTestServer(t, nil)
+
+	bob := dial(t, l)
+	bob.join("bob", "lobby")
+	bob.do("/json on")
+
+	alice := dial(t, l)
+	alice.join("alice", "lobby")
+	if line, _ := bob.expect("has joined"); !strings.Contains(line, `"nick":"alice","event":"join"`) {
+		t.Errorf("join notice = %s", line)
+	}
+	alice.do("/name alicia")
+	if line, _ := bob.expect("is now known as"); !strings.Contains(line, `"nick":"alicia","event":"nick"`) {
+		t.Errorf("nick notice = %s", line)
+	}
+	alice.send("/quit")
+	if line, _ := bob.expect("has left"); !strings.Contains(line, `"nick":"alicia","event":"leave"`) {
+		t.Errorf("leave notice = %s", line)
+	}
+}
+
+func TestTyping(t *testing.T) {
+	clock := newFakeClock()
+	_, l := newTestServer(t, nil, WithClock(clock.Now))
+
+	alice, bob, carol := dial(t, l), dial(t, l), dial(t, l)
+	alice.join("alice", "lobby")
+	bob.join("bob", "lobby")
+	carol.join("carol", "lobby")
+	if out := carol.do("/typing off"); !hasLine(out, "typing notices off") {
+		t.Errorf("/typing off got %q", out)
+	}
+
+	alice.do("/typing")
+	bob.expect("alice is typing…")
+	// a second /typing inside the debounce is dropped; one after it is not
+	alice.do("/typing")
+	clock.Advance(TypingDebounce)
+	alice.do("/typing")
+	alice.do("/msg done")
+	_, skipped := bob.expect("alice : done")
+	n := 0
+	for _, line := range skipped {
+		if strings.Contains(line, "alice is typing") {
+			n++
+		}
+	}
+	if n != 1 {
+		t.Errorf("bob saw %d typing notices after the debounce, want 1: %q", n, skipped)
+	}
+	// the message ends the typing, so the next notice is not debounced
+	alice.do("/typing")
+	bob.expect("alice is typing…")
+
+	if _, skipped := carol.expect("alice : done"); hasLine(skipped, "is typing") {
+		t.Errorf("carol hides typing notices but got %q", skipped)
+	}
+	dave := dial(t, l)
+	dave.do("/name dave")
+	if out := dave.do("/join lobby"); hasLine(out, "is typing") {
+		t.Errorf("typing notices were replayed from history: %q", out)
+	}
+}
+
+func TestReactions(t *testing.T) {
+	_, l := newTestServer(t, nil)
+
+	alice, bob, carol := dial(t, l), dial(t, l), dial(t, l)
+	alice.join("alice", "lobby")
+	bob.join("bob", "lobby")
+	carol.join("carol", "lobby")
+	carol.do("/mute bob")
+	alice.do("/msg hello")
+
+	if out := bob.do("/react 1 👍"); !hasLine(out, "bob reacted 👍 to [1]") {
+		t.Errorf("bob did not see his own reaction: %q", out)
+	}
+	alice.expect("bob reacted 👍 to [1]")
+	if out := carol.do("/msg marker"); hasLine(out, "reacted") {
+		t.Errorf("carol muted bob but saw his reaction: %q", out)
+	}
+
+	if out := bob.do("/react 9 👍"); !hasLine(out, "no message 9 in lobby") {
+		t.Errorf("/react to a missing message got %q", out)
+	}
+	if out := bob.do("/react 1 " + strings.Repeat("x", MaxReactionLength+1)); !hasLine(out, "reaction is longer than") {
+		t.Errorf("/react with a long reaction got %q", out)
+	}
+
+	alice.do("/json on")
+	bob.do("/react 1 🎉")
+	if line, _ := alice.expect(`"type":"reaction"`); !strings.Contains(line, `"messageId":1`) || !strings.Contains(line, `"nick":"bob"`) {
+		t.Errorf("JSON reaction = %s", line)
+	}
+
+	// reactions are kept in history and replayed after their message
+	dave := dial(t, l)
+	dave.do("/name dave")
+	dave.send("/join lobby")
+	dave.expect("[1] alice : hello")
+	dave.expect("bob reacted 👍 to [1]")
+	dave.expect("bob reacted 🎉 to [1]")
+}
+
+func TestReplyAndThread(t *testing.T) {
+	_, l := newTestServer(t, nil)
+
+	alice, bob := dial(t, l), dial(t, l)
+	alice.join("alice", "lobby")
+	bob.join("bob", "lobby")
+	alice.do("/msg question")
+	alice.do("/msg unrelated")
+	bob.do("/reply 1 answer")
+	alice.expect("[3 re 1] bob : answer")
+	alice.do("/reply 3 thanks")
+	bob.expect("[4 re 3] alice : thanks")
+
+	if out := bob.do("/reply 9 lost"); !hasLine(out, "no message 9 in lobby") {
+		t.Errorf("/reply to a missing message got %q", out)
+	}
+
+	bob.send("/thread 1")
+	_, out := bob.expect("[4 re 3] alice : thanks")
+	if !hasLine(out, "[1] alice : question") || !hasLine(out, "[3 re 1] bob : answer") || hasLine(out, "unrelated") {
+		t.Errorf("/thread 1 got %q", out)
+	}
+	if out := bob.do("/thread 9"); !hasLine(out, "no message 9 in lobby") {
+		t.Errorf("/thread for a missing message got %q", out)
+	}
+}
@@ -0,0 +1,47 @@
+package chat
+
+import (
+	"sync"
+	"time"
+)
+
+const DefaultLastSeenTTL = 7 * 24 * time.Hour
+
+// SeenStore remembers when each nickname was last active after its client
+// has gone, for /last. Entries older than TTL are forgotten.
+type SeenStore struct {
+	TTL  time.Duration
+	mu   sync.Mutex
+	seen map[string]time.Time
+}
+
+func NewSeenStore(ttl time.Duration) *SeenStore {
+	return &SeenStore{
+		TTL:  ttl,
+		seen: make(map[string]time.Time),
+	}
+}
+
+// Record notes that nick was last active at at, pruning expired entries.
+func (s *SeenStore) Record(nick string, at time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.seen[nick] = at
+	for n, t := range s.seen {
+		if at.Sub(t) > s.TTL {
+			delete(s.seen, n)
+		}
+	}
+}
+
+// Lookup returns when nick was last active, unless that is more than TTL
+// before now.
+func (s *SeenStore) Lookup(nick string, now time.Time) (time.Time, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	t, ok := s.seen[nick]
+	if !ok || now.Sub(t) > s.TTL {
+		return time.Time{}, false
+	}
+	return t, true
+}
@@ -1,76 +1,1031 @@
 package chat
 
 import (
+	"context"
+	"crypto/subtle"
+	"crypto/tls"
 	"errors"
 	"fmt"
-	"log"
 	"net"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/sirupsen/logrus"
+)
+
+var ErrServerClosed = errors.New("chat: server closed")
+
+const (
+	DefaultMOTD                = "Welcome! Use /join ROOM to start chatting."
+	DefaultCommandBufferSize   = 64
+	DefaultKeepAlivePeriod     = 30 * time.Second
+	DefaultMaxConnectionsPerIP = 10
+	DefaultMessagePrefix       = "> "
+	DefaultErrorPrefix         = "Error: "
+	DefaultMaxLineLength       = 4096
+	DefaultHeartbeatMisses     = 3
+	DefaultNickName            = "Anonymous"
+	// shutdownWriteTimeout bounds the goodbye write to each client when the
+	// Shutdown context has no deadline of its own.
+	shutdownWriteTimeout = 5 * time.Second
 )
 
+// Server processes every command that mutates rooms or membership on the
+// single Run goroutine while holding mu for writing. When Workers > 0, the
+// read-only commands (see CommandSpec.ReadOnly) are handed to a small pool that
+// holds mu for reading, so they can run alongside each other but never
+// alongside a mutation. Those replies may therefore overtake earlier commands
+// from the same client.
+//
+// When RoomWorkers > 0, commands that only touch the client's own room (see
+// CommandSpec.RoomScoped) run on one of RoomWorkers goroutines picked by the
+// room, also holding mu for reading. A busy room then only delays the rooms
+// that share its worker, and each room's commands still run in order. Run
+// waits for a client's queued room commands before running any other command
+// of theirs, so a client's own commands keep their order too.
 type Server struct {
-	Rooms    map[string]*Room `json:"rooms"`
-	Commands chan Command     `json:"commands"`
+	Rooms             map[string]*Room `json:"rooms"`
+	Commands          chan Command     `json:"-"`
+	MaxMembersPerRoom int              `json:"maxMembersPerRoom"`
+	MaxRooms          int              `json:"maxRooms"`
+	MaxConnections    int              `json:"maxConnections"`
+	// MaxConnectionsPerIP caps simultaneous connections from one remote IP.
+	// Zero means unlimited.
+	MaxConnectionsPerIP int `json:"maxConnectionsPerIP"`
+	HistorySize         int `json:"historySize"`
+	// RoomHistorySizes overrides HistorySize for rooms created with these names.
+	RoomHistorySizes map[string]int `json:"roomHistorySizes"`
+	// RoomBannedWords starts the room filter of rooms created with these
+	// names, see /filter.
+	RoomBannedWords map[string][]string `json:"-"`
+	KeepAlivePeriod time.Duration       `json:"keepAlivePeriod"`
+	// ReadTimeout disconnects clients that send nothing for this long. Zero
+	// disables it.
+	ReadTimeout time.Duration `json:"readTimeout"`
+	// IdleWarning is how long before the read timeout an idle client is told
+	// it is about to be disconnected. Clients with a ReadTimeout of
+	// IdleWarning or less get no warning, and zero disables it.
+	IdleWarning time.Duration `json:"idleWarning"`
+	// MessageRate and MessageBurst limit how fast each client may post: a
+	// burst of MessageBurst messages, then MessageRate a second. A rate of
+	// zero disables the limit.
+	MessageRate  float64 `json:"messageRate"`
+	MessageBurst int     `json:"messageBurst"`
+	// HeartbeatInterval, when positive, has the server send every client a
+	// PING that often; a client that sends nothing for HeartbeatMisses
+	// intervals in a row is disconnected as dead.
+	HeartbeatInterval time.Duration `json:"heartbeatInterval"`
+	HeartbeatMisses   int           `json:"heartbeatMisses"`
+	// OutboxSize is how many lines each client can have waiting to be
+	// written, and WriteTimeout how long one write may take before the
+	// client is dropped. Zero WriteTimeout means no limit.
+	OutboxSize   int           `json:"outboxSize"`
+	WriteTimeout time.Duration `json:"writeTimeout"`
+	// SlowConsumerTimeout disconnects a client whose outbound queue has
+	// stayed full this long. Until then, lines that do not fit are dropped.
+	// Zero never disconnects.
+	SlowConsumerTimeout time.Duration `json:"slowConsumerTimeout"`
+	// MaxLineLength is the longest input line accepted, in bytes; longer
+	// lines are refused with an error. Zero allows any length.
+	MaxLineLength int `json:"maxLineLength"`
+	// A client posting more than FloodMessages messages within FloodWindow,
+	// or FloodRepeats identical messages in a row, cannot post for
+	// FloodMuteDuration. Zero disables either check.
+	FloodMessages     int           `json:"floodMessages"`
+	FloodWindow       time.Duration `json:"floodWindow"`
+	FloodRepeats      int           `json:"floodRepeats"`
+	FloodMuteDuration time.Duration `json:"floodMuteDuration"`
+	MOTD              string        `json:"motd"`
+	// MessagePrefix and ErrorPrefix start every plain-text line sent to a
+	// client: chat, system messages and errors respectively. Set them to ""
+	// to send undecorated lines. JSON mode ignores both.
+	MessagePrefix string `json:"messagePrefix"`
+	ErrorPrefix   string `json:"errorPrefix"`
+	// DefaultRoom, when set, is joined automatically by every new client.
+	DefaultRoom string `json:"defaultRoom"`
+	Workers     int    `json:"workers"`
+	// RoomWorkers is how many goroutines run room-scoped commands; 0 runs
+	// them on the Run goroutine.
+	RoomWorkers int         `json:"roomWorkers"`
+	Filter      Filter      `json:"-"`
+	Audit       AuditWriter `json:"-"`
+	// NewHistory, when set, builds the in-memory history of each new room
+	// instead of a CircularBuffer.
+	NewHistory func(room string, size int) HistoryStore `json:"-"`
+	// PersistentHistory, when set, persists room history across restarts.
+	PersistentHistory PersistentHistory `json:"-"`
+	// Events is told about joins, leaves, messages and nickname changes.
+	Events     EventSink     `json:"-"`
+	Bans       *BanList      `json:"-"`
+	AdminToken string        `json:"-"`
+	Sessions   *SessionStore `json:"-"`
+	// Accounts, when set, enables /register and /login. Registered
+	// nicknames can only be used by their owner, and guests lose the
+	// AccountOnly commands.
+	Accounts *Accounts `json:"-"`
+	// AdminNicks are accounts that become admins whenever they log in, as
+	// if they had typed /admin. They take effect only with Accounts, since
+	// anyone can use a guest nickname.
+	AdminNicks []string `json:"-"`
+	// Seen remembers when departed nicknames were last active, for /last.
+	Seen *SeenStore `json:"-"`
+	// Middleware wraps every command clients type, the first outermost;
+	// see Middleware. Set it before serving.
+	Middleware []Middleware `json:"-"`
+	// handler is the command handler wrapped in Middleware, built when Run
+	// starts.
+	handler CommandHandler
+	// IncomingWebhooks may post into their rooms through HooksAPI.
+	IncomingWebhooks []IncomingWebhook `json:"-"`
+	// hookClients are the clients incoming webhooks post as, by token;
+	// guarded by mu.
+	hookClients map[string]*Client
+	// MessageRoomArg enables the form /msg ROOM MESSAGE, where the
+	// target room is named explicitly; it must be the sender's own room.
+	// /msg MESSAGE still posts to the current room when its first word is
+	// not a room name.
+	MessageRoomArg bool `json:"messageRoomArg"`
+	// ChatV2Replies answers plain-text clients in the words of the old
+	// chatv2 server, for the clients written against it: "Rooms: ..." for
+	// /rooms, "Nickname changed to: ..." for /name, "nick: text" chat lines,
+	// "nick joined the room" and "nick left the room", and no room welcome or
+	// "OK" acknowledgements. Pair it with an empty MessagePrefix. JSON and IRC
+	// clients are unaffected.
+	ChatV2Replies bool             `json:"chatV2Replies"`
+	Now           func() time.Time `json:"-"`
+
+	// logger is set by WithLogger; without it the server logs through the
+	// package's logger.
+	logger *logrus.Logger
+
+	startedAt   time.Time
+	messages    atomic.Int64
+	connections atomic.Int32
+	mu          sync.RWMutex
+	clientsMu   sync.Mutex
+	clients     map[*Client]struct{}
+	// nicks indexes connected clients by nickname; guarded by clientsMu.
+	nicks   map[string]*Client
+	perIPMu sync.Mutex
+	perIP   map[string]int
+	// loginBackoffs slows down password guessing; see loginlimit.go.
+	loginBackoffs map[string]*loginBackoff
+
+	// ctx is cancelled when Shutdown starts; every client's context derives
+	// from it so blocked reads and sends give up promptly.
+	ctx    context.Context
+	cancel context.CancelFunc
+	// sendMu guards closing: clients hold it for reading while they send on
+	// Commands, and Shutdown takes it for writing before closing the channel.
+	sendMu    sync.RWMutex
+	closing   bool
+	runOnce   sync.Once
+	runDone   chan struct{}
+	listenMu  sync.Mutex
+	listeners []net.Listener
+	// shutdownRequested is closed by /shutdown.
+	shutdownRequested chan struct{}
+	shutdownOnce      sync.Once
+}
+
+func NewServer(opts ...Option) *Server {
+	s := &Server{
+		Rooms:               make(map[string]*Room),
+		Commands:            make(chan Command, DefaultCommandBufferSize), // ? /msg -> /join -> /rooms -> /name -> quit
+		MaxMembersPerRoom:   DefaultMaxMembersPerRoom,
+		HistorySize:         DefaultHistorySize,
+		KeepAlivePeriod:     DefaultKeepAlivePeriod,
+		MessageRate:         DefaultMessageRate,
+		MessageBurst:        DefaultMessageBurst,
+		MaxLineLength:       DefaultMaxLineLength,
+		OutboxSize:          DefaultOutboxSize,
+		WriteTimeout:        DefaultWriteTimeout,
+		SlowConsumerTimeout: DefaultSlowConsumerTimeout,
+		IdleWarning:         DefaultIdleWarning,
+		HeartbeatMisses:     DefaultHeartbeatMisses,
+		FloodMessages:       DefaultFloodMessages,
+		FloodWindow:         DefaultFloodWindow,
+		FloodRepeats:        DefaultFloodRepeats,
+		FloodMuteDuration:   DefaultFloodMuteDuration,
+		MOTD:                DefaultMOTD,
+		MessagePrefix:       DefaultMessagePrefix,
+		ErrorPrefix:         DefaultErrorPrefix,
+		clients:             make(map[*Client]struct{}),
+		nicks:               make(map[string]*Client),
+		perIP:               make(map[string]int),
+		loginBackoffs:       make(map[string]*loginBackoff),
+		MaxConnectionsPerIP: DefaultMaxConnectionsPerIP,
+		runDone:             make(chan struct{}),
+		shutdownRequested:   make(chan struct{}),
+		Now:                 time.Now,
+		Events:              NopEventSink{},
+		Seen:                NewSeenStore(DefaultLastSeenTTL),
+	}
+	s.ctx, s.cancel = context.WithCancel(context.Background())
+	s.Bans, _ = NewBanList()
+	for _, opt := range opts {
+		opt(s)
+	}
+	s.startedAt = s.Now()
+	return s
+}
+
+// CreateRoom creates a room up front with its own member limit, overriding
+// MaxMembersPerRoom for that room. A limit of 0 means unlimited.
+func (s *Server) CreateRoom(name string, maxMembers int) (*Room, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.Rooms[name]; ok {
+		return nil, errorf(ErrRoomExists, "room %q already exists", name)
+	}
+	r := s.newRoom(name, maxMembers, s.historySizeFor(name))
+	s.Rooms[name] = r
+	return r, nil
 }
 
-func NewServer() *Server {
-	return &Server{
-		Rooms:    make(map[string]*Room),
-		Commands: make(chan Command), // ? /msg -> /join -> /rooms -> /name -> quit
+// RestoreRooms recreates every room that has persisted history, loading its
+// last messages into the room's buffer, so they are replayed to the first
+// clients to join after a restart. Call it before Run.
+func (s *Server) RestoreRooms() error {
+	if s.PersistentHistory == nil {
+		return nil
+	}
+	names, err := s.PersistentHistory.Rooms()
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, name := range names {
+		if _, ok := s.Rooms[name]; ok {
+			continue
+		}
+		if s.MaxRooms > 0 && len(s.Rooms) >= s.MaxRooms {
+			break
+		}
+		s.Rooms[name] = s.newRoom(name, s.MaxMembersPerRoom, s.historySizeFor(name))
 	}
+	return nil
 }
 
+// Run processes commands until Shutdown closes the channel. Commands queued
+// before that are still processed; Run returns once the channel is drained.
+// Serve starts it, so embedders rarely need to; calls after the first return
+// at once.
 func (s *Server) Run() {
+	s.runOnce.Do(s.run)
+}
+
+func (s *Server) run() {
+	defer close(s.runDone)
+	s.handler = s.chain()
+
+	var readOnly chan Command
+	var workers sync.WaitGroup
+	if s.Workers > 0 {
+		readOnly = make(chan Command, cap(s.Commands))
+		for i := 0; i < s.Workers; i++ {
+			workers.Add(1)
+			go func() {
+				defer workers.Done()
+				s.worker(readOnly)
+			}()
+		}
+		defer workers.Wait()
+		defer close(readOnly)
+	}
+
+	var roomQueues []chan Command
+	if s.RoomWorkers > 0 {
+		roomQueues = make([]chan Command, s.RoomWorkers)
+		for i := range roomQueues {
+			roomQueues[i] = make(chan Command, cap(s.Commands))
+			workers.Add(1)
+			go func(cmds <-chan Command) {
+				defer workers.Done()
+				s.roomWorker(cmds)
+			}(roomQueues[i])
+		}
+		defer workers.Wait()
+		defer func() {
+			for _, q := range roomQueues {
+				close(q)
+			}
+		}()
+	}
+
 	for cmd := range s.Commands {
-		switch cmd.ID {
-		case CMD_NICKNAME:
-			s.NickName(cmd.Client, cmd.Args)
-		case CMD_ROOMS:
-			s.ListRooms(cmd.Client, cmd.Args)
-		case CMD_JOIN:
-			s.Join(cmd.Client, cmd.Args)
-		case CMD_MSG:
-			s.Message(cmd.Client, cmd.Args)
-		case CMD_QUIT:
-			s.Quit(cmd.Client, cmd.Args)
+		c := cmd.Client
+		s.mu.Lock()
+		// internal commands have negative IDs and are not client activity
+		// and neither are heartbeat replies
+		if cmd.ID >= 0 && cmd.ID != CMD_PONG {
+			c.LastSeen = s.Now()
+		}
+		var room *Room
+		if roomQueues != nil {
+			room = s.commandRoom(cmd)
+		}
+		if room != nil {
+			s.mu.Unlock()
+			i := int(room.shard % uint32(len(roomQueues)))
+			if i != c.pendingWorker {
+				c.pending.Wait()
+				c.pendingWorker = i
+			}
+			c.pending.Add(1)
+			roomQueues[i] <- cmd
+			continue
+		}
+		if spec, ok := commands[cmd.ID]; ok && readOnly != nil && spec.ReadOnly {
+			s.mu.Unlock()
+			readOnly <- cmd
+			continue
+		}
+		if roomQueues != nil {
+			s.mu.Unlock()
+			c.pending.Wait()
+			s.mu.Lock()
+		}
+		s.dispatch(cmd)
+		s.mu.Unlock()
+	}
+}
+
+// commandRoom returns the room whose worker runs cmd, or nil when cmd must
+// run on the Run goroutine: it is not room-scoped, the client is in no room,
+// it names a room other than the client's own, or the client is away.
+func (s *Server) commandRoom(cmd Command) *Room {
+	room := cmd.Client.Room
+	if spec, ok := commands[cmd.ID]; !ok || !spec.RoomScoped || room == nil {
+		return nil
+	}
+	// posting brings an away client back, which changes state other
+	// workers read
+	if cmd.Client.Away {
+		return nil
+	}
+	switch cmd.ID {
+	case CMD_MSG:
+		if s.MessageRoomArg && len(cmd.Args) > 1 {
+			if r, ok := s.Rooms[cmd.Args[1]]; ok && r != room {
+				return nil
+			}
+		}
+	case CMD_HISTORY, CMD_SEARCH, CMD_SEEN:
+		if len(cmd.Args) > 1 && cmd.Args[1] != "" && s.Rooms[cmd.Args[1]] != room {
+			return nil
+		}
+	}
+	return room
+}
+
+// Enqueue hands cmd to the Run loop. It reports false once Shutdown has begun,
+// in which case the command is dropped. A sender blocked on a full queue is
+// released as soon as shutdown starts, and the closing check under sendMu
+// means nobody can send on the channel after Shutdown closes it.
+func (s *Server) Enqueue(cmd Command) bool {
+	s.sendMu.RLock()
+	defer s.sendMu.RUnlock()
+	if s.closing {
+		return false
+	}
+	select {
+	case s.Commands <- cmd:
+		return true
+	case <-s.ctx.Done():
+		return false
+	}
+}
+
+// Serve accepts connections on l, starting Run if nothing has yet, until ctx
+// is done or the server is shut down. When ctx is done the server is closed
+// as by Close. Serve may be called for several listeners at once; it returns
+// ErrServerClosed once the server is shutting down.
+func (s *Server) Serve(ctx context.Context, l net.Listener) error {
+	s.listenMu.Lock()
+	if s.isClosing() {
+		s.listenMu.Unlock()
+		l.Close()
+		return ErrServerClosed
+	}
+	s.listeners = append(s.listeners, l)
+	s.listenMu.Unlock()
+
+	go s.Run()
+	stop := context.AfterFunc(ctx, func() {
+		s.Close()
+	})
+	defer stop()
+
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			if s.isClosing() {
+				return ErrServerClosed
+			}
+			if errors.Is(err, net.ErrClosed) {
+				return err
+			}
+			s.Logger().WithFields(logrus.Fields{
+				"error": err.Error(),
+			}).Error("unable to accept connection")
+			continue
+		}
+		// refuse banned addresses before they count towards any limit;
+		// NewClient checks again for connections that arrive another way
+		if s.Bans.IsBanned(remoteIP(conn)) {
+			go s.reject(conn, RejectBanned, "you are banned")
+			continue
+		}
+
+		go s.NewClient(conn)
+	}
+}
+
+// Shutdown stops accepting connections, stops clients from queueing new
+// commands and waits for Run to finish the ones already queued. It then tells
+// every client the server is shutting down and closes their connections. If
+// ctx expires first, the connections are closed without a goodbye.
+func (s *Server) Shutdown(ctx context.Context) error {
+	s.stop()
+	// drain what is queued even if nothing ever started Run
+	go s.Run()
+
+	select {
+	case <-s.runDone:
+		s.farewell(ctx)
+		if s.PersistentHistory != nil {
+			return s.PersistentHistory.Flush()
+		}
+		return nil
+	case <-ctx.Done():
+		s.closeAll(time.Now())
+		return ctx.Err()
+	}
+}
+
+// Close stops the server at once: it stops accepting connections and
+// commands and closes every connection without waiting for queued commands
+// or saying goodbye. Use Shutdown to stop gracefully.
+func (s *Server) Close() error {
+	s.stop()
+	go s.Run()
+	s.closeAll(time.Now())
+	return nil
+}
+
+// stop cancels the server's context, closes its listeners and closes
+// Commands, so no new connections or commands are accepted.
+func (s *Server) stop() {
+	s.cancel()
+
+	s.listenMu.Lock()
+	for _, l := range s.listeners {
+		l.Close()
+	}
+	s.listeners = nil
+	s.listenMu.Unlock()
+
+	s.sendMu.Lock()
+	if !s.closing {
+		s.closing = true
+		close(s.Commands)
+	}
+	s.sendMu.Unlock()
+}
+
+// farewell announces the shutdown to every room, and to clients who are not
+// in one, then closes every connection. Run has exited, so nothing else is
+// writing to clients.
+func (s *Server) farewell(ctx context.Context) {
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		deadline = time.Now().Add(shutdownWriteTimeout)
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.clientsMu.Lock()
+	for c := range s.clients {
+		if c.Room == nil {
+			c.Message("server shutting down")
+		}
+	}
+	s.clientsMu.Unlock()
+	for _, r := range s.Rooms {
+		r.Announce("server shutting down")
+	}
+	s.closeAll(deadline)
+}
+
+// closeAll closes every client, giving their writers until deadline to flush
+// what is queued before the connections are cut.
+func (s *Server) closeAll(deadline time.Time) {
+	s.clientsMu.Lock()
+	defer s.clientsMu.Unlock()
+	for c := range s.clients {
+		disconnectsCounter.WithLabelValues(ReasonShutdown).Inc()
+		c.Close()
+	}
+	timer := time.NewTimer(time.Until(deadline))
+	defer timer.Stop()
+	for c := range s.clients {
+		if c.writerDone == nil {
+			continue
+		}
+		select {
+		case <-c.writerDone:
+		case <-timer.C:
+			// out of time: cut whoever is still flushing
+			for c := range s.clients {
+				c.Conn.Close()
+			}
+			return
+		}
+	}
+}
+
+// isClosing reports whether Shutdown or Close has started. Both cancel ctx
+// before closing the listeners, so Serve sees it as soon as Accept fails.
+func (s *Server) isClosing() bool {
+	return s.ctx.Err() != nil
+}
+
+func (s *Server) worker(cmds <-chan Command) {
+	for cmd := range cmds {
+		s.mu.RLock()
+		s.dispatch(cmd)
+		s.mu.RUnlock()
+	}
+}
+
+// roomWorker runs room-scoped commands. Every room it serves only ever has
+// its commands run here, so it may change room state while holding mu for
+// reading.
+func (s *Server) roomWorker(cmds <-chan Command) {
+	for cmd := range cmds {
+		s.mu.RLock()
+		s.dispatch(cmd)
+		s.mu.RUnlock()
+		cmd.Client.pending.Done()
+	}
+}
+
+func (s *Server) dispatch(cmd Command) {
+	start := time.Now()
+	commandsCounter.WithLabelValues(cmd.ID.String()).Inc()
+	defer func() {
+		commandDuration.WithLabelValues(cmd.ID.String()).Observe(time.Since(start).Seconds())
+	}()
+
+	s.Logger().WithFields(logrus.Fields{
+		"command_id": cmd.ID.String(),
+		"client":     cmd.Client.Conn.RemoteAddr().String(),
+	}).Info("processing command")
+
+	if spec, ok := commands[cmd.ID]; ok && spec.AccountOnly && s.Accounts != nil && cmd.Client.Account == "" && !cmd.Client.Admin {
+		cmd.Client.Error(errorf(ErrPermissionDenied, "guests cannot use %s, /register or /login first", cmd.ID))
+		return
+	}
+	if spec, ok := commands[cmd.ID]; ok && spec.AdminOnly && !cmd.Client.Admin {
+		cmd.Client.Error(errorf(ErrPermissionDenied, "%s is for admins only", cmd.ID))
+		return
+	}
+
+	switch cmd.ID {
+	case cmdDisconnect:
+		s.disconnect(cmd.Client)
+	case cmdDeferred:
+		if !cmd.Client.left {
+			cmd.fn()
 		}
+	default:
+		s.handle(cmd)
 	}
 }
 
 func (s *Server) NewClient(conn net.Conn) {
-	log.Printf("new client has connected: %s", conn.RemoteAddr().String())
+	if conn == nil {
+		s.Logger().Error("refusing to serve a nil connection")
+		return
+	}
+
+	if s.Bans.IsBanned(remoteIP(conn)) {
+		s.reject(conn, RejectBanned, "you are banned")
+		return
+	}
+
+	n := s.connections.Add(1)
+	defer s.connections.Add(-1)
+	if s.MaxConnections > 0 && int(n) > s.MaxConnections {
+		s.reject(conn, RejectServerFull, "server at capacity")
+		return
+	}
+
+	ip := remoteIP(conn)
+	if !s.acquireIP(ip) {
+		s.reject(conn, RejectPerIPLimit, "too many connections from your address")
+		return
+	}
+	defer s.releaseIP(ip)
+
+	connectionsGauge.Inc()
+	defer connectionsGauge.Dec()
+
+	s.Logger().WithFields(logrus.Fields{
+		"remote_addr": conn.RemoteAddr().String(),
+	}).Info("new client has connected")
+	s.configureConn(conn)
+	s.sendMOTD(conn)
+
+	ctx, cancel := context.WithCancel(s.ctx)
+	defer cancel()
+	// unblock the pending read as soon as the server shuts down
+	stop := context.AfterFunc(ctx, func() {
+		conn.SetReadDeadline(time.Now())
+	})
+	defer stop()
 
 	c := &Client{
-		Conn:     conn,
-		NickName: "Anonymous",
-		Commands: s.Commands,
+		ctx:         ctx,
+		Conn:        conn,
+		NickName:    DefaultNickName,
+		server:      s,
+		ReadTimeout: s.ReadTimeout,
+		LastSeen:    s.Now(),
+	}
+	c.irc, _ = conn.(*ircConn)
+	c.trusted = isTrusted(conn)
+	if s.MessageRate > 0 && !c.trusted {
+		c.RateLimiter = NewRateLimiter(s.MessageRate, max(1, s.MessageBurst))
+	}
+
+	// the writer comes first, so that nothing the Run goroutine sends once
+	// c is visible to it bypasses the outbox
+	c.startWriter(max(1, s.OutboxSize), s.WriteTimeout)
+	s.issueSession(c)
+	s.addClient(c)
+	// closeAll only closes the clients it finds, so one that connected while
+	// the server was closing has to close itself
+	if s.isClosing() {
+		s.removeClient(c)
+		c.Close()
+		return
+	}
+	if s.DefaultRoom != "" {
+		s.Enqueue(Command{
+			ID:     CMD_JOIN,
+			Client: c,
+			Args:   []string{"/join", s.DefaultRoom},
+		})
+	}
+
+	if s.HeartbeatInterval > 0 {
+		go c.heartbeat(ctx, s.HeartbeatInterval, max(1, s.HeartbeatMisses))
+	}
+
+	if err := c.ReadInput(); err != nil {
+		reason := classifyDisconnect(c, err)
+		s.Logger().WithFields(logrus.Fields{
+			"remote_addr": conn.RemoteAddr().String(),
+			"reason":      reason,
+			"error":       err.Error(),
+		}).Debug("stopped reading from client")
+		if reason == ReasonTimeout {
+			c.Message(fmt.Sprintf("disconnected after %s of inactivity", formatDuration(c.ReadTimeout)))
+		}
+		c.leaveReason = reason
+		s.Enqueue(Command{
+			ID:     cmdDisconnect,
+			Client: c,
+		})
+	}
+}
+
+// Reasons a connection is refused before it becomes a client, used for the
+// reason log field and the tcp_chat_rejected_connections_total label.
+const (
+	RejectBanned     = "banned"
+	RejectServerFull = "server_full"
+	RejectPerIPLimit = "per_ip_limit"
+)
+
+// reject tells conn why it is being refused and closes it.
+func (s *Server) reject(conn net.Conn, reason, msg string) {
+	rejectedConnectionsCounter.WithLabelValues(reason).Inc()
+	s.Logger().WithFields(logrus.Fields{
+		"remote_addr": conn.RemoteAddr().String(),
+		"reason":      reason,
+	}).Warn("rejecting client")
+	if _, ok := conn.(*ircConn); ok {
+		msg = "ERROR :" + msg
+	}
+	conn.Write([]byte(msg + "\n"))
+	conn.Close()
+}
+
+// acquireIP counts a new connection from ip, refusing it when the address is
+// already at MaxConnectionsPerIP. Every successful acquire is paired with
+// exactly one releaseIP, deferred in NewClient.
+func (s *Server) acquireIP(ip string) bool {
+	s.perIPMu.Lock()
+	defer s.perIPMu.Unlock()
+	if s.MaxConnectionsPerIP > 0 && s.perIP[ip] >= s.MaxConnectionsPerIP {
+		return false
+	}
+	s.perIP[ip]++
+	return true
+}
+
+func (s *Server) releaseIP(ip string) {
+	s.perIPMu.Lock()
+	defer s.perIPMu.Unlock()
+	if s.perIP[ip] <= 1 {
+		delete(s.perIP, ip)
+		return
+	}
+	s.perIP[ip]--
+}
+
+// configureConn applies socket hygiene to a new connection. Keepalive only
+// makes sense for TCP, so other connections (websockets, pipes in tests) are
+// left alone; the read deadline is handled per read in ReadInput.
+func (s *Server) configureConn(conn net.Conn) {
+	if ic, ok := conn.(*ircConn); ok {
+		conn = ic.Conn
 	}
+	if tc, ok := conn.(*tls.Conn); ok {
+		conn = tc.NetConn()
+	}
+	tcp, ok := conn.(*net.TCPConn)
+	if !ok || s.KeepAlivePeriod <= 0 {
+		return
+	}
+	err := tcp.SetKeepAlive(true)
+	if err == nil {
+		err = tcp.SetKeepAlivePeriod(s.KeepAlivePeriod)
+	}
+	if err != nil {
+		s.Logger().WithFields(logrus.Fields{
+			"remote_addr": conn.RemoteAddr().String(),
+			"error":       err.Error(),
+		}).Warn("failed to enable tcp keepalive")
+	}
+}
+
+func (s *Server) issueSession(c *Client) {
+	if s.Sessions == nil {
+		return
+	}
+	token, err := s.Sessions.NewToken()
+	if err != nil {
+		s.Logger().WithFields(logrus.Fields{
+			"remote_addr": c.Conn.RemoteAddr().String(),
+			"error":       err.Error(),
+		}).Error("failed to issue session token")
+		return
+	}
+	c.SessionToken = token
+	c.Message(fmt.Sprintf("your session token: %s", token))
+}
+
+func (s *Server) addClient(c *Client) {
+	s.clientsMu.Lock()
+	defer s.clientsMu.Unlock()
+	s.clients[c] = struct{}{}
+}
+
+func (s *Server) removeClient(c *Client) {
+	s.clientsMu.Lock()
+	defer s.clientsMu.Unlock()
+	delete(s.clients, c)
+	if s.nicks[c.NickName] == c {
+		delete(s.nicks, c.NickName)
+	}
+}
+
+// claimNick renames c to nick in the nickname index, failing if another
+// client already holds it. DefaultNickName is shared by every client that has
+// not picked a name yet, so it is never indexed.
+func (s *Server) claimNick(c *Client, nick string) error {
+	s.clientsMu.Lock()
+	defer s.clientsMu.Unlock()
+	if other, ok := s.nicks[nick]; ok && other != c {
+		return errorf(ErrNickTaken, "nickname %s is already in use", nick)
+	}
+	if s.nicks[c.NickName] == c {
+		delete(s.nicks, c.NickName)
+	}
+	c.NickName = nick
+	if nick != DefaultNickName {
+		s.nicks[nick] = c
+	}
+	return nil
+}
+
+// findClient returns the connected client using nick, if any.
+func (s *Server) findClient(nick string) *Client {
+	s.clientsMu.Lock()
+	defer s.clientsMu.Unlock()
+	return s.nicks[nick]
+}
+
+// sendMOTD writes the MOTD ahead of everything else. IRC clients get it as
+// part of their welcome instead, once they have registered.
+func (s *Server) sendMOTD(conn net.Conn) {
+	if _, ok := conn.(*ircConn); ok || s.MOTD == "" {
+		return
+	}
+	motd := s.MOTD
+	if !strings.HasSuffix(motd, "\n") {
+		motd += "\n"
+	}
+	conn.Write([]byte(motd))
+}
 
-	c.ReadInput()
+func (s *Server) ConnectionCount() int {
+	return int(s.connections.Load())
 }
 
 func (s *Server) NickName(c *Client, args []string) {
-	c.NickName = args[1]
-	c.Message(fmt.Sprintf("all right, Server will know you by %s", c.NickName))
+	if len(args) < 2 || args[1] == "" {
+		c.Error(usageError(CMD_NICKNAME))
+		return
+	}
+	if s.Accounts != nil && c.Account != args[1] && s.Accounts.Exists(args[1]) {
+		c.Error(errorf(ErrPermissionDenied, "nickname %s is registered, use /login to claim it", args[1]))
+		return
+	}
+	oldName := c.NickName
+	if err := s.claimNick(c, args[1]); err != nil {
+		c.Error(err)
+		return
+	}
+	c.renamed(oldName)
+	if c.Room != nil && oldName != c.NickName {
+		c.Room.BroadcastEvent(c, "nick", c.NickName, fmt.Sprintf("%s is now known as %s", oldName, c.NickName))
+	}
+	s.renameMutes(oldName, c.NickName)
+	if oldName != c.NickName {
+		s.Seen.Record(oldName, c.LastSeen)
+		s.Events.OnNickChange(c, oldName, c.NickName)
+	}
 }
 
+// Join moves c into the named room, creating it if needed. Like every
+// mutating command it runs on the Run goroutine with mu held for writing, so
+// looking the room up and storing a new one is a single atomic step: clients
+// racing to join a brand-new room always end up sharing one Room and its
+// history.
 func (s *Server) Join(c *Client, args []string) {
+	if len(args) < 2 || args[1] == "" {
+		c.Error(usageError(CMD_JOIN))
+		return
+	}
 	roomName := args[1]
+	opts, err := parseJoinArgs(args[2:])
+	if err != nil {
+		c.Error(err)
+		return
+	}
+	historySize := opts.historySize
 	r, ok := s.Rooms[roomName]
+	if ok && historySize > 0 {
+		c.Error(errorf(ErrInvalidArgument, "history size can only be set when creating a room"))
+		return
+	}
 	if !ok {
-		r = &Room{
-			Name:    roomName,
-			Members: make(map[net.Addr]*Client),
+		if s.MaxRooms > 0 && len(s.Rooms) >= s.MaxRooms {
+			c.Error(errorf(ErrRoomLimit, "cannot create room, room limit reached"))
+			return
+		}
+		if historySize > 0 && !c.Admin {
+			c.Error(errorf(ErrPermissionDenied, "permission denied: only admins can set the history size"))
+			return
+		}
+		if historySize == 0 {
+			historySize = s.historySizeFor(roomName)
+		}
+		r = s.newRoom(roomName, s.MaxMembersPerRoom, historySize)
+		r.Owner = c
+		if opts.password != "" {
+			r.Lock(opts.password)
 		}
 		s.Rooms[roomName] = r
 	}
-	r.Members[c.Conn.RemoteAddr()] = c
+	if c.Room == r {
+		c.Message(fmt.Sprintf("you are already in %s", r.Name))
+		return
+	}
+	if !c.Admin && !r.IsOwner(c) && r.IsBanned(c) {
+		c.Error(errorf(ErrPermissionDenied, "you are banned from %s", r.Name))
+		return
+	}
+	if !c.Admin && !r.IsOwner(c) && !r.CheckPassword(opts.password) {
+		if opts.password == "" {
+			c.Error(errorf(ErrPermissionDenied, "room %q requires a password. usage: %s", r.Name, commands[CMD_JOIN].Usage))
+		} else {
+			c.Error(errorf(ErrPermissionDenied, "wrong password for room %q", r.Name))
+		}
+		return
+	}
+	if !r.AddMember(c, s.Now()) {
+		c.Error(errorf(ErrRoomFull, "room %q is full", r.Name))
+		return
+	}
 	s.quitCurrentRoom(c)
 
 	c.Room = r
 
-	r.Broadcast(c, fmt.Sprintf("%s has joined the room", c.NickName))
-	c.Message(fmt.Sprintf("Welcome to %s", r.Name))
+	c.welcome(r)
+	for _, m := range r.History.LastN(r.History.Len()) {
+		c.replay(m)
+	}
+	r.markReceived(c, r.LastMessageID())
+	r.BroadcastEvent(c, "join", c.NickName, s.joinedText(c.NickName))
+	s.Events.OnJoin(c, r)
+}
+
+// newRoom builds a room and restores its persisted history, if any.
+func (s *Server) newRoom(name string, maxMembers, historySize int) *Room {
+	r := NewRoom(name, maxMembers, historySize)
+	if words, ok := s.RoomBannedWords[name]; ok {
+		r.Filter = NewRoomFilter(words...)
+	}
+	if s.NewHistory != nil {
+		r.History = s.NewHistory(name, historySize)
+	}
+	if s.PersistentHistory == nil {
+		return r
+	}
+	msgs, err := s.PersistentHistory.Load(name, historySize)
+	if err != nil {
+		s.Logger().WithFields(logrus.Fields{
+			"room":  name,
+			"error": err.Error(),
+		}).Error("failed to load room history")
+	}
+	r.restore(msgs)
+	return r
+}
+
+// historySizeFor falls back to the defaults when the configured size is out of
+// range, since a zero-sized buffer cannot hold anything.
+func (s *Server) historySizeFor(room string) int {
+	if size, ok := s.RoomHistorySizes[room]; ok && validateHistorySize(size) == nil {
+		return size
+	}
+	if validateHistorySize(s.HistorySize) == nil {
+		return s.HistorySize
+	}
+	return DefaultHistorySize
+}
+
+type joinOptions struct {
+	historySize int
+	password    string
+}
+
+// parseJoinArgs reads what may follow /join ROOM: an optional password and
+// the optional --history=N flag. historySize is 0 when the flag is absent.
+func parseJoinArgs(args []string) (joinOptions, error) {
+	var opts joinOptions
+	for _, f := range args {
+		if !strings.HasPrefix(f, "--") {
+			if opts.password != "" {
+				return joinOptions{}, errorf(ErrUsage, "unexpected argument %q. usage: %s", f, commands[CMD_JOIN].Usage)
+			}
+			opts.password = f
+			continue
+		}
+		value, ok := strings.CutPrefix(f, "--history=")
+		if !ok {
+			return joinOptions{}, errorf(ErrUsage, "unknown option %q. usage: %s", f, commands[CMD_JOIN].Usage)
+		}
+		n, err := strconv.Atoi(value)
+		if err != nil {
+			return joinOptions{}, errorf(ErrInvalidArgument, "invalid history size %q", value)
+		}
+		if err := validateHistorySize(n); err != nil {
+			return joinOptions{}, err
+		}
+		opts.historySize = n
+	}
+	return opts, nil
+}
+
+func validateHistorySize(n int) error {
+	if n < 1 || n > MaxHistorySize {
+		return errorf(ErrInvalidArgument, "history size must be between 1 and %d", MaxHistorySize)
+	}
+	return nil
 }
 
 func (s *Server) ListRooms(c *Client, args []string) {
@@ -80,26 +1035,1428 @@ func (s *Server) ListRooms(c *Client, args []string) {
 		rooms = append(rooms, name)
 	}
 
+	if s.ChatV2Replies {
+		if len(rooms) == 0 {
+			rooms = []string{"no rooms available"}
+		}
+		c.Message("Rooms: " + strings.Join(rooms, ", "))
+		return
+	}
 	c.Message(fmt.Sprintf("available rooms are %s", strings.Join(rooms, ", ")))
 }
 
-func (s *Server) Message(c *Client, args []string) {
+// postMessage is the /msg handler: it posts the message and acknowledges it
+// in JSON mode.
+func (s *Server) postMessage(cmd Command) {
+	if id, delivered, ok := s.Message(cmd.Client, cmd.Args); ok {
+		cmd.Client.Ack(cmd.MsgID, id, delivered)
+	}
+}
+
+// Message posts to the client's room and reports the message ID the room
+// assigned and how many members it reached.
+func (s *Server) Message(c *Client, args []string) (uint64, int, bool) {
+	if len(args) < 2 {
+		c.Error(usageError(CMD_MSG))
+		return 0, 0, false
+	}
+	room, text := c.Room, args[1:]
+	if s.MessageRoomArg {
+		// /msg ROOM MESSAGE names the room whenever the first word is an
+		// existing room; otherwise the whole line goes to the current room.
+		// Only members may post, so the room's lock and bans still apply.
+		if r, ok := s.Rooms[args[1]]; ok {
+			if r != c.Room {
+				c.Error(errorf(ErrNotInRoom, "you must join %s to post there", r.Name))
+				return 0, 0, false
+			}
+			text = args[2:]
+		}
+	}
+	if room == nil {
+		c.Error(errorf(ErrNotInRoom, "you must join the room first"))
+		return 0, 0, false
+	}
+
+	id, delivered, err := s.post(c, room, strings.Join(text, " "), 0)
+	if err != nil {
+		c.Error(err)
+		return 0, 0, false
+	}
+	return id, delivered, true
+}
+
+// post sends a chat message, a reply when parentID is not zero, from c to
+// room and returns its ID and how many members it reached. It refuses
+// messages from clients muted for flooding.
+func (s *Server) post(c *Client, room *Room, msg string, parentID uint64) (uint64, int, error) {
+	if err := s.checkFlood(c, room, msg); err != nil {
+		return 0, 0, err
+	}
+	if s.Filter != nil {
+		msg = s.Filter.Filter(msg)
+	}
+	if room.Filter != nil {
+		filtered, ok := room.Filter.Apply(msg)
+		if !ok {
+			return 0, 0, errorf(ErrRejected, "your message uses a word that is not allowed in %s", room.Name)
+		}
+		msg = filtered
+	}
+	if c.Away {
+		s.Back(c, nil)
+	}
+	m := Message{ID: room.NextMessageID(), ParentID: parentID, Kind: KindChat, Nick: c.NickName, Text: msg, Sent: s.Now()}
+	s.record(room, m)
+	delivered, _ := room.Send(c, m)
+	room.Mention(c, m)
+	room.MarkRead(c, m.ID)
+	// the message ends the typing, so the next /typing is announced at once
+	c.lastTyping = time.Time{}
+	s.messages.Add(1)
+	s.audit(c, room, msg)
+	s.Events.OnMessage(c, room, msg)
+
+	for member := range room.Members {
+		if member != c && member.Away && mentions(msg, member.NickName) {
+			c.Message(member.AwayMessage())
+		}
+	}
+	return m.ID, delivered, nil
+}
+
+// record appends m to the room's history and, when configured, the
+// persistent store.
+func (s *Server) record(room *Room, m Message) {
+	room.History.Append(m)
+	if s.PersistentHistory != nil {
+		s.PersistentHistory.Append(room.Name, m.String())
+	}
+}
+
+// parseMessageID reads a message ID as shown in history, with or without the
+// brackets, e.g. "12", "[12]" or "#12".
+func parseMessageID(arg string) (uint64, error) {
+	id, err := strconv.ParseUint(strings.Trim(arg, "[]#"), 10, 64)
+	if err != nil {
+		return 0, errorf(ErrInvalidArgument, "invalid message id %q", arg)
+	}
+	return id, nil
+}
+
+// reply is the /reply handler: it posts a reply to a message in the client's
+// room and acknowledges it like /msg.
+func (s *Server) reply(cmd Command) {
+	c, args := cmd.Client, cmd.Args
+	if len(args) < 3 {
+		c.Error(usageError(CMD_REPLY))
+		return
+	}
+	if c.Room == nil {
+		c.Error(errorf(ErrNotInRoom, "you must join the room first"))
+		return
+	}
+	parentID, err := parseMessageID(args[1])
+	if err != nil {
+		c.Error(err)
+		return
+	}
+	if _, ok := c.Room.FindMessage(parentID); !ok {
+		c.Error(errorf(ErrMessageNotFound, "no message %d in %s", parentID, c.Room.Name))
+		return
+	}
+	id, delivered, err := s.post(c, c.Room, strings.Join(args[2:], " "), parentID)
+	if err != nil {
+		c.Error(err)
+		return
+	}
+	c.Ack(cmd.MsgID, id, delivered)
+}
+
+// Thread shows a message and every reply under it, directly or through other
+// replies, in the order they were posted.
+func (s *Server) Thread(c *Client, args []string) {
+	if len(args) < 2 {
+		c.Error(usageError(CMD_THREAD))
+		return
+	}
 	if c.Room == nil {
-		c.Error(errors.New("you must join the room first"))
+		c.Error(errorf(ErrNotInRoom, "you must join the room first"))
+		return
+	}
+	rootID, err := parseMessageID(args[1])
+	if err != nil {
+		c.Error(err)
+		return
+	}
+	if _, ok := c.Room.FindMessage(rootID); !ok {
+		c.Error(errorf(ErrMessageNotFound, "no message %d in %s", rootID, c.Room.Name))
+		return
+	}
+	// replies always come after their parent, so one pass in posting order
+	// finds the whole thread
+	inThread := map[uint64]bool{rootID: true}
+	for _, m := range c.Room.History.LastN(c.Room.History.Len()) {
+		if m.Kind != KindChat {
+			continue
+		}
+		if m.ID == rootID || inThread[m.ParentID] {
+			inThread[m.ID] = true
+			c.replay(m)
+		}
 	}
-	c.Room.Broadcast(c, c.NickName+" : "+strings.Join(args[1:], " "))
 }
 
-func (s *Server) Quit(c *Client, args []string) {
-	log.Printf("Client has disconnected: %s", c.Conn.RemoteAddr().String())
-	s.quitCurrentRoom(c)
-	c.Message("sad to see you go :(")
-	c.Conn.Close()
+// History pages backwards through a room's history: /history ROOM N shows the
+// last N messages and /history ROOM N ID the N before message ID. Only members
+// of the room and admins may read it.
+func (s *Server) History(c *Client, args []string) {
+	if len(args) < 3 {
+		c.Error(usageError(CMD_HISTORY))
+		return
+	}
+	r, ok := s.Rooms[args[1]]
+	if !ok {
+		c.Error(errorf(ErrRoomNotFound, "room not found"))
+		return
+	}
+	if c.Room != r && !c.Admin {
+		c.Error(errorf(ErrNotInRoom, "you must join %s first", r.Name))
+		return
+	}
+	n, err := strconv.Atoi(args[2])
+	if err != nil || n < 1 || n > MaxHistorySize {
+		c.Error(errorf(ErrInvalidArgument, "N must be between 1 and %d", MaxHistorySize))
+		return
+	}
+	var before uint64
+	if len(args) > 3 {
+		if before, err = parseMessageID(args[3]); err != nil {
+			c.Error(err)
+			return
+		}
+	}
+	page := r.History.Before(before, n)
+	if len(page) == 0 {
+		c.Message(fmt.Sprintf("no more history in %s", r.Name))
+		return
+	}
+	for _, m := range page {
+		c.replay(m)
+	}
 }
 
-func (s *Server) quitCurrentRoom(c *Client) {
-	if c.Room != nil {
-		delete(c.Room.Members, c.Conn.RemoteAddr())
-		c.Room.Broadcast(c, fmt.Sprintf("%s has left the chat", c.NickName))
+// MaxSearchResults caps how many matches /search shows; the newest win.
+const MaxSearchResults = 50
+
+// Search lists the chat messages in a room's history that contain a query,
+// ignoring case, with their IDs and when they were sent. Like /history, only
+// members of the room and admins may search it.
+func (s *Server) Search(c *Client, args []string) {
+	if len(args) < 3 || strings.TrimSpace(strings.Join(args[2:], " ")) == "" {
+		c.Error(usageError(CMD_SEARCH))
+		return
+	}
+	r, ok := s.Rooms[args[1]]
+	if !ok {
+		c.Error(errorf(ErrRoomNotFound, "room not found"))
+		return
+	}
+	if c.Room != r && !c.Admin {
+		c.Error(errorf(ErrNotInRoom, "you must join %s first", r.Name))
+		return
+	}
+	query := strings.Join(args[2:], " ")
+	var matches []Message
+	for _, m := range r.History.Search(query) {
+		if m.Kind == KindChat {
+			matches = append(matches, m)
+		}
+	}
+	if len(matches) == 0 {
+		c.Message(fmt.Sprintf("no messages in %s match %q", r.Name, query))
+		return
+	}
+	matches = matches[max(0, len(matches)-MaxSearchResults):]
+	c.Message(fmt.Sprintf("%d messages in %s match %q:", len(matches), r.Name, query))
+	for _, m := range matches {
+		sent := "unknown time"
+		if !m.Sent.IsZero() {
+			sent = m.Sent.UTC().Format(time.DateTime)
+		}
+		c.Message(fmt.Sprintf("%s %s", sent, m))
+	}
+}
+
+// MaxReactionLength caps a reaction, in runes, after filtering.
+const MaxReactionLength = 32
+
+// React attaches an emoji reaction to a message in the client's room.
+func (s *Server) React(c *Client, args []string) {
+	if len(args) < 3 || args[2] == "" {
+		c.Error(usageError(CMD_REACT))
+		return
+	}
+	if c.Room == nil {
+		c.Error(errorf(ErrNotInRoom, "you must join the room first"))
+		return
+	}
+	id, err := parseMessageID(args[1])
+	if err != nil {
+		c.Error(err)
+		return
+	}
+	if _, ok := c.Room.FindMessage(id); !ok {
+		c.Error(errorf(ErrMessageNotFound, "no message %d in %s", id, c.Room.Name))
+		return
+	}
+	emoji := args[2]
+	if s.Filter != nil {
+		emoji = s.Filter.Filter(emoji)
+	}
+	if utf8.RuneCountInString(emoji) > MaxReactionLength {
+		c.Error(errorf(ErrInvalidArgument, "reaction is longer than %d characters", MaxReactionLength))
+		return
+	}
+	rx := Message{ParentID: id, Kind: KindReaction, Nick: c.NickName, Text: emoji, Sent: s.Now()}
+	s.record(c.Room, rx)
+	c.Room.React(rx)
+}
+
+// Rename moves a room to a new name. It runs on the Run goroutine under the
+// rooms lock, so no command ever sees both names or neither.
+func (s *Server) Rename(c *Client, args []string) {
+	if len(args) < 3 {
+		c.Error(usageError(CMD_RENAME))
+		return
+	}
+	oldName, newName := args[1], args[2]
+	r, ok := s.Rooms[oldName]
+	if !ok {
+		c.Error(errorf(ErrRoomNotFound, "room not found"))
+		return
+	}
+	if !c.Admin && !r.IsOwner(c) {
+		c.Error(errorf(ErrPermissionDenied, "permission denied"))
+		return
+	}
+	if _, exists := s.Rooms[newName]; exists {
+		c.Error(errorf(ErrRoomExists, "room %q already exists", newName))
+		return
+	}
+
+	if s.PersistentHistory != nil {
+		if err := s.PersistentHistory.Rename(oldName, newName); err != nil {
+			s.Logger().WithFields(logrus.Fields{
+				"room":  oldName,
+				"error": err.Error(),
+			}).Error("failed to move room history")
+		}
+	}
+	delete(s.Rooms, oldName)
+	r.Name = newName
+	s.Rooms[newName] = r
+	s.renameHooks(oldName, newName)
+	if rs, ok := s.Events.(RoomStateSink); ok {
+		rs.OnRoomRename(oldName, newName)
+	}
+	r.Announce(fmt.Sprintf("this room is now called %s", newName))
+	if c.Room != r {
+		c.Message(fmt.Sprintf("renamed %s to %s", oldName, newName))
+	}
+}
+
+// Lock makes a room require a password to join. Members already inside stay.
+func (s *Server) Lock(c *Client, args []string) {
+	if len(args) < 3 || args[2] == "" {
+		c.Error(usageError(CMD_LOCK))
+		return
+	}
+	r, ok := s.Rooms[args[1]]
+	if !ok {
+		c.Error(errorf(ErrRoomNotFound, "room not found"))
+		return
+	}
+	if !c.Admin && !r.IsOwner(c) {
+		c.Error(errorf(ErrPermissionDenied, "permission denied"))
+		return
+	}
+	r.Lock(args[2])
+	c.Message(fmt.Sprintf("locked %s", r.Name))
+}
+
+func (s *Server) Unlock(c *Client, args []string) {
+	if len(args) < 2 {
+		c.Error(usageError(CMD_UNLOCK))
+		return
+	}
+	r, ok := s.Rooms[args[1]]
+	if !ok {
+		c.Error(errorf(ErrRoomNotFound, "room not found"))
+		return
+	}
+	if !c.Admin && !r.IsOwner(c) {
+		c.Error(errorf(ErrPermissionDenied, "permission denied"))
+		return
+	}
+	r.Unlock()
+	c.Message(fmt.Sprintf("unlocked %s", r.Name))
+}
+
+func (s *Server) Clear(c *Client, args []string) {
+	if c.Room == nil {
+		c.Error(errorf(ErrNotInRoom, "you must join the room first"))
+		return
+	}
+	if !c.Admin && !c.Room.IsOwner(c) {
+		c.Error(errorf(ErrPermissionDenied, "permission denied"))
+		return
+	}
+	c.Room.History.Clear()
+	s.deleteHistory(c.Room.Name)
+	c.Room.Announce(fmt.Sprintf("room history cleared by %s", c.NickName))
+}
+
+// deleteHistory drops the persisted history of a room, so a cleared or
+// deleted room does not come back on the next start.
+func (s *Server) deleteHistory(room string) {
+	if s.PersistentHistory == nil {
+		return
+	}
+	if err := s.PersistentHistory.Delete(room); err != nil {
+		s.Logger().WithFields(logrus.Fields{
+			"room":  room,
+			"error": err.Error(),
+		}).Error("failed to delete room history")
+	}
+}
+
+// Set changes a setting of the client's room. Only the operator and admins
+// may; the one setting so far is "history N", the number of messages the room
+// keeps.
+func (s *Server) Set(c *Client, args []string) {
+	if len(args) < 3 || args[1] != "history" {
+		c.Error(usageError(CMD_SET))
+		return
+	}
+	if c.Room == nil {
+		c.Error(errorf(ErrNotInRoom, "you must join the room first"))
+		return
+	}
+	if !c.Admin && !c.Room.IsOwner(c) {
+		c.Error(errorf(ErrPermissionDenied, "permission denied"))
+		return
+	}
+	n, err := strconv.Atoi(args[2])
+	if err != nil {
+		c.Error(errorf(ErrInvalidArgument, "history size must be a number"))
+		return
+	}
+	if err := validateHistorySize(n); err != nil {
+		c.Error(err)
+		return
+	}
+	c.Room.History.Resize(n)
+	c.Room.Announce(fmt.Sprintf("%s set the history size of %s to %d", c.NickName, c.Room.Name, n))
+}
+
+// FilterWords is the /filter handler: operators add and remove the words
+// their room disallows and choose whether messages using them are masked or
+// rejected. With no arguments it lists the room's filter.
+func (s *Server) FilterWords(c *Client, args []string) {
+	r := c.Room
+	if r == nil {
+		c.Error(errorf(ErrNotInRoom, "you must join the room first"))
+		return
+	}
+	if len(args) < 2 {
+		if r.Filter == nil || len(r.Filter.Words()) == 0 {
+			c.Message(fmt.Sprintf("no words are filtered in %s", r.Name))
+			return
+		}
+		c.Message(fmt.Sprintf("%s filters (%s): %s", r.Name, r.Filter.Mode, strings.Join(r.Filter.Words(), ", ")))
+		return
+	}
+	if !c.Admin && !r.IsOwner(c) {
+		c.Error(errorf(ErrPermissionDenied, "permission denied"))
+		return
+	}
+	if len(args) < 3 {
+		c.Error(usageError(CMD_FILTER))
+		return
+	}
+	if r.Filter == nil {
+		r.Filter = NewRoomFilter()
+	}
+	switch args[1] {
+	case "add":
+		replacement := strings.Join(args[3:], " ")
+		if !r.Filter.Add(args[2], replacement) {
+			c.Error(errorf(ErrInvalidArgument, "%q is not a single word", args[2]))
+			return
+		}
+		c.Message(fmt.Sprintf("filtering %s in %s", strings.ToLower(args[2]), r.Name))
+	case "remove":
+		if !r.Filter.Remove(args[2]) {
+			c.Error(errorf(ErrInvalidArgument, "%s is not filtered in %s", args[2], r.Name))
+			return
+		}
+		c.Message(fmt.Sprintf("no longer filtering %s in %s", strings.ToLower(args[2]), r.Name))
+	case "mode":
+		mode := FilterMode(args[2])
+		if mode != FilterMask && mode != FilterReject {
+			c.Error(usageError(CMD_FILTER))
+			return
+		}
+		r.Filter.Mode = mode
+		c.Message(fmt.Sprintf("filtered words in %s are now handled with %s", r.Name, mode))
+	default:
+		c.Error(usageError(CMD_FILTER))
+		return
+	}
+	s.Logger().WithFields(logrus.Fields{
+		"nick":   c.NickName,
+		"room":   r.Name,
+		"action": args[1],
+	}).Info("room filter changed")
+}
+
+func (s *Server) ColorMode(c *Client, args []string) {
+	if len(args) < 2 || (args[1] != "on" && args[1] != "off") {
+		c.Error(usageError(CMD_COLOR))
+		return
+	}
+	c.color.Store(args[1] == "on")
+	c.Message(fmt.Sprintf("color %s", args[1]))
+}
+
+// DoNotDisturb toggles DND mode: while it is on, room chat is only delivered
+// when it mentions the client's nickname.
+func (s *Server) DoNotDisturb(c *Client, args []string) {
+	if len(args) < 2 || (args[1] != "on" && args[1] != "off") {
+		c.Error(usageError(CMD_DND))
+		return
+	}
+	c.DND = args[1] == "on"
+	c.Message(fmt.Sprintf("do not disturb %s", args[1]))
+}
+
+// TypingDebounce is the least time between two typing notices from one
+// client; more frequent /typing commands are dropped silently.
+const TypingDebounce = 3 * time.Second
+
+// Typing announces that the client is typing, or with on|off chooses whether
+// the client receives typing notices from others.
+func (s *Server) Typing(c *Client, args []string) {
+	if len(args) > 1 && args[1] != "" {
+		if args[1] != "on" && args[1] != "off" {
+			c.Error(usageError(CMD_TYPING))
+			return
+		}
+		c.HideTyping = args[1] == "off"
+		c.Message(fmt.Sprintf("typing notices %s", args[1]))
+		return
+	}
+	if c.Room == nil {
+		return
+	}
+	now := s.Now()
+	if now.Sub(c.lastTyping) < TypingDebounce {
+		return
+	}
+	c.lastTyping = now
+	c.Room.Typing(c)
+}
+
+func (s *Server) JSONMode(c *Client, args []string) {
+	if len(args) < 2 || (args[1] != "on" && args[1] != "off") {
+		c.Error(usageError(CMD_JSON))
+		return
+	}
+	c.jsonMode.Store(args[1] == "on")
+	c.Message(fmt.Sprintf("json mode %s", args[1]))
+}
+
+// maxUsersListed caps /users output on busy servers.
+const maxUsersListed = 100
+
+func (s *Server) Users(c *Client, args []string) {
+	s.clientsMu.Lock()
+	entries := make([]string, 0, len(s.clients))
+	for u := range s.clients {
+		room := "none"
+		if u.Room != nil {
+			room = u.Room.Name
+		}
+		entries = append(entries, fmt.Sprintf("%s [%s]", u.NickName, room))
+	}
+	s.clientsMu.Unlock()
+
+	sort.Strings(entries)
+	total := len(entries)
+	if total > maxUsersListed {
+		entries = append(entries[:maxUsersListed], fmt.Sprintf("... and %d more", total-maxUsersListed))
+	}
+	c.Message(fmt.Sprintf("connected users (%d): %s", total, strings.Join(entries, ", ")))
+}
+
+// Help lists every command with its description, or describes the one named.
+func (s *Server) Help(c *Client, args []string) {
+	if len(args) > 1 && args[1] != "" {
+		name := args[1]
+		if !strings.HasPrefix(name, "/") {
+			name = "/" + name
+		}
+		id, ok := commandsByName[resolveAlias(name)]
+		if !ok {
+			c.Error(errorf(ErrUnknownCommand, "Unknown command: %s", name))
+			return
+		}
+		spec := commands[id]
+		c.Message(fmt.Sprintf("%s - %s", spec.Usage, spec.Description))
+		return
+	}
+	specs := make([]*CommandSpec, 0, len(commands))
+	for _, spec := range commands {
+		specs = append(specs, spec)
+	}
+	sort.Slice(specs, func(i, j int) bool {
+		return specs[i].Name() < specs[j].Name()
+	})
+	c.Message("available commands:")
+	for _, spec := range specs {
+		if spec.AdminOnly && !c.Admin {
+			continue
+		}
+		c.Message(fmt.Sprintf("%s - %s", spec.Usage, spec.Description))
+	}
+}
+
+// Who lists the members of a room, the current one by default, with their
+// presence, how long ago they joined and how long they have been idle.
+func (s *Server) Who(c *Client, args []string) {
+	r := c.Room
+	if len(args) > 1 && args[1] != "" {
+		var ok bool
+		if r, ok = s.Rooms[args[1]]; !ok {
+			c.Error(errorf(ErrRoomNotFound, "room not found"))
+			return
+		}
+	}
+	if r == nil {
+		c.Error(errorf(ErrNotInRoom, "you must join the room first. usage: %s", commands[CMD_WHO].Usage))
+		return
+	}
+	members := make([]*Client, 0, len(r.Members))
+	for m := range r.Members {
+		members = append(members, m)
+	}
+	sort.Slice(members, func(i, j int) bool {
+		return members[i].NickName < members[j].NickName
+	})
+	now := s.Now()
+	entries := make([]string, len(members))
+	for i, m := range members {
+		entries[i] = fmt.Sprintf("%s (%s, joined %s ago, idle %s)",
+			m.NickName, m.Presence(), formatDuration(now.Sub(r.JoinedAt(m))), formatDuration(now.Sub(m.LastSeen)))
+	}
+	c.Message(fmt.Sprintf("members of %s (%d): %s", r.Name, len(entries), strings.Join(entries, ", ")))
+}
+
+// MarkRead is the /read handler: it acknowledges the messages in the client's
+// room up to an ID, or all of them.
+func (s *Server) MarkRead(c *Client, args []string) {
+	r := c.Room
+	if r == nil {
+		c.Error(errorf(ErrNotInRoom, "you must join the room first"))
+		return
+	}
+	id := r.LastMessageID()
+	if len(args) > 1 && args[1] != "" {
+		var err error
+		if id, err = parseMessageID(args[1]); err != nil {
+			c.Error(err)
+			return
+		}
+		if id > r.LastMessageID() {
+			c.Error(errorf(ErrMessageNotFound, "no message %d in %s", id, r.Name))
+			return
+		}
+	}
+	r.MarkRead(c, id)
+	c.Message(fmt.Sprintf("read up to %d in %s", r.Cursor(c).Read, r.Name))
+}
+
+// ReadReceipts lists how far each member of a room has received and read.
+func (s *Server) ReadReceipts(c *Client, args []string) {
+	r := c.Room
+	if len(args) > 1 && args[1] != "" {
+		var ok bool
+		if r, ok = s.Rooms[args[1]]; !ok {
+			c.Error(errorf(ErrRoomNotFound, "room not found"))
+			return
+		}
+	}
+	if r == nil {
+		c.Error(errorf(ErrNotInRoom, "you must join the room first. usage: %s", commands[CMD_SEEN].Usage))
+		return
+	}
+	members := make([]*Client, 0, len(r.Members))
+	for m := range r.Members {
+		members = append(members, m)
+	}
+	sort.Slice(members, func(i, j int) bool {
+		return members[i].NickName < members[j].NickName
+	})
+	entries := make([]string, len(members))
+	for i, m := range members {
+		cur := r.Cursor(m)
+		entries[i] = fmt.Sprintf("%s (read %d, received %d)", m.NickName, cur.Read, cur.Received)
+	}
+	c.Message(fmt.Sprintf("read receipts for %s (latest %d): %s", r.Name, r.LastMessageID(), strings.Join(entries, ", ")))
+}
+
+// Last reports whether a nickname is online, or how long ago it was last
+// active.
+func (s *Server) Last(c *Client, args []string) {
+	if len(args) < 2 || args[1] == "" {
+		c.Error(usageError(CMD_LAST))
+		return
+	}
+	nick := args[1]
+	if s.findClient(nick) != nil {
+		c.Message(fmt.Sprintf("%s is online now", nick))
+		return
+	}
+	now := s.Now()
+	at, ok := s.Seen.Lookup(nick, now)
+	if !ok {
+		c.Error(errorf(ErrUserNotFound, "unknown user"))
+		return
+	}
+	c.Message(fmt.Sprintf("%s was last seen %s ago", nick, formatDuration(now.Sub(at))))
+}
+
+// Ping answers /ping with pong, echoing any argument, so clients can check
+// the connection is alive.
+func (s *Server) Ping(c *Client, args []string) {
+	c.Message(strings.TrimSpace("pong " + strings.Join(args[1:], " ")))
+}
+
+// Pong is the reply to the server's PING. Reading it is all the heartbeat
+// needs, so there is nothing left to do.
+func (s *Server) Pong(c *Client, args []string) {}
+
+func (s *Server) Uptime(c *Client, args []string) {
+	c.Message(fmt.Sprintf("up %s", formatDuration(s.Now().Sub(s.startedAt))))
+}
+
+func (s *Server) Stats(c *Client, args []string) {
+	c.Message(fmt.Sprintf("connections: %d, rooms: %d, messages: %d",
+		s.ConnectionCount(), len(s.Rooms), s.messages.Load()))
+}
+
+func (s *Server) Admin(c *Client, args []string) {
+	if len(args) < 2 {
+		c.Error(usageError(CMD_ADMIN))
+		return
+	}
+	if s.AdminToken == "" || subtle.ConstantTimeCompare([]byte(args[1]), []byte(s.AdminToken)) != 1 {
+		c.Error(errorf(ErrInvalidToken, "invalid admin token"))
+		return
+	}
+	c.Admin = true
+	c.Message("you are now an admin")
+}
+
+// grantAdminNick makes c an admin if its account is one of AdminNicks.
+func (s *Server) grantAdminNick(c *Client) {
+	if c.Admin || c.Account == "" {
+		return
+	}
+	for _, nick := range s.AdminNicks {
+		if nick == c.Account {
+			c.Admin = true
+			c.Message("you are now an admin")
+			return
+		}
+	}
+}
+
+// Register creates an account for nick and logs the client in as it. The
+// password is hashed on its own goroutine; the result comes back through
+// cmdDeferred.
+func (s *Server) Register(c *Client, args []string) {
+	if s.Accounts == nil {
+		c.Error(errorf(ErrUnavailable, "accounts are disabled"))
+		return
+	}
+	if len(args) < 3 || args[1] == "" {
+		c.Error(usageError(CMD_REGISTER))
+		return
+	}
+	nick, password := args[1], args[2]
+	if nick == DefaultNickName {
+		c.Error(errorf(ErrInvalidArgument, "%s cannot be registered", nick))
+		return
+	}
+	if len(password) < MinPasswordLength {
+		c.Error(errorf(ErrInvalidArgument, "password must be at least %d characters", MinPasswordLength))
+		return
+	}
+	if s.Accounts.Exists(nick) {
+		c.Error(errorf(ErrNickTaken, "nickname %s is already registered", nick))
+		return
+	}
+	if other := s.findClient(nick); other != nil && other != c {
+		c.Error(errorf(ErrNickTaken, "nickname %s is already in use", nick))
+		return
+	}
+	if !s.startHashing(c) {
+		return
+	}
+	go func() {
+		err := s.Accounts.Register(nick, password)
+		s.Enqueue(Command{ID: cmdDeferred, Client: c, fn: func() {
+			c.hashing = false
+			if errors.Is(err, errAccountExists) {
+				c.Error(errorf(ErrNickTaken, "nickname %s is already registered", nick))
+				return
+			}
+			if err != nil {
+				s.Logger().WithFields(logrus.Fields{
+					"nick":  nick,
+					"error": err.Error(),
+				}).Error("failed to register account")
+				c.Error(errorf(ErrInternal, "unable to register %s", nick))
+				return
+			}
+			c.Message(fmt.Sprintf("registered %s", nick))
+			s.authenticate(c, nick)
+		}})
+	}()
+}
+
+// Login checks the password for nick off the Run goroutine and, if it
+// matches, gives the client that nickname.
+func (s *Server) Login(c *Client, args []string) {
+	if s.Accounts == nil {
+		c.Error(errorf(ErrUnavailable, "accounts are disabled"))
+		return
+	}
+	if len(args) < 3 || args[1] == "" {
+		c.Error(usageError(CMD_LOGIN))
+		return
+	}
+	nick, password := args[1], args[2]
+	if c.Account == nick {
+		c.Message(fmt.Sprintf("you are already logged in as %s", nick))
+		return
+	}
+	if err := s.checkLoginBackoff(c); err != nil {
+		c.Error(err)
+		return
+	}
+	if !s.startHashing(c) {
+		return
+	}
+	go func() {
+		ok := s.Accounts.Verify(nick, password)
+		s.Enqueue(Command{ID: cmdDeferred, Client: c, fn: func() {
+			c.hashing = false
+			if !ok {
+				s.loginFailed(c)
+				c.Error(errorf(ErrAuthFailed, "invalid nickname or password"))
+				return
+			}
+			s.loginSucceeded(c)
+			if other := s.findClient(nick); other != nil && other != c {
+				c.Error(errorf(ErrNickTaken, "%s is already logged in elsewhere", nick))
+				return
+			}
+			c.Message(fmt.Sprintf("you are now logged in as %s", nick))
+			s.authenticate(c, nick)
+		}})
+	}()
+}
+
+// startHashing lets c have one /register or /login hashing at a time, so a
+// client cannot queue up unbounded bcrypt work.
+func (s *Server) startHashing(c *Client) bool {
+	if c.hashing {
+		c.Error(errorf(ErrRateLimited, "wait for your last /register or /login to finish"))
+		return false
+	}
+	c.hashing = true
+	return true
+}
+
+// authenticate marks c as the owner of the account nick, switches it to that
+// nickname and swaps its session token for a signed one that can /resume the
+// account.
+func (s *Server) authenticate(c *Client, nick string) {
+	c.Account = nick
+	if c.NickName != nick {
+		s.NickName(c, []string{"/name", nick})
+	}
+	s.grantAdminNick(c)
+	if s.Sessions == nil {
+		return
+	}
+	token, err := s.Sessions.Sign(nick)
+	if err != nil {
+		s.Logger().WithFields(logrus.Fields{
+			"nick":  nick,
+			"error": err.Error(),
+		}).Error("failed to sign session token")
+		return
+	}
+	if c.SessionToken != "" {
+		s.Sessions.Revoke(c.SessionToken)
+	}
+	c.SessionToken = token
+	c.Message(fmt.Sprintf("your session token: %s", token))
+}
+
+// Ban bans a user from the whole server by address when an admin uses it.
+// For the operator of the current room it bans the user from that room only.
+func (s *Server) Ban(c *Client, args []string) {
+	if len(args) < 2 {
+		c.Error(usageError(CMD_BAN))
+		return
+	}
+	if !c.Admin {
+		s.roomBan(c, args[1])
+		return
+	}
+	target := s.findClient(args[1])
+	if target == nil {
+		c.Error(errorf(ErrUserNotFound, "no user named %s", args[1]))
+		return
+	}
+	ip := remoteIP(target.Conn)
+	if err := s.Bans.Ban(ip); err != nil {
+		c.Error(errorf(ErrInternal, "unable to ban %s: %v", ip, err))
+		return
+	}
+	s.Logger().WithFields(logrus.Fields{
+		"admin":  c.NickName,
+		"target": target.NickName,
+		"ip":     ip,
+	}).Info("banned client")
+	c.Message(fmt.Sprintf("banned %s (%s)", target.NickName, ip))
+
+	target.write("you are banned\n")
+	s.closeClient(target, ReasonBanned)
+}
+
+// roomBan bans nick, and its address when it is online, from the operator's
+// current room for as long as the room exists.
+func (s *Server) roomBan(c *Client, nick string) {
+	r := c.Room
+	if r == nil || !r.IsOwner(c) {
+		c.Error(errorf(ErrPermissionDenied, "permission denied"))
+		return
+	}
+	if nick == c.NickName {
+		c.Error(errorf(ErrInvalidArgument, "you cannot ban yourself"))
+		return
+	}
+	ip := ""
+	target := s.findClient(nick)
+	if target != nil {
+		ip = remoteIP(target.Conn)
+	}
+	r.Ban(nick, ip)
+	if target != nil && target.Room == r {
+		s.removeFromRoom(target, fmt.Sprintf("%s was banned by %s", nick, c.NickName))
+		target.Message(fmt.Sprintf("you were banned from %s by %s", r.Name, c.NickName))
+	}
+	c.Message(fmt.Sprintf("banned %s from %s", nick, r.Name))
+}
+
+// Kick removes a member from the room. Operators can kick from their own
+// room, admins from any room.
+func (s *Server) Kick(c *Client, args []string) {
+	if len(args) < 2 || args[1] == "" {
+		c.Error(usageError(CMD_KICK))
+		return
+	}
+	target := s.findClient(args[1])
+	if target == nil || target.Room == nil {
+		c.Error(errorf(ErrUserNotFound, "%s is not in a room", args[1]))
+		return
+	}
+	if target == c {
+		c.Error(errorf(ErrInvalidArgument, "you cannot kick yourself"))
+		return
+	}
+	r := target.Room
+	if !c.Admin && (c.Room != r || !r.IsOwner(c)) {
+		c.Error(errorf(ErrPermissionDenied, "permission denied"))
+		return
+	}
+	s.removeFromRoom(target, fmt.Sprintf("%s was kicked by %s", target.NickName, c.NickName))
+	target.Message(fmt.Sprintf("you were kicked from %s by %s", r.Name, c.NickName))
+	if c.Room != r {
+		c.Message(fmt.Sprintf("kicked %s from %s", target.NickName, r.Name))
+	}
+}
+
+// removeFromRoom takes c out of its room and tells the remaining members why.
+func (s *Server) removeFromRoom(c *Client, notice string) {
+	r := c.Room
+	r.RemoveMember(c)
+	c.Room = nil
+	r.BroadcastEvent(nil, "leave", c.NickName, notice)
+	s.Events.OnLeave(c, r)
+	c.parted(r, notice)
+}
+
+// Leave takes the client out of its room without joining another.
+func (s *Server) Leave(c *Client, args []string) {
+	r := c.Room
+	if r == nil {
+		c.Error(errorf(ErrNotInRoom, "you are not in a room"))
+		return
+	}
+	s.removeFromRoom(c, s.leftText(c.NickName, "the room"))
+	c.Message(fmt.Sprintf("you left %s", r.Name))
+}
+
+func (s *Server) Unban(c *Client, args []string) {
+	if !c.Admin {
+		c.Error(errorf(ErrPermissionDenied, "permission denied"))
+		return
+	}
+	if len(args) < 2 {
+		c.Error(usageError(CMD_UNBAN))
+		return
+	}
+	unbanned, err := s.Bans.Unban(args[1])
+	if err != nil {
+		c.Error(errorf(ErrInternal, "unable to unban %s: %v", args[1], err))
+		return
+	}
+	if !unbanned {
+		c.Error(errorf(ErrInvalidArgument, "%s is not banned", args[1]))
+		return
+	}
+	s.Logger().WithFields(logrus.Fields{
+		"admin": c.NickName,
+		"ip":    args[1],
+	}).Info("unbanned address")
+	c.Message(fmt.Sprintf("unbanned %s", args[1]))
+}
+
+// BanIP bans an address or CIDR range from the server, for good or for the
+// given duration, and disconnects every client connected from it.
+func (s *Server) BanIP(c *Client, args []string) {
+	if len(args) < 2 || args[1] == "" {
+		c.Error(usageError(CMD_BANIP))
+		return
+	}
+	var d time.Duration
+	if len(args) > 2 {
+		var err error
+		d, err = time.ParseDuration(args[2])
+		if err != nil || d <= 0 {
+			c.Error(errorf(ErrInvalidArgument, "%s is not a duration such as 30m or 24h", args[2]))
+			return
+		}
+	}
+	if err := s.Bans.BanFor(args[1], d); err != nil {
+		var parseErr *net.ParseError
+		if errors.As(err, &parseErr) {
+			c.Error(errorf(ErrInvalidArgument, "%s is not an IP address or CIDR range", args[1]))
+		} else {
+			c.Error(errorf(ErrInternal, "unable to ban %s: %v", args[1], err))
+		}
+		return
+	}
+	var targets []*Client
+	s.clientsMu.Lock()
+	for other := range s.clients {
+		if other != c && s.Bans.IsBanned(remoteIP(other.Conn)) {
+			targets = append(targets, other)
+		}
+	}
+	s.clientsMu.Unlock()
+	s.Logger().WithFields(logrus.Fields{
+		"admin":        c.NickName,
+		"entry":        args[1],
+		"duration":     d.String(),
+		"disconnected": len(targets),
+	}).Info("banned address")
+	for _, target := range targets {
+		target.write("you are banned\n")
+		s.closeClient(target, ReasonBanned)
+	}
+	if d > 0 {
+		c.Message(fmt.Sprintf("banned %s for %s, disconnecting %d clients", args[1], d, len(targets)))
+		return
+	}
+	c.Message(fmt.Sprintf("banned %s, disconnecting %d clients", args[1], len(targets)))
+}
+
+// Announce sends an announcement to every connected client.
+func (s *Server) Announce(c *Client, args []string) {
+	text, err := announcement(strings.Join(args[1:], " "))
+	if err != nil {
+		c.Error(errorf(ErrUsage, "%v. usage: %s", err, commands[CMD_ANNOUNCE].Usage))
+		return
+	}
+	s.Logger().WithFields(logrus.Fields{
+		"admin": c.NickName,
+	}).Info("announcement sent")
+	s.announce(nil, text)
+}
+
+// RequestShutdown asks the program running the server to shut it down,
+// announcing the admin's message first if there is one. See
+// ShutdownRequested.
+func (s *Server) RequestShutdown(c *Client, args []string) {
+	if text := strings.TrimSpace(strings.Join(args[1:], " ")); text != "" {
+		text, err := announcement(text)
+		if err != nil {
+			c.Error(err)
+			return
+		}
+		s.announce(nil, text)
+	}
+	s.Logger().WithFields(logrus.Fields{
+		"admin": c.NickName,
+	}).Warn("shutdown requested")
+	s.shutdownOnce.Do(func() {
+		close(s.shutdownRequested)
+	})
+	c.Message("shutdown requested")
+}
+
+// ShutdownRequested is closed once an admin types /shutdown. The server does
+// not stop by itself: whatever runs it should call Shutdown, as config.Main
+// does.
+func (s *Server) ShutdownRequested() <-chan struct{} {
+	return s.shutdownRequested
+}
+
+// Invite asks another client to join the inviter's current room.
+func (s *Server) Invite(c *Client, args []string) {
+	if len(args) < 2 || args[1] == "" {
+		c.Error(usageError(CMD_INVITE))
+		return
+	}
+	if c.Room == nil {
+		c.Error(errorf(ErrNotInRoom, "you must join the room first"))
+		return
+	}
+	target := s.findClient(args[1])
+	if target == nil {
+		c.Error(errorf(ErrUserNotFound, "no user named %s", args[1]))
+		return
+	}
+	if target == c {
+		c.Error(errorf(ErrInvalidArgument, "you cannot invite yourself"))
+		return
+	}
+	if target.Room == c.Room {
+		c.Error(errorf(ErrInvalidArgument, "%s is already in %s", target.NickName, c.Room.Name))
+		return
+	}
+	target.Message(fmt.Sprintf("%s invites you to join %s (type /join %s)", c.NickName, c.Room.Name, c.Room.Name))
+	c.Message(fmt.Sprintf("invited %s to %s", target.NickName, c.Room.Name))
+}
+
+// DirectMessage delivers a private message to one client, wherever it is.
+func (s *Server) DirectMessage(c *Client, args []string) {
+	if len(args) < 3 || args[1] == "" {
+		c.Error(usageError(CMD_DM))
+		return
+	}
+	target := s.findClient(args[1])
+	if target == nil {
+		c.Error(errorf(ErrUserNotFound, "%s is not online", args[1]))
+		return
+	}
+	if target == c {
+		c.Error(errorf(ErrInvalidArgument, "you cannot message yourself"))
+		return
+	}
+	msg := strings.Join(args[2:], " ")
+	if s.Filter != nil {
+		msg = s.Filter.Filter(msg)
+	}
+	if !target.HasMuted(c.NickName) {
+		if err := target.deliverDM(c.NickName, msg); err != nil {
+			writeErrorsCounter.WithLabelValues("reply").Inc()
+		}
+	}
+	s.auditDM(c, target, msg)
+	c.Message(fmt.Sprintf("[dm to %s] %s", target.NickName, msg))
+	if target.Away {
+		c.Message(target.AwayMessage())
+	}
+}
+
+func (s *Server) Mute(c *Client, args []string) {
+	if len(args) < 2 {
+		c.Error(usageError(CMD_MUTE))
+		return
+	}
+	nick := args[1]
+	if nick == c.NickName {
+		c.Error(errorf(ErrInvalidArgument, "you cannot mute yourself"))
+		return
+	}
+	if c.Muted == nil {
+		c.Muted = make(map[string]bool)
+	}
+	c.Muted[nick] = true
+	c.Message(fmt.Sprintf("muted %s", nick))
+}
+
+func (s *Server) Unmute(c *Client, args []string) {
+	if len(args) < 2 {
+		c.Error(usageError(CMD_UNMUTE))
+		return
+	}
+	nick := args[1]
+	if !c.Muted[nick] {
+		c.Error(errorf(ErrInvalidArgument, "%s is not muted", nick))
+		return
+	}
+	delete(c.Muted, nick)
+	c.Message(fmt.Sprintf("unmuted %s", nick))
+}
+
+// renameMutes carries mutes over to a user's new nickname so renaming does not
+// escape them.
+func (s *Server) renameMutes(oldName, newName string) {
+	if oldName == newName {
+		return
+	}
+	s.clientsMu.Lock()
+	defer s.clientsMu.Unlock()
+	for c := range s.clients {
+		if c.Muted[oldName] {
+			delete(c.Muted, oldName)
+			c.Muted[newName] = true
+		}
+	}
+}
+
+func (s *Server) audit(c *Client, room *Room, msg string) {
+	if s.Audit == nil {
+		return
+	}
+	s.Audit.Audit(AuditEntry{
+		Time:       time.Now(),
+		Room:       room.Name,
+		NickName:   c.NickName,
+		RemoteAddr: c.Conn.RemoteAddr().String(),
+		Message:    msg,
+	})
+}
+
+func (s *Server) auditDM(c *Client, target *Client, msg string) {
+	if s.Audit == nil {
+		return
+	}
+	s.Audit.Audit(AuditEntry{
+		Time:       time.Now(),
+		Target:     target.NickName,
+		NickName:   c.NickName,
+		RemoteAddr: c.Conn.RemoteAddr().String(),
+		Message:    msg,
+	})
+}
+
+func (s *Server) Away(c *Client, args []string) {
+	c.Away = true
+	c.AwayReason = strings.Join(args[1:], " ")
+	c.Message("you are now marked as away")
+}
+
+func (s *Server) Back(c *Client, args []string) {
+	if !c.Away {
+		c.Message("you are not marked as away")
+		return
+	}
+	c.Away = false
+	c.AwayReason = ""
+	c.Message("welcome back, you are no longer away")
+}
+
+// MaxQuitMessageLength caps the optional /quit message, in runes.
+const MaxQuitMessageLength = 200
+
+// Quit disconnects the client. Anything after /quit is shown to the room as
+// the client's parting words.
+func (s *Server) Quit(c *Client, args []string) {
+	msg := strings.TrimSpace(strings.Join(args[1:], " "))
+	if s.Filter != nil && msg != "" {
+		msg = s.Filter.Filter(msg)
+	}
+	if r := []rune(msg); len(r) > MaxQuitMessageLength {
+		msg = string(r[:MaxQuitMessageLength])
+	}
+	c.quitMessage = msg
+	if s.Sessions != nil && c.SessionToken != "" {
+		s.Sessions.Revoke(c.SessionToken)
+	}
+	c.Message("sad to see you go :(")
+	s.closeClient(c, ReasonQuit)
+}
+
+// disconnect cleans up after a connection that dropped without /quit, keeping
+// its session around so the client can /resume.
+func (s *Server) disconnect(c *Client) {
+	if c.left {
+		return
+	}
+	if s.Sessions != nil && c.SessionToken != "" {
+		roomName := ""
+		if c.Room != nil {
+			roomName = c.Room.Name
+		}
+		s.Sessions.Save(c.SessionToken, c.NickName, roomName)
+	}
+	s.closeClient(c, c.leaveReason)
+}
+
+// closeClient is the single teardown path for a client, however it leaves:
+// it takes the client out of its room and the client registry, freeing its
+// nickname, records why it left and closes the connection. Calling it again
+// is a no-op.
+func (s *Server) closeClient(c *Client, reason string) {
+	if c.left {
+		return
+	}
+	c.left = true
+	s.Seen.Record(c.NickName, c.LastSeen)
+	disconnectsCounter.WithLabelValues(reason).Inc()
+	s.Logger().WithFields(logrus.Fields{
+		"remote_addr": c.Conn.RemoteAddr().String(),
+		"reason":      reason,
+	}).Info("client has disconnected")
+	s.quitCurrentRoom(c)
+	s.removeClient(c)
+	c.Close()
+}
+
+func (s *Server) Resume(c *Client, args []string) {
+	if s.Sessions == nil {
+		c.Error(errorf(ErrUnavailable, "sessions are disabled"))
+		return
+	}
+	if len(args) < 2 {
+		c.Error(usageError(CMD_RESUME))
+		return
+	}
+	account, signed := s.Sessions.Verify(args[1])
+	sess, ok := s.Sessions.Claim(args[1])
+	if !ok && !signed {
+		c.Error(errorf(ErrInvalidToken, "invalid or expired session token"))
+		return
+	}
+	c.SessionToken = args[1]
+	if signed {
+		// The old connection may still look alive if the drop has not been
+		// noticed yet; the new one takes over its nickname and room.
+		if old := s.findClient(account); old != nil && old != c {
+			if !ok && old.Room != nil {
+				sess.Room = old.Room.Name
+			}
+			old.Message("your session was resumed from another connection")
+			s.closeClient(old, ReasonReplaced)
+		}
+		c.Account = account
+		sess.NickName = account
+		s.grantAdminNick(c)
+	}
+	if sess.NickName != c.NickName {
+		s.NickName(c, []string{"/name", sess.NickName})
+	}
+	if sess.Room != "" {
+		s.Join(c, []string{"/join", sess.Room})
+	}
+}
+
+// joinedText announces that nick joined a room.
+func (s *Server) joinedText(nick string) string {
+	if s.ChatV2Replies {
+		return nick + " joined the room"
+	}
+	return nick + " has joined the room"
+}
+
+// leftText announces that nick left what: the room, or the chat altogether.
+// chatv2 said "left the room" either way.
+func (s *Server) leftText(nick, what string) string {
+	if s.ChatV2Replies {
+		return nick + " left the room"
+	}
+	return nick + " has left " + what
+}
+
+func (s *Server) quitCurrentRoom(c *Client) {
+	if c.Room != nil {
+		c.Room.RemoveMember(c)
+		if c.quitMessage != "" && !s.ChatV2Replies {
+			c.Room.BroadcastEvent(c, "leave", c.NickName, fmt.Sprintf("%s has left: %s", c.NickName, c.quitMessage))
+		} else {
+			c.Room.BroadcastEvent(c, "leave", c.NickName, s.leftText(c.NickName, "the chat"))
+		}
+		s.Events.OnLeave(c, c.Room)
+		c.Room = nil
+	}
+}
+
+// mentions reports whether text contains nick as a whole word, ignoring case.
+func mentions(text, nick string) bool {
+	if nick == "" {
+		return false
+	}
+	fields := strings.FieldsFunc(text, func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r) && r != '_' && r != '-'
+	})
+	for _, f := range fields {
+		if strings.EqualFold(f, nick) {
+			return true
+		}
+	}
+	return false
+}
+
+// formatDuration renders d using its two largest units, e.g. 3h12m or 45s.
+func formatDuration(d time.Duration) string {
+	if d < time.Second {
+		return "0s"
+	}
+	units := []struct {
+		size time.Duration
+		name string
+	}{
+		{24 * time.Hour, "d"},
+		{time.Hour, "h"},
+		{time.Minute, "m"},
+		{time.Second, "s"},
+	}
+	var b strings.Builder
+	shown := 0
+	for _, u := range units {
+		if shown == 2 {
+			break
+		}
+		n := d / u.size
+		if n == 0 && shown == 0 {
+			continue
+		}
+		d -= n * u.size
+		if n > 0 {
+			fmt.Fprintf(&b, "%d%s", n, u.name)
+		}
+		shown++
 	}
+	return b.String()
 }
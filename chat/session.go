@@ -0,0 +1,183 @@
+package chat
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	DefaultSessionTTL = 5 * time.Minute
+	// DefaultAccountTokenTTL is how long the signed token handed out on
+	// /register or /login stays valid.
+	DefaultAccountTokenTTL = 24 * time.Hour
+)
+
+type Session struct {
+	NickName string
+	Room     string
+	Expires  time.Time
+}
+
+// SessionStore remembers who a client was for a while after they drop, keyed
+// by the token handed out when they connected. Logged-in clients get a signed
+// token instead, which also proves their account on /resume until
+// AccountTokenTTL runs out or it is revoked.
+type SessionStore struct {
+	TTL             time.Duration
+	AccountTokenTTL time.Duration
+	Now             func() time.Time
+	mu              sync.Mutex
+	sessions        map[string]Session
+	key             []byte
+	// revoked holds signed tokens that were revoked before they expired.
+	revoked map[string]time.Time
+}
+
+// NewSessionStore signs account tokens with a random key, so they stop
+// working when the process restarts. Use SetKey to keep them valid across
+// restarts.
+func NewSessionStore(ttl time.Duration) *SessionStore {
+	key := make([]byte, 32)
+	rand.Read(key)
+	return &SessionStore{
+		TTL:             ttl,
+		AccountTokenTTL: DefaultAccountTokenTTL,
+		Now:             time.Now,
+		sessions:        make(map[string]Session),
+		key:             key,
+		revoked:         make(map[string]time.Time),
+	}
+}
+
+func (s *SessionStore) SetKey(key []byte) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.key = key
+}
+
+func (s *SessionStore) NewToken() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// Save records the client's state under token until the TTL runs out.
+func (s *SessionStore) Save(token, nick, room string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := s.Now()
+	s.sessions[token] = Session{NickName: nick, Room: room, Expires: now.Add(s.TTL)}
+	for t, sess := range s.sessions {
+		if now.After(sess.Expires) {
+			delete(s.sessions, t)
+		}
+	}
+}
+
+// Claim returns and forgets the session for token. Expired sessions are never
+// returned.
+func (s *SessionStore) Claim(token string) (Session, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	sess, ok := s.sessions[token]
+	if !ok {
+		return Session{}, false
+	}
+	delete(s.sessions, token)
+	if s.Now().After(sess.Expires) {
+		return Session{}, false
+	}
+	return sess, true
+}
+
+// Revoke forgets the session for token and, for a signed token, refuses it
+// from now until it would have expired anyway.
+func (s *SessionStore) Revoke(token string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.sessions, token)
+	if _, expires, ok := s.verify(token); ok {
+		s.revoked[token] = expires
+	}
+	now := s.Now()
+	for t, expires := range s.revoked {
+		if now.After(expires) {
+			delete(s.revoked, t)
+		}
+	}
+}
+
+// Sign issues a token that proves the holder logged in as account. The
+// token is "payload.mac", both base64url, where the payload is
+// "expiry:nonce:account".
+func (s *SessionStore) Sign(account string) (string, error) {
+	nonce, err := s.NewToken()
+	if err != nil {
+		return "", err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	expires := s.Now().Add(s.AccountTokenTTL).Unix()
+	payload := fmt.Sprintf("%d:%s:%s", expires, nonce, account)
+	return base64.RawURLEncoding.EncodeToString([]byte(payload)) + "." +
+		base64.RawURLEncoding.EncodeToString(s.mac(payload)), nil
+}
+
+// Verify returns the account a signed token was issued for. It fails for
+// plain session tokens and for tokens that are forged, expired or revoked.
+func (s *SessionStore) Verify(token string) (string, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	account, _, ok := s.verify(token)
+	if !ok {
+		return "", false
+	}
+	if _, revoked := s.revoked[token]; revoked {
+		return "", false
+	}
+	return account, true
+}
+
+func (s *SessionStore) verify(token string) (string, time.Time, bool) {
+	encPayload, encMAC, ok := strings.Cut(token, ".")
+	if !ok {
+		return "", time.Time{}, false
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(encPayload)
+	if err != nil {
+		return "", time.Time{}, false
+	}
+	mac, err := base64.RawURLEncoding.DecodeString(encMAC)
+	if err != nil || !hmac.Equal(mac, s.mac(string(payload))) {
+		return "", time.Time{}, false
+	}
+	fields := strings.SplitN(string(payload), ":", 3)
+	if len(fields) != 3 {
+		return "", time.Time{}, false
+	}
+	unix, err := strconv.ParseInt(fields[0], 10, 64)
+	if err != nil {
+		return "", time.Time{}, false
+	}
+	expires := time.Unix(unix, 0)
+	if s.Now().After(expires) {
+		return "", time.Time{}, false
+	}
+	return fields[2], expires, true
+}
+
+func (s *SessionStore) mac(payload string) []byte {
+	h := hmac.New(sha256.New, s.key)
+	h.Write([]byte(payload))
+	return h.Sum(nil)
+}
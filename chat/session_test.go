@@ -0,0 +1,141 @@
+package chat
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSessionStoreExpiry(t *testing.T) {
+	clock := newFakeClock()
+	store := NewSessionStore(time.Minute)
+	store.Now = clock.Now
+
+	store.Save("tok", "alice", "lobby")
+	clock.Advance(30 * time.Second)
+	if sess, ok := store.Claim("tok"); !ok || sess.NickName != "alice" || sess.Room != "lobby" {
+		t.Fatalf("Claim = %+v, %t", sess, ok)
+	}
+	if _, ok := store.Claim("tok"); ok {
+		t.Error("a session could be claimed twice")
+	}
+
+	store.Save("old", "bob", "")
+	clock.Advance(2 * time.Minute)
+	if _, ok := store.Claim("old"); ok {
+		t.Error("an expired session was claimed")
+	}
+}
+
+func TestSignedTokens(t *testing.T) {
+	clock := newFakeClock()
+	store := NewSessionStore(time.Minute)
+	store.Now = clock.Now
+	store.AccountTokenTTL = time.Hour
+
+	token, err := store.Sign("alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if account, ok := store.Verify(token); !ok || account != "alice" {
+		t.Fatalf("Verify = %q, %t", account, ok)
+	}
+	if _, ok := store.Verify(token[:len(token)-2] + "xx"); ok {
+		t.Error("a forged token verified")
+	}
+	if _, ok := store.Verify("plain-token"); ok {
+		t.Error("a plain token verified as signed")
+	}
+
+	other := NewSessionStore(time.Minute)
+	if _, ok := other.Verify(token); ok {
+		t.Error("a token verified under another key")
+	}
+
+	store.Revoke(token)
+	if _, ok := store.Verify(token); ok {
+		t.Error("a revoked token verified")
+	}
+
+	fresh, _ := store.Sign("alice")
+	clock.Advance(2 * time.Hour)
+	if _, ok := store.Verify(fresh); ok {
+		t.Error("an expired token verified")
+	}
+}
+
+// sessionToken reads the token the server hands c.
+func sessionToken(c *testClient) string {
+	c.t.Helper()
+	line, _ := c.expect("your session token: ")
+	_, token, _ := strings.Cut(line, "your session token: ")
+	return token
+}
+
+func TestResumeAfterDrop(t *testing.T) {
+	_, l := newTestServer(t, func(s *Server) { s.Sessions = NewSessionStore(time.Minute) })
+
+	bob := dial(t, l)
+	bob.join("bob", "lobby")
+	alice := dial(t, l)
+	token := sessionToken(alice)
+	alice.join("alice", "lobby")
+
+	// a dropped connection keeps its session
+	alice.conn.Close()
+	bob.expect("alice has left the chat")
+
+	again := dial(t, l)
+	sessionToken(again)
+	if out := again.do("/resume " + token); !hasLine(out, "Server will know you by alice") || !hasLine(out, "Welcome to lobby") {
+		t.Errorf("/resume got %q", out)
+	}
+	bob.expect("alice has joined the room")
+
+	if out := dial(t, l).do("/resume " + token); !hasLine(out, "invalid or expired session token") {
+		t.Errorf("second /resume got %q", out)
+	}
+}
+
+func TestQuitRevokesSession(t *testing.T) {
+	_, l := newTestServer(t, func(s *Server) { s.Sessions = NewSessionStore(time.Minute) })
+
+	alice := dial(t, l)
+	token := sessionToken(alice)
+	alice.join("alice", "lobby")
+	alice.send("/quit")
+	alice.expectClosed()
+
+	if out := dial(t, l).do("/resume " + token); !hasLine(out, "invalid or expired session token") {
+		t.Errorf("/resume after /quit got %q", out)
+	}
+}
+
+func TestResumeSignedTakesOver(t *testing.T) {
+	_, l := newTestServer(t, func(s *Server) {
+		s.Sessions = NewSessionStore(time.Minute)
+		s.Accounts = newTestAccounts(t)
+		s.MessageRate = 0
+	})
+
+	alice := dial(t, l)
+	sessionToken(alice)
+	alice.send("/register alice hunter22")
+	alice.expect("registered alice")
+	signed := sessionToken(alice)
+	alice.do("/join lobby")
+
+	// the old connection is still open; the resume replaces it
+	laptop := dial(t, l)
+	sessionToken(laptop)
+	laptop.send("/resume " + signed)
+	if out := alice.expectClosed(); !hasLine(out, "your session was resumed from another connection") {
+		t.Errorf("old connection got %q", out)
+	}
+	if _, skipped := laptop.expect("Welcome to lobby"); !hasLine(skipped, "Server will know you by alice") {
+		t.Errorf("resume got %q", skipped)
+	}
+	if out := laptop.do("/invite nobody"); hasLine(out, "guests cannot use") {
+		t.Errorf("the resumed client is not logged in: %q", out)
+	}
+}
@@ -0,0 +1,154 @@
+package chat
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestShutdownDrainsQueuedCommands(t *testing.T) {
+	s, l := newTestServer(t, func(s *Server) { s.FloodMessages = 0 })
+
+	alice, bob := dial(t, l), dial(t, l)
+	alice.join("alice", "lobby")
+	bob.join("bob", "lobby")
+
+	c := s.findClient("alice")
+	const n = 50
+	for i := 0; i < n; i++ {
+		s.Enqueue(Command{ID: CMD_MSG, Client: c, Args: []string{"/msg", fmt.Sprintf("queued-%d", i)}})
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), testTimeout)
+	defer cancel()
+	if err := s.Shutdown(ctx); err != nil {
+		t.Fatalf("Shutdown: %v", err)
+	}
+
+	out := bob.expectClosed()
+	for i := 0; i < n; i++ {
+		if !hasLine(out, fmt.Sprintf("queued-%d", i)) {
+			t.Fatalf("queued-%d was dropped; bob got %q", i, out)
+		}
+	}
+	if last := out[len(out)-1]; last != "> server shutting down" {
+		t.Errorf("last line = %q, want the shutdown notice", last)
+	}
+	if s.Enqueue(Command{ID: CMD_MSG, Client: c, Args: []string{"/msg", "late"}}) {
+		t.Error("Enqueue accepted a command after Shutdown")
+	}
+}
+
+// TestShutdownWithActiveSenders is meant for -race: clients keep posting
+// while the server shuts down underneath them.
+func TestShutdownWithActiveSenders(t *testing.T) {
+	s, l := newTestServer(t, func(s *Server) {
+		s.FloodMessages = 0
+		s.MessageRate = 0
+	})
+
+	clients := make([]*testClient, 8)
+	for i := range clients {
+		clients[i] = dial(t, l)
+		clients[i].join(fmt.Sprintf("user%d", i), "lobby")
+	}
+
+	var senders sync.WaitGroup
+	for i, c := range clients {
+		senders.Add(1)
+		go func(i int, conn net.Conn) {
+			defer senders.Done()
+			for j := 0; j < 20; j++ {
+				if _, err := fmt.Fprintf(conn, "/msg %d-%d\n", i, j); err != nil {
+					return
+				}
+			}
+		}(i, c.conn)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), testTimeout)
+	defer cancel()
+	if err := s.Shutdown(ctx); err != nil {
+		t.Fatalf("Shutdown: %v", err)
+	}
+	for _, c := range clients {
+		c.expectClosed()
+	}
+	senders.Wait()
+	waitFor(t, func() bool { return s.ConnectionCount() == 0 })
+}
+
+func TestServeAfterClose(t *testing.T) {
+	s := NewServer()
+	l := NewPipeListener()
+	served := make(chan error, 1)
+	go func() { served <- s.Serve(context.Background(), l) }()
+
+	conn, err := l.Dial()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	s.Close()
+	select {
+	case err := <-served:
+		if !errors.Is(err, ErrServerClosed) {
+			t.Errorf("Serve returned %v, want ErrServerClosed", err)
+		}
+	case <-time.After(testTimeout):
+		t.Fatal("Serve did not return after Close")
+	}
+	if _, err := l.Dial(); !errors.Is(err, net.ErrClosed) {
+		t.Errorf("dialing a closed listener gave %v", err)
+	}
+	if err := s.Serve(context.Background(), NewPipeListener()); !errors.Is(err, ErrServerClosed) {
+		t.Errorf("Serve after Close returned %v", err)
+	}
+}
+
+func TestServeStopsWithContext(t *testing.T) {
+	s := NewServer()
+	l := NewPipeListener()
+	ctx, cancel := context.WithCancel(context.Background())
+	served := make(chan error, 1)
+	go func() { served <- s.Serve(ctx, l) }()
+
+	conn, err := l.Dial()
+	if err != nil {
+		t.Fatal(err)
+	}
+	cancel()
+	select {
+	case err := <-served:
+		if !errors.Is(err, ErrServerClosed) {
+			t.Errorf("Serve returned %v, want ErrServerClosed", err)
+		}
+	case <-time.After(testTimeout):
+		t.Fatal("Serve did not return after the context was cancelled")
+	}
+	// the connection is closed with the server
+	conn.SetReadDeadline(time.Now().Add(testTimeout))
+	buf := make([]byte, 512)
+	for {
+		if _, err := conn.Read(buf); err != nil {
+			if errors.Is(err, os.ErrDeadlineExceeded) {
+				t.Fatal("connection still open after the server closed")
+			}
+			break
+		}
+	}
+}
+
+func TestNewClientNil(t *testing.T) {
+	s := NewServer()
+	defer s.Close()
+	s.NewClient(nil)
+	if n := s.ConnectionCount(); n != 0 {
+		t.Errorf("ConnectionCount() = %d after a nil connection", n)
+	}
+}
@@ -0,0 +1,69 @@
+package chat
+
+import (
+	"sort"
+	"time"
+)
+
+// ServerState is a point-in-time copy of the server that is safe to read,
+// marshal and hold on to without any locks.
+type ServerState struct {
+	StartedAt   time.Time     `json:"startedAt"`
+	Connections int           `json:"connections"`
+	Messages    int64         `json:"messages"`
+	Rooms       []RoomState   `json:"rooms"`
+	Clients     []ClientState `json:"clients"`
+}
+
+type RoomState struct {
+	Name       string   `json:"name"`
+	Owner      string   `json:"owner,omitempty"`
+	Members    []string `json:"members"`
+	MaxMembers int      `json:"maxMembers"`
+	HistoryLen int      `json:"historyLen"`
+	Locked     bool     `json:"locked"`
+}
+
+// Snapshot copies the current rooms and members. It holds the rooms lock for
+// reading, so it never observes a command half-applied.
+func (s *Server) Snapshot() ServerState {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	state := ServerState{
+		StartedAt:   s.startedAt,
+		Connections: s.ConnectionCount(),
+		Messages:    s.messages.Load(),
+		Rooms:       make([]RoomState, 0, len(s.Rooms)),
+	}
+	for _, r := range s.Rooms {
+		rs := RoomState{
+			Name:       r.Name,
+			Members:    r.Nicknames(nil),
+			MaxMembers: r.MaxMembers,
+			HistoryLen: r.History.Len(),
+			Locked:     r.Locked(),
+		}
+		if rs.Members == nil {
+			rs.Members = []string{}
+		}
+		if r.Owner != nil {
+			rs.Owner = r.Owner.NickName
+		}
+		state.Rooms = append(state.Rooms, rs)
+	}
+	sort.Slice(state.Rooms, func(i, j int) bool {
+		return state.Rooms[i].Name < state.Rooms[j].Name
+	})
+
+	s.clientsMu.Lock()
+	state.Clients = make([]ClientState, 0, len(s.clients))
+	for c := range s.clients {
+		state.Clients = append(state.Clients, c.State())
+	}
+	s.clientsMu.Unlock()
+	sort.Slice(state.Clients, func(i, j int) bool {
+		return state.Clients[i].NickName < state.Clients[j].NickName
+	})
+	return state
+}
@@ -0,0 +1,68 @@
+package chat
+
+import (
+	"encoding/json"
+	"net"
+	"reflect"
+	"sort"
+	"testing"
+)
+
+func TestSnapshotMarshals(t *testing.T) {
+	s, l := newTestServer(t, nil)
+	alice, bob := dial(t, l), dial(t, l)
+	alice.join("alice", "lobby")
+	bob.join("bob", "lobby")
+	alice.do("/msg hello")
+
+	data, err := json.Marshal(s.Snapshot())
+	if err != nil {
+		t.Fatalf("marshal snapshot: %v", err)
+	}
+	var got ServerState
+	if err := json.Unmarshal(data, &got); err != nil {
+		t.Fatalf("unmarshal snapshot: %v", err)
+	}
+	if got.Connections != 2 || got.Messages != 1 {
+		t.Errorf("connections, messages = %d, %d; want 2, 1", got.Connections, got.Messages)
+	}
+	if len(got.Rooms) != 1 {
+		t.Fatalf("rooms = %+v, want just lobby", got.Rooms)
+	}
+	if r := got.Rooms[0]; r.Name != "lobby" || r.Owner != "alice" || r.HistoryLen != 1 ||
+		!reflect.DeepEqual(r.Members, []string{"alice", "bob"}) {
+		t.Errorf("lobby = %+v", r)
+	}
+	if len(got.Clients) != 2 || got.Clients[0].NickName != "alice" || got.Clients[1].Room != "lobby" {
+		t.Errorf("clients = %+v", got.Clients)
+	}
+}
+
+func TestClientMarshalsWithoutConn(t *testing.T) {
+	s, _ := newTestServer(t, nil)
+	conn, peer := net.Pipe()
+	defer conn.Close()
+	defer peer.Close()
+	c := &Client{Conn: conn, NickName: "alice", Admin: true, server: s}
+
+	data, err := json.Marshal(c)
+	if err != nil {
+		t.Fatalf("marshal client: %v", err)
+	}
+	var fields map[string]any
+	if err := json.Unmarshal(data, &fields); err != nil {
+		t.Fatalf("unmarshal client: %v", err)
+	}
+	var keys []string
+	for k := range fields {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	want := []string{"admin", "away", "awayReason", "dnd", "hideTyping", "lastSeen", "muted", "nickName"}
+	if !reflect.DeepEqual(keys, want) {
+		t.Errorf("client keys = %q, want %q", keys, want)
+	}
+	if fields["nickName"] != "alice" || fields["admin"] != true {
+		t.Errorf("client = %s", data)
+	}
+}
@@ -0,0 +1,205 @@
+package chat
+
+import (
+	"database/sql"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	_ "modernc.org/sqlite"
+)
+
+const sqliteSchema = `
+CREATE TABLE IF NOT EXISTS messages (
+	id   INTEGER PRIMARY KEY AUTOINCREMENT,
+	room TEXT NOT NULL,
+	line TEXT NOT NULL,
+	sent INTEGER NOT NULL
+);
+CREATE INDEX IF NOT EXISTS messages_room_id ON messages (room, id);
+`
+
+// SQLiteHistory persists room history in a SQLite database. Like FileHistory
+// it queues appends in memory and writes them in one transaction per flush
+// interval, so posting a message never waits on the database.
+type SQLiteHistory struct {
+	db *sql.DB
+
+	mu      sync.Mutex
+	pending []sqliteRow
+	flushMu sync.Mutex
+
+	done    chan struct{}
+	stopped chan struct{}
+	once    sync.Once
+}
+
+type sqliteRow struct {
+	room string
+	line string
+	sent time.Time
+}
+
+// NewSQLiteHistory opens, creating if needed, the database at path.
+func NewSQLiteHistory(path string, interval time.Duration) (*SQLiteHistory, error) {
+	if interval <= 0 {
+		interval = DefaultHistoryFlushInterval
+	}
+	db, err := sql.Open("sqlite", path)
+	if err != nil {
+		return nil, err
+	}
+	// SQLite allows one writer at a time; a single connection avoids
+	// SQLITE_BUSY between the flusher and Load.
+	db.SetMaxOpenConns(1)
+	if _, err := db.Exec(sqliteSchema); err != nil {
+		db.Close()
+		return nil, err
+	}
+	h := &SQLiteHistory{
+		db:      db,
+		done:    make(chan struct{}),
+		stopped: make(chan struct{}),
+	}
+	go h.run(interval)
+	return h, nil
+}
+
+// Append queues line for room. It never touches the database.
+func (h *SQLiteHistory) Append(room, line string) {
+	h.mu.Lock()
+	h.pending = append(h.pending, sqliteRow{room: room, line: line, sent: time.Now()})
+	h.mu.Unlock()
+}
+
+// Load returns up to the last n stored messages of room, oldest first, with
+// the time each was stored as Sent, including lines that are still waiting
+// to be flushed.
+func (h *SQLiteHistory) Load(room string, n int) ([]Message, error) {
+	if err := h.Flush(); err != nil {
+		return nil, err
+	}
+	rows, err := h.db.Query(`SELECT line, sent FROM (
+		SELECT id, line, sent FROM messages WHERE room = ? ORDER BY id DESC LIMIT ?
+	) ORDER BY id`, room, n)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var msgs []Message
+	for rows.Next() {
+		var line string
+		var sent int64
+		if err := rows.Scan(&line, &sent); err != nil {
+			return nil, err
+		}
+		m := ParseMessage(line)
+		m.Sent = time.UnixMilli(sent)
+		msgs = append(msgs, m)
+	}
+	return msgs, rows.Err()
+}
+
+// Rooms lists every room with at least one stored message.
+func (h *SQLiteHistory) Rooms() ([]string, error) {
+	if err := h.Flush(); err != nil {
+		return nil, err
+	}
+	rows, err := h.db.Query(`SELECT DISTINCT room FROM messages ORDER BY room`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var rooms []string
+	for rows.Next() {
+		var room string
+		if err := rows.Scan(&room); err != nil {
+			return nil, err
+		}
+		rooms = append(rooms, room)
+	}
+	return rooms, rows.Err()
+}
+
+// Rename moves the stored history of a renamed room.
+func (h *SQLiteHistory) Rename(oldName, newName string) error {
+	if err := h.Flush(); err != nil {
+		return err
+	}
+	h.flushMu.Lock()
+	defer h.flushMu.Unlock()
+	_, err := h.db.Exec(`UPDATE messages SET room = ? WHERE room = ?`, newName, oldName)
+	return err
+}
+
+// Delete removes the stored history of room.
+func (h *SQLiteHistory) Delete(room string) error {
+	if err := h.Flush(); err != nil {
+		return err
+	}
+	h.flushMu.Lock()
+	defer h.flushMu.Unlock()
+	_, err := h.db.Exec(`DELETE FROM messages WHERE room = ?`, room)
+	return err
+}
+
+// Flush writes every pending line to the database now.
+func (h *SQLiteHistory) Flush() error {
+	h.flushMu.Lock()
+	defer h.flushMu.Unlock()
+
+	h.mu.Lock()
+	batch := h.pending
+	h.pending = nil
+	h.mu.Unlock()
+	if len(batch) == 0 {
+		return nil
+	}
+
+	tx, err := h.db.Begin()
+	if err != nil {
+		return err
+	}
+	stmt, err := tx.Prepare(`INSERT INTO messages (room, line, sent) VALUES (?, ?, ?)`)
+	if err != nil {
+		return errors.Join(err, tx.Rollback())
+	}
+	defer stmt.Close()
+	for _, row := range batch {
+		if _, err := stmt.Exec(row.room, row.line, row.sent.UnixMilli()); err != nil {
+			return errors.Join(err, tx.Rollback())
+		}
+	}
+	return tx.Commit()
+}
+
+// Close stops the background flusher, performs a final flush and closes the
+// database. Nothing may be appended after Close.
+func (h *SQLiteHistory) Close() error {
+	h.once.Do(func() {
+		close(h.done)
+		<-h.stopped
+	})
+	return errors.Join(h.Flush(), h.db.Close())
+}
+
+func (h *SQLiteHistory) run(interval time.Duration) {
+	defer close(h.stopped)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-h.done:
+			return
+		case <-ticker.C:
+			if err := h.Flush(); err != nil {
+				log.WithFields(logrus.Fields{
+					"error": err.Error(),
+				}).Error("failed to flush room history")
+			}
+		}
+	}
+}
@@ -0,0 +1,22 @@
+package chat
+
+import (
+	"crypto/tls"
+	"net"
+)
+
+// Listen opens a TCP listener for chat clients on addr. When certFile and
+// keyFile are set, connections are served over TLS using that key pair.
+func Listen(addr, certFile, keyFile string) (net.Listener, error) {
+	if certFile == "" && keyFile == "" {
+		return net.Listen("tcp", addr)
+	}
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, err
+	}
+	return tls.Listen("tcp", addr, &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+	})
+}
@@ -0,0 +1,44 @@
+package chat
+
+import "strings"
+
+var errUnbalancedQuote = errorf(ErrInvalidInput, `unbalanced quote, close it with " or escape it as \"`)
+
+// tokenize splits a command line on spaces, keeping double-quoted runs
+// together so /name "John Doe" yields a single argument. Inside quotes, \"
+// and \\ stand for a literal quote and backslash.
+func tokenize(line string) ([]string, error) {
+	var (
+		args    []string
+		cur     strings.Builder
+		inQuote bool
+		inToken bool
+	)
+	for i := 0; i < len(line); i++ {
+		ch := line[i]
+		switch {
+		case inQuote && ch == '\\' && i+1 < len(line) && (line[i+1] == '"' || line[i+1] == '\\'):
+			i++
+			cur.WriteByte(line[i])
+		case ch == '"':
+			inQuote = !inQuote
+			inToken = true
+		case ch == ' ' && !inQuote:
+			if inToken {
+				args = append(args, cur.String())
+				cur.Reset()
+				inToken = false
+			}
+		default:
+			cur.WriteByte(ch)
+			inToken = true
+		}
+	}
+	if inQuote {
+		return nil, errUnbalancedQuote
+	}
+	if inToken {
+		args = append(args, cur.String())
+	}
+	return args, nil
+}
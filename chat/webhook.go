@@ -0,0 +1,325 @@
+package chat
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	DefaultWebhookQueueSize = 1024
+	DefaultWebhookAttempts  = 5
+	DefaultWebhookBackoff   = time.Second
+	DefaultWebhookTimeout   = 10 * time.Second
+
+	// WebhookSignatureHeader carries "sha256=" and the hex HMAC-SHA256 of
+	// the body keyed with the webhook secret.
+	WebhookSignatureHeader = "X-Chat-Signature"
+	// WebhookEventHeader carries the event's type.
+	WebhookEventHeader = "X-Chat-Event"
+)
+
+// Webhooks is an EventSink that POSTs the messages, joins and leaves of rooms
+// to the URLs registered for them, as the JSON of an Event. Each URL has a
+// queue and a background goroutine of its own, so events reach it in order
+// and a slow or failing URL holds up nobody else; if a URL's queue is full
+// the event is dropped and logged rather than stalling the chat. A delivery
+// that fails with a network error, a 429 or a 5xx status is retried with
+// doubling backoff; any other status gives up at once.
+type Webhooks struct {
+	// Client sends the requests. Its Timeout bounds each attempt.
+	Client *http.Client
+	// Attempts is how many times a delivery is tried before it is dropped.
+	Attempts int
+	// Backoff is the wait before the first retry, doubled for each retry
+	// after it.
+	Backoff time.Duration
+
+	secret    []byte
+	queueSize int
+	mu        sync.RWMutex
+	hooks     map[string][]string
+	// queues holds the queue of each registered URL, however many rooms
+	// it is registered for
+	queues  map[string]chan webhookDelivery
+	ctx     context.Context
+	cancel  context.CancelFunc
+	workers sync.WaitGroup
+	once    sync.Once
+}
+
+type webhookDelivery struct {
+	url   string
+	event Event
+}
+
+// NewWebhooks returns a dispatcher signing its requests with secret, which
+// may be empty to send them unsigned, and queueing up to queueSize events
+// for each URL.
+func NewWebhooks(secret string, queueSize int) *Webhooks {
+	if queueSize <= 0 {
+		queueSize = DefaultWebhookQueueSize
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	return &Webhooks{
+		Client:    &http.Client{Timeout: DefaultWebhookTimeout},
+		Attempts:  DefaultWebhookAttempts,
+		Backoff:   DefaultWebhookBackoff,
+		secret:    []byte(secret),
+		queueSize: queueSize,
+		hooks:     make(map[string][]string),
+		queues:    make(map[string]chan webhookDelivery),
+		ctx:       ctx,
+		cancel:    cancel,
+	}
+}
+
+// CheckWebhookURL reports whether rawURL can be a webhook: an absolute http
+// or https URL.
+func CheckWebhookURL(rawURL string) error {
+	u, err := url.Parse(rawURL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("webhook %q is not an http or https URL", rawURL)
+	}
+	return nil
+}
+
+// Add registers rawURL for room's events. It must pass CheckWebhookURL.
+func (w *Webhooks) Add(room, rawURL string) error {
+	if err := CheckWebhookURL(rawURL); err != nil {
+		return err
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	for _, existing := range w.hooks[room] {
+		if existing == rawURL {
+			return nil
+		}
+	}
+	w.hooks[room] = append(w.hooks[room], rawURL)
+	if _, ok := w.queues[rawURL]; !ok && w.ctx.Err() == nil {
+		queue := make(chan webhookDelivery, w.queueSize)
+		w.queues[rawURL] = queue
+		w.workers.Add(1)
+		go w.run(queue)
+	}
+	return nil
+}
+
+// Remove unregisters rawURL from room and reports whether it was registered.
+func (w *Webhooks) Remove(room, rawURL string) bool {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	urls := w.hooks[room]
+	for i, existing := range urls {
+		if existing == rawURL {
+			w.hooks[room] = append(urls[:i:i], urls[i+1:]...)
+			if len(w.hooks[room]) == 0 {
+				delete(w.hooks, room)
+			}
+			w.stopUnused(rawURL)
+			return true
+		}
+	}
+	return false
+}
+
+// OnRoomRename moves the webhooks of oldName to newName, adding them to any
+// newName already had.
+func (w *Webhooks) OnRoomRename(oldName, newName string) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	urls, ok := w.hooks[oldName]
+	if !ok {
+		return
+	}
+	delete(w.hooks, oldName)
+	for _, u := range urls {
+		if !containsString(w.hooks[newName], u) {
+			w.hooks[newName] = append(w.hooks[newName], u)
+		}
+	}
+}
+
+// OnRoomDelete unregisters every webhook of room.
+func (w *Webhooks) OnRoomDelete(room string) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	urls := w.hooks[room]
+	delete(w.hooks, room)
+	for _, u := range urls {
+		w.stopUnused(u)
+	}
+}
+
+// stopUnused stops the worker of rawURL once no room has it registered,
+// after it has delivered what is already queued. w.mu must be held.
+func (w *Webhooks) stopUnused(rawURL string) {
+	for _, urls := range w.hooks {
+		if containsString(urls, rawURL) {
+			return
+		}
+	}
+	if queue, ok := w.queues[rawURL]; ok {
+		close(queue)
+		delete(w.queues, rawURL)
+	}
+}
+
+func containsString(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+// URLs returns the webhooks registered for room.
+func (w *Webhooks) URLs(room string) []string {
+	w.mu.RLock()
+	defer w.mu.RUnlock()
+	return append([]string(nil), w.hooks[room]...)
+}
+
+// Close stops the dispatcher, abandoning the events still queued and any
+// delivery waiting to be retried.
+func (w *Webhooks) Close() {
+	w.once.Do(func() {
+		w.cancel()
+		w.workers.Wait()
+	})
+}
+
+func (w *Webhooks) OnJoin(c *Client, r *Room) {
+	w.publish(Event{Type: "join", NickName: c.NickName, Room: r.Name})
+}
+
+func (w *Webhooks) OnLeave(c *Client, r *Room) {
+	w.publish(Event{Type: "leave", NickName: c.NickName, Room: r.Name})
+}
+
+func (w *Webhooks) OnMessage(c *Client, r *Room, msg string) {
+	w.publish(Event{Type: "message", NickName: c.NickName, Room: r.Name, Text: msg})
+}
+
+// OnNickChange does nothing: a nickname belongs to no room.
+func (w *Webhooks) OnNickChange(*Client, string, string) {}
+
+func (w *Webhooks) publish(e Event) {
+	e.Time = time.Now()
+	w.mu.RLock()
+	defer w.mu.RUnlock()
+	for _, u := range w.hooks[e.Room] {
+		queue, ok := w.queues[u]
+		if !ok {
+			continue
+		}
+		select {
+		case queue <- webhookDelivery{url: u, event: e}:
+		default:
+			webhookFailuresCounter.WithLabelValues("queue_full").Inc()
+			log.WithFields(logrus.Fields{
+				"room": e.Room,
+				"url":  u,
+			}).Warn("webhook queue full, dropping event")
+		}
+	}
+}
+
+// run delivers the events of one URL's queue until the queue is closed or
+// the dispatcher is.
+func (w *Webhooks) run(queue <-chan webhookDelivery) {
+	defer w.workers.Done()
+	for {
+		select {
+		case <-w.ctx.Done():
+			return
+		case d, ok := <-queue:
+			if !ok {
+				return
+			}
+			w.deliver(d)
+		}
+	}
+}
+
+// deliver tries d until it succeeds, fails for good or the dispatcher closes.
+func (w *Webhooks) deliver(d webhookDelivery) {
+	body, err := json.Marshal(d.event)
+	if err != nil {
+		return
+	}
+	backoff := w.Backoff
+	for attempt := 1; ; attempt++ {
+		retry, err := w.post(d.url, d.event.Type, body)
+		if err == nil {
+			return
+		}
+		if !retry || attempt >= w.Attempts {
+			webhookFailuresCounter.WithLabelValues("failed").Inc()
+			log.WithFields(logrus.Fields{
+				"room":     d.event.Room,
+				"url":      d.url,
+				"attempts": attempt,
+				"error":    err.Error(),
+			}).Warn("webhook delivery failed, dropping event")
+			return
+		}
+		timer := time.NewTimer(backoff)
+		select {
+		case <-w.ctx.Done():
+			timer.Stop()
+			return
+		case <-timer.C:
+		}
+		backoff *= 2
+	}
+}
+
+// post makes one attempt at delivering body to target and reports whether a
+// failure is worth retrying.
+func (w *Webhooks) post(target, eventType string, body []byte) (retry bool, err error) {
+	req, err := http.NewRequestWithContext(w.ctx, http.MethodPost, target, bytes.NewReader(body))
+	if err != nil {
+		return false, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(WebhookEventHeader, eventType)
+	if len(w.secret) > 0 {
+		req.Header.Set(WebhookSignatureHeader, SignWebhook(w.secret, body))
+	}
+	resp, err := w.Client.Do(req)
+	if err != nil {
+		return true, err
+	}
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 4096))
+	resp.Body.Close()
+	switch {
+	case resp.StatusCode < 300:
+		return false, nil
+	case resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500:
+		return true, fmt.Errorf("webhook answered %s", resp.Status)
+	default:
+		return false, fmt.Errorf("webhook answered %s", resp.Status)
+	}
+}
+
+// SignWebhook returns the WebhookSignatureHeader value for body, so receivers
+// can check it with hmac.Equal.
+func SignWebhook(secret, body []byte) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
@@ -0,0 +1,197 @@
+package chat
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+// webhookReceiver records the events POSTed to it, answering with the
+// statuses in order and 200 once they run out.
+type webhookReceiver struct {
+	mu       sync.Mutex
+	statuses []int
+	events   []Event
+	bodies   [][]byte
+	headers  []http.Header
+}
+
+func newWebhookReceiver(t *testing.T, statuses ...int) (*webhookReceiver, *httptest.Server) {
+	rec := &webhookReceiver{statuses: statuses}
+	hs := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		rec.mu.Lock()
+		defer rec.mu.Unlock()
+		if len(rec.statuses) > 0 {
+			status := rec.statuses[0]
+			rec.statuses = rec.statuses[1:]
+			if status != http.StatusOK {
+				w.WriteHeader(status)
+				return
+			}
+		}
+		var e Event
+		json.Unmarshal(body, &e)
+		rec.events = append(rec.events, e)
+		rec.bodies = append(rec.bodies, body)
+		rec.headers = append(rec.headers, r.Header)
+	}))
+	t.Cleanup(hs.Close)
+	return rec, hs
+}
+
+func (rec *webhookReceiver) count() int {
+	rec.mu.Lock()
+	defer rec.mu.Unlock()
+	return len(rec.events)
+}
+
+func newTestWebhooks(t *testing.T) *Webhooks {
+	w := NewWebhooks("secret", 0)
+	w.Backoff = time.Millisecond
+	t.Cleanup(w.Close)
+	return w
+}
+
+func TestWebhooksPostRoomEvents(t *testing.T) {
+	rec, hs := newWebhookReceiver(t)
+	hooks := newTestWebhooks(t)
+	if err := hooks.Add("lobby", hs.URL); err != nil {
+		t.Fatal(err)
+	}
+	_, l := newTestServer(t, func(s *Server) { s.Events = hooks })
+
+	alice, bob := dial(t, l), dial(t, l)
+	alice.join("alice", "lobby")
+	bob.join("bob", "elsewhere")
+	alice.send("/msg hello")
+	alice.expect("OK")
+	alice.do("/join elsewhere")
+	waitFor(t, func() bool { return rec.count() == 3 })
+
+	rec.mu.Lock()
+	defer rec.mu.Unlock()
+	for i, want := range []Event{
+		{Type: "join", NickName: "alice", Room: "lobby"},
+		{Type: "message", NickName: "alice", Room: "lobby", Text: "hello"},
+		{Type: "leave", NickName: "alice", Room: "lobby"},
+	} {
+		got := rec.events[i]
+		if got.Type != want.Type || got.NickName != want.NickName || got.Room != want.Room || got.Text != want.Text || got.Time.IsZero() {
+			t.Errorf("event %d = %+v, want %+v", i, got, want)
+		}
+		if sig := rec.headers[i].Get(WebhookSignatureHeader); sig != SignWebhook([]byte("secret"), rec.bodies[i]) {
+			t.Errorf("event %d signed %q", i, sig)
+		}
+		if typ := rec.headers[i].Get(WebhookEventHeader); typ != want.Type {
+			t.Errorf("event %d has %s %q", i, WebhookEventHeader, typ)
+		}
+	}
+}
+
+func TestWebhooksRetry(t *testing.T) {
+	rec, hs := newWebhookReceiver(t, http.StatusServiceUnavailable, http.StatusTooManyRequests)
+	hooks := newTestWebhooks(t)
+	hooks.Add("lobby", hs.URL)
+	hooks.publish(Event{Type: "message", Room: "lobby", Text: "eventually"})
+	waitFor(t, func() bool { return rec.count() == 1 })
+
+	// a 4xx other than 429 is not retried, and the next event still goes out
+	rec.mu.Lock()
+	rec.statuses = []int{http.StatusBadRequest}
+	rec.mu.Unlock()
+	hooks.publish(Event{Type: "message", Room: "lobby", Text: "refused"})
+	hooks.publish(Event{Type: "message", Room: "lobby", Text: "accepted"})
+	waitFor(t, func() bool { return rec.count() == 2 })
+	rec.mu.Lock()
+	defer rec.mu.Unlock()
+	if rec.events[0].Text != "eventually" || rec.events[1].Text != "accepted" {
+		t.Errorf("delivered %+v", rec.events)
+	}
+}
+
+func TestWebhooksGiveUp(t *testing.T) {
+	rec, hs := newWebhookReceiver(t, 500, 500, 500)
+	hooks := newTestWebhooks(t)
+	hooks.Attempts = 2
+	hooks.Add("lobby", hs.URL)
+	hooks.publish(Event{Type: "message", Room: "lobby", Text: "lost"})
+	hooks.publish(Event{Type: "message", Room: "lobby", Text: "after"})
+	waitFor(t, func() bool { return rec.count() == 1 })
+	rec.mu.Lock()
+	defer rec.mu.Unlock()
+	// two attempts for the first event, then the third 500 for the second
+	// event's first attempt before it gets through
+	if rec.events[0].Text != "after" {
+		t.Errorf("delivered %+v", rec.events)
+	}
+}
+
+func TestWebhooksRegistration(t *testing.T) {
+	hooks := newTestWebhooks(t)
+	for _, bad := range []string{"", "not a url", "ftp://example.com/hook", "/relative"} {
+		if err := hooks.Add("lobby", bad); err == nil {
+			t.Errorf("Add(%q) succeeded", bad)
+		}
+	}
+	hooks.Add("lobby", "https://example.com/a")
+	hooks.Add("lobby", "https://example.com/b")
+	hooks.Add("lobby", "https://example.com/a")
+	if got := hooks.URLs("lobby"); len(got) != 2 {
+		t.Errorf("URLs = %v, want each URL once", got)
+	}
+	if !hooks.Remove("lobby", "https://example.com/a") || hooks.Remove("lobby", "https://example.com/a") {
+		t.Error("Remove did not report removing the URL exactly once")
+	}
+	if got := hooks.URLs("lobby"); len(got) != 1 || got[0] != "https://example.com/b" {
+		t.Errorf("URLs after Remove = %v", got)
+	}
+}
+
+func TestWebhooksFailingURLDoesNotDelayOthers(t *testing.T) {
+	dead := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	t.Cleanup(dead.Close)
+	rec, hs := newWebhookReceiver(t)
+	hooks := newTestWebhooks(t)
+	// the dead URL would hold a shared dispatcher for the rest of the test
+	hooks.Backoff = time.Hour
+	hooks.Add("lobby", dead.URL)
+	hooks.Add("lobby", hs.URL)
+
+	hooks.publish(Event{Type: "message", Room: "lobby", Text: "first"})
+	hooks.publish(Event{Type: "message", Room: "lobby", Text: "second"})
+	waitFor(t, func() bool { return rec.count() == 2 })
+}
+
+func TestWebhooksFollowRoomRenames(t *testing.T) {
+	rec, hs := newWebhookReceiver(t)
+	hooks := newTestWebhooks(t)
+	hooks.Add("lobby", hs.URL)
+	_, l := newTestServer(t, func(s *Server) { s.Events = EventSinks{hooks} })
+
+	alice := dial(t, l)
+	alice.join("alice", "lobby")
+	alice.do("/rename lobby hall")
+	alice.send("/msg still here")
+	alice.expect("OK")
+	waitFor(t, func() bool { return rec.count() == 2 })
+	rec.mu.Lock()
+	if got := rec.events[1]; got.Room != "hall" || got.Text != "still here" {
+		t.Errorf("delivered %+v after the rename", got)
+	}
+	rec.mu.Unlock()
+	if got := hooks.URLs("lobby"); len(got) != 0 {
+		t.Errorf("lobby still has webhooks %v", got)
+	}
+
+	hooks.OnRoomDelete("hall")
+	if got := hooks.URLs("hall"); len(got) != 0 {
+		t.Errorf("hall still has webhooks %v after it was deleted", got)
+	}
+}
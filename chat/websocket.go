@@ -0,0 +1,101 @@
+package chat
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/sirupsen/logrus"
+)
+
+var upgrader = websocket.Upgrader{
+	ReadBufferSize:  1024,
+	WriteBufferSize: 1024,
+}
+
+// wsConn adapts a websocket connection to net.Conn so browser clients can go
+// through the same ReadInput/command pipeline as raw TCP clients. Every text
+// frame is read as one line of input and every Write is sent as one frame.
+type wsConn struct {
+	ws      *websocket.Conn
+	pending []byte
+	writeMu sync.Mutex
+}
+
+func newWSConn(ws *websocket.Conn) *wsConn {
+	return &wsConn{ws: ws}
+}
+
+func (w *wsConn) Read(p []byte) (int, error) {
+	for len(w.pending) == 0 {
+		msgType, data, err := w.ws.ReadMessage()
+		if err != nil {
+			if websocket.IsCloseError(err, websocket.CloseNormalClosure, websocket.CloseGoingAway, websocket.CloseNoStatusReceived) {
+				return 0, io.EOF
+			}
+			return 0, err
+		}
+		if msgType != websocket.TextMessage {
+			continue
+		}
+		data = bytes.TrimRight(data, "\r\n")
+		w.pending = append(data, '\n')
+	}
+
+	n := copy(p, w.pending)
+	w.pending = w.pending[n:]
+	return n, nil
+}
+
+func (w *wsConn) Write(p []byte) (int, error) {
+	w.writeMu.Lock()
+	defer w.writeMu.Unlock()
+
+	if err := w.ws.WriteMessage(websocket.TextMessage, bytes.TrimRight(p, "\n")); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+func (w *wsConn) Close() error {
+	w.writeMu.Lock()
+	msg := websocket.FormatCloseMessage(websocket.CloseNormalClosure, "")
+	w.ws.WriteControl(websocket.CloseMessage, msg, time.Now().Add(time.Second))
+	w.writeMu.Unlock()
+	return w.ws.Close()
+}
+
+func (w *wsConn) LocalAddr() net.Addr  { return w.ws.LocalAddr() }
+func (w *wsConn) RemoteAddr() net.Addr { return w.ws.RemoteAddr() }
+
+func (w *wsConn) SetDeadline(t time.Time) error {
+	if err := w.ws.SetReadDeadline(t); err != nil {
+		return err
+	}
+	return w.ws.SetWriteDeadline(t)
+}
+
+func (w *wsConn) SetReadDeadline(t time.Time) error  { return w.ws.SetReadDeadline(t) }
+func (w *wsConn) SetWriteDeadline(t time.Time) error { return w.ws.SetWriteDeadline(t) }
+
+func (s *Server) ServeWS(w http.ResponseWriter, r *http.Request) {
+	ws, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		s.Logger().WithFields(logrus.Fields{
+			"remote_addr": r.RemoteAddr,
+			"error":       err.Error(),
+		}).Error("failed to upgrade websocket connection")
+		return
+	}
+	if s.MaxLineLength > 0 {
+		// a frame is a whole line, so gorilla must refuse oversized frames
+		// before buffering them; that closes the connection
+		ws.SetReadLimit(int64(s.MaxLineLength) + 2)
+	}
+
+	s.NewClient(newWSConn(ws))
+}
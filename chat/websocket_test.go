@@ -0,0 +1,84 @@
+package chat
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+func dialWS(t *testing.T, url string) *websocket.Conn {
+	t.Helper()
+	ws, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(url, "http"), nil)
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	t.Cleanup(func() { ws.Close() })
+	return ws
+}
+
+// readWSUntil reads frames until one contains want.
+func readWSUntil(t *testing.T, ws *websocket.Conn, want string) string {
+	t.Helper()
+	ws.SetReadDeadline(time.Now().Add(testTimeout))
+	for {
+		_, data, err := ws.ReadMessage()
+		if err != nil {
+			t.Fatalf("waiting for %q: %v", want, err)
+		}
+		if strings.Contains(string(data), want) {
+			return string(data)
+		}
+	}
+}
+
+func TestWebSocketJoinAndMessage(t *testing.T) {
+	s, l := newTestServer(t, nil)
+	hs := httptest.NewServer(http.HandlerFunc(s.ServeWS))
+	defer hs.Close()
+
+	bob := dial(t, l)
+	bob.join("bob", "lobby")
+
+	ws := dialWS(t, hs.URL)
+	readWSUntil(t, ws, "welcome")
+	for _, line := range []string{"/name alice", "/join lobby", "/msg hello from the browser"} {
+		if err := ws.WriteMessage(websocket.TextMessage, []byte(line)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	readWSUntil(t, ws, "currently here: bob")
+	bob.expect("alice has joined the room")
+	if line, _ := bob.expect("hello from the browser"); !strings.Contains(line, "alice : hello from the browser") {
+		t.Errorf("bob got %q", line)
+	}
+
+	bob.send("/msg hi alice")
+	if frame := readWSUntil(t, ws, "hi alice"); strings.HasSuffix(frame, "\n") {
+		t.Errorf("frame %q should not end in a newline", frame)
+	}
+}
+
+func TestWebSocketCloseLeavesRoom(t *testing.T) {
+	s, l := newTestServer(t, nil)
+	hs := httptest.NewServer(http.HandlerFunc(s.ServeWS))
+	defer hs.Close()
+
+	bob := dial(t, l)
+	bob.join("bob", "lobby")
+
+	ws := dialWS(t, hs.URL)
+	readWSUntil(t, ws, "welcome")
+	ws.WriteMessage(websocket.TextMessage, []byte("/name alice"))
+	ws.WriteMessage(websocket.TextMessage, []byte("/join lobby"))
+	bob.expect("alice has joined the room")
+
+	ws.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""))
+	bob.expect("alice has left the chat")
+	if out := bob.do("/who"); hasLine(out, "alice") {
+		t.Errorf("alice still listed after closing: %q", out)
+	}
+}
@@ -0,0 +1,296 @@
+// Package chatbot is a small SDK for writing bots for the chat server. A Bot
+// connects as an ordinary client, switches to the JSON protocol and calls the
+// handlers registered with OnMessage, OnJoin and the like for what it reads,
+// so bots never parse the server's lines themselves:
+//
+//	bot := chatbot.New("echo", "lobby")
+//	bot.OnMessage(func(b *chatbot.Bot, m chatbot.Message) {
+//		b.Reply(m.ID, m.Text)
+//	})
+//	err := bot.DialAndRun(ctx, "localhost:3000")
+package chatbot
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Message is a chat message posted by someone else in the bot's room.
+type Message struct {
+	ID uint64
+	// ParentID is the message this one replies to, or 0.
+	ParentID uint64
+	Nick     string
+	Text     string
+}
+
+// Mention is a message that mentions the bot as @nick.
+type Mention struct {
+	Message
+	Room string
+}
+
+// ServerError is an error the server reported for one of the bot's
+// commands. Code is the chat package's machine-readable ErrorCode.
+type ServerError struct {
+	Code    string
+	Message string
+}
+
+func (e *ServerError) Error() string {
+	return e.Code + ": " + e.Message
+}
+
+// Bot is a chat client driven by callbacks. Register the handlers, then call
+// Run or DialAndRun. The handlers run one at a time on the goroutine reading
+// from the server, in the order the server sent things; they may call the
+// bot's sending methods, which never wait for a reply.
+type Bot struct {
+	// Nick is the nickname the bot asks for when it connects.
+	Nick string
+	// Rooms are joined in turn when the bot connects. The server keeps a
+	// client in one room at a time, so the bot ends up in the last.
+	Rooms []string
+
+	onConnect []func(*Bot)
+	onMessage []func(*Bot, Message)
+	onMention []func(*Bot, Mention)
+	onJoin    []func(*Bot, string)
+	onLeave   []func(*Bot, string)
+	onNotice  []func(*Bot, string)
+	onError   []func(*Bot, error)
+
+	mu   sync.Mutex
+	conn net.Conn
+}
+
+// New returns a bot called nick that joins rooms when it connects.
+func New(nick string, rooms ...string) *Bot {
+	return &Bot{Nick: nick, Rooms: rooms}
+}
+
+// OnConnect calls f once the bot has asked for its nickname, before it joins
+// its rooms, e.g. to send /admin or /login.
+func (b *Bot) OnConnect(f func(b *Bot)) {
+	b.onConnect = append(b.onConnect, f)
+}
+
+// OnMessage calls f for every chat message others post in the bot's room.
+func (b *Bot) OnMessage(f func(b *Bot, m Message)) {
+	b.onMessage = append(b.onMessage, f)
+}
+
+// OnMention calls f when someone mentions the bot as @nick, even in another
+// room.
+func (b *Bot) OnMention(f func(b *Bot, m Mention)) {
+	b.onMention = append(b.onMention, f)
+}
+
+// OnJoin calls f with the nickname of everyone who joins the bot's room.
+func (b *Bot) OnJoin(f func(b *Bot, nick string)) {
+	b.onJoin = append(b.onJoin, f)
+}
+
+// OnLeave calls f with the nickname of everyone who leaves the bot's room,
+// whether they quit, moved on or were kicked.
+func (b *Bot) OnLeave(f func(b *Bot, nick string)) {
+	b.onLeave = append(b.onLeave, f)
+}
+
+// OnNotice calls f with the text of every other server notice, such as the
+// replies to the bot's own commands.
+func (b *Bot) OnNotice(f func(b *Bot, text string)) {
+	b.onNotice = append(b.onNotice, f)
+}
+
+// OnError calls f with each *ServerError the server reports for the bot's
+// commands.
+func (b *Bot) OnError(f func(b *Bot, err error)) {
+	b.onError = append(b.onError, f)
+}
+
+// DialAndRun connects to the chat server at addr over TCP and runs the bot
+// until ctx is done or the server hangs up.
+func (b *Bot) DialAndRun(ctx context.Context, addr string) error {
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return err
+	}
+	return b.Run(ctx, conn)
+}
+
+// Run serves the bot over conn, which it closes when it returns: it sets up
+// the JSON protocol, takes the bot's nickname, calls the OnConnect handlers,
+// joins its rooms and then calls the other handlers until ctx is done or the
+// connection ends. It returns ctx's error, or nil when the server closed the
+// connection.
+func (b *Bot) Run(ctx context.Context, conn net.Conn) error {
+	b.mu.Lock()
+	if b.conn != nil {
+		b.mu.Unlock()
+		conn.Close()
+		return errors.New("chatbot: bot is already running")
+	}
+	b.conn = conn
+	b.mu.Unlock()
+	defer func() {
+		b.mu.Lock()
+		b.conn = nil
+		b.mu.Unlock()
+		conn.Close()
+	}()
+	stop := context.AfterFunc(ctx, func() { conn.Close() })
+	defer stop()
+
+	// the server may not read a line until the greeting has been read, so
+	// reading starts before the bot sends anything
+	lines := make(chan string, 64)
+	done := make(chan struct{})
+	defer close(done)
+	var readErr error
+	go func() {
+		defer close(lines)
+		sc := bufio.NewScanner(conn)
+		for sc.Scan() {
+			select {
+			case lines <- sc.Text():
+			case <-done:
+				return
+			}
+		}
+		readErr = sc.Err()
+	}()
+
+	for _, line := range []string{"/json on", "/name " + Quote(b.Nick)} {
+		if err := b.Command(line); err != nil {
+			return err
+		}
+	}
+	for _, f := range b.onConnect {
+		f(b)
+	}
+	for _, room := range b.Rooms {
+		if err := b.Join(room); err != nil {
+			return err
+		}
+	}
+
+	for line := range lines {
+		b.handle(line)
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if readErr != nil && !errors.Is(readErr, net.ErrClosed) {
+		return readErr
+	}
+	return nil
+}
+
+// output is a line of the server's JSON output.
+type output struct {
+	Type      string `json:"type"`
+	Text      string `json:"text"`
+	Code      string `json:"code"`
+	Message   string `json:"message"`
+	MessageID uint64 `json:"messageId"`
+	ParentID  uint64 `json:"parentId"`
+	Nick      string `json:"nick"`
+	Event     string `json:"event"`
+}
+
+func (b *Bot) handle(line string) {
+	var out output
+	if !strings.HasPrefix(line, "{") || json.Unmarshal([]byte(line), &out) != nil {
+		// the greeting, sent before /json on takes effect
+		return
+	}
+	switch out.Type {
+	case "ping":
+		b.Command("/pong")
+	case "error":
+		err := &ServerError{Code: out.Code, Message: out.Message}
+		for _, f := range b.onError {
+			f(b, err)
+		}
+	case "mention":
+		m := Mention{Message: Message{ID: out.MessageID, Nick: out.Nick, Text: out.Message}, Room: out.Text}
+		for _, f := range b.onMention {
+			f(b, m)
+		}
+	case "message":
+		switch {
+		case out.MessageID != 0:
+			m := Message{ID: out.MessageID, ParentID: out.ParentID, Nick: out.Nick, Text: strings.TrimPrefix(out.Text, out.Nick+" : ")}
+			for _, f := range b.onMessage {
+				f(b, m)
+			}
+		case out.Event == "join":
+			for _, f := range b.onJoin {
+				f(b, out.Nick)
+			}
+		case out.Event == "leave":
+			for _, f := range b.onLeave {
+				f(b, out.Nick)
+			}
+		default:
+			for _, f := range b.onNotice {
+				f(b, out.Text)
+			}
+		}
+	}
+}
+
+// ErrMultiline is returned for text or a command line that holds a line
+// break, which the server would read as a second command.
+var ErrMultiline = errors.New("chatbot: text must be a single line")
+
+// Send posts text to the bot's room. text must be a single line; Send
+// returns ErrMultiline rather than post one that is not, so split text
+// that may hold line breaks and send each line.
+func (b *Bot) Send(text string) error {
+	return b.Command("/msg " + text)
+}
+
+// Reply posts text to the bot's room as a reply to message id. Like Send, it
+// returns ErrMultiline for text with a line break.
+func (b *Bot) Reply(id uint64, text string) error {
+	return b.Command("/reply " + strconv.FormatUint(id, 10) + " " + text)
+}
+
+// Join moves the bot to room.
+func (b *Bot) Join(room string) error {
+	return b.Command("/join " + Quote(room))
+}
+
+// Command sends exactly one line of input to the server as typed, e.g.
+// "/kick bob", without its line ending; it returns ErrMultiline if line holds
+// a "\r" or "\n". Quote arguments that may contain spaces. Errors the server
+// reports arrive through OnError.
+func (b *Bot) Command(line string) error {
+	if strings.ContainsAny(line, "\r\n") {
+		return ErrMultiline
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.conn == nil {
+		return errors.New("chatbot: bot is not running")
+	}
+	_, err := fmt.Fprintf(b.conn, "%s\n", line)
+	return err
+}
+
+// Quote makes arg a single argument to a command, even if it contains spaces
+// or quotes.
+func Quote(arg string) string {
+	arg = strings.ReplaceAll(arg, `\`, `\\`)
+	return `"` + strings.ReplaceAll(arg, `"`, `\"`) + `"`
+}
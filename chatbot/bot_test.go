@@ -0,0 +1,233 @@
+package chatbot
+
+import (
+	"context"
+	"errors"
+	"io"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/fahimimam/chatApplication/chat"
+	"github.com/sirupsen/logrus"
+)
+
+func TestMain(m *testing.M) {
+	logger := logrus.New()
+	logger.SetOutput(io.Discard)
+	chat.SetLogger(logger)
+	os.Exit(m.Run())
+}
+
+const testTimeout = 5 * time.Second
+
+// newTestServer serves a chat server on a PipeListener until the test ends.
+func newTestServer(t *testing.T, configure func(s *chat.Server)) (*chat.Server, *chat.PipeListener) {
+	t.Helper()
+	s := chat.NewServer()
+	s.FloodMessages = 0
+	s.FloodRepeats = 0
+	if configure != nil {
+		configure(s)
+	}
+	l := chat.NewPipeListener()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		s.Serve(context.Background(), l)
+	}()
+	t.Cleanup(func() {
+		s.Close()
+		<-done
+	})
+	return s, l
+}
+
+// run runs b on a new connection to l until the test ends.
+func run(t *testing.T, l *chat.PipeListener, b *Bot) {
+	t.Helper()
+	conn, err := l.Dial()
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() { done <- b.Run(ctx, conn) }()
+	t.Cleanup(func() {
+		cancel()
+		<-done
+	})
+}
+
+// inRoom waits until the server lists nick as a member of room.
+func inRoom(t *testing.T, s *chat.Server, nick, room string) {
+	t.Helper()
+	deadline := time.Now().Add(testTimeout)
+	for time.Now().Before(deadline) {
+		for _, r := range s.Snapshot().Rooms {
+			for _, m := range r.Members {
+				if r.Name == room && m == nick {
+					return
+				}
+			}
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	t.Fatalf("%s never joined %s", nick, room)
+}
+
+func receive[T any](t *testing.T, ch <-chan T) T {
+	t.Helper()
+	select {
+	case v := <-ch:
+		return v
+	case <-time.After(testTimeout):
+		var zero T
+		t.Fatal("timed out waiting for the bot")
+		return zero
+	}
+}
+
+func TestEchoBot(t *testing.T) {
+	s, l := newTestServer(t, nil)
+
+	echo := New("echo", "lobby")
+	echo.OnMessage(func(b *Bot, m Message) {
+		b.Reply(m.ID, m.Text)
+	})
+	echo.OnJoin(func(b *Bot, nick string) {
+		b.Send("welcome " + nick)
+	})
+	left := make(chan string, 1)
+	echo.OnLeave(func(b *Bot, nick string) {
+		left <- nick
+	})
+	run(t, l, echo)
+	inRoom(t, s, "echo", "lobby")
+
+	messages := make(chan Message, 4)
+	alice := New("alice", "lobby")
+	alice.OnMessage(func(b *Bot, m Message) {
+		messages <- m
+	})
+	run(t, l, alice)
+
+	if m := receive(t, messages); m.Nick != "echo" || m.Text != "welcome alice" {
+		t.Errorf("alice got %+v, want the welcome", m)
+	}
+	alice.Send("hello there")
+	if m := receive(t, messages); m.Text != "hello there" || m.ParentID == 0 || m.ParentID == m.ID {
+		t.Errorf("alice got %+v, want the echo as a reply", m)
+	}
+
+	alice.Command("/quit")
+	if nick := receive(t, left); nick != "alice" {
+		t.Errorf("echo saw %s leave", nick)
+	}
+}
+
+func TestBotMentionsAndErrors(t *testing.T) {
+	s, l := newTestServer(t, nil)
+
+	mentions := make(chan Mention, 1)
+	errs := make(chan error, 1)
+	notices := make(chan string, 16)
+	bot := New("helper", "lobby")
+	bot.OnMention(func(b *Bot, m Mention) { mentions <- m })
+	bot.OnError(func(b *Bot, err error) { errs <- err })
+	bot.OnNotice(func(b *Bot, text string) { notices <- text })
+	run(t, l, bot)
+	inRoom(t, s, "helper", "lobby")
+
+	alice := New("alice", "lobby")
+	run(t, l, alice)
+	inRoom(t, s, "alice", "lobby")
+	alice.Send("@helper are you there?")
+	if m := receive(t, mentions); m.Nick != "alice" || m.Room != "lobby" || m.Text != "@helper are you there?" {
+		t.Errorf("mention = %+v", m)
+	}
+
+	bot.Command("/nosuchcommand")
+	err := receive(t, errs)
+	if se, ok := err.(*ServerError); !ok || se.Code != string(chat.ErrUnknownCommand) {
+		t.Errorf("error = %v, want an unknown_command ServerError", err)
+	}
+	bot.Command("/ping hi")
+	for receive(t, notices) != "pong hi" {
+		// skip the replies to joining
+	}
+}
+
+func TestBotAnswersHeartbeat(t *testing.T) {
+	s, l := newTestServer(t, func(s *chat.Server) {
+		s.HeartbeatInterval = 10 * time.Millisecond
+		s.HeartbeatMisses = 2
+	})
+	bot := New("steady")
+	run(t, l, bot)
+	time.Sleep(100 * time.Millisecond)
+	if n := s.ConnectionCount(); n != 1 {
+		t.Errorf("%d connections after several heartbeats, want the bot still connected", n)
+	}
+}
+
+func TestBotOnConnect(t *testing.T) {
+	s, l := newTestServer(t, func(s *chat.Server) { s.AdminToken = "secret" })
+	bot := New("moderator", "lobby")
+	bot.OnConnect(func(b *Bot) {
+		b.Command("/admin " + Quote("secret"))
+	})
+	run(t, l, bot)
+	inRoom(t, s, "moderator", "lobby")
+	for _, c := range s.Snapshot().Clients {
+		if c.NickName == "moderator" && !c.Admin {
+			t.Error("the bot is not an admin after OnConnect")
+		}
+	}
+}
+
+func TestBotRejectsLineBreaks(t *testing.T) {
+	s, l := newTestServer(t, nil)
+	messages := make(chan Message, 4)
+	alice := New("alice", "lobby")
+	alice.OnMessage(func(b *Bot, m Message) { messages <- m })
+	run(t, l, alice)
+	mallory := New("mallory", "lobby")
+	run(t, l, mallory)
+	inRoom(t, s, "alice", "lobby")
+	inRoom(t, s, "mallory", "lobby")
+
+	for name, err := range map[string]error{
+		"Send":    mallory.Send("hi\n/kick alice"),
+		"Reply":   mallory.Reply(1, "hi\r/quit"),
+		"Command": mallory.Command("/ping\n/name alice"),
+		"Join":    mallory.Join("games\n/quit"),
+	} {
+		if !errors.Is(err, ErrMultiline) {
+			t.Errorf("%s with a line break returned %v, want ErrMultiline", name, err)
+		}
+	}
+	mallory.Send("after")
+	if m := receive(t, messages); m.Nick != "mallory" || m.Text != "after" {
+		t.Errorf("alice got %+v, want only the single-line message", m)
+	}
+	inRoom(t, s, "mallory", "lobby")
+}
+
+func TestBotNotRunning(t *testing.T) {
+	if err := New("idle").Send("hello"); err == nil {
+		t.Error("Send on a bot that is not running succeeded")
+	}
+	_, l := newTestServer(t, nil)
+	bot := New("twice")
+	run(t, l, bot)
+	conn, _ := l.Dial()
+	// the first Run may not have claimed the bot yet
+	deadline := time.Now().Add(testTimeout)
+	for bot.Command("/ping") != nil && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+	if err := bot.Run(context.Background(), conn); err == nil {
+		t.Error("a second Run succeeded")
+	}
+}
@@ -0,0 +1,48 @@
+package chatbot_test
+
+import (
+	"context"
+	"log"
+	"strings"
+
+	"github.com/fahimimam/chatApplication/chatbot"
+)
+
+// An echo bot repeats every message in its room as a reply.
+func Example_echo() {
+	bot := chatbot.New("echo", "lobby")
+	bot.OnMessage(func(b *chatbot.Bot, m chatbot.Message) {
+		b.Reply(m.ID, m.Text)
+	})
+	bot.OnJoin(func(b *chatbot.Bot, nick string) {
+		b.Send("hi " + nick + ", I repeat everything you say")
+	})
+	if err := bot.DialAndRun(context.Background(), "localhost:3000"); err != nil {
+		log.Fatal(err)
+	}
+}
+
+// A moderator bot kicks whoever uses a banned word. It becomes an admin
+// first, since only admins and room operators may /kick.
+func Example_moderator() {
+	banned := []string{"spam", "scam"}
+	bot := chatbot.New("moderator", "lobby")
+	bot.OnMessage(func(b *chatbot.Bot, m chatbot.Message) {
+		for _, word := range banned {
+			if strings.Contains(strings.ToLower(m.Text), word) {
+				b.Command("/kick " + chatbot.Quote(m.Nick))
+				b.Send(m.Nick + " was removed for posting " + word)
+				return
+			}
+		}
+	})
+	bot.OnConnect(func(b *chatbot.Bot) {
+		b.Command("/admin " + chatbot.Quote("s3cret"))
+	})
+	bot.OnError(func(b *chatbot.Bot, err error) {
+		log.Print(err)
+	})
+	if err := bot.DialAndRun(context.Background(), "localhost:3000"); err != nil {
+		log.Fatal(err)
+	}
+}
@@ -0,0 +1,205 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/fahimimam/chatApplication/chat"
+)
+
+const usage = `usage: chatctl [flags] COMMAND [ARGS]
+
+commands:
+  rooms                    list the rooms
+  clients                  list the connected clients
+  kick NICK                disconnect a client
+  announce [-room ROOM] TEXT
+                           send TEXT to every client, or to ROOM's members
+  delete-room NAME         delete a room, moving its members out
+
+flags:
+`
+
+// chatctl operates a running chat server through its admin API, which is
+// served under /admin/ on the server's metrics address.
+func main() {
+	addr := flag.String("addr", envOr("CHAT_ADMIN_URL", "http://localhost:2112"), "base URL of the server's admin API (env CHAT_ADMIN_URL)")
+	token := flag.String("token", "", "the server's admin token (env CHAT_ADMIN_TOKEN)")
+	asJSON := flag.Bool("json", false, "print the API's JSON instead of a table")
+	flag.Usage = func() {
+		fmt.Fprint(flag.CommandLine.Output(), usage)
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if flag.NArg() == 0 {
+		flag.Usage()
+		os.Exit(2)
+	}
+	// The token is read here rather than as the flag's default so -h does
+	// not print it.
+	if *token == "" {
+		*token = os.Getenv("CHAT_ADMIN_TOKEN")
+	}
+
+	c := &client{
+		base:  strings.TrimSuffix(*addr, "/") + "/admin",
+		token: *token,
+		http:  &http.Client{Timeout: 10 * time.Second},
+		json:  *asJSON,
+	}
+	if err := c.run(flag.Arg(0), flag.Args()[1:]); err != nil {
+		fmt.Fprintln(os.Stderr, "chatctl:", err)
+		os.Exit(1)
+	}
+}
+
+type client struct {
+	base  string
+	token string
+	http  *http.Client
+	json  bool
+}
+
+func (c *client) run(command string, args []string) error {
+	switch command {
+	case "rooms":
+		if len(args) != 0 {
+			return fmt.Errorf("usage: chatctl rooms")
+		}
+		var rooms []chat.RoomState
+		return c.list("/rooms", &rooms, func(w io.Writer) {
+			fmt.Fprintln(w, "NAME\tMEMBERS\tMAX\tOWNER\tLOCKED")
+			for _, r := range rooms {
+				fmt.Fprintf(w, "%s\t%d\t%d\t%s\t%t\n", r.Name, len(r.Members), r.MaxMembers, r.Owner, r.Locked)
+			}
+		})
+	case "clients":
+		if len(args) != 0 {
+			return fmt.Errorf("usage: chatctl clients")
+		}
+		var clients []chat.ClientState
+		return c.list("/clients", &clients, func(w io.Writer) {
+			fmt.Fprintln(w, "NICK\tADDRESS\tROOM\tAWAY\tADMIN")
+			for _, cl := range clients {
+				fmt.Fprintf(w, "%s\t%s\t%s\t%t\t%t\n", cl.NickName, cl.RemoteAddr, cl.Room, cl.Away, cl.Admin)
+			}
+		})
+	case "kick":
+		if len(args) != 1 {
+			return fmt.Errorf("usage: chatctl kick NICK")
+		}
+		if err := c.do(http.MethodPost, "/clients/"+url.PathEscape(args[0])+"/kick", nil, nil); err != nil {
+			return err
+		}
+		fmt.Printf("kicked %s\n", args[0])
+		return nil
+	case "announce":
+		fs := flag.NewFlagSet("announce", flag.ContinueOnError)
+		room := fs.String("room", "", "only announce to this room's members")
+		if err := fs.Parse(args); err != nil {
+			return err
+		}
+		if fs.NArg() == 0 {
+			return fmt.Errorf("usage: chatctl announce [-room ROOM] TEXT")
+		}
+		body := map[string]string{"text": strings.Join(fs.Args(), " "), "room": *room}
+		var resp struct {
+			Delivered int `json:"delivered"`
+		}
+		if err := c.do(http.MethodPost, "/announce", body, &resp); err != nil {
+			return err
+		}
+		fmt.Printf("delivered to %d clients\n", resp.Delivered)
+		return nil
+	case "delete-room":
+		if len(args) != 1 {
+			return fmt.Errorf("usage: chatctl delete-room NAME")
+		}
+		if err := c.do(http.MethodDelete, "/rooms/"+url.PathEscape(args[0]), nil, nil); err != nil {
+			return err
+		}
+		fmt.Printf("deleted %s\n", args[0])
+		return nil
+	default:
+		return fmt.Errorf("unknown command %q; run chatctl -h for the list", command)
+	}
+}
+
+// list fetches path into v and prints it with table, or as indented JSON
+// with -json.
+func (c *client) list(path string, v any, table func(io.Writer)) error {
+	if err := c.do(http.MethodGet, path, nil, v); err != nil {
+		return err
+	}
+	if c.json {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		return enc.Encode(v)
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	table(w)
+	return w.Flush()
+}
+
+// do sends body as JSON, if it is not nil, and decodes the response into
+// out, if it is not nil. API errors come back as the server's message.
+func (c *client) do(method, path string, body, out any) error {
+	var r io.Reader
+	if body != nil {
+		b, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		r = bytes.NewReader(b)
+	}
+	req, err := http.NewRequest(method, c.base+path, r)
+	if err != nil {
+		return err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if c.token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.token)
+	}
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 300 {
+		var apiErr struct {
+			Code  string `json:"code"`
+			Error string `json:"error"`
+		}
+		b, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+		if json.Unmarshal(b, &apiErr) == nil && apiErr.Error != "" {
+			return fmt.Errorf("%s (%s)", apiErr.Error, apiErr.Code)
+		}
+		if resp.StatusCode == http.StatusForbidden {
+			return fmt.Errorf("forbidden: check -token or CHAT_ADMIN_TOKEN")
+		}
+		return fmt.Errorf("%s: %s", resp.Status, strings.TrimSpace(string(b)))
+	}
+	if out == nil {
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+func envOr(key, def string) string {
+	if v := os.Getenv(key); v != "" {
+		return v
+	}
+	return def
+}
@@ -0,0 +1,75 @@
+package config
+
+import (
+	"context"
+	"net"
+
+	"github.com/fahimimam/chatApplication/bridge"
+	"github.com/fahimimam/chatApplication/chat"
+	"github.com/sirupsen/logrus"
+)
+
+// DefaultSlackNick and DefaultDiscordNick are the nicknames bridges use in
+// their rooms.
+const (
+	DefaultSlackNick   = "slack"
+	DefaultDiscordNick = "discord"
+)
+
+// StartBridges connects the configured bridges to s over an in-memory
+// listener, each on a goroutine of its own, until s shuts down. Bridges are
+// trusted connections, exempt from the message rate limit and flood
+// protection. A bridge that loses either side reconnects; see
+// bridge.Bridge.RunDialer.
+func (c *Config) StartBridges(s *chat.Server, log logrus.FieldLogger) {
+	var bridges []*bridge.Bridge
+	for _, sb := range c.SlackBridges {
+		slack := bridge.NewSlack(sb.Token, sb.Channel)
+		slack.Users = sb.Users
+		bridges = append(bridges, bridge.New(orDefault(sb.Nick, DefaultSlackNick), sb.Room, slack))
+	}
+	for _, db := range c.DiscordBridges {
+		discord := bridge.NewDiscord(db.Token, db.Channel)
+		discord.WebhookURL = db.WebhookURL
+		discord.Users = db.Users
+		discord.Log = log
+		bridges = append(bridges, bridge.New(orDefault(db.Nick, DefaultDiscordNick), db.Room, discord))
+	}
+	if len(bridges) == 0 {
+		return
+	}
+	l := chat.NewPipeListener()
+	go s.Serve(context.Background(), l)
+	for _, b := range bridges {
+		b.Log = log
+		go runBridge(l, b, log)
+	}
+}
+
+func orDefault(value, def string) string {
+	if value == "" {
+		return def
+	}
+	return value
+}
+
+func runBridge(l *chat.PipeListener, b *bridge.Bridge, log logrus.FieldLogger) {
+	log = log.WithFields(logrus.Fields{
+		"room":   b.Room,
+		"remote": b.Remote.Name(),
+	})
+	log.Info("bridge started")
+	b.RunDialer(context.Background(), func() (net.Conn, error) {
+		// a bridge speaks for everyone in the remote channel, so it is
+		// trusted not to flood
+		return l.DialTrusted(bridgeAddr(b.Remote.Name() + "/" + b.Room))
+	})
+	log.Info("bridge stopped")
+}
+
+// bridgeAddr is the remote address the chat server sees for a bridge, so
+// bridges do not count against one MaxConnectionsPerIP.
+type bridgeAddr string
+
+func (a bridgeAddr) Network() string { return "bridge" }
+func (a bridgeAddr) String() string  { return string(a) }
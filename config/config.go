@@ -0,0 +1,476 @@
+// Package config loads the chat server's settings from a JSON or YAML file,
+// CHAT_* environment variables and command-line flags, in increasing order of
+// precedence.
+package config
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/fahimimam/chatApplication/chat"
+	"github.com/sirupsen/logrus"
+	"gopkg.in/yaml.v3"
+)
+
+type Config struct {
+	Addr                string   `json:"addr" yaml:"addr"`
+	MetricsAddr         string   `json:"metricsAddr" yaml:"metricsAddr"`
+	GRPCAddr            string   `json:"grpcAddr" yaml:"grpcAddr"`
+	IRCAddr             string   `json:"ircAddr" yaml:"ircAddr"`
+	TLSCert             string   `json:"tlsCert" yaml:"tlsCert"`
+	TLSKey              string   `json:"tlsKey" yaml:"tlsKey"`
+	RequireTLS          bool     `json:"requireTLS" yaml:"requireTLS"`
+	MaxConnections      int      `json:"maxConnections" yaml:"maxConnections"`
+	MaxConnectionsPerIP int      `json:"maxConnectionsPerIP" yaml:"maxConnectionsPerIP"`
+	MaxMembersPerRoom   int      `json:"maxMembersPerRoom" yaml:"maxMembersPerRoom"`
+	MaxRooms            int      `json:"maxRooms" yaml:"maxRooms"`
+	HistorySize         int      `json:"historySize" yaml:"historySize"`
+	HistoryDir          string   `json:"historyDir" yaml:"historyDir"`
+	HistoryDB           string   `json:"historyDB" yaml:"historyDB"`
+	CommandBuffer       int      `json:"commandBuffer" yaml:"commandBuffer"`
+	Workers             int      `json:"workers" yaml:"workers"`
+	RoomWorkers         int      `json:"roomWorkers" yaml:"roomWorkers"`
+	MOTD                string   `json:"motd" yaml:"motd"`
+	MOTDFile            string   `json:"motdFile" yaml:"motdFile"`
+	LogLevel            string   `json:"logLevel" yaml:"logLevel"`
+	BannedIPs           []string `json:"bannedIPs" yaml:"bannedIPs"`
+	BanFile             string   `json:"banFile" yaml:"banFile"`
+	BannedWordsFile     string   `json:"bannedWordsFile" yaml:"bannedWordsFile"`
+	Emoji               bool     `json:"emoji" yaml:"emoji"`
+	EmojiFile           string   `json:"emojiFile" yaml:"emojiFile"`
+	AuditLog            string   `json:"auditLog" yaml:"auditLog"`
+	AdminToken          string   `json:"adminToken" yaml:"adminToken"`
+	AdminNicks          []string `json:"adminNicks" yaml:"adminNicks"`
+	AccountsFile        string   `json:"accountsFile" yaml:"accountsFile"`
+	SessionTTL          Duration `json:"sessionTTL" yaml:"sessionTTL"`
+	SessionSecret       string   `json:"sessionSecret" yaml:"sessionSecret"`
+	AccountTokenTTL     Duration `json:"accountTokenTTL" yaml:"accountTokenTTL"`
+	IdleTimeout         Duration `json:"idleTimeout" yaml:"idleTimeout"`
+	MessageRate         float64  `json:"messageRate" yaml:"messageRate"`
+	MessageBurst        int      `json:"messageBurst" yaml:"messageBurst"`
+	MaxLineLength       int      `json:"maxLineLength" yaml:"maxLineLength"`
+	OutboxSize          int      `json:"outboxSize" yaml:"outboxSize"`
+	WriteTimeout        Duration `json:"writeTimeout" yaml:"writeTimeout"`
+	SlowConsumerTimeout Duration `json:"slowConsumerTimeout" yaml:"slowConsumerTimeout"`
+	HeartbeatInterval   Duration `json:"heartbeatInterval" yaml:"heartbeatInterval"`
+	HeartbeatMisses     int      `json:"heartbeatMisses" yaml:"heartbeatMisses"`
+	FloodMessages       int      `json:"floodMessages" yaml:"floodMessages"`
+	FloodWindow         Duration `json:"floodWindow" yaml:"floodWindow"`
+	FloodRepeats        int      `json:"floodRepeats" yaml:"floodRepeats"`
+	FloodMute           Duration `json:"floodMute" yaml:"floodMute"`
+	ShutdownTimeout     Duration `json:"shutdownTimeout" yaml:"shutdownTimeout"`
+	DefaultRoom         string   `json:"defaultRoom" yaml:"defaultRoom"`
+	MessageRoomArg      bool     `json:"messageRoomArg" yaml:"messageRoomArg"`
+	ChatV2Replies       bool     `json:"chatV2Replies" yaml:"chatV2Replies"`
+	MessagePrefix       string   `json:"messagePrefix" yaml:"messagePrefix"`
+	ErrorPrefix         string   `json:"errorPrefix" yaml:"errorPrefix"`
+	WebhookSecret       string   `json:"webhookSecret" yaml:"webhookSecret"`
+
+	// RoomHistorySizes overrides HistorySize for rooms with these names. It
+	// can only be set in the config file.
+	RoomHistorySizes map[string]int `json:"roomHistorySizes" yaml:"roomHistorySizes"`
+	// RoomBannedWords are the words filtered in rooms with these names until
+	// their operators change them with /filter. It can only be set in the
+	// config file.
+	RoomBannedWords map[string][]string `json:"roomBannedWords" yaml:"roomBannedWords"`
+	// RoomWebhooks are the URLs each room's messages, joins and leaves are
+	// POSTed to. It can only be set in the config file.
+	RoomWebhooks map[string][]string `json:"roomWebhooks" yaml:"roomWebhooks"`
+	// IncomingWebhooks may post into their rooms at /hooks/ROOM on
+	// MetricsAddr. It can only be set in the config file.
+	IncomingWebhooks []chat.IncomingWebhook `json:"incomingWebhooks" yaml:"incomingWebhooks"`
+	// SlackBridges mirror rooms and Slack channels. It can only be set in
+	// the config file.
+	SlackBridges []SlackBridge `json:"slackBridges" yaml:"slackBridges"`
+	// DiscordBridges mirror rooms and Discord channels. It can only be set
+	// in the config file.
+	DiscordBridges []DiscordBridge `json:"discordBridges" yaml:"discordBridges"`
+}
+
+// SlackBridge mirrors Room and a Slack channel; see bridge.Slack.
+type SlackBridge struct {
+	Room string `json:"room" yaml:"room"`
+	// Channel is the ID of the Slack channel, such as C0123456789.
+	Channel string `json:"channel" yaml:"channel"`
+	// Token is a Slack bot token.
+	Token string `json:"token" yaml:"token"`
+	// Nick is the bridge's nickname in the room; "slack" when empty.
+	Nick string `json:"nick" yaml:"nick"`
+	// Users maps Slack user IDs to their nicknames in the room.
+	Users map[string]string `json:"users" yaml:"users"`
+}
+
+// DiscordBridge mirrors Room and a Discord channel; see bridge.Discord.
+type DiscordBridge struct {
+	Room string `json:"room" yaml:"room"`
+	// Channel is the ID of the Discord channel.
+	Channel string `json:"channel" yaml:"channel"`
+	// Token is a Discord bot token.
+	Token string `json:"token" yaml:"token"`
+	// WebhookURL, when set, posts messages from the room under each
+	// chatter's nickname.
+	WebhookURL string `json:"webhookURL" yaml:"webhookURL"`
+	// Nick is the bridge's nickname in the room; "discord" when empty.
+	Nick string `json:"nick" yaml:"nick"`
+	// Users maps Discord user IDs to their nicknames in the room.
+	Users map[string]string `json:"users" yaml:"users"`
+}
+
+// Duration is a time.Duration written as a string such as "30s" in JSON and
+// YAML.
+type Duration struct {
+	time.Duration
+}
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(d.String())
+}
+
+func (d *Duration) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return fmt.Errorf("duration must be a string such as \"30s\": %w", err)
+	}
+	v, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	d.Duration = v
+	return nil
+}
+
+func (d Duration) MarshalYAML() (any, error) {
+	return d.String(), nil
+}
+
+func (d *Duration) UnmarshalYAML(value *yaml.Node) error {
+	var s string
+	if err := value.Decode(&s); err != nil {
+		return fmt.Errorf("duration must be a string such as \"30s\": %w", err)
+	}
+	v, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	d.Duration = v
+	return nil
+}
+
+// DefaultShutdownTimeout is how long the servers wait on SIGINT or SIGTERM
+// before closing the remaining connections without a goodbye.
+const DefaultShutdownTimeout = 10 * time.Second
+
+func Default() *Config {
+	return &Config{
+		Addr:                ":3000",
+		MaxConnectionsPerIP: chat.DefaultMaxConnectionsPerIP,
+		MaxMembersPerRoom:   chat.DefaultMaxMembersPerRoom,
+		HistorySize:         chat.DefaultHistorySize,
+		CommandBuffer:       chat.DefaultCommandBufferSize,
+		LogLevel:            "info",
+		SessionTTL:          Duration{chat.DefaultSessionTTL},
+		AccountTokenTTL:     Duration{chat.DefaultAccountTokenTTL},
+		ShutdownTimeout:     Duration{DefaultShutdownTimeout},
+		MessageRate:         chat.DefaultMessageRate,
+		MessageBurst:        chat.DefaultMessageBurst,
+		MaxLineLength:       chat.DefaultMaxLineLength,
+		OutboxSize:          chat.DefaultOutboxSize,
+		WriteTimeout:        Duration{chat.DefaultWriteTimeout},
+		SlowConsumerTimeout: Duration{chat.DefaultSlowConsumerTimeout},
+		HeartbeatMisses:     chat.DefaultHeartbeatMisses,
+		FloodMessages:       chat.DefaultFloodMessages,
+		FloodWindow:         Duration{chat.DefaultFloodWindow},
+		FloodRepeats:        chat.DefaultFloodRepeats,
+		FloodMute:           Duration{chat.DefaultFloodMuteDuration},
+		MessagePrefix:       chat.DefaultMessagePrefix,
+		ErrorPrefix:         chat.DefaultErrorPrefix,
+	}
+}
+
+// RegisterFlags binds a flag to every setting, using the current values as
+// defaults.
+func (c *Config) RegisterFlags(fs *flag.FlagSet) {
+	fs.StringVar(&c.Addr, "addr", c.Addr, "address the chat server listens on")
+	fs.StringVar(&c.MetricsAddr, "metrics-addr", c.MetricsAddr, "address serving /metrics, /ws and the admin API, over TLS when -tls-cert is set; empty disables it")
+	fs.StringVar(&c.GRPCAddr, "grpc-addr", c.GRPCAddr, "address serving the gRPC API; empty disables it. Uses the TLS certificate when one is set")
+	fs.StringVar(&c.IRCAddr, "irc-addr", c.IRCAddr, "address serving IRC clients such as irssi or weechat, over TLS when -tls-cert is set; empty disables it")
+	fs.StringVar(&c.TLSCert, "tls-cert", c.TLSCert, "path to the TLS certificate; with -tls-key, clients must connect over TLS")
+	fs.StringVar(&c.TLSKey, "tls-key", c.TLSKey, "path to the TLS private key")
+	fs.BoolVar(&c.RequireTLS, "require-tls", c.RequireTLS, "refuse to start without a TLS certificate and key")
+	fs.IntVar(&c.MaxConnections, "max-connections", c.MaxConnections, "simultaneous connections allowed; 0 means unlimited")
+	fs.IntVar(&c.MaxConnectionsPerIP, "max-connections-per-ip", c.MaxConnectionsPerIP, "simultaneous connections allowed from one IP; 0 means unlimited")
+	fs.IntVar(&c.MaxMembersPerRoom, "max-members-per-room", c.MaxMembersPerRoom, "members allowed in each room")
+	fs.IntVar(&c.MaxRooms, "max-rooms", c.MaxRooms, "rooms that can exist at once; 0 means unlimited")
+	fs.IntVar(&c.HistorySize, "history-size", c.HistorySize, "number of messages each room keeps for replay")
+	fs.StringVar(&c.HistoryDir, "history-dir", c.HistoryDir, "directory where room history is persisted across restarts")
+	fs.StringVar(&c.HistoryDB, "history-db", c.HistoryDB, "path to a SQLite database where room history is persisted across restarts")
+	fs.IntVar(&c.CommandBuffer, "command-buffer", c.CommandBuffer, "commands clients can queue before they block")
+	fs.IntVar(&c.Workers, "workers", c.Workers, "goroutines serving read-only commands; 0 runs them on the main loop")
+	fs.IntVar(&c.RoomWorkers, "room-workers", c.RoomWorkers, "goroutines serving commands that only touch the sender's room, each for a share of the rooms; 0 runs them on the main loop")
+	fs.StringVar(&c.MOTDFile, "motd-file", c.MOTDFile, "path to a message-of-the-day file shown to clients on connect")
+	fs.StringVar(&c.LogLevel, "log-level", c.LogLevel, "log level: debug, info, warn or error")
+	fs.Var((*listValue)(&c.BannedIPs), "banned-ips", "comma separated IPs or CIDR ranges refused at connect time")
+	fs.StringVar(&c.BanFile, "ban-file", c.BanFile, "path to the file keeping bans made with /ban and /banip across restarts")
+	fs.StringVar(&c.BannedWordsFile, "banned-words", c.BannedWordsFile, "path to a file of words to mask in messages, one per line")
+	fs.BoolVar(&c.Emoji, "emoji", c.Emoji, "expand :shortcode: emoji in messages")
+	fs.StringVar(&c.EmojiFile, "emoji-file", c.EmojiFile, "path to extra emoji shortcodes, one \"name emoji\" pair per line; implies -emoji")
+	fs.StringVar(&c.AuditLog, "audit-log", c.AuditLog, "path to an append-only audit log of every message")
+	fs.StringVar(&c.AdminToken, "admin-token", c.AdminToken, "token that grants admin commands via /admin TOKEN (env CHAT_ADMIN_TOKEN)")
+	fs.Var((*listValue)(&c.AdminNicks), "admin-nicks", "comma separated accounts that become admins when they log in; needs -accounts-file")
+	fs.StringVar(&c.AccountsFile, "accounts-file", c.AccountsFile, "path to the registered accounts file; enables /register and /login")
+	fs.DurationVar(&c.SessionTTL.Duration, "session-ttl", c.SessionTTL.Duration, "how long a dropped client can /resume its session; 0 disables session tokens")
+	fs.StringVar(&c.SessionSecret, "session-secret", c.SessionSecret, "key that signs account session tokens so they survive restarts; random when empty (env CHAT_SESSION_SECRET)")
+	fs.DurationVar(&c.AccountTokenTTL.Duration, "account-token-ttl", c.AccountTokenTTL.Duration, "how long the session token issued on /register or /login can /resume the account")
+	fs.DurationVar(&c.IdleTimeout.Duration, "idle-timeout", c.IdleTimeout.Duration, "disconnect clients that send nothing for this long; 0 disables it")
+	fs.Float64Var(&c.MessageRate, "message-rate", c.MessageRate, "messages a second each client may post after a burst; 0 disables the limit")
+	fs.IntVar(&c.MessageBurst, "message-burst", c.MessageBurst, "messages each client may post at once before -message-rate applies")
+	fs.IntVar(&c.MaxLineLength, "max-line-length", c.MaxLineLength, "longest input line accepted, in bytes; 0 allows any length")
+	fs.IntVar(&c.OutboxSize, "outbox-size", c.OutboxSize, "lines each client can have waiting to be written")
+	fs.DurationVar(&c.WriteTimeout.Duration, "write-timeout", c.WriteTimeout.Duration, "how long a single write to a client may take; 0 means no limit")
+	fs.DurationVar(&c.SlowConsumerTimeout.Duration, "slow-consumer-timeout", c.SlowConsumerTimeout.Duration, "disconnect clients whose outbound queue stays full this long; 0 never does")
+	fs.DurationVar(&c.HeartbeatInterval.Duration, "heartbeat-interval", c.HeartbeatInterval.Duration, "how often to PING clients; 0 disables the heartbeat")
+	fs.IntVar(&c.HeartbeatMisses, "heartbeat-misses", c.HeartbeatMisses, "heartbeats a client may leave unanswered before it is disconnected")
+	fs.IntVar(&c.FloodMessages, "flood-messages", c.FloodMessages, "messages a client may post within -flood-window before being muted; 0 disables the check")
+	fs.DurationVar(&c.FloodWindow.Duration, "flood-window", c.FloodWindow.Duration, "window -flood-messages is counted over")
+	fs.IntVar(&c.FloodRepeats, "flood-repeats", c.FloodRepeats, "identical messages in a row that get a client muted; 0 disables the check")
+	fs.DurationVar(&c.FloodMute.Duration, "flood-mute", c.FloodMute.Duration, "how long a flooding client is muted")
+	fs.DurationVar(&c.ShutdownTimeout.Duration, "shutdown-timeout", c.ShutdownTimeout.Duration, "how long to wait for queued commands and goodbyes on SIGINT, SIGTERM or /shutdown")
+	fs.StringVar(&c.DefaultRoom, "default-room", c.DefaultRoom, "room every new client joins automatically")
+	fs.BoolVar(&c.MessageRoomArg, "message-room-arg", c.MessageRoomArg, "let /msg ROOM MESSAGE post to a named room")
+	fs.BoolVar(&c.ChatV2Replies, "chatv2-replies", c.ChatV2Replies, "answer plain-text clients in the words of the old chatv2 server")
+	fs.StringVar(&c.MessagePrefix, "message-prefix", c.MessagePrefix, "text in front of every message line sent to clients")
+	fs.StringVar(&c.ErrorPrefix, "error-prefix", c.ErrorPrefix, "text in front of every error line sent to clients")
+	fs.StringVar(&c.WebhookSecret, "webhook-secret", c.WebhookSecret, "key that signs webhook requests in their X-Chat-Signature header; unsigned when empty (env CHAT_WEBHOOK_SECRET)")
+}
+
+// Resolve layers the settings after fs has been parsed: the file at path (if
+// any) replaces the defaults, the environment overrides the file, and flags
+// given explicitly on the command line override both. Every flag can be set
+// from the environment as CHAT_ followed by its name in upper case with
+// dashes as underscores, e.g. CHAT_LOG_LEVEL for -log-level. The result is
+// validated.
+func (c *Config) Resolve(fs *flag.FlagSet, path string) error {
+	set := make(map[string]string)
+	fs.Visit(func(f *flag.Flag) {
+		set[f.Name] = f.Value.String()
+	})
+
+	if path != "" {
+		if err := c.loadFile(path); err != nil {
+			return err
+		}
+	}
+	if err := c.applyEnv(fs); err != nil {
+		return err
+	}
+	for name, value := range set {
+		if err := fs.Set(name, value); err != nil {
+			return err
+		}
+	}
+	return c.Validate()
+}
+
+func (c *Config) loadFile(path string) error {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	switch filepath.Ext(path) {
+	case ".yaml", ".yml":
+		dec := yaml.NewDecoder(bytes.NewReader(b))
+		dec.KnownFields(true)
+		err = dec.Decode(c)
+	default:
+		dec := json.NewDecoder(bytes.NewReader(b))
+		dec.DisallowUnknownFields()
+		err = dec.Decode(c)
+	}
+	if err != nil {
+		return fmt.Errorf("%s: %w", path, err)
+	}
+	return nil
+}
+
+func (c *Config) applyEnv(fs *flag.FlagSet) error {
+	var err error
+	fs.VisitAll(func(f *flag.Flag) {
+		v, ok := os.LookupEnv(EnvName(f.Name))
+		if !ok || err != nil {
+			return
+		}
+		if serr := fs.Set(f.Name, v); serr != nil {
+			err = fmt.Errorf("%s: %w", EnvName(f.Name), serr)
+		}
+	})
+	if v := os.Getenv("CHAT_MOTD"); v != "" {
+		c.MOTD = v
+	}
+	return err
+}
+
+// EnvName is the environment variable that sets the flag called name.
+func EnvName(name string) string {
+	return "CHAT_" + strings.ToUpper(strings.ReplaceAll(name, "-", "_"))
+}
+
+// Validate reports every problem with the settings at once.
+func (c *Config) Validate() error {
+	var errs []error
+	if c.Addr == "" {
+		errs = append(errs, errors.New("addr must be set"))
+	}
+	if (c.TLSCert == "") != (c.TLSKey == "") {
+		errs = append(errs, errors.New("tlsCert and tlsKey must be set together"))
+	}
+	if c.RequireTLS && c.TLSCert == "" {
+		errs = append(errs, errors.New("requireTLS is set but no tlsCert and tlsKey are configured; refusing to serve plaintext"))
+	}
+	if c.HistorySize < 1 || c.HistorySize > chat.MaxHistorySize {
+		errs = append(errs, fmt.Errorf("historySize must be between 1 and %d, got %d", chat.MaxHistorySize, c.HistorySize))
+	}
+	rooms := make([]string, 0, len(c.RoomHistorySizes))
+	for room := range c.RoomHistorySizes {
+		rooms = append(rooms, room)
+	}
+	sort.Strings(rooms)
+	for _, room := range rooms {
+		if size := c.RoomHistorySizes[room]; size < 1 || size > chat.MaxHistorySize {
+			errs = append(errs, fmt.Errorf("roomHistorySizes[%s] must be between 1 and %d, got %d", room, chat.MaxHistorySize, size))
+		}
+	}
+	rooms = rooms[:0]
+	for room := range c.RoomWebhooks {
+		rooms = append(rooms, room)
+	}
+	sort.Strings(rooms)
+	for _, room := range rooms {
+		for _, u := range c.RoomWebhooks[room] {
+			if err := chat.CheckWebhookURL(u); err != nil {
+				errs = append(errs, fmt.Errorf("roomWebhooks[%s]: %w", room, err))
+			}
+		}
+	}
+	for i, hook := range c.IncomingWebhooks {
+		if hook.Room == "" || hook.Nick == "" || hook.Token == "" {
+			errs = append(errs, fmt.Errorf("incomingWebhooks[%d] needs a room, a nick and a token", i))
+		}
+	}
+	if len(c.IncomingWebhooks) > 0 && c.MetricsAddr == "" {
+		errs = append(errs, errors.New("incomingWebhooks needs metricsAddr to be served"))
+	}
+	for i, b := range c.SlackBridges {
+		if b.Room == "" || b.Channel == "" || b.Token == "" {
+			errs = append(errs, fmt.Errorf("slackBridges[%d] needs a room, a channel and a token", i))
+		}
+	}
+	for i, b := range c.DiscordBridges {
+		if b.Room == "" || b.Channel == "" || b.Token == "" {
+			errs = append(errs, fmt.Errorf("discordBridges[%d] needs a room, a channel and a token", i))
+		}
+		if b.WebhookURL != "" && chat.CheckWebhookURL(b.WebhookURL) != nil {
+			errs = append(errs, fmt.Errorf("discordBridges[%d]: webhookURL %q is not an http or https URL", i, b.WebhookURL))
+		}
+	}
+	if len(c.AdminNicks) > 0 && c.AccountsFile == "" {
+		errs = append(errs, errors.New("adminNicks needs accountsFile, or anyone could take an admin's nickname"))
+	}
+	if c.HistoryDir != "" && c.HistoryDB != "" {
+		errs = append(errs, errors.New("historyDir and historyDB cannot both be set"))
+	}
+	if c.MaxMembersPerRoom < 1 {
+		errs = append(errs, fmt.Errorf("maxMembersPerRoom must be at least 1, got %d", c.MaxMembersPerRoom))
+	}
+	for _, limit := range []struct {
+		name  string
+		value int
+	}{
+		{"maxConnections", c.MaxConnections},
+		{"maxConnectionsPerIP", c.MaxConnectionsPerIP},
+		{"maxRooms", c.MaxRooms},
+		{"maxLineLength", c.MaxLineLength},
+		{"floodMessages", c.FloodMessages},
+		{"floodRepeats", c.FloodRepeats},
+		{"commandBuffer", c.CommandBuffer},
+		{"workers", c.Workers},
+		{"roomWorkers", c.RoomWorkers},
+	} {
+		if limit.value < 0 {
+			errs = append(errs, fmt.Errorf("%s must not be negative, got %d", limit.name, limit.value))
+		}
+	}
+	if c.SessionTTL.Duration < 0 {
+		errs = append(errs, fmt.Errorf("sessionTTL must not be negative, got %s", c.SessionTTL))
+	}
+	if c.AccountTokenTTL.Duration <= 0 {
+		errs = append(errs, fmt.Errorf("accountTokenTTL must be positive, got %s", c.AccountTokenTTL))
+	}
+	if c.IdleTimeout.Duration < 0 {
+		errs = append(errs, fmt.Errorf("idleTimeout must not be negative, got %s", c.IdleTimeout))
+	}
+	if c.MessageRate < 0 {
+		errs = append(errs, fmt.Errorf("messageRate must not be negative, got %g", c.MessageRate))
+	}
+	if c.MessageRate > 0 && c.MessageBurst < 1 {
+		errs = append(errs, fmt.Errorf("messageBurst must be at least 1 when messageRate is set, got %d", c.MessageBurst))
+	}
+	if c.FloodMessages > 0 && c.FloodWindow.Duration <= 0 {
+		errs = append(errs, fmt.Errorf("floodWindow must be positive when floodMessages is set, got %s", c.FloodWindow))
+	}
+	if (c.FloodMessages > 0 || c.FloodRepeats > 0) && c.FloodMute.Duration <= 0 {
+		errs = append(errs, fmt.Errorf("floodMute must be positive when flood protection is on, got %s", c.FloodMute))
+	}
+	if c.OutboxSize < 1 {
+		errs = append(errs, fmt.Errorf("outboxSize must be at least 1, got %d", c.OutboxSize))
+	}
+	if c.WriteTimeout.Duration < 0 {
+		errs = append(errs, fmt.Errorf("writeTimeout must not be negative, got %s", c.WriteTimeout))
+	}
+	if c.SlowConsumerTimeout.Duration < 0 {
+		errs = append(errs, fmt.Errorf("slowConsumerTimeout must not be negative, got %s", c.SlowConsumerTimeout))
+	}
+	if c.HeartbeatInterval.Duration < 0 {
+		errs = append(errs, fmt.Errorf("heartbeatInterval must not be negative, got %s", c.HeartbeatInterval))
+	}
+	if c.HeartbeatInterval.Duration > 0 && c.HeartbeatMisses < 1 {
+		errs = append(errs, fmt.Errorf("heartbeatMisses must be at least 1 when heartbeatInterval is set, got %d", c.HeartbeatMisses))
+	}
+	if c.ShutdownTimeout.Duration <= 0 {
+		errs = append(errs, fmt.Errorf("shutdownTimeout must be positive, got %s", c.ShutdownTimeout))
+	}
+	if _, err := logrus.ParseLevel(c.LogLevel); err != nil {
+		errs = append(errs, fmt.Errorf("logLevel: %w", err))
+	}
+	if _, err := chat.NewBanList(c.BannedIPs...); err != nil {
+		errs = append(errs, fmt.Errorf("bannedIPs: %w", err))
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("invalid config:\n%w", errors.Join(errs...))
+	}
+	return nil
+}
+
+// listValue is a comma separated flag.Value for a string slice.
+type listValue []string
+
+func (l *listValue) String() string {
+	return strings.Join(*l, ",")
+}
+
+func (l *listValue) Set(s string) error {
+	*l = nil
+	for _, v := range strings.Split(s, ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			*l = append(*l, v)
+		}
+	}
+	return nil
+}
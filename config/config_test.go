@@ -0,0 +1,199 @@
+package config
+
+import (
+	"flag"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/fahimimam/chatApplication/chat"
+)
+
+// resolve parses args into a fresh default config, as main does, and
+// resolves it against the file at path.
+func resolve(t *testing.T, path string, args ...string) (*Config, error) {
+	t.Helper()
+	cfg := Default()
+	fs := flag.NewFlagSet("chat", flag.ContinueOnError)
+	fs.SetOutput(io.Discard)
+	cfg.RegisterFlags(fs)
+	if err := fs.Parse(args); err != nil {
+		t.Fatal(err)
+	}
+	return cfg, cfg.Resolve(fs, path)
+}
+
+func writeFile(t *testing.T, name, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestDefaultIsValid(t *testing.T) {
+	if err := Default().Validate(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestExampleConfig(t *testing.T) {
+	cfg, err := resolve(t, "../config.example.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.MaxConnections != 1000 || cfg.IdleTimeout.Duration != 30*time.Minute || cfg.RoomHistorySizes["announcements"] != 1000 {
+		t.Errorf("example config loaded as %+v", cfg)
+	}
+}
+
+func TestYAMLConfig(t *testing.T) {
+	path := writeFile(t, "chat.yaml", "addr: \":4000\"\nsessionTTL: 90s\nadminNicks: [root]\naccountsFile: accounts.json\n")
+	cfg, err := resolve(t, path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.Addr != ":4000" || cfg.SessionTTL.Duration != 90*time.Second || len(cfg.AdminNicks) != 1 {
+		t.Errorf("YAML config loaded as %+v", cfg)
+	}
+}
+
+func TestUnknownFieldsRejected(t *testing.T) {
+	for name, content := range map[string]string{
+		"chat.json": `{"adr": ":4000"}`,
+		"chat.yaml": "adr: \":4000\"\n",
+	} {
+		if _, err := resolve(t, writeFile(t, name, content)); err == nil {
+			t.Errorf("%s with a misspelled field loaded", name)
+		}
+	}
+	if _, err := resolve(t, writeFile(t, "chat.json", `{"sessionTTL": 300}`)); err == nil || !strings.Contains(err.Error(), `such as "30s"`) {
+		t.Errorf("a numeric duration gave %v", err)
+	}
+}
+
+func TestPrecedence(t *testing.T) {
+	path := writeFile(t, "chat.json", `{"addr": ":4000", "maxRooms": 5, "logLevel": "warn"}`)
+	t.Setenv("CHAT_MAX_ROOMS", "7")
+	t.Setenv("CHAT_LOG_LEVEL", "debug")
+	t.Setenv("CHAT_MOTD", "hello from the environment")
+
+	cfg, err := resolve(t, path, "-log-level", "error", "-banned-ips", "10.0.0.1, 10.1.0.0/16")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.Addr != ":4000" {
+		t.Errorf("addr = %q, want the file's", cfg.Addr)
+	}
+	if cfg.MaxRooms != 7 {
+		t.Errorf("maxRooms = %d, want the environment's", cfg.MaxRooms)
+	}
+	if cfg.LogLevel != "error" {
+		t.Errorf("logLevel = %q, want the flag's", cfg.LogLevel)
+	}
+	if cfg.MOTD != "hello from the environment" {
+		t.Errorf("motd = %q", cfg.MOTD)
+	}
+	if len(cfg.BannedIPs) != 2 || cfg.BannedIPs[1] != "10.1.0.0/16" {
+		t.Errorf("bannedIPs = %q", cfg.BannedIPs)
+	}
+}
+
+func TestBadEnvironment(t *testing.T) {
+	t.Setenv("CHAT_MAX_ROOMS", "many")
+	if _, err := resolve(t, ""); err == nil || !strings.Contains(err.Error(), "CHAT_MAX_ROOMS") {
+		t.Errorf("a bad environment value gave %v", err)
+	}
+}
+
+func TestValidateListsEveryProblem(t *testing.T) {
+	cfg := Default()
+	cfg.Addr = ""
+	cfg.TLSCert = "cert.pem"
+	cfg.HistorySize = 0
+	cfg.RoomHistorySizes = map[string]int{"big": -1}
+	cfg.AdminNicks = []string{"root"}
+	cfg.HistoryDir, cfg.HistoryDB = "history", "history.db"
+	cfg.MaxRooms = -1
+	cfg.LogLevel = "loud"
+	cfg.BannedIPs = []string{"not-an-ip"}
+	cfg.RoomWebhooks = map[string][]string{"lobby": {"ftp://example.com/hook"}}
+	cfg.IncomingWebhooks = []chat.IncomingWebhook{{Room: "lobby", Nick: "ci"}}
+	cfg.SlackBridges = []SlackBridge{{Room: "lobby", Token: "xoxb-1"}}
+	cfg.DiscordBridges = []DiscordBridge{{Room: "lobby", Channel: "1", Token: "t", WebhookURL: "discord"}}
+
+	err := cfg.Validate()
+	if err == nil {
+		t.Fatal("Validate accepted an invalid config")
+	}
+	for _, want := range []string{
+		"addr must be set",
+		"tlsCert and tlsKey must be set together",
+		"historySize must be between",
+		"roomHistorySizes[big]",
+		"adminNicks needs accountsFile",
+		"historyDir and historyDB cannot both be set",
+		"maxRooms must not be negative",
+		"logLevel:",
+		"bannedIPs:",
+		"roomWebhooks[lobby]",
+		"incomingWebhooks[0] needs a room, a nick and a token",
+		"incomingWebhooks needs metricsAddr",
+		"slackBridges[0] needs a room, a channel and a token",
+		"discordBridges[0]: webhookURL",
+	} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("error does not mention %q:\n%v", want, err)
+		}
+	}
+}
+
+func TestRequireTLS(t *testing.T) {
+	if _, err := resolve(t, "", "-require-tls"); err == nil || !strings.Contains(err.Error(), "refusing to serve plaintext") {
+		t.Errorf("requireTLS without a certificate gave %v", err)
+	}
+}
+
+func TestNewServer(t *testing.T) {
+	dir := t.TempDir()
+	cfg := Default()
+	cfg.AccountsFile = filepath.Join(dir, "accounts.json")
+	cfg.AdminNicks = []string{"root"}
+	cfg.MOTDFile = writeFile(t, "motd.txt", "from the file")
+	cfg.HistoryDir = filepath.Join(dir, "history")
+	cfg.MaxRooms = 3
+	cfg.RoomBannedWords = map[string][]string{"lobby": {"darn"}}
+	cfg.RoomWebhooks = map[string][]string{"lobby": {"https://example.com/hook"}}
+	cfg.MetricsAddr = ":2112"
+	cfg.IncomingWebhooks = []chat.IncomingWebhook{{Room: "lobby", Nick: "ci", Token: "t0ken"}}
+	if err := cfg.Validate(); err != nil {
+		t.Fatal(err)
+	}
+
+	s, cleanup, err := cfg.NewServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cleanup()
+	if s.MOTD != "from the file" || s.MaxRooms != 3 || len(s.AdminNicks) != 1 || s.Accounts == nil || s.PersistentHistory == nil || len(s.RoomBannedWords["lobby"]) != 1 || len(s.IncomingWebhooks) != 1 {
+		t.Errorf("the server was not configured from cfg")
+	}
+	if hooks, ok := s.Events.(*chat.Webhooks); !ok || len(hooks.URLs("lobby")) != 1 {
+		t.Errorf("Events = %T, want the room webhooks", s.Events)
+	}
+
+	cfg.MOTDFile = filepath.Join(dir, "missing.txt")
+	if _, _, err := cfg.NewServer(); err == nil {
+		t.Error("a missing MOTD file was not reported")
+	}
+}
+
+func TestEnvName(t *testing.T) {
+	if got := EnvName("max-connections-per-ip"); got != "CHAT_MAX_CONNECTIONS_PER_IP" {
+		t.Errorf("EnvName = %s", got)
+	}
+}
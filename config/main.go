@@ -0,0 +1,139 @@
+package config
+
+import (
+	"context"
+	"flag"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/fahimimam/chatApplication/api"
+	"github.com/fahimimam/chatApplication/chat"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/sirupsen/logrus"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+)
+
+// Main runs a chat server until SIGINT, SIGTERM or an admin's /shutdown,
+// then shuts it down gracefully. cfg holds the binary's defaults; the config
+// file named by -config or CHAT_CONFIG, the environment and the command line
+// override them as described on Resolve. When MetricsAddr is set it serves
+// /metrics, the /ws gateway, the /admin/events stream, the admin API under
+// /admin/ and the incoming webhooks under /hooks/ there, when GRPCAddr is set
+// the gRPC API, and when IRCAddr is set it accepts IRC clients there. All of
+// them use TLS when a certificate is configured. The configured bridges run
+// for as long as the server does.
+func Main(cfg *Config) {
+	configFile := flag.String("config", os.Getenv("CHAT_CONFIG"), "path to a JSON or YAML config file; env and flags override its values")
+	cfg.RegisterFlags(flag.CommandLine)
+	flag.Parse()
+
+	log := logrus.New()
+	log.SetFormatter(&logrus.TextFormatter{})
+	log.SetOutput(os.Stdout)
+	if err := cfg.Resolve(flag.CommandLine, *configFile); err != nil {
+		log.Fatal(err)
+	}
+	log.SetLevel(cfg.Level())
+	// the audit log, webhooks and history stores log through the package's
+	// logger rather than the server's
+	chat.SetLogger(log)
+
+	s, cleanup, err := cfg.NewServer(chat.WithLogger(log), chat.WithMetrics(prometheus.DefaultRegisterer))
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer cleanup()
+
+	if cfg.MetricsAddr != "" {
+		hub := chat.NewEventHub(chat.DefaultEventBufferSize)
+		s.Events = chat.EventSinks{s.Events, hub}
+		mux := http.NewServeMux()
+		mux.Handle("/metrics", promhttp.Handler())
+		mux.HandleFunc("/ws", s.ServeWS)
+		mux.Handle("/admin/events", s.RequireAdmin(hub))
+		mux.Handle("/admin/", http.StripPrefix("/admin", s.RequireAdmin(s.AdminAPI())))
+		mux.Handle("/hooks/", http.StripPrefix("/hooks", s.HooksAPI()))
+		// the gateway and admin API carry chat and the admin token, so
+		// they get the same TLS as the chat listener
+		l, err := chat.Listen(cfg.MetricsAddr, cfg.TLSCert, cfg.TLSKey)
+		if err != nil {
+			log.Fatal("unable to start the metrics server ", err.Error())
+		}
+		go func() {
+			log.Fatal(http.Serve(l, mux))
+		}()
+	}
+
+	cfg.StartBridges(s, log)
+
+	var grpcServer *grpc.Server
+	if cfg.GRPCAddr != "" {
+		var opts []grpc.ServerOption
+		if cfg.TLSCert != "" && cfg.TLSKey != "" {
+			creds, err := credentials.NewServerTLSFromFile(cfg.TLSCert, cfg.TLSKey)
+			if err != nil {
+				log.Fatal("unable to load TLS certificate for gRPC ", err.Error())
+			}
+			opts = append(opts, grpc.Creds(creds))
+		}
+		l, err := net.Listen("tcp", cfg.GRPCAddr)
+		if err != nil {
+			log.Fatal("unable to start the gRPC server ", err.Error())
+		}
+		grpcServer = grpc.NewServer(opts...)
+		api.RegisterChatServer(grpcServer, api.NewService(s))
+		go func() {
+			log.Fatal(grpcServer.Serve(l))
+		}()
+	}
+
+	if cfg.IRCAddr != "" {
+		l, err := chat.Listen(cfg.IRCAddr, cfg.TLSCert, cfg.TLSKey)
+		if err != nil {
+			log.Fatal("unable to start the IRC listener ", err.Error())
+		}
+		go func() {
+			if err := s.Serve(context.Background(), chat.IRCListener(l)); err != nil && err != chat.ErrServerClosed {
+				log.Fatal("IRC listener stopped ", err.Error())
+			}
+		}()
+		log.Info("Accepting IRC clients on: ", cfg.IRCAddr)
+	}
+
+	listener, err := chat.Listen(cfg.Addr, cfg.TLSCert, cfg.TLSKey)
+	if err != nil {
+		log.Fatal("unable to start the server ", err.Error())
+	}
+	defer listener.Close()
+	log.Info("Started server on: ", cfg.Addr)
+
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+		defer stop()
+		select {
+		case <-ctx.Done():
+		case <-s.ShutdownRequested():
+		}
+		log.Info("shutting down")
+		ctx, cancel := context.WithTimeout(context.Background(), cfg.ShutdownTimeout.Duration)
+		defer cancel()
+		if err := s.Shutdown(ctx); err != nil {
+			log.Warn("shutdown incomplete: ", err.Error())
+		}
+		if grpcServer != nil {
+			grpcServer.Stop()
+		}
+	}()
+
+	if err := s.Serve(context.Background(), listener); err != nil && err != chat.ErrServerClosed {
+		log.Fatal("server stopped ", err.Error())
+	}
+	<-stopped
+}
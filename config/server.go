@@ -0,0 +1,165 @@
+package config
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/fahimimam/chatApplication/chat"
+	"github.com/sirupsen/logrus"
+)
+
+// Level is the parsed LogLevel. Call it on a validated config.
+func (c *Config) Level() logrus.Level {
+	level, err := logrus.ParseLevel(c.LogLevel)
+	if err != nil {
+		return logrus.InfoLevel
+	}
+	return level
+}
+
+// NewServer builds a chat server from the settings. The returned cleanup
+// func flushes and closes the audit log and history store and stops the
+// webhooks; call it once the server has stopped.
+func (c *Config) NewServer(opts ...chat.Option) (*chat.Server, func(), error) {
+	opts = append([]chat.Option{
+		chat.WithCommandBuffer(c.CommandBuffer),
+		chat.WithWorkers(c.Workers),
+		chat.WithRoomWorkers(c.RoomWorkers),
+		chat.WithHistorySize(c.HistorySize),
+	}, opts...)
+	s := chat.NewServer(opts...)
+
+	var closers []func()
+	cleanup := func() {
+		for i := len(closers) - 1; i >= 0; i-- {
+			closers[i]()
+		}
+	}
+	fail := func(format string, err error) (*chat.Server, func(), error) {
+		cleanup()
+		return nil, nil, fmt.Errorf(format, err)
+	}
+
+	if c.MOTDFile != "" {
+		b, err := os.ReadFile(c.MOTDFile)
+		if err != nil {
+			return fail("unable to load motd: %w", err)
+		}
+		s.MOTD = string(b)
+	} else if c.MOTD != "" {
+		s.MOTD = c.MOTD
+	}
+	if len(c.BannedIPs) > 0 || c.BanFile != "" {
+		bans, err := chat.LoadBanList(c.BanFile, c.BannedIPs...)
+		if err != nil {
+			return fail("unable to load bans: %w", err)
+		}
+		s.Bans = bans
+	}
+	s.AdminToken = c.AdminToken
+	s.AdminNicks = c.AdminNicks
+	if c.AccountsFile != "" {
+		accounts, err := chat.NewAccounts(c.AccountsFile)
+		if err != nil {
+			return fail("unable to load accounts: %w", err)
+		}
+		s.Accounts = accounts
+	}
+	s.RoomHistorySizes = c.RoomHistorySizes
+	s.RoomBannedWords = c.RoomBannedWords
+	s.IncomingWebhooks = c.IncomingWebhooks
+	s.MaxConnections = c.MaxConnections
+	s.MaxConnectionsPerIP = c.MaxConnectionsPerIP
+	s.MaxMembersPerRoom = c.MaxMembersPerRoom
+	s.MaxRooms = c.MaxRooms
+	s.ReadTimeout = c.IdleTimeout.Duration
+	s.MessageRate = c.MessageRate
+	s.MessageBurst = c.MessageBurst
+	s.MaxLineLength = c.MaxLineLength
+	s.OutboxSize = c.OutboxSize
+	s.WriteTimeout = c.WriteTimeout.Duration
+	s.SlowConsumerTimeout = c.SlowConsumerTimeout.Duration
+	s.HeartbeatInterval = c.HeartbeatInterval.Duration
+	s.HeartbeatMisses = c.HeartbeatMisses
+	s.FloodMessages = c.FloodMessages
+	s.FloodWindow = c.FloodWindow.Duration
+	s.FloodRepeats = c.FloodRepeats
+	s.FloodMuteDuration = c.FloodMute.Duration
+	s.DefaultRoom = c.DefaultRoom
+	s.MessageRoomArg = c.MessageRoomArg
+	s.ChatV2Replies = c.ChatV2Replies
+	s.MessagePrefix = c.MessagePrefix
+	s.ErrorPrefix = c.ErrorPrefix
+	if c.SessionTTL.Duration > 0 {
+		s.Sessions = chat.NewSessionStore(c.SessionTTL.Duration)
+		s.Sessions.AccountTokenTTL = c.AccountTokenTTL.Duration
+		if c.SessionSecret != "" {
+			s.Sessions.SetKey([]byte(c.SessionSecret))
+		}
+	}
+
+	var filters chat.Filters
+	if c.BannedWordsFile != "" {
+		filter, err := chat.LoadWordFilter(c.BannedWordsFile)
+		if err != nil {
+			return fail("unable to load banned words: %w", err)
+		}
+		filters = append(filters, filter)
+	}
+	if c.Emoji || c.EmojiFile != "" {
+		expander := chat.NewEmojiExpander()
+		if c.EmojiFile != "" {
+			if err := expander.LoadFile(c.EmojiFile); err != nil {
+				return fail("unable to load emoji shortcodes: %w", err)
+			}
+		}
+		filters = append(filters, expander)
+	}
+	if len(filters) > 0 {
+		s.Filter = filters
+	}
+	if len(c.RoomWebhooks) > 0 {
+		webhooks := chat.NewWebhooks(c.WebhookSecret, chat.DefaultWebhookQueueSize)
+		closers = append(closers, webhooks.Close)
+		for room, urls := range c.RoomWebhooks {
+			for _, u := range urls {
+				if err := webhooks.Add(room, u); err != nil {
+					return fail("unable to register webhooks: %w", err)
+				}
+			}
+		}
+		s.Events = webhooks
+	}
+	if c.AuditLog != "" {
+		f, err := os.OpenFile(c.AuditLog, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+		if err != nil {
+			return fail("unable to open audit log: %w", err)
+		}
+		audit := chat.NewAuditLogger(f, 1024)
+		closers = append(closers, func() {
+			audit.Close()
+			f.Close()
+		})
+		s.Audit = audit
+	}
+	if c.HistoryDir != "" {
+		store, err := chat.NewFileHistory(c.HistoryDir, chat.DefaultHistoryFlushInterval)
+		if err != nil {
+			return fail("unable to open history directory: %w", err)
+		}
+		closers = append(closers, func() { store.Close() })
+		s.PersistentHistory = store
+	}
+	if c.HistoryDB != "" {
+		store, err := chat.NewSQLiteHistory(c.HistoryDB, chat.DefaultHistoryFlushInterval)
+		if err != nil {
+			return fail("unable to open history database: %w", err)
+		}
+		closers = append(closers, func() { store.Close() })
+		s.PersistentHistory = store
+	}
+	if err := s.RestoreRooms(); err != nil {
+		return fail("unable to restore rooms: %w", err)
+	}
+	return s, cleanup, nil
+}